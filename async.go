@@ -0,0 +1,276 @@
+package zk
+
+import (
+	"context"
+	"errors"
+)
+
+// The asynchronous variants of the basic operations queue the request right
+// away and return a channel that receives its result, so many requests can be
+// in flight at the same time. Requests are sent in the order they were
+// queued, and every channel receives exactly one value. Queueing blocks if
+// the send queue of the connection is full.
+
+// GetResponse is the result of GetAsync.
+type GetResponse struct {
+	Data []byte
+	Stat *Stat
+	Err  error
+}
+
+// ExistsResponse is the result of ExistsAsync.
+type ExistsResponse struct {
+	Exists bool
+	Stat   *Stat
+	Err    error
+}
+
+// ChildrenResponse is the result of ChildrenAsync.
+type ChildrenResponse struct {
+	Children []string
+	Stat     *Stat
+	Err      error
+}
+
+// CreateResponse is the result of CreateAsync.
+type CreateResponse struct {
+	Path string
+	Err  error
+}
+
+// SetResponse is the result of SetAsync.
+type SetResponse struct {
+	Stat *Stat
+	Err  error
+}
+
+// GetAsync is like Get, but returns without waiting for the response.
+func (c *Conn) GetAsync(path string) <-chan GetResponse {
+	ch := make(chan GetResponse, 1)
+	if err := validatePath(path, false); err != nil {
+		ch <- GetResponse{Err: err}
+		return ch
+	}
+
+	res := &getDataResponse{}
+	req := &getDataRequest{Path: path, Watch: false}
+	_, end := c.trace(context.Background(), opGetData, req)
+	recv := c.queueRequest(opGetData, req, res, nil)
+	go func() {
+		_, err := c.wait(recv)
+		if end != nil {
+			end(err)
+		}
+		if err == ErrConnectionClosed {
+			ch <- GetResponse{Err: err}
+			return
+		}
+		data := res.Data
+		if err == nil {
+			data, err = c.decompress(data)
+		}
+		ch <- GetResponse{Data: data, Stat: &res.Stat, Err: err}
+	}()
+	return ch
+}
+
+// ExistsAsync is like Exists, but returns without waiting for the response.
+func (c *Conn) ExistsAsync(path string) <-chan ExistsResponse {
+	ch := make(chan ExistsResponse, 1)
+	if err := validatePath(path, false); err != nil {
+		ch <- ExistsResponse{Err: err}
+		return ch
+	}
+
+	res := &existsResponse{}
+	req := &existsRequest{Path: path, Watch: false}
+	_, end := c.trace(context.Background(), opExists, req)
+	recv := c.queueRequest(opExists, req, res, nil)
+	go func() {
+		_, err := c.wait(recv)
+		if end != nil {
+			end(err)
+		}
+		if err == ErrConnectionClosed {
+			ch <- ExistsResponse{Err: err}
+			return
+		}
+		exists := true
+		if errors.Is(err, ErrNoNode) {
+			exists = false
+			err = nil
+		}
+		ch <- ExistsResponse{Exists: exists, Stat: &res.Stat, Err: err}
+	}()
+	return ch
+}
+
+// ExistsMany tells the existence of many znodes in one go: the requests are
+// all queued before waiting for any response, so it takes about one round
+// trip instead of one per path. The results are in the order of paths, with a
+// nil stat for the znodes that don't exist. If checking any of the paths
+// fails, the error of the first one is returned.
+func (c *Conn) ExistsMany(paths []string) ([]bool, []*Stat, error) {
+	chans := make([]<-chan ExistsResponse, len(paths))
+	for i, path := range paths {
+		chans[i] = c.ExistsAsync(path)
+	}
+
+	exists := make([]bool, len(paths))
+	stats := make([]*Stat, len(paths))
+	var err error
+	for i, ch := range chans {
+		res := <-ch
+		if res.Err != nil {
+			if err == nil {
+				err = res.Err
+			}
+			continue
+		}
+		exists[i] = res.Exists
+		if res.Exists {
+			stats[i] = res.Stat
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return exists, stats, nil
+}
+
+// ChildrenWithStats returns the stats of the children of the znode at path,
+// by name, along with the stat of the znode. The stats are fetched like
+// ExistsMany, so it takes about two round trips however many children there
+// are. Children deleted between listing and fetching their stats are left
+// out.
+func (c *Conn) ChildrenWithStats(path string) (map[string]*Stat, *Stat, error) {
+	children, stat, err := c.Children(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	paths := make([]string, len(children))
+	for i, child := range children {
+		paths[i] = joinPath(path, child)
+	}
+	exists, stats, err := c.ExistsMany(paths)
+	if err != nil {
+		return nil, nil, err
+	}
+	childStats := make(map[string]*Stat, len(children))
+	for i, child := range children {
+		if exists[i] {
+			childStats[child] = stats[i]
+		}
+	}
+	return childStats, stat, nil
+}
+
+// ChildrenAsync is like Children, but returns without waiting for the
+// response.
+func (c *Conn) ChildrenAsync(path string) <-chan ChildrenResponse {
+	ch := make(chan ChildrenResponse, 1)
+	if err := validatePath(path, false); err != nil {
+		ch <- ChildrenResponse{Err: err}
+		return ch
+	}
+
+	res := &getChildren2Response{}
+	req := &getChildren2Request{Path: path, Watch: false}
+	_, end := c.trace(context.Background(), opGetChildren2, req)
+	recv := c.queueRequest(opGetChildren2, req, res, nil)
+	go func() {
+		_, err := c.wait(recv)
+		if end != nil {
+			end(err)
+		}
+		if err == ErrConnectionClosed {
+			ch <- ChildrenResponse{Err: err}
+			return
+		}
+		ch <- ChildrenResponse{Children: res.Children, Stat: &res.Stat, Err: err}
+	}()
+	return ch
+}
+
+// CreateAsync is like Create, but returns without waiting for the response.
+func (c *Conn) CreateAsync(path string, data []byte, flags int32, acl []ACL) <-chan CreateResponse {
+	ch := make(chan CreateResponse, 1)
+	if err := validatePath(path, flags&FlagSequence == FlagSequence); err != nil {
+		ch <- CreateResponse{Err: err}
+		return ch
+	}
+
+	data, err := c.compress(data)
+	if err != nil {
+		ch <- CreateResponse{Err: err}
+		return ch
+	}
+	res := &createResponse{}
+	req := &CreateRequest{path, data, acl, flags}
+	_, end := c.trace(context.Background(), opCreate, req)
+	recv := c.queueRequest(opCreate, req, res, nil)
+	go func() {
+		_, err := c.wait(recv)
+		if end != nil {
+			end(err)
+		}
+		if err == ErrConnectionClosed {
+			ch <- CreateResponse{Err: err}
+			return
+		}
+		ch <- CreateResponse{Path: res.Path, Err: err}
+	}()
+	return ch
+}
+
+// SetAsync is like Set, but returns without waiting for the response.
+func (c *Conn) SetAsync(path string, data []byte, version int32) <-chan SetResponse {
+	ch := make(chan SetResponse, 1)
+	if err := validatePath(path, false); err != nil {
+		ch <- SetResponse{Err: err}
+		return ch
+	}
+
+	data, err := c.compress(data)
+	if err != nil {
+		ch <- SetResponse{Err: err}
+		return ch
+	}
+	res := &setDataResponse{}
+	req := &SetDataRequest{path, data, version}
+	_, end := c.trace(context.Background(), opSetData, req)
+	recv := c.queueRequest(opSetData, req, res, nil)
+	go func() {
+		_, err := c.wait(recv)
+		if end != nil {
+			end(err)
+		}
+		if err == ErrConnectionClosed {
+			ch <- SetResponse{Err: err}
+			return
+		}
+		ch <- SetResponse{Stat: &res.Stat, Err: err}
+	}()
+	return ch
+}
+
+// DeleteAsync is like Delete, but returns without waiting for the response.
+func (c *Conn) DeleteAsync(path string, version int32) <-chan error {
+	ch := make(chan error, 1)
+	if err := validatePath(path, false); err != nil {
+		ch <- err
+		return ch
+	}
+
+	req := &DeleteRequest{path, version}
+	_, end := c.trace(context.Background(), opDelete, req)
+	recv := c.queueRequest(opDelete, req, &deleteResponse{}, nil)
+	go func() {
+		_, err := c.wait(recv)
+		if end != nil {
+			end(err)
+		}
+		ch <- err
+	}()
+	return ch
+}
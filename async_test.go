@@ -0,0 +1,139 @@
+package zk
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestAsync(t *testing.T) {
+	fs := newFakeTreeServer(t)
+	defer fs.Close()
+
+	zk := connectFake(t, fs)
+
+	// Requests are sent in order, so each one sees the previous ones.
+	const n = 50
+	acl := WorldACL(PermAll)
+	creates := make([]<-chan CreateResponse, n)
+	gets := make([]<-chan GetResponse, n)
+	for i := 0; i < n; i++ {
+		path := fmt.Sprintf("/node-%d", i)
+		creates[i] = zk.CreateAsync(path, []byte(path), 0, acl)
+		gets[i] = zk.GetAsync(path)
+	}
+	for i := 0; i < n; i++ {
+		path := fmt.Sprintf("/node-%d", i)
+		if res := <-creates[i]; res.Err != nil || res.Path != path {
+			t.Fatalf("CreateAsync returned %+v; want path %s", res, path)
+		}
+		if res := <-gets[i]; res.Err != nil || string(res.Data) != path || res.Stat == nil {
+			t.Fatalf("GetAsync returned %+v; want data %s", res, path)
+		}
+	}
+
+	if res := <-zk.ChildrenAsync("/"); res.Err != nil || len(res.Children) != n {
+		t.Fatalf("ChildrenAsync returned %d children, %v; want %d", len(res.Children), res.Err, n)
+	}
+	if res := <-zk.SetAsync("/node-0", []byte("new"), 0); res.Err != nil || res.Stat.Version != 1 {
+		t.Fatalf("SetAsync returned %+v", res)
+	}
+	if res := <-zk.SetAsync("/node-0", []byte("new"), 0); !errors.Is(res.Err, ErrBadVersion) {
+		t.Fatalf("SetAsync with a wrong version returned %v; want %v", res.Err, ErrBadVersion)
+	}
+	if err := <-zk.DeleteAsync("/node-0", -1); err != nil {
+		t.Fatalf("DeleteAsync returned error: %v", err)
+	}
+	if res := <-zk.ExistsAsync("/node-0"); res.Err != nil || res.Exists {
+		t.Fatalf("ExistsAsync returned %+v for a deleted node", res)
+	}
+	if res := <-zk.ExistsAsync("/node-1"); res.Err != nil || !res.Exists {
+		t.Fatalf("ExistsAsync returned %+v", res)
+	}
+	if res := <-zk.GetAsync("/node-0"); !errors.Is(res.Err, ErrNoNode) {
+		t.Fatalf("GetAsync of a deleted node returned %v; want %v", res.Err, ErrNoNode)
+	}
+	if res := <-zk.GetAsync("invalid"); !errors.Is(res.Err, ErrInvalidPath) {
+		t.Fatalf("GetAsync with an invalid path returned %v; want %v", res.Err, ErrInvalidPath)
+	}
+
+	zk.Close()
+	if res := <-zk.GetAsync("/node-1"); res.Err != ErrConnectionClosed {
+		t.Fatalf("GetAsync after Close returned %v; want %v", res.Err, ErrConnectionClosed)
+	}
+}
+
+func TestExistsMany(t *testing.T) {
+	fs := newFakeTreeServer(t)
+	defer fs.Close()
+
+	zk := connectFake(t, fs)
+
+	for _, path := range []string{"/a", "/c"} {
+		if _, err := zk.Create(path, []byte(path), 0, WorldACL(PermAll)); err != nil {
+			t.Fatalf("Create returned error: %v", err)
+		}
+	}
+
+	paths := []string{"/c", "/b", "/a", "/d"}
+	exists, stats, err := zk.ExistsMany(paths)
+	if err != nil {
+		t.Fatalf("ExistsMany returned error: %v", err)
+	}
+	want := []bool{true, false, true, false}
+	for i, path := range paths {
+		if exists[i] != want[i] || (stats[i] != nil) != want[i] {
+			t.Fatalf("ExistsMany returned %v, %v for %s; want %v", exists[i], stats[i], path, want[i])
+		}
+		if want[i] && stats[i].DataLength != int32(len(path)) {
+			t.Fatalf("ExistsMany returned the stat %+v for %s; want the stat of %s", stats[i], path, path)
+		}
+	}
+
+	if _, _, err := zk.ExistsMany([]string{"/a", "invalid"}); !errors.Is(err, ErrInvalidPath) {
+		t.Fatalf("ExistsMany with an invalid path returned %v; want %v", err, ErrInvalidPath)
+	}
+}
+
+func TestChildrenWithStats(t *testing.T) {
+	fs := newFakeServer(t, func(opcode int32, body []byte) (interface{}, ErrCode) {
+		switch opcode {
+		case opGetChildren2:
+			// The child "gone" is deleted before its stat is fetched.
+			return &getChildren2Response{Children: []string{"a", "b", "gone"}, Stat: Stat{NumChildren: 3}}, 0
+		case opExists:
+			req := &existsRequest{}
+			if _, err := decodePacket(body, req); err != nil {
+				return nil, errMarshallingError
+			}
+			if req.Path == "/parent/gone" {
+				return nil, errNoNode
+			}
+			return &existsResponse{Stat: Stat{DataLength: int32(len(req.Path))}}, 0
+		}
+		return nil, errUnimplemented
+	})
+	defer fs.Close()
+
+	zk := connectFake(t, fs)
+
+	children, stat, err := zk.ChildrenWithStats("/parent")
+	if err != nil {
+		t.Fatalf("ChildrenWithStats returned error: %v", err)
+	}
+	if stat.NumChildren != 3 {
+		t.Fatalf("ChildrenWithStats returned the parent stat %+v", stat)
+	}
+	if len(children) != 2 {
+		t.Fatalf("ChildrenWithStats returned %v; want the stats of a and b", children)
+	}
+	for _, child := range []string{"a", "b"} {
+		if s := children[child]; s == nil || s.DataLength != int32(len("/parent/"+child)) {
+			t.Fatalf("ChildrenWithStats returned the stat %+v for %s; want its own", s, child)
+		}
+	}
+
+	if _, _, err := zk.ChildrenWithStats("invalid"); !errors.Is(err, ErrInvalidPath) {
+		t.Fatalf("ChildrenWithStats with an invalid path returned %v; want %v", err, ErrInvalidPath)
+	}
+}
@@ -0,0 +1,109 @@
+package zk
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// atomicMaxRetries is how many times an update of a DistributedAtomicInt64 is
+// retried when another client updated the value first.
+const atomicMaxRetries = 100
+
+var (
+	// ErrAtomicContention is returned when an update of a
+	// DistributedAtomicInt64 kept losing against concurrent updates.
+	ErrAtomicContention = errors.New("zk: too many concurrent updates of the atomic value")
+	// ErrBadAtomicValue is returned when the node of a DistributedAtomicInt64
+	// doesn't hold an int64.
+	ErrBadAtomicValue = errors.New("zk: atomic value is not an int64")
+)
+
+// DistributedAtomicInt64 is an int64 stored in a single node, that is updated
+// with compare-and-set on the node version. It mirrors Curator's
+// DistributedAtomicLong and stores the value as 8 big-endian bytes. A value
+// whose node doesn't exist yet is 0; the node is created on the first update.
+type DistributedAtomicInt64 struct {
+	c    *Conn
+	path string
+	acl  []ACL
+}
+
+// NewAtomic creates a new atomic value at path, using the provided connection.
+// The node is created with the given ACL. Its parent must exist.
+func NewAtomic(c *Conn, path string, acl []ACL) *DistributedAtomicInt64 {
+	return &DistributedAtomicInt64{
+		c:    c,
+		path: path,
+		acl:  acl,
+	}
+}
+
+// Get returns the current value.
+func (a *DistributedAtomicInt64) Get() (int64, error) {
+	value, _, err := a.get()
+	return value, err
+}
+
+// Set sets the value, whatever its current value is.
+func (a *DistributedAtomicInt64) Set(value int64) error {
+	for i := 0; i < atomicMaxRetries; i++ {
+		_, err := a.c.Set(a.path, encodeAtomic(value), -1)
+		if !errors.Is(err, ErrNoNode) {
+			return err
+		}
+		_, created, err := a.c.CreateIfNotExists(a.path, encodeAtomic(value), 0, a.acl)
+		if err != nil || created {
+			return err
+		}
+	}
+	return ErrAtomicContention
+}
+
+// Add adds delta to the value and returns the new value.
+func (a *DistributedAtomicInt64) Add(delta int64) (int64, error) {
+	for i := 0; i < atomicMaxRetries; i++ {
+		value, version, err := a.get()
+		if err != nil {
+			return 0, err
+		}
+		value += delta
+		if version < 0 {
+			_, created, err := a.c.CreateIfNotExists(a.path, encodeAtomic(value), 0, a.acl)
+			if err != nil {
+				return 0, err
+			}
+			if created {
+				return value, nil
+			}
+			continue
+		}
+		_, err = a.c.Set(a.path, encodeAtomic(value), version)
+		if err == nil {
+			return value, nil
+		} else if !errors.Is(err, ErrBadVersion) && !errors.Is(err, ErrNoNode) {
+			return 0, err
+		}
+	}
+	return 0, ErrAtomicContention
+}
+
+// get returns the current value and the version of its node, or -1 if the
+// node doesn't exist.
+func (a *DistributedAtomicInt64) get() (int64, int32, error) {
+	data, stat, err := a.c.Get(a.path)
+	if errors.Is(err, ErrNoNode) {
+		return 0, -1, nil
+	} else if err != nil {
+		return 0, 0, err
+	}
+	if len(data) != 8 {
+		return 0, 0, ErrBadAtomicValue
+	}
+	return int64(binary.BigEndian.Uint64(data)), stat.Version, nil
+}
+
+func encodeAtomic(value int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(value))
+	return b
+}
@@ -0,0 +1,61 @@
+package zk
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestDistributedAtomicInt64(t *testing.T) {
+	fs := newFakeTreeServer(t)
+	defer fs.Close()
+
+	const (
+		workers = 5
+		adds    = 20
+	)
+	conns := make([]*Conn, workers)
+	for i := range conns {
+		conns[i] = connectFake(t, fs)
+	}
+
+	acl := WorldACL(PermAll)
+	a := NewAtomic(conns[0], "/test-atomic", acl)
+	if v, err := a.Get(); err != nil || v != 0 {
+		t.Fatalf("Get of a missing value returned %d, %v; want 0, nil", v, err)
+	}
+
+	// Concurrent increments, starting without a node.
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			a := NewAtomic(conns[i], "/test-atomic", acl)
+			for j := 0; j < adds; j++ {
+				if _, err := a.Add(1); err != nil {
+					t.Errorf("Add returned error: %v", err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if v, err := a.Get(); err != nil || v != workers*adds {
+		t.Fatalf("Get returned %d, %v; want %d", v, err, workers*adds)
+	}
+
+	if err := a.Set(-5); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if v, err := a.Add(2); err != nil || v != -3 {
+		t.Fatalf("Add returned %d, %v; want -3", v, err)
+	}
+
+	if _, err := conns[0].Create("/test-not-atomic", []byte("foo"), 0, acl); err != nil {
+		t.Fatalf("Create returned error: %v", err)
+	}
+	if _, err := NewAtomic(conns[0], "/test-not-atomic", acl).Add(1); !errors.Is(err, ErrBadAtomicValue) {
+		t.Fatalf("Add of a node that doesn't hold an int64 returned %v; want %v", err, ErrBadAtomicValue)
+	}
+}
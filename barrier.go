@@ -0,0 +1,160 @@
+package zk
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+const barrierReadyNode = "ready"
+
+// DoubleBarrier lets a group of participants start and finish a computation
+// together. Enter blocks until count participants entered the barrier, and
+// Leave blocks until all of them left it. A participant whose session dies
+// while inside the barrier counts as having left.
+type DoubleBarrier struct {
+	c        *Conn
+	path     string
+	count    int
+	acl      []ACL
+	name     string
+	nodePath string
+}
+
+// NewDoubleBarrier creates a new participant of the barrier at path, using
+// the provided connection. count is the number of participants the barrier
+// waits for in Enter. The path must be a node that is only used by this
+// barrier.
+func NewDoubleBarrier(c *Conn, path string, count int) *DoubleBarrier {
+	var id [16]byte
+	io.ReadFull(rand.Reader, id[:])
+	name := fmt.Sprintf("%x", id)
+	return &DoubleBarrier{
+		c:        c,
+		path:     path,
+		count:    count,
+		acl:      WorldACL(PermAll),
+		name:     name,
+		nodePath: path + "/" + name,
+	}
+}
+
+// Enter joins the barrier and waits until count participants joined.
+func (b *DoubleBarrier) Enter() error {
+	_, err := b.c.Create(b.nodePath, []byte{}, FlagEphemeral, b.acl)
+	if errors.Is(err, ErrNoNode) {
+		if err = createParentNodes(b.c, b.path, b.acl); err != nil {
+			return err
+		}
+		_, err = b.c.Create(b.nodePath, []byte{}, FlagEphemeral, b.acl)
+	}
+	if err != nil && !errors.Is(err, ErrNodeExists) {
+		return err
+	}
+
+	readyPath := b.path + "/" + barrierReadyNode
+	for {
+		// Watch the ready node before counting, so it can't be missed.
+		exists, _, ch, err := b.c.ExistsW(readyPath)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return nil
+		}
+
+		participants, err := b.participants()
+		if err != nil {
+			return err
+		}
+		if len(participants) >= b.count {
+			_, err := b.c.Create(readyPath, []byte{}, 0, b.acl)
+			if err != nil && !errors.Is(err, ErrNodeExists) {
+				return err
+			}
+			return nil
+		}
+
+		ev := <-ch
+		if ev.Err != nil {
+			return ev.Err
+		}
+	}
+}
+
+// Leave leaves the barrier and waits until all participants left it.
+func (b *DoubleBarrier) Leave() error {
+	for {
+		participants, err := b.participants()
+		if err != nil {
+			return err
+		}
+
+		ours := -1
+		for i, p := range participants {
+			if p == b.name {
+				ours = i
+			}
+		}
+		switch {
+		case len(participants) == 0:
+			return b.deleteReady()
+		case len(participants) == 1 && ours == 0:
+			if err := b.c.Delete(b.nodePath, -1); err != nil && !errors.Is(err, ErrNoNode) {
+				return err
+			}
+			return b.deleteReady()
+		}
+
+		// The lowest participant leaves last and waits for the highest one;
+		// everybody else leaves right away and waits for the lowest one.
+		wait := participants[0]
+		if ours == 0 {
+			wait = participants[len(participants)-1]
+		} else if ours > 0 {
+			if err := b.c.Delete(b.nodePath, -1); err != nil && !errors.Is(err, ErrNoNode) {
+				return err
+			}
+		}
+
+		exists, _, ch, err := b.c.ExistsW(b.path + "/" + wait)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		ev := <-ch
+		if ev.Err != nil {
+			return ev.Err
+		}
+	}
+}
+
+// deleteReady deletes the ready node once the last participant left, so
+// the barrier can be used again.
+func (b *DoubleBarrier) deleteReady() error {
+	err := b.c.Delete(b.path+"/"+barrierReadyNode, -1)
+	if errors.Is(err, ErrNoNode) {
+		err = nil
+	}
+	return err
+}
+
+// participants returns the sorted names of the participants in the barrier.
+func (b *DoubleBarrier) participants() ([]string, error) {
+	children, _, err := b.c.Children(b.path)
+	if err != nil {
+		return nil, err
+	}
+	participants := children[:0]
+	for _, child := range children {
+		if child != barrierReadyNode {
+			participants = append(participants, child)
+		}
+	}
+	sort.Strings(participants)
+	return participants, nil
+}
@@ -0,0 +1,84 @@
+package zk
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDoubleBarrier(t *testing.T) {
+	fs := newFakeTreeServer(t)
+	defer fs.Close()
+
+	const count = 3
+	conns := make([]*Conn, count+1)
+	for i := range conns {
+		conns[i] = connectFake(t, fs)
+	}
+
+	var entering, left int32
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			b := NewDoubleBarrier(conns[i], "/test-barrier", count)
+
+			time.Sleep(time.Duration(i) * 100 * time.Millisecond)
+			atomic.AddInt32(&entering, 1)
+			if err := b.Enter(); err != nil {
+				t.Errorf("Enter returned error: %v", err)
+				return
+			}
+			if n := atomic.LoadInt32(&entering); n != count {
+				t.Errorf("Enter returned when only %d of %d participants entered", n, count)
+			}
+
+			time.Sleep(time.Duration(count-i) * 100 * time.Millisecond)
+			atomic.AddInt32(&left, 1)
+			if err := b.Leave(); err != nil {
+				t.Errorf("Leave returned error: %v", err)
+				return
+			}
+			if n := atomic.LoadInt32(&left); n != count {
+				t.Errorf("Leave returned when only %d of %d participants left", n, count)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// The barrier can be used again, and a participant whose session dies
+	// inside the barrier counts as having left.
+	dead := NewDoubleBarrier(conns[count], "/test-barrier", 2)
+	alive := NewDoubleBarrier(conns[0], "/test-barrier", 2)
+	entered := make(chan error, 1)
+	go func() {
+		entered <- dead.Enter()
+	}()
+	if err := alive.Enter(); err != nil {
+		t.Fatalf("Enter returned error: %v", err)
+	}
+	if err := <-entered; err != nil {
+		t.Fatalf("Enter returned error: %v", err)
+	}
+
+	leaving := make(chan error, 1)
+	go func() {
+		leaving <- alive.Leave()
+	}()
+	select {
+	case err := <-leaving:
+		t.Fatalf("Leave returned %v while another participant is inside", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	fs.ExpireSession(conns[count].SessionID())
+	select {
+	case err := <-leaving:
+		if err != nil {
+			t.Fatalf("Leave returned error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Leave did not return after the other participant's session died")
+	}
+}
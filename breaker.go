@@ -0,0 +1,163 @@
+package zk
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned by requests while the circuit breaker set by
+// WithCircuitBreaker is open.
+var ErrCircuitOpen = errors.New("zk: circuit breaker is open")
+
+// CircuitState is the state of the circuit breaker set by WithCircuitBreaker.
+type CircuitState int
+
+const (
+	// CircuitClosed means requests are sent as usual.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen means requests fail with ErrCircuitOpen.
+	CircuitOpen
+	// CircuitHalfOpen means the cooldown is over and a single request is
+	// sent to probe the ensemble. The others fail with ErrCircuitOpen.
+	CircuitHalfOpen
+)
+
+var circuitStateNames = map[CircuitState]string{
+	CircuitClosed:   "CircuitClosed",
+	CircuitOpen:     "CircuitOpen",
+	CircuitHalfOpen: "CircuitHalfOpen",
+}
+
+func (s CircuitState) String() string {
+	if name := circuitStateNames[s]; name != "" {
+		return name
+	}
+	return "Unknown"
+}
+
+// CircuitBreakerRecorder can be implemented by a MetricsRecorder passed to
+// WithMetrics to be notified when the circuit breaker changes state.
+type CircuitBreakerRecorder interface {
+	RecordCircuitState(state CircuitState)
+}
+
+// WithCircuitBreaker returns a connection option that stops sending requests
+// while the ensemble is unavailable. After threshold consecutive requests
+// failed because the connection was lost, the session expired or the request
+// timed out, requests fail with ErrCircuitOpen right away. Once cooldown
+// passed, the next request is sent as a probe: if it succeeds, requests are
+// sent again, otherwise the breaker stays open for another cooldown. Other
+// errors, such as ErrNoNode, count as successes.
+//
+// The breaker applies to the synchronous methods and the Ctx ones, not to the
+// Async ones. There is no circuit breaker by default.
+func WithCircuitBreaker(threshold int, cooldown time.Duration) connOption {
+	return func(c *Conn) {
+		c.breaker = &circuitBreaker{
+			threshold: threshold,
+			cooldown:  cooldown,
+			now:       time.Now,
+		}
+	}
+}
+
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time         // replaced by tests
+	onChange  func(state CircuitState) // may be nil
+
+	mu       sync.Mutex // protects the fields below
+	state    CircuitState
+	failures int       // consecutive failures while closed
+	openedAt time.Time // when the breaker last opened
+	probing  bool      // a probe is in flight while half-open
+}
+
+// allow returns ErrCircuitOpen if a request must not be sent. Otherwise the
+// caller must report the result of the request with done.
+func (b *circuitBreaker) allow() error {
+	b.mu.Lock()
+	changed := false
+	switch b.state {
+	case CircuitOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			b.mu.Unlock()
+			return ErrCircuitOpen
+		}
+		b.state = CircuitHalfOpen
+		changed = true
+		fallthrough
+	case CircuitHalfOpen:
+		if b.probing {
+			b.mu.Unlock()
+			return ErrCircuitOpen
+		}
+		b.probing = true
+	}
+	b.mu.Unlock()
+	if changed {
+		b.notify(CircuitHalfOpen)
+	}
+	return nil
+}
+
+// done records the result of a request that allow let through.
+func (b *circuitBreaker) done(err error) {
+	b.mu.Lock()
+	from := b.state
+	switch {
+	case isUnavailable(err):
+		b.failures++
+		if b.state == CircuitHalfOpen || b.failures >= b.threshold {
+			b.state = CircuitOpen
+			b.openedAt = b.now()
+			b.failures = 0
+		}
+	case isContextErr(err):
+		// Says nothing about the ensemble.
+	default:
+		b.state = CircuitClosed
+		b.failures = 0
+	}
+	if from == CircuitHalfOpen {
+		b.probing = false
+	}
+	to := b.state
+	b.mu.Unlock()
+	if to != from {
+		b.notify(to)
+	}
+}
+
+func (b *circuitBreaker) notify(state CircuitState) {
+	if b.onChange != nil {
+		b.onChange(state)
+	}
+}
+
+// isUnavailable reports whether a request failed because the ensemble did not
+// serve it.
+func isUnavailable(err error) bool {
+	return errors.Is(err, ErrConnectionClosed) || errors.Is(err, ErrSessionExpired) ||
+		errors.Is(err, ErrRequestTimeout) || errors.Is(err, ErrServerRequestTimeout) ||
+		errors.Is(err, ErrConnectionLoss) || errors.Is(err, ErrOperationTimeout)
+}
+
+func isContextErr(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// breakerAllow checks the circuit breaker before sending a request. It
+// returns a function to report the result of the request to.
+func (c *Conn) breakerAllow() (func(error), error) {
+	if c.breaker == nil {
+		return func(error) {}, nil
+	}
+	if err := c.breaker.allow(); err != nil {
+		return nil, err
+	}
+	return c.breaker.done, nil
+}
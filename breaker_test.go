@@ -0,0 +1,138 @@
+package zk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// breakerRecorder is a testRecorder that also keeps the circuit states.
+type breakerRecorder struct {
+	testRecorder
+	states []CircuitState
+}
+
+func (r *breakerRecorder) RecordCircuitState(state CircuitState) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.states = append(r.states, state)
+}
+
+func (r *breakerRecorder) States() []CircuitState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]CircuitState(nil), r.states...)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var failing int32 = 1
+	fs := newFakeServer(t, func(opcode int32, body []byte) (interface{}, ErrCode) {
+		if atomic.LoadInt32(&failing) != 0 {
+			return nil, errRequestTimeout
+		}
+		if opcode == opExists {
+			return &existsResponse{}, 0
+		}
+		return nil, errNoNode
+	})
+	defer fs.Close()
+
+	r := &breakerRecorder{}
+	conn := connectFake(t, fs, WithMetrics(r), WithCircuitBreaker(3, time.Minute))
+	var mu sync.Mutex
+	now := time.Now()
+	conn.breaker.now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	advance := func(d time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		now = now.Add(d)
+	}
+	exists := func() error {
+		_, _, err := conn.Exists("/a")
+		return err
+	}
+
+	// Closed: failures go through until the threshold is reached.
+	for i := 0; i < 3; i++ {
+		if err := exists(); !errors.Is(err, ErrServerRequestTimeout) {
+			t.Fatalf("Exists %d returned %v; want %v", i, err, ErrServerRequestTimeout)
+		}
+	}
+
+	// Open: requests fail fast, without reaching the server.
+	atomic.StoreInt32(&failing, 0)
+	if err := exists(); err != ErrCircuitOpen {
+		t.Fatalf("Exists with an open circuit returned %v; want %v", err, ErrCircuitOpen)
+	}
+	if _, _, err := conn.GetCtx(context.Background(), "/a"); err != ErrCircuitOpen {
+		t.Fatalf("GetCtx with an open circuit returned %v; want %v", err, ErrCircuitOpen)
+	}
+
+	// Half-open: a failed probe opens the circuit again.
+	atomic.StoreInt32(&failing, 1)
+	advance(time.Minute)
+	if err := exists(); !errors.Is(err, ErrServerRequestTimeout) {
+		t.Fatalf("probe returned %v; want %v", err, ErrServerRequestTimeout)
+	}
+	if err := exists(); err != ErrCircuitOpen {
+		t.Fatalf("Exists after a failed probe returned %v; want %v", err, ErrCircuitOpen)
+	}
+
+	// A successful probe closes the circuit. Errors of the request itself,
+	// like ErrNoNode, count as successes.
+	atomic.StoreInt32(&failing, 0)
+	advance(time.Minute)
+	if _, _, err := conn.Get("/a"); !errors.Is(err, ErrNoNode) {
+		t.Fatalf("probe returned %v; want %v", err, ErrNoNode)
+	}
+	if err := exists(); err != nil {
+		t.Fatalf("Exists with a closed circuit returned error: %v", err)
+	}
+
+	want := []CircuitState{CircuitOpen, CircuitHalfOpen, CircuitOpen, CircuitHalfOpen, CircuitClosed}
+	if got := r.States(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("recorded the states %v; want %v", got, want)
+	}
+}
+
+func TestCircuitBreakerSingleProbe(t *testing.T) {
+	b := &circuitBreaker{threshold: 1, cooldown: time.Second, now: time.Now}
+	if err := b.allow(); err != nil {
+		t.Fatalf("allow with a closed circuit returned %v", err)
+	}
+	b.done(ErrConnectionClosed)
+	b.openedAt = b.openedAt.Add(-time.Second)
+
+	if err := b.allow(); err != nil {
+		t.Fatalf("allow after the cooldown returned %v", err)
+	}
+	if err := b.allow(); err != ErrCircuitOpen {
+		t.Fatalf("allow while probing returned %v; want %v", err, ErrCircuitOpen)
+	}
+	// A canceled probe lets another one through.
+	b.done(context.Canceled)
+	if err := b.allow(); err != nil {
+		t.Fatalf("allow after a canceled probe returned %v", err)
+	}
+	b.done(nil)
+	if b.state != CircuitClosed {
+		t.Fatalf("state after a successful probe is %v; want %v", b.state, CircuitClosed)
+	}
+
+	// Only consecutive failures count.
+	b.threshold = 2
+	b.done(ErrConnectionClosed)
+	b.done(nil)
+	b.done(ErrConnectionClosed)
+	if b.state != CircuitClosed {
+		t.Fatalf("state after interleaved failures is %v; want %v", b.state, CircuitClosed)
+	}
+}
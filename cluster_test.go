@@ -1,6 +1,7 @@
 package zk
 
 import (
+	"errors"
 	"sync"
 	"testing"
 	"time"
@@ -237,14 +238,14 @@ func TestIntegration_BadSession(t *testing.T) {
 	}
 	defer zk.Close()
 
-	if err := zk.Delete("/gozk-test", -1); err != nil && err != ErrNoNode {
+	if err := zk.Delete("/gozk-test", -1); err != nil && !errors.Is(err, ErrNoNode) {
 		t.Fatalf("Delete returned error: %+v", err)
 	}
 
 	zk.conn.Close()
 	time.Sleep(time.Millisecond * 100)
 
-	if err := zk.Delete("/gozk-test", -1); err != nil && err != ErrNoNode {
+	if err := zk.Delete("/gozk-test", -1); err != nil && !errors.Is(err, ErrNoNode) {
 		t.Fatalf("Delete returned error: %+v", err)
 	}
 }
@@ -0,0 +1,147 @@
+package zk
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+)
+
+// Codec compresses the data of znodes; see WithCompression.
+type Codec interface {
+	// ID identifies the codec in the header of the values it compressed. It
+	// must not be 0; values up to 15 are reserved for this package.
+	ID() byte
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+// GzipCodec is a Codec using gzip at the given compression level, e.g.
+// gzip.BestCompression. The zero value uses gzip.DefaultCompression.
+type GzipCodec struct {
+	Level int
+}
+
+// ID implements Codec.
+func (GzipCodec) ID() byte { return 1 }
+
+// Compress implements Codec.
+func (g GzipCodec) Compress(data []byte) ([]byte, error) {
+	level := g.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress implements Codec.
+func (GzipCodec) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// DefaultCompressionThreshold is the size from which values are compressed,
+// unless set otherwise with WithCompressionThreshold.
+const DefaultCompressionThreshold = 1024
+
+// compressedMagic starts the header of values written with WithCompression.
+// It is followed by the format version and the codec ID. As 0xff never
+// appears in UTF-8, it doesn't start text values, such as JSON.
+var compressedMagic = []byte{0xff, 'z', 'k', 'c'}
+
+const (
+	compressedVersion    = 1
+	compressedHeaderSize = 6
+	storedCodecID        = 0 // the value is not compressed, only given a header
+)
+
+// WithCompression returns a connection option that compresses the data of
+// znodes, e.g. to store JSON documents that would exceed the size limit of
+// the server otherwise. Create, Set and their variants compress values of at
+// least DefaultCompressionThreshold bytes, or as set by
+// WithCompressionThreshold, with codec if that makes them smaller, and prefix
+// them with a small header naming the codec. Get and its
+// variants remove the header and decompress the values, and return values
+// without header as they are, so znodes written without compression, e.g. by
+// other clients, can still be read. The Stat of a znode reports the size as
+// stored. Transactions and MultiRead do not compress values.
+//
+// Clients that don't use WithCompression read the compressed values with
+// their header, so all clients of a znode must use the same codec.
+func WithCompression(codec Codec) connOption {
+	return func(c *Conn) {
+		c.codec = codec
+	}
+}
+
+// WithCompressionThreshold returns a connection option that sets the size
+// from which values are compressed by the codec set with WithCompression.
+func WithCompressionThreshold(size int) connOption {
+	return func(c *Conn) {
+		c.compressionThreshold = size
+	}
+}
+
+// compress returns the data to store for a value when compression is on.
+func (c *Conn) compress(data []byte) ([]byte, error) {
+	if c.codec == nil {
+		return data, nil
+	}
+	if len(data) >= c.compressionThreshold {
+		compressed, err := c.codec.Compress(data)
+		if err != nil {
+			return nil, fmt.Errorf("zk: compressing data: %w", err)
+		}
+		if len(compressed)+compressedHeaderSize < len(data) {
+			return withCompressedHeader(c.codec.ID(), compressed), nil
+		}
+	}
+	if bytes.HasPrefix(data, compressedMagic) {
+		// Without a header of its own, the value would be mistaken for a
+		// compressed one when read.
+		return withCompressedHeader(storedCodecID, data), nil
+	}
+	return data, nil
+}
+
+// decompress returns the value for data stored with compress.
+func (c *Conn) decompress(data []byte) ([]byte, error) {
+	if c.codec == nil || len(data) < compressedHeaderSize || !bytes.HasPrefix(data, compressedMagic) ||
+		data[len(compressedMagic)] != compressedVersion {
+		return data, nil
+	}
+	switch id := data[compressedHeaderSize-1]; id {
+	case storedCodecID:
+		return data[compressedHeaderSize:], nil
+	case c.codec.ID():
+		value, err := c.codec.Decompress(data[compressedHeaderSize:])
+		if err != nil {
+			return nil, fmt.Errorf("zk: decompressing data: %w", err)
+		}
+		return value, nil
+	default:
+		return nil, fmt.Errorf("zk: data compressed with unknown codec %d", id)
+	}
+}
+
+func withCompressedHeader(id byte, data []byte) []byte {
+	buf := make([]byte, 0, compressedHeaderSize+len(data))
+	buf = append(buf, compressedMagic...)
+	buf = append(buf, compressedVersion, id)
+	return append(buf, data...)
+}
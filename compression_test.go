@@ -0,0 +1,102 @@
+package zk
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestCompression(t *testing.T) {
+	fs := newFakeTreeServer(t)
+	defer fs.Close()
+
+	plain := connectFake(t, fs)
+	zk := connectFake(t, fs, WithCompression(GzipCodec{}))
+
+	compressible := []byte(strings.Repeat(`{"key":"value"},`, 1000))
+	incompressible := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(incompressible)
+	small := []byte("small")
+	magic := append(append([]byte(nil), compressedMagic...), compressedVersion, GzipCodec{}.ID())
+
+	tests := []struct {
+		name       string
+		data       []byte
+		compressed bool
+	}{
+		{"compressible", compressible, true},
+		{"incompressible", incompressible, false},
+		{"small", small, false},
+		{"empty", nil, false},
+		{"magic", magic, false},
+	}
+	for _, tt := range tests {
+		path := "/" + tt.name
+		if _, err := zk.Create(path, tt.data, 0, WorldACL(PermAll)); err != nil {
+			t.Fatalf("%s: Create returned error: %v", tt.name, err)
+		}
+		data, stat, err := zk.Get(path)
+		if err != nil {
+			t.Fatalf("%s: Get returned error: %v", tt.name, err)
+		}
+		if !bytes.Equal(data, tt.data) {
+			t.Fatalf("%s: Get returned %d bytes that differ from the %d written", tt.name, len(data), len(tt.data))
+		}
+		stored, _, err := plain.Get(path)
+		if err != nil {
+			t.Fatalf("%s: Get without compression returned error: %v", tt.name, err)
+		}
+		if compressed := len(stored) < len(tt.data); compressed != tt.compressed {
+			t.Fatalf("%s: stored %d bytes for %d; want compressed %v", tt.name, len(stored), len(tt.data), tt.compressed)
+		}
+		if int(stat.DataLength) != len(stored) {
+			t.Fatalf("%s: Stat.DataLength is %d; want the stored size %d", tt.name, stat.DataLength, len(stored))
+		}
+	}
+
+	if _, err := zk.Set("/small", compressible, -1); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	res := <-zk.GetAsync("/small")
+	if res.Err != nil || !bytes.Equal(res.Data, compressible) {
+		t.Fatalf("GetAsync returned %d bytes, %v; want the value set", len(res.Data), res.Err)
+	}
+	data, _, _, err := zk.GetW("/small")
+	if err != nil || !bytes.Equal(data, compressible) {
+		t.Fatalf("GetW returned %d bytes, %v; want the value set", len(data), err)
+	}
+
+	// Values written without compression are read as they are.
+	if _, err := plain.Create("/legacy", compressible, 0, WorldACL(PermAll)); err != nil {
+		t.Fatalf("Create without compression returned error: %v", err)
+	}
+	if data, _, err := zk.Get("/legacy"); err != nil || !bytes.Equal(data, compressible) {
+		t.Fatalf("Get of a value written without compression returned %d bytes, %v", len(data), err)
+	}
+
+	// A value compressed by another codec is an error, not garbage.
+	other := append(append([]byte(nil), compressedMagic...), compressedVersion, 42, 1, 2, 3)
+	if _, err := plain.Create("/other", other, 0, WorldACL(PermAll)); err != nil {
+		t.Fatalf("Create without compression returned error: %v", err)
+	}
+	if _, _, err := zk.Get("/other"); err == nil {
+		t.Fatalf("Get of a value compressed with an unknown codec succeeded")
+	}
+}
+
+func TestCompressionThreshold(t *testing.T) {
+	c := &Conn{codec: GzipCodec{}, compressionThreshold: DefaultCompressionThreshold}
+	data := []byte(strings.Repeat("a", 100))
+	if stored, _ := c.compress(data); !bytes.Equal(stored, data) {
+		t.Fatalf("value below the default threshold was compressed")
+	}
+	WithCompressionThreshold(10)(c)
+	stored, err := c.compress(data)
+	if err != nil || len(stored) >= len(data) {
+		t.Fatalf("compress with a lower threshold returned %d bytes, %v; want fewer than %d", len(stored), err, len(data))
+	}
+	if got, err := c.decompress(stored); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("decompress returned %q, %v; want %q", got, err, data)
+	}
+}
@@ -0,0 +1,126 @@
+package zk
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// configNode is the znode that holds the dynamic configuration of the ensemble.
+const configNode = "/zookeeper/config"
+
+// ClusterConfig is the dynamic configuration of an ensemble, as stored in the
+// configuration znode returned by GetConfig.
+type ClusterConfig struct {
+	// Version is the zxid of the reconfiguration that created this config.
+	Version int64
+	Servers []ClusterServer
+}
+
+// ClusterServer is a single "server.<id>=..." entry of a ClusterConfig.
+type ClusterServer struct {
+	ID           int
+	Host         string
+	PeerPort     int
+	ElectionPort int
+	// Role is "participant" or "observer".
+	Role string
+	// ClientAddr is the address the server accepts client connections on.
+	// It is empty if the server does not serve clients.
+	ClientAddr string
+}
+
+// String returns the server in the format accepted by IncrementalReconfig
+// and Reconfig.
+func (s ClusterServer) String() string {
+	str := fmt.Sprintf("server.%d=%s:%d:%d:%s", s.ID, s.Host, s.PeerPort, s.ElectionPort, s.Role)
+	if s.ClientAddr != "" {
+		str += ";" + s.ClientAddr
+	}
+	return str
+}
+
+// ParseConfig parses the contents of the configuration znode, e.g.
+//
+//	server.1=10.0.0.1:2888:3888:participant;0.0.0.0:2181
+//	server.2=10.0.0.2:2888:3888:observer;0.0.0.0:2181
+//	version=100000000
+func ParseConfig(data []byte) (*ClusterConfig, error) {
+	cfg := &ClusterConfig{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		key, value, ok := cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("zk: invalid config line %q", line)
+		}
+		switch {
+		case key == "version":
+			version, err := strconv.ParseInt(value, 16, 64)
+			if err != nil {
+				return nil, fmt.Errorf("zk: invalid config version %q: %v", value, err)
+			}
+			cfg.Version = version
+		case strings.HasPrefix(key, "server."):
+			server, err := parseConfigServer(strings.TrimPrefix(key, "server."), value)
+			if err != nil {
+				return nil, fmt.Errorf("zk: invalid config line %q: %v", line, err)
+			}
+			cfg.Servers = append(cfg.Servers, server)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// parseConfigServer parses the id and value of a "server.<id>=<host>:<peer
+// port>:<election port>[:<role>][;[<client host>:]<client port>]" entry.
+func parseConfigServer(id, value string) (ClusterServer, error) {
+	var server ClusterServer
+	var err error
+	if server.ID, err = strconv.Atoi(id); err != nil {
+		return server, fmt.Errorf("invalid server id %q", id)
+	}
+
+	addr, client, hasClient := cut(value, ";")
+	if hasClient {
+		if !strings.Contains(client, ":") {
+			client = "0.0.0.0:" + client
+		}
+		server.ClientAddr = client
+	}
+
+	// The host may be a bracketed IPv6 address, so split from the right.
+	parts := strings.Split(addr, ":")
+	server.Role = "participant"
+	if last := parts[len(parts)-1]; last == "participant" || last == "observer" {
+		server.Role = last
+		parts = parts[:len(parts)-1]
+	}
+	if len(parts) < 3 {
+		return server, fmt.Errorf("missing ports in %q", addr)
+	}
+	if server.ElectionPort, err = strconv.Atoi(parts[len(parts)-1]); err != nil {
+		return server, fmt.Errorf("invalid election port %q", parts[len(parts)-1])
+	}
+	if server.PeerPort, err = strconv.Atoi(parts[len(parts)-2]); err != nil {
+		return server, fmt.Errorf("invalid peer port %q", parts[len(parts)-2])
+	}
+	server.Host = strings.Join(parts[:len(parts)-2], ":")
+	return server, nil
+}
+
+// cut slices s around the first instance of sep.
+func cut(s, sep string) (before, after string, found bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
@@ -0,0 +1,37 @@
+package zk
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	data := []byte("server.1=10.0.0.1:2888:3888:participant;0.0.0.0:2181\n" +
+		"server.2=10.0.0.2:2888:3888:observer;2181\n" +
+		"server.3=[::1]:2888:3888\n" +
+		"version=100000000")
+	cfg, err := ParseConfig(data)
+	if err != nil {
+		t.Fatalf("ParseConfig returned error: %v", err)
+	}
+	want := &ClusterConfig{
+		Version: 0x100000000,
+		Servers: []ClusterServer{
+			{ID: 1, Host: "10.0.0.1", PeerPort: 2888, ElectionPort: 3888, Role: "participant", ClientAddr: "0.0.0.0:2181"},
+			{ID: 2, Host: "10.0.0.2", PeerPort: 2888, ElectionPort: 3888, Role: "observer", ClientAddr: "0.0.0.0:2181"},
+			{ID: 3, Host: "[::1]", PeerPort: 2888, ElectionPort: 3888, Role: "participant"},
+		},
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Fatalf("ParseConfig returned %+v; want %+v", cfg, want)
+	}
+	if s := cfg.Servers[0].String(); s != "server.1=10.0.0.1:2888:3888:participant;0.0.0.0:2181" {
+		t.Fatalf("String returned %q", s)
+	}
+
+	for _, bad := range []string{"server.x=10.0.0.1:2888:3888", "server.1=10.0.0.1:2888", "version=zz", "garbage"} {
+		if _, err := ParseConfig([]byte(bad)); err == nil {
+			t.Errorf("ParseConfig(%q) returned no error", bad)
+		}
+	}
+}
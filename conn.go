@@ -10,8 +10,10 @@ Possible watcher events:
 */
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -27,10 +29,22 @@ import (
 // because attempts to connect to all servers in the list failed.
 var ErrNoServer = errors.New("zk: could not connect to a server")
 
+// ErrGaveUp indicates that the connection was closed because it failed to
+// connect more often than allowed by WithMaxReconnectAttempts.
+var ErrGaveUp = errors.New("zk: gave up connecting to the servers")
+
+// errServerRemoved ends the send loop when UpdateServers removed the server
+// the client is connected to.
+var errServerRemoved = errors.New("zk: server removed from the server list")
+
 // ErrInvalidPath indicates that an operation was being attempted on
 // an invalid path. (e.g. empty path).
 var ErrInvalidPath = errors.New("zk: invalid path")
 
+// ErrWatchesNotReset is the error of the EventNotWatching events sent when
+// the watches are dropped after reconnecting, see WithAutoResetWatches.
+var ErrWatchesNotReset = errors.New("zk: watches not reset after reconnecting")
+
 // DefaultLogger uses the stdlib log package for logging.
 var DefaultLogger Logger = defaultLogger{}
 
@@ -47,6 +61,8 @@ const (
 	watchTypeData watchType = iota
 	watchTypeExist
 	watchTypeChild
+	watchTypePersistent
+	watchTypePersistentRecursive
 )
 
 type watchPathType struct {
@@ -62,6 +78,16 @@ type Logger interface {
 	Printf(string, ...interface{})
 }
 
+// StructuredLogger is a leveled logger. Every message comes with alternating
+// keys and values, such as "server" and the address of the server. A
+// *slog.Logger implements it.
+type StructuredLogger interface {
+	Debug(msg string, keysAndValues ...interface{})
+	Info(msg string, keysAndValues ...interface{})
+	Warn(msg string, keysAndValues ...interface{})
+	Error(msg string, keysAndValues ...interface{})
+}
+
 type authCreds struct {
 	scheme string
 	auth   []byte
@@ -69,47 +95,103 @@ type authCreds struct {
 
 // Conn is the client connection and tracks all details for communication with the server.
 type Conn struct {
-	lastZxid         int64
+	lastZxid         int64 // accessed atomically; first to be 64-bit aligned
 	sessionID        int64
-	state            State // must be 32-bit aligned
+	state            State         // must be 32-bit aligned
+	stateMu          sync.Mutex    // protects stateChanged
+	stateChanged     chan struct{} // closed and replaced on every state change
 	xid              uint32
-	sessionTimeoutMs int32 // session timeout in milliseconds
+	sessionTimeoutMs int32      // session timeout in milliseconds; accessed atomically
+	passwdMu         sync.Mutex // protects passwd
 	passwd           []byte
 
 	dialer         Dialer
+	tlsConfig      *tls.Config // nil for plaintext connections
 	hostProvider   HostProvider
 	serverMu       sync.Mutex // protects server
 	server         string     // remember the address/port of the current server
 	conn           net.Conn
 	eventChan      chan Event
-	eventCallback  EventCallback // may be nil
+	eventCallback  EventCallback   // may be nil
+	metrics        MetricsRecorder // may be nil
+	tracer         Tracer          // may be nil
+	retryPolicy    RetryPolicy     // nil means requests are not retried
+	breaker        *circuitBreaker // nil for no circuit breaker
 	shouldQuit     chan struct{}
 	shouldQuitOnce sync.Once
 	pingInterval   time.Duration
 	recvTimeout    time.Duration
 	connectTimeout time.Duration
+	backoff        backoff // delay after failing to connect to all servers
+	jitter         float64 // randomizes reconnect delays and ping intervals
+	maxAttempts    int     // failed connection attempts before giving up; 0 for no limit
+	failedAttempts int     // consecutive failed connection attempts
+	gaveUp         int32   // set to 1 when the connection gave up; accessed atomically
+	saslRejected   int32   // set to 1 when the SASL credentials were rejected; accessed atomically
+	canBeReadOnly  bool    // accept connections to read-only servers
+	readOnly       int32   // 1 if connected to a read-only server; accessed atomically
+	sessionRenewed int32   // 1 if the last connect replaced an expired session; accessed atomically
+	renewing       bool    // the session expired, so the next one replaces it
 	maxBufferSize  int
 
-	creds   []authCreds
-	credsMu sync.Mutex // protects server
+	// handshakeTimeout bounds the session handshake with a server; if zero,
+	// it is derived from the session timeout.
+	handshakeTimeout time.Duration
+	keepAlive        time.Duration // TCP keep-alive period; 0 for the default
+	noDelay          *bool         // nil for the default
+	maxPingInterval  time.Duration // set by WithPingInterval; 0 for the default
+	coalesceWatches  bool          // set by WithCoalescedWatches
+	noResetWatches   bool          // set by WithAutoResetWatches(false)
+	requestTimeout   time.Duration // set by WithRequestTimeout; 0 for no timeout
+
+	codec                Codec // nil for no compression; set by WithCompression
+	compressionThreshold int
+
+	// pendingSlots holds a value for every request counted against the limit
+	// set by WithMaxPendingRequests; nil for no limit.
+	pendingSlots    chan struct{}
+	pendingFailFast bool // fail instead of blocking when pendingSlots is full
+
+	rateLimiter  *rateLimiter // nil for no limit; set by WithRateLimit
+	rateFailFast bool         // fail instead of blocking when over the rate limit
+
+	ephemerals *ephemeralTracker // nil unless WithLostEphemeralsCallback or WithEphemeralRecovery is set
+
+	eventChanSize  int                 // set by WithEventChannelSize
+	eventOverflow  EventOverflowPolicy // set by WithEventOverflowPolicy
+	eventsDropping int32               // 1 while events are dropped; accessed atomically
+
+	creds      []authCreds
+	credsMu    sync.Mutex // protects server
+	saslClient SASLClient // may be nil
 
 	sendChan     chan *request
 	requests     map[int32]*request // Xid -> pending request
 	requestsLock sync.Mutex
+	unsent       int32         // requests queued but not sent yet; accessed atomically
+	draining     chan struct{} // closed by CloseGracefully
+	drainingOnce sync.Once
 	watchers     map[watchPathType][]chan Event
-	watchersLock sync.Mutex
-	closeChan    chan struct{} // channel to tell send loop stop
+	watchersLock sync.Mutex // protects watchers and persistentWatchers
+
+	persistentWatchers map[watchPathType][]*persistentWatcher
+	closeChan          chan struct{} // channel to tell send loop stop
+	reconnect          chan string   // server to disconnect from, see UpdateServers
+	connectedMu        sync.Mutex    // protects connected
+	connected          chan struct{} // closed and replaced when a session is established
 
 	// Debug (used by unit tests)
 	reconnectLatch   chan struct{}
+	reconnectDelayFn func(time.Duration) // called with each reconnect delay
 	setWatchLimit    int
 	setWatchCallback func([]*setWatchesRequest)
+	pingTickerFn     func(time.Duration) (<-chan time.Time, func()) // replaces time.NewTicker
 
 	// Debug (for recurring re-auth hang)
 	debugCloseRecvLoop bool
 	resendZkAuthFn     func(context.Context, *Conn) error
 
-	logger  Logger
+	logger  StructuredLogger
 	logInfo bool // true if information messages are logged; false if only errors are logged
 
 	buf []byte
@@ -118,6 +200,31 @@ type Conn struct {
 // connOption represents a connection option.
 type connOption func(c *Conn)
 
+// backoff computes exponentially growing delays. It is only used by the
+// connection loop, so it needs no locking.
+type backoff struct {
+	initial time.Duration
+	max     time.Duration
+	factor  float64
+	delay   time.Duration // next delay; 0 starts over at initial
+}
+
+func (b *backoff) next() time.Duration {
+	if b.delay == 0 {
+		b.delay = b.initial
+	}
+	d := b.delay
+	b.delay = time.Duration(float64(b.delay) * b.factor)
+	if b.delay > b.max || b.delay <= 0 {
+		b.delay = b.max
+	}
+	return d
+}
+
+func (b *backoff) reset() {
+	b.delay = 0
+}
+
 type request struct {
 	xid        int32
 	opcode     int32
@@ -133,6 +240,11 @@ type request struct {
 	// loop the caller can use recvFunc to insert some synchronously code
 	// after a response.
 	recvFunc func(*request, *responseHeader, error)
+
+	canceled  int32 // set atomically when the caller stopped waiting for the response
+	holdsSlot int32 // 1 while the request holds one of c.pendingSlots; accessed atomically
+
+	sent time.Time // when the request was sent, if metrics are recorded
 }
 
 type response struct {
@@ -150,6 +262,37 @@ type Event struct {
 	Server string // For connection events
 }
 
+// String formats the event for logging, e.g.
+// Event{Type:EventNodeDataChanged State:StateHasSession Path:/foo}. Err and
+// Server are only included if set.
+func (e Event) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Event{Type:%v State:%v", e.Type, e.State)
+	if e.Path != "" {
+		fmt.Fprintf(&b, " Path:%s", e.Path)
+	}
+	if e.Server != "" {
+		fmt.Fprintf(&b, " Server:%s", e.Server)
+	}
+	if e.Err != nil {
+		fmt.Fprintf(&b, " Err:%v", e.Err)
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+// IsWatchEvent reports whether the event is about a watched znode, i.e. was
+// sent to a watch channel, including EventNotWatching when a watch is lost.
+func (e Event) IsWatchEvent() bool {
+	return e.Type != EventSession
+}
+
+// IsStateEvent reports whether the event is a change of the connection or
+// session state, as sent on the channel returned by Connect.
+func (e Event) IsStateEvent() bool {
+	return e.Type == EventSession
+}
+
 // HostProvider is used to represent a set of hosts a ZooKeeper client should connect to.
 // It is an analog of the Java equivalent:
 // http://svn.apache.org/viewvc/zookeeper/trunk/src/java/main/org/apache/zookeeper/client/HostProvider.java?view=markup
@@ -165,6 +308,14 @@ type HostProvider interface {
 	Connected()
 }
 
+// ConnectFailedNotifier is an optional interface implemented by a HostProvider
+// that wants to know when connecting to a server returned by Next failed, for
+// example to look up its address again before it is handed out next time.
+type ConnectFailedNotifier interface {
+	// ConnectFailed notifies the HostProvider that connecting to server failed.
+	ConnectFailed(server string)
+}
+
 // ConnectWithDialer establishes a new connection to a pool of zookeeper servers
 // using a custom Dialer. See Connect for further information about session timeout.
 // This method is deprecated and provided for compatibility: use the WithDialer option instead.
@@ -178,41 +329,74 @@ func ConnectWithDialer(servers []string, sessionTimeout time.Duration, dialer Di
 // the session timeout it's possible to reestablish a connection to a different
 // server and keep the same session. This is means any ephemeral nodes and
 // watches are maintained.
+//
+// Connect returns immediately and the connection is established in the
+// background; use ConnectContext to wait for the session.
 func Connect(servers []string, sessionTimeout time.Duration, options ...connOption) (*Conn, <-chan Event, error) {
+	return connect(servers, sessionTimeout, options...)
+}
+
+// ConnectContext is like Connect, but it waits until a session is established
+// before returning. If ctx is done before, the connection is closed and
+// ctx.Err() is returned.
+func ConnectContext(ctx context.Context, servers []string, sessionTimeout time.Duration, options ...connOption) (*Conn, <-chan Event, error) {
+	conn, ec, err := connect(servers, sessionTimeout, options...)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := conn.WaitForConnection(ctx); err != nil {
+		// Close can block for up to a second waiting for the close request.
+		go conn.Close()
+		return nil, nil, err
+	}
+	return conn, ec, nil
+}
+
+func connect(servers []string, sessionTimeout time.Duration, options ...connOption) (*Conn, <-chan Event, error) {
 	if len(servers) == 0 {
 		return nil, nil, errors.New("zk: server list must not be empty")
 	}
 
 	srvs := FormatServers(servers)
 
-	// Randomize the order of the servers to avoid creating hotspots
-	stringShuffle(srvs)
-
-	ec := make(chan Event, eventChanSize)
 	conn := &Conn{
-		dialer:         net.DialTimeout,
-		hostProvider:   &DNSHostProvider{},
-		conn:           nil,
-		state:          StateDisconnected,
-		eventChan:      ec,
-		shouldQuit:     make(chan struct{}),
-		connectTimeout: 1 * time.Second,
-		sendChan:       make(chan *request, sendChanSize),
-		requests:       make(map[int32]*request),
-		watchers:       make(map[watchPathType][]chan Event),
-		passwd:         emptyPassword,
-		logger:         DefaultLogger,
-		logInfo:        true, // default is true for backwards compatability
-		buf:            make([]byte, bufferSize),
-		resendZkAuthFn: resendZkAuth,
+		hostProvider:       &DNSHostProvider{},
+		conn:               nil,
+		state:              StateDisconnected,
+		shouldQuit:         make(chan struct{}),
+		draining:           make(chan struct{}),
+		connected:          make(chan struct{}),
+		connectTimeout:     1 * time.Second,
+		backoff:            backoff{initial: time.Second, max: time.Second, factor: 1},
+		sendChan:           make(chan *request, sendChanSize),
+		reconnect:          make(chan string, 1),
+		requests:           make(map[int32]*request),
+		watchers:           make(map[watchPathType][]chan Event),
+		persistentWatchers: make(map[watchPathType][]*persistentWatcher),
+		passwd:             emptyPassword,
+		logger:             printfLogger{DefaultLogger},
+		logInfo:            true, // default is true for backwards compatability
+		buf:                make([]byte, bufferSize),
+		resendZkAuthFn:     resendZkAuth,
+
+		compressionThreshold: DefaultCompressionThreshold,
+		eventChanSize:        eventChanSize,
 	}
 
 	// Set provided options.
 	for _, option := range options {
 		option(conn)
 	}
+	if conn.dialer == nil {
+		conn.dialer = conn.dialTCP
+	}
+	ec := make(chan Event, conn.eventChanSize)
+	conn.eventChan = ec
+	if r, ok := conn.metrics.(CircuitBreakerRecorder); ok && conn.breaker != nil {
+		conn.breaker.onChange = r.RecordCircuitState
+	}
 
-	if err := conn.hostProvider.Init(srvs); err != nil {
+	if err := conn.initHostProvider(srvs); err != nil {
 		return nil, nil, err
 	}
 
@@ -222,29 +406,235 @@ func Connect(servers []string, sessionTimeout time.Duration, options ...connOpti
 
 	go func() {
 		conn.loop(ctx)
-		conn.flushRequests(ErrClosing)
-		conn.invalidateWatches(ErrClosing)
+		conn.flushRequests(conn.closeErr(ErrClosing))
+		conn.invalidateWatches(conn.closeErr(ErrClosing))
+		if closer, ok := conn.hostProvider.(io.Closer); ok {
+			closer.Close()
+		}
 		close(conn.eventChan)
 	}()
 	return conn, ec, nil
 }
 
 // WithDialer returns a connection option specifying a non-default Dialer.
+// WithKeepAlive and WithTCPNoDelay don't apply to connections made by it, so
+// the dialer is responsible for configuring them.
 func WithDialer(dialer Dialer) connOption {
 	return func(c *Conn) {
 		c.dialer = dialer
 	}
 }
 
+// WithKeepAlive returns a connection option that sets the TCP keep-alive
+// period of the connections to the servers, so half-open connections, e.g.
+// dropped by a load balancer, are detected sooner. A negative period disables
+// keep-alives. By default, the keep-alive settings of the net package are
+// used.
+func WithKeepAlive(period time.Duration) connOption {
+	return func(c *Conn) {
+		c.keepAlive = period
+	}
+}
+
+// WithTCPNoDelay returns a connection option that sets whether Nagle's
+// algorithm is disabled on the connections to the servers. It is disabled by
+// default, as in the net package, which keeps the latency of small requests
+// low.
+func WithTCPNoDelay(noDelay bool) connOption {
+	return func(c *Conn) {
+		c.noDelay = &noDelay
+	}
+}
+
+// WithTLSConfig returns a connection option that makes the client connect to
+// the servers' secure client port over TLS, with a new TLS handshake on every
+// (re)connect. The config is used for every server; if its ServerName is empty,
+// the host of the server being dialed is used to verify its certificate.
+// For mutual TLS, put the client certificate in the config's Certificates.
+func WithTLSConfig(config *tls.Config) connOption {
+	return func(c *Conn) {
+		c.tlsConfig = config
+	}
+}
+
+// WithReconnectBackoff returns a connection option that makes the client back
+// off exponentially when it failed to connect to any of the servers: it waits
+// initial before the next attempt, and factor times longer after each further
+// failure, up to max. The delay is reset once a connection is established.
+// The default is to wait one second between attempts.
+func WithReconnectBackoff(initial, max time.Duration, factor float64) connOption {
+	return func(c *Conn) {
+		if max < initial {
+			max = initial
+		}
+		if factor < 1 {
+			factor = 1
+		}
+		c.backoff = backoff{initial: initial, max: max, factor: factor}
+	}
+}
+
+// WithReconnectJitter returns a connection option that randomizes each
+// reconnect delay by up to ±fraction of it, and shortens each connection's
+// ping interval by up to half of fraction, so that many clients don't
+// reconnect and ping in lockstep after a failover. The fraction must be in
+// [0, 1].
+func WithReconnectJitter(fraction float64) connOption {
+	return func(c *Conn) {
+		if fraction < 0 {
+			fraction = 0
+		} else if fraction > 1 {
+			fraction = 1
+		}
+		c.jitter = fraction
+	}
+}
+
+// WithMaxReconnectAttempts returns a connection option that makes the client
+// give up after n consecutive failed attempts to connect to a server. It then
+// closes the connection: its event channel is closed and all requests fail
+// with ErrGaveUp. An attempt fails if dialing the server or the handshake with
+// it fails; establishing a session resets the count. The default of 0 retries
+// forever.
+func WithMaxReconnectAttempts(n int) connOption {
+	return func(c *Conn) {
+		c.maxAttempts = n
+	}
+}
+
+// WithReadOnly returns a connection option that allows the client to connect
+// to servers that lost contact with the quorum and serve reads only. While
+// connected to such a server, the state is StateConnectedReadOnly instead of
+// StateHasSession, ReadOnly returns true and writes fail with ErrNotReadOnlyOp.
+// The servers must be started with readonlymode.enabled.
+func WithReadOnly(readOnly bool) connOption {
+	return func(c *Conn) {
+		c.canBeReadOnly = readOnly
+	}
+}
+
+// WithMaxPendingRequests returns a connection option that limits the number
+// of requests that were queued and not answered yet to n. Once the limit is
+// reached, new requests block until earlier ones complete, so a slow server
+// pushes back on the application instead of letting the queue grow without
+// bound. Requests with a context stop waiting once it is done. See
+// WithPendingRequestsFailFast to fail them instead. The default of 0 sets
+// no limit.
+func WithMaxPendingRequests(n int) connOption {
+	return func(c *Conn) {
+		if n > 0 {
+			c.pendingSlots = make(chan struct{}, n)
+		} else {
+			c.pendingSlots = nil
+		}
+	}
+}
+
+// WithPendingRequestsFailFast returns a connection option that makes requests
+// over the limit set by WithMaxPendingRequests fail with ErrTooManyRequests
+// right away, instead of blocking.
+func WithPendingRequestsFailFast() connOption {
+	return func(c *Conn) {
+		c.pendingFailFast = true
+	}
+}
+
+// WithCoalescedWatches returns a connection option that sets a watch on the
+// server only for the first of several GetW, ExistsW or ChildrenW calls on a
+// znode. The server keeps one watch per kind and znode for a session anyway,
+// so later calls only add another channel to the watch the client already
+// has, and all of them receive its event. This saves the server from
+// re-registering the watch every time, e.g. for caches with many readers.
+func WithCoalescedWatches() connOption {
+	return func(c *Conn) {
+		c.coalesceWatches = true
+	}
+}
+
+// WithAutoResetWatches returns a connection option that sets whether the
+// watches are set again on the server after reconnecting, which they are by
+// default. Without, the watches are dropped instead, for applications that
+// set again the watches they still need: their channels receive an
+// EventNotWatching event with ErrWatchesNotReset and are closed, as are the
+// channels of persistent watches, and a single EventNotWatching event with an
+// empty path is sent to the event channel. The recipes of this package
+// expect their watches to be reset, so they should not be used without.
+func WithAutoResetWatches(reset bool) connOption {
+	return func(c *Conn) {
+		c.noResetWatches = !reset
+	}
+}
+
+// WithSession returns a connection option that resumes an existing session,
+// as returned by SessionID and SessionPassword, instead of creating a new one.
+// Its ephemeral nodes and watches on the server are kept. If the session
+// expired in the meantime, the state goes to StateExpired and a new session
+// is created, as after any other expiry.
+func WithSession(sessionID int64, passwd []byte) connOption {
+	return func(c *Conn) {
+		c.sessionID = sessionID
+		c.passwd = append([]byte(nil), passwd...)
+	}
+}
+
 // WithHostProvider returns a connection option specifying a non-default HostProvider.
+// If the HostProvider implements io.Closer, it is closed once the connection is closed.
+// The servers passed to Init are shuffled first, except for the DNSHostProvider and
+// WeightedHostProvider, which order them themselves.
 func WithHostProvider(hostProvider HostProvider) connOption {
 	return func(c *Conn) {
 		c.hostProvider = hostProvider
 	}
 }
 
+// WithConnectTimeout returns a connection option that bounds connecting to a
+// single server, i.e. dialing it and the session handshake, so the client
+// quickly moves on from servers that don't answer. By default dialing times
+// out after one second and the handshake after ten times the read timeout
+// derived from the session timeout. With ConnectContext, the deadline of the
+// context still bounds the whole attempt to get a session.
+func WithConnectTimeout(timeout time.Duration) connOption {
+	return func(c *Conn) {
+		c.connectTimeout = timeout
+		c.handshakeTimeout = timeout
+	}
+}
+
+// WithPingInterval returns a connection option that sends pings to the server
+// at most every interval, e.g. to keep the connection busy through proxies
+// or load balancers that drop idle connections. By default pings are sent
+// every third of the negotiated session timeout; longer intervals are
+// ignored, as the server would expire the session before the next ping.
+func WithPingInterval(interval time.Duration) connOption {
+	return func(c *Conn) {
+		c.maxPingInterval = interval
+	}
+}
+
+// WithRequestTimeout returns a connection option that makes a request fail
+// with ErrRequestTimeout if it is not answered within timeout, e.g. because
+// the server is stalled, while the session is kept. It applies to the
+// synchronous methods, and to the Ctx ones if the context has no deadline of
+// its own. As with a canceled context, the server may still apply a write
+// that timed out; its error says so, and wraps ErrRequestTimeout. By default
+// requests wait until answered or the connection is lost.
+func WithRequestTimeout(timeout time.Duration) connOption {
+	return func(c *Conn) {
+		c.requestTimeout = timeout
+	}
+}
+
 // WithLogger returns a connection option specifying a non-default Logger.
 func WithLogger(logger Logger) connOption {
+	return func(c *Conn) {
+		c.logger = printfLogger{logger}
+	}
+}
+
+// WithStructuredLogger returns a connection option specifying a leveled
+// logger to use instead of a Logger. Information messages are still only
+// logged if WithLogInfo is not set to false.
+func WithStructuredLogger(logger StructuredLogger) connOption {
 	return func(c *Conn) {
 		c.logger = logger
 	}
@@ -262,8 +652,12 @@ func WithLogInfo(logInfo bool) connOption {
 type EventCallback func(Event)
 
 // WithEventCallback returns a connection option that specifies an event
-// callback.
-// The callback must not block - doing so would delay the ZK go routines.
+// callback. It is called synchronously, in order, for every event also sent
+// on the event channel, including the EventSession events of all state
+// changes. Unlike the channel, it never misses an event.
+// The callback must not block - doing so would delay the ZK go routines. In
+// particular it must not wait for requests on the connection, which would
+// deadlock; hand the event to another goroutine to do that.
 func WithEventCallback(cb EventCallback) connOption {
 	return func(c *Conn) {
 		c.eventCallback = cb
@@ -323,32 +717,188 @@ func (c *Conn) Close() {
 	})
 }
 
+// CloseGracefully is like Close, but first waits for the requests that are
+// already queued or sent to be answered, e.g. to make sure a final Set was
+// applied before exiting. Meanwhile, new requests fail with ErrClosing. If
+// ctx is done first, the connection is closed anyway, the requests still
+// waiting for an answer fail with ErrConnectionClosed, and ctx.Err() is
+// returned.
+func (c *Conn) CloseGracefully(ctx context.Context) error {
+	c.drainingOnce.Do(func() { close(c.draining) })
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for c.pendingRequests() > 0 {
+		select {
+		case <-ticker.C:
+		case <-c.shouldQuit:
+			return nil
+		case <-ctx.Done():
+			c.Close()
+			return ctx.Err()
+		}
+	}
+	c.Close()
+	return nil
+}
+
+// WaitForConnection blocks until the connection has a session, which may be
+// with a read-only server if it was created with WithReadOnly. It returns
+// right away if it already has one. If ctx is done first, ctx.Err() is
+// returned; if the connection is closed, ErrClosing, ErrGaveUp if it gave up
+// connecting, or ErrAuthFailed if its SASL credentials were rejected.
+func (c *Conn) WaitForConnection(ctx context.Context) error {
+	select {
+	case <-c.shouldQuit:
+		// The state may not have changed yet.
+		return c.closeErr(ErrClosing)
+	default:
+	}
+	return c.waitForState(ctx, func(s State) bool { return s == StateHasSession || s == StateConnectedReadOnly })
+}
+
+// Ping checks that a server is reachable and the session is alive, e.g. for a
+// readiness endpoint, independently of the pings the client sends in the
+// background. It sends a cheap request, checking that "/" exists, and waits
+// for the answer, or until ctx is done or the timeout set by WithRequestTimeout
+// passes. Unlike other requests, it fails right away with ErrConnectionClosed
+// while the client is not connected, rather than waiting to reconnect, and it
+// is not retried.
+func (c *Conn) Ping(ctx context.Context) error {
+	select {
+	case <-c.shouldQuit:
+		return c.closeErr(ErrClosing)
+	default:
+	}
+	if s := c.State(); s != StateHasSession && s != StateConnectedReadOnly {
+		return ErrConnectionClosed
+	}
+	_, err := c.requestTimeoutOnce(ctx, opExists, &existsRequest{Path: "/"}, &existsResponse{}, nil)
+	return err
+}
+
 // State returns the current state of the connection.
 func (c *Conn) State() State {
 	return State(atomic.LoadInt32((*int32)(&c.state)))
 }
 
+// SessionTimeout returns the session timeout. Once connected, it is the
+// timeout negotiated with the server, which may differ from the requested one.
+// The ping interval and receive timeout are derived from it.
+func (c *Conn) SessionTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt32(&c.sessionTimeoutMs)) * time.Millisecond
+}
+
+// ReadOnly reports whether the client is connected to a read-only server.
+// It can only be true if the connection was created with WithReadOnly.
+func (c *Conn) ReadOnly() bool {
+	return atomic.LoadInt32(&c.readOnly) != 0
+}
+
+// LastZxid returns the zxid of the latest change seen by the connection, as
+// carried by the last response. The server the client reconnects to must
+// have seen it too, so it only grows during a session; it starts over at 0
+// with a new session. It can be used to order observations or to detect a
+// client that stopped seeing changes.
+func (c *Conn) LastZxid() int64 {
+	return atomic.LoadInt64(&c.lastZxid)
+}
+
 // SessionID returns the current session id of the connection.
 func (c *Conn) SessionID() int64 {
 	return atomic.LoadInt64(&c.sessionID)
 }
 
+// SessionRenewed reports whether the last connect established a new session
+// because the previous one expired, rather than resuming the session. The
+// ephemeral nodes and watches of the expired session are gone then, so
+// recipes, such as an election, need to start over. It is false for the first
+// session of the connection, unless it replaces a session given to WithSession
+// that expired. It is set before the StateHasSession event of the connect is
+// sent.
+func (c *Conn) SessionRenewed() bool {
+	return atomic.LoadInt32(&c.sessionRenewed) != 0
+}
+
+// SessionPassword returns the password of the current session. Together with
+// the session id, it allows another connection to resume the session with
+// WithSession, e.g. after a process restart.
+func (c *Conn) SessionPassword() []byte {
+	c.passwdMu.Lock()
+	defer c.passwdMu.Unlock()
+	return append([]byte(nil), c.passwd...)
+}
+
+func (c *Conn) setPassword(passwd []byte) {
+	c.passwdMu.Lock()
+	c.passwd = passwd
+	c.passwdMu.Unlock()
+}
+
 // SetLogger sets the logger to be used for printing errors.
 // Logger is an interface provided by this package.
 func (c *Conn) SetLogger(l Logger) {
-	c.logger = l
+	c.logger = printfLogger{l}
 }
 
 func (c *Conn) setTimeouts(sessionTimeoutMs int32) {
-	c.sessionTimeoutMs = sessionTimeoutMs
+	atomic.StoreInt32(&c.sessionTimeoutMs, sessionTimeoutMs)
 	sessionTimeout := time.Duration(sessionTimeoutMs) * time.Millisecond
 	c.recvTimeout = sessionTimeout * 2 / 3
 	c.pingInterval = c.recvTimeout / 2
+	if c.maxPingInterval > 0 && c.maxPingInterval < c.pingInterval {
+		c.pingInterval = c.maxPingInterval
+	}
 }
 
 func (c *Conn) setState(state State) {
+	c.stateMu.Lock()
 	atomic.StoreInt32((*int32)(&c.state), int32(state))
-	c.sendEvent(Event{Type: EventSession, State: state, Server: c.Server()})
+	if c.stateChanged != nil {
+		close(c.stateChanged)
+		c.stateChanged = nil
+	}
+	c.stateMu.Unlock()
+	c.sendEvent(Event{Type: EventSession, State: state, Server: c.serverAddr()})
+}
+
+// waitForState blocks until ok returns true for the state of the connection.
+// It returns ctx.Err() if ctx is done first, or ErrClosing if the connection
+// is closed.
+func (c *Conn) waitForState(ctx context.Context, ok func(State) bool) error {
+	for {
+		c.stateMu.Lock()
+		if c.stateChanged == nil {
+			c.stateChanged = make(chan struct{})
+		}
+		changed := c.stateChanged
+		state := c.State()
+		c.stateMu.Unlock()
+
+		if ok(state) {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.shouldQuit:
+			return c.closeErr(ErrClosing)
+		}
+	}
+}
+
+// closeErr returns the error for requests on a closed connection: ErrGaveUp
+// if it gave up connecting, ErrAuthFailed if the SASL credentials were
+// rejected, err otherwise.
+func (c *Conn) closeErr(err error) error {
+	if atomic.LoadInt32(&c.gaveUp) != 0 {
+		return ErrGaveUp
+	}
+	if atomic.LoadInt32(&c.saslRejected) != 0 {
+		return ErrAuthFailed
+	}
+	return err
 }
 
 func (c *Conn) sendEvent(evt Event) {
@@ -358,8 +908,9 @@ func (c *Conn) sendEvent(evt Event) {
 
 	select {
 	case c.eventChan <- evt:
+		atomic.StoreInt32(&c.eventsDropping, 0)
 	default:
-		// panic("zk: event channel full - it must be monitored and never allowed to be full")
+		c.overflowEvent(evt)
 	}
 }
 
@@ -374,8 +925,12 @@ func (c *Conn) connect() error {
 
 		if retryStart {
 			c.flushUnsentRequests(ErrNoServer)
+			delay := jitter(c.backoff.next(), -c.jitter, c.jitter)
+			if c.reconnectDelayFn != nil {
+				c.reconnectDelayFn(delay)
+			}
 			select {
-			case <-time.After(time.Second):
+			case <-time.After(delay):
 				// pass
 			case <-c.shouldQuit:
 				c.setState(StateDisconnected)
@@ -384,18 +939,107 @@ func (c *Conn) connect() error {
 			}
 		}
 
-		zkConn, err := c.dialer("tcp", c.Server(), c.connectTimeout)
+		zkConn, err := c.dial(c.serverAddr())
 		if err == nil {
 			c.conn = zkConn
 			c.setState(StateConnected)
 			if c.logInfo {
-				c.logger.Printf("connected to %s", c.Server())
+				c.logger.Info("connected", "server", c.serverAddr())
 			}
 			return nil
 		}
 
-		c.logger.Printf("failed to connect to %s: %v", c.Server(), err)
+		c.logger.Warn("failed to connect", "server", c.serverAddr(), "error", err, "attempt", c.failedAttempts+1)
+		if n, ok := c.hostProvider.(ConnectFailedNotifier); ok {
+			n.ConnectFailed(c.serverAddr())
+		}
+
+		if c.attemptFailed() {
+			c.setState(StateDisconnected)
+			c.flushUnsentRequests(ErrGaveUp)
+			return ErrGaveUp
+		}
+	}
+}
+
+// attemptFailed counts a failed attempt to connect to a server. Once the
+// limit set by WithMaxReconnectAttempts is reached, it closes the connection
+// and returns true.
+func (c *Conn) attemptFailed() bool {
+	c.failedAttempts++
+	if c.maxAttempts == 0 || c.failedAttempts < c.maxAttempts {
+		return false
+	}
+	c.logger.Error("giving up connecting", "attempts", c.failedAttempts)
+	atomic.StoreInt32(&c.gaveUp, 1)
+	c.shouldQuitOnce.Do(func() { close(c.shouldQuit) })
+	return true
+}
+
+// tcpConn is the part of *net.TCPConn that dialTCP configures.
+type tcpConn interface {
+	SetKeepAlive(keepalive bool) error
+	SetKeepAlivePeriod(d time.Duration) error
+	SetNoDelay(noDelay bool) error
+}
+
+// dialTCP is the default Dialer. It applies the WithKeepAlive and
+// WithTCPNoDelay options to the connection.
+func (c *Conn) dialTCP(network, address string, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout(network, address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if tc, ok := conn.(tcpConn); ok {
+		if err := c.configureTCP(tc); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (c *Conn) configureTCP(tc tcpConn) error {
+	if c.keepAlive != 0 {
+		if err := tc.SetKeepAlive(c.keepAlive > 0); err != nil {
+			return err
+		}
+		if c.keepAlive > 0 {
+			if err := tc.SetKeepAlivePeriod(c.keepAlive); err != nil {
+				return err
+			}
+		}
+	}
+	if c.noDelay != nil {
+		return tc.SetNoDelay(*c.noDelay)
+	}
+	return nil
+}
+
+// dial connects to the server, doing the TLS handshake if TLS is enabled.
+func (c *Conn) dial(server string) (net.Conn, error) {
+	conn, err := c.dialer("tcp", server, c.connectTimeout)
+	if err != nil || c.tlsConfig == nil {
+		return conn, err
+	}
+
+	config := c.tlsConfig
+	if config.ServerName == "" {
+		config = config.Clone()
+		if host, _, err := net.SplitHostPort(server); err == nil {
+			config.ServerName = host
+		} else {
+			config.ServerName = server
+		}
 	}
+	tlsConn := tls.Client(conn, config)
+	tlsConn.SetDeadline(time.Now().Add(c.connectTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("tls handshake: %w", err)
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
 }
 
 func (c *Conn) sendRequest(
@@ -424,25 +1068,33 @@ func (c *Conn) sendRequest(
 }
 
 func (c *Conn) loop(ctx context.Context) {
+	connected := false
 	for {
 		if err := c.connect(); err != nil {
-			// c.Close() was called
+			// c.Close() was called, or the connection gave up
 			return
 		}
 
 		err := c.authenticate()
 		switch {
-		case err == ErrSessionExpired:
-			c.logger.Printf("authentication failed: %s", err)
+		case errors.Is(err, ErrSessionExpired):
+			c.logger.Warn("authentication failed", "server", c.serverAddr(), "error", err)
 			c.invalidateWatches(err)
 		case err != nil && c.conn != nil:
-			c.logger.Printf("authentication failed: %s", err)
+			c.logger.Warn("authentication failed", "server", c.serverAddr(), "error", err)
 			c.conn.Close()
+			c.attemptFailed()
 		case err == nil:
+			c.failedAttempts = 0
+			if connected && c.metrics != nil {
+				c.metrics.RecordReconnect()
+			}
+			connected = true
 			if c.logInfo {
-				c.logger.Printf("authenticated: id=%d, timeout=%d", c.SessionID(), c.sessionTimeoutMs)
+				c.logger.Info("authenticated", "server", c.serverAddr(), "session", c.SessionID(), "timeout", atomic.LoadInt32(&c.sessionTimeoutMs))
 			}
-			c.hostProvider.Connected()        // mark success
+			c.hostProvider.Connected() // mark success
+			c.backoff.reset()
 			c.closeChan = make(chan struct{}) // channel to tell send loop stop
 
 			var wg sync.WaitGroup
@@ -452,13 +1104,33 @@ func (c *Conn) loop(ctx context.Context) {
 				defer c.conn.Close() // causes recv loop to EOF/exit
 				defer wg.Done()
 
+				if c.saslClient != nil {
+					err := c.saslAuthenticate(ctx)
+					switch {
+					case err == ErrConnectionClosed || err == ErrClosing:
+						return
+					case err != nil:
+						c.logger.Error("SASL authentication failed", "server", c.serverAddr(), "error", err)
+						c.saslFailed()
+						return
+					}
+					c.setSessionState()
+				}
+
 				if err := c.resendZkAuthFn(ctx, c); err != nil {
-					c.logger.Printf("error in resending auth creds: %v", err)
+					c.logger.Warn("failed to resend auth creds", "server", c.serverAddr(), "error", err)
+					if errors.Is(err, ErrAuthFailed) {
+						// Requests would fail with ErrNoAuth on the new
+						// connection, so let the application know.
+						c.setState(StateAuthFailed)
+					}
 					return
 				}
 
-				if err := c.sendLoop(); err != nil || c.logInfo {
-					c.logger.Printf("send loop terminated: %v", err)
+				if err := c.sendLoop(); err != nil && err != errServerRemoved {
+					c.logger.Warn("send loop terminated", "server", c.serverAddr(), "error", err)
+				} else if c.logInfo {
+					c.logger.Info("send loop terminated", "server", c.serverAddr(), "error", err)
 				}
 			}()
 
@@ -473,28 +1145,39 @@ func (c *Conn) loop(ctx context.Context) {
 				} else {
 					err = c.recvLoop(c.conn)
 				}
-				if err != io.EOF || c.logInfo {
-					c.logger.Printf("recv loop terminated: %v", err)
+				if err != io.EOF {
+					c.logger.Warn("recv loop terminated", "server", c.serverAddr(), "error", err)
+				} else if c.logInfo {
+					c.logger.Info("recv loop terminated", "server", c.serverAddr(), "error", err)
 				}
 				if err == nil {
 					panic("zk: recvLoop should never return nil error")
 				}
 			}()
 
-			c.sendSetWatches()
+			if c.noResetWatches {
+				c.dropWatches()
+			} else {
+				c.sendSetWatches()
+			}
+			c.signalConnected()
 			wg.Wait()
 		}
 
-		c.setState(StateDisconnected)
+		atomic.StoreInt32(&c.readOnly, 0)
+		if atomic.LoadInt32(&c.saslRejected) == 0 {
+			// Otherwise the client stays in StateAuthFailed, see saslFailed.
+			c.setState(StateDisconnected)
+		}
 
 		select {
 		case <-c.shouldQuit:
-			c.flushRequests(ErrClosing)
+			c.flushRequests(c.closeErr(ErrClosing))
 			return
 		default:
 		}
 
-		if err != ErrSessionExpired {
+		if !errors.Is(err, ErrSessionExpired) {
 			err = ErrConnectionClosed
 		}
 		c.flushRequests(err)
@@ -515,7 +1198,8 @@ func (c *Conn) flushUnsentRequests(err error) {
 		default:
 			return
 		case req := <-c.sendChan:
-			req.recvChan <- response{-1, err}
+			atomic.AddInt32(&c.unsent, -1)
+			c.respond(req, response{-1, err})
 		}
 	}
 }
@@ -524,7 +1208,8 @@ func (c *Conn) flushUnsentRequests(err error) {
 func (c *Conn) flushRequests(err error) {
 	c.requestsLock.Lock()
 	for _, req := range c.requests {
-		req.recvChan <- response{-1, err}
+		c.recordRequest(req, err)
+		c.respond(req, response{-1, err})
 	}
 	c.requests = make(map[int32]*request)
 	c.requestsLock.Unlock()
@@ -545,9 +1230,11 @@ func (c *Conn) notifyWatches(ev Event) {
 	}
 	c.watchersLock.Lock()
 	defer c.watchersLock.Unlock()
+	fired := false
 	for _, t := range wTypes {
 		wpt := watchPathType{ev.Path, t}
 		if watchers := c.watchers[wpt]; len(watchers) > 0 {
+			fired = true
 			for _, ch := range watchers {
 				ch <- ev
 				close(ch)
@@ -555,6 +1242,60 @@ func (c *Conn) notifyWatches(ev Event) {
 			delete(c.watchers, wpt)
 		}
 	}
+
+	switch ev.Type {
+	case EventNodeCreated, EventNodeDataChanged, EventNodeChildrenChanged, EventNodeDeleted:
+		for _, w := range c.persistentWatchers[watchPathType{ev.Path, watchTypePersistent}] {
+			fired = true
+			w.push(ev)
+		}
+	}
+	switch ev.Type {
+	case EventNodeCreated, EventNodeDataChanged, EventNodeDeleted:
+		// Recursive watches on the path or any of its ancestors.
+		for p := ev.Path; ; p = parentPath(p) {
+			for _, w := range c.persistentWatchers[watchPathType{p, watchTypePersistentRecursive}] {
+				fired = true
+				w.push(ev)
+			}
+			if p == "/" || p == "" {
+				break
+			}
+		}
+	}
+	if fired && c.metrics != nil {
+		c.metrics.RecordWatchFired(ev.Path)
+	}
+}
+
+// parentPath returns the parent of the znode at path.
+func parentPath(path string) string {
+	i := strings.LastIndexByte(path, '/')
+	if i <= 0 {
+		return "/"
+	}
+	return path[:i]
+}
+
+// joinPath returns the path of the child of the znode at path.
+func joinPath(path, child string) string {
+	return strings.TrimSuffix(path, "/") + "/" + child
+}
+
+// nextConnect returns a channel that is closed the next time the client has a
+// session with a server, after reconnecting or getting a new session. Recipes
+// use it to read again what they could have missed while disconnected.
+func (c *Conn) nextConnect() <-chan struct{} {
+	c.connectedMu.Lock()
+	defer c.connectedMu.Unlock()
+	return c.connected
+}
+
+func (c *Conn) signalConnected() {
+	c.connectedMu.Lock()
+	close(c.connected)
+	c.connected = make(chan struct{})
+	c.connectedMu.Unlock()
 }
 
 // Send error to all watchers and clear watchers map
@@ -573,48 +1314,144 @@ func (c *Conn) invalidateWatches(err error) {
 		}
 		c.watchers = make(map[watchPathType][]chan Event)
 	}
+
+	for pathType, watchers := range c.persistentWatchers {
+		ev := Event{Type: EventNotWatching, State: StateDisconnected, Path: pathType.path, Err: err}
+		c.sendEvent(ev) // also publish globally
+		for _, w := range watchers {
+			w.push(ev)
+			w.close()
+		}
+	}
+	c.persistentWatchers = make(map[watchPathType][]*persistentWatcher)
 }
 
-func (c *Conn) sendSetWatches() {
+// dropWatches drops the watches after reconnecting, instead of setting them
+// again, see WithAutoResetWatches.
+func (c *Conn) dropWatches() {
 	c.watchersLock.Lock()
 	defer c.watchersLock.Unlock()
 
-	if len(c.watchers) == 0 {
+	if len(c.watchers) == 0 && len(c.persistentWatchers) == 0 {
 		return
 	}
-
-	// NB: A ZK server, by default, rejects packets >1mb. So, if we have too
-	// many watches to reset, we need to break this up into multiple packets
-	// to avoid hitting that limit. Mirroring the Java client behavior: we are
-	// conservative in that we limit requests to 128kb (since server limit is
-	// is actually configurable and could conceivably be configured smaller
-	// than default of 1mb).
-	limit := 128 * 1024
-	if c.setWatchLimit > 0 {
-		limit = c.setWatchLimit
-	}
-
-	var reqs []*setWatchesRequest
-	var req *setWatchesRequest
-	var sizeSoFar int
-
-	n := 0
 	for pathType, watchers := range c.watchers {
-		if len(watchers) == 0 {
-			continue
+		ev := Event{Type: EventNotWatching, State: StateHasSession, Path: pathType.path, Err: ErrWatchesNotReset}
+		for _, ch := range watchers {
+			ch <- ev
+			close(ch)
 		}
-		addlLen := 4 + len(pathType.path)
+	}
+	c.watchers = make(map[watchPathType][]chan Event)
+	for pathType, watchers := range c.persistentWatchers {
+		ev := Event{Type: EventNotWatching, State: StateHasSession, Path: pathType.path, Err: ErrWatchesNotReset}
+		for _, w := range watchers {
+			w.push(ev)
+			w.close()
+		}
+	}
+	c.persistentWatchers = make(map[watchPathType][]*persistentWatcher)
+	c.sendEvent(Event{Type: EventNotWatching, State: StateHasSession, Server: c.serverAddr(), Err: ErrWatchesNotReset})
+}
+
+// sendSetWatches restores the watches on the server after reconnecting. The
+// persistent watches are restored with setWatches2 along with the others,
+// like the Java client does, so the server also sends the events missed
+// while disconnected. If the server doesn't support setWatches2, they are
+// added again with addWatch instead, and the others restored with setWatches.
+func (c *Conn) sendSetWatches() {
+	c.watchersLock.Lock()
+	defer c.watchersLock.Unlock()
+
+	hasPersistent := false
+	for _, watchers := range c.persistentWatchers {
+		if len(watchers) > 0 {
+			hasPersistent = true
+			break
+		}
+	}
+
+	legacy := c.setWatchesRequests(false)
+	var reqs []*setWatchesRequest
+	for _, req := range legacy {
+		reqs = append(reqs, &setWatchesRequest{
+			RelativeZxid: req.RelativeZxid,
+			DataWatches:  req.DataWatches,
+			ExistWatches: req.ExistWatches,
+			ChildWatches: req.ChildWatches,
+		})
+	}
+	if !hasPersistent {
+		if len(reqs) > 0 {
+			if c.setWatchCallback != nil {
+				c.setWatchCallback(reqs)
+			}
+			go c.resendSetWatches(reqs)
+		}
+		return
+	}
+
+	reqs2 := c.setWatchesRequests(true)
+	addWatches := c.persistentWatchRequests()
+	go func() {
+		res := &setWatchesResponse{}
+		for i, req := range reqs2 {
+			_, err := c.request(opSetWatches2, req, res, nil)
+			if i == 0 && errors.Is(err, ErrUnimplemented) {
+				// A server before 3.6, e.g. during a rolling upgrade.
+				c.resendSetWatches(reqs)
+				c.resendPersistentWatches(addWatches)
+				return
+			}
+			if err != nil {
+				c.logger.Warn("failed to set previous watches", "error", err)
+				break
+			}
+		}
+	}()
+}
+
+// setWatchesRequests returns the requests to restore the watches, with the
+// persistent ones if persistent is set. Callers must hold c.watchersLock.
+func (c *Conn) setWatchesRequests(persistent bool) []*setWatches2Request {
+	// NB: A ZK server, by default, rejects packets >1mb. So, if we have too
+	// many watches to reset, we need to break this up into multiple packets
+	// to avoid hitting that limit. Mirroring the Java client behavior: we are
+	// conservative in that we limit requests to 128kb (since server limit is
+	// is actually configurable and could conceivably be configured smaller
+	// than default of 1mb). A smaller max buffer size, which should match
+	// the server's, lowers the limit further.
+	limit := 128 * 1024
+	if c.maxBufferSize > 0 && c.maxBufferSize < limit {
+		limit = c.maxBufferSize
+	}
+	if c.setWatchLimit > 0 {
+		limit = c.setWatchLimit
+	}
+	overhead := 28 // fixed overhead of a set-watches packet
+	if persistent {
+		overhead += 8 // two more lists
+	}
+
+	var reqs []*setWatches2Request
+	var req *setWatches2Request
+	var sizeSoFar int
+
+	add := func(pathType watchPathType) {
+		addlLen := 4 + len(pathType.path)
 		if req == nil || sizeSoFar+addlLen > limit {
 			if req != nil {
 				// add to set of requests that we'll send
 				reqs = append(reqs, req)
 			}
-			sizeSoFar = 28 // fixed overhead of a set-watches packet
-			req = &setWatchesRequest{
-				RelativeZxid: c.lastZxid,
-				DataWatches:  make([]string, 0),
-				ExistWatches: make([]string, 0),
-				ChildWatches: make([]string, 0),
+			sizeSoFar = overhead
+			req = &setWatches2Request{
+				RelativeZxid:               atomic.LoadInt64(&c.lastZxid),
+				DataWatches:                make([]string, 0),
+				ExistWatches:               make([]string, 0),
+				ChildWatches:               make([]string, 0),
+				PersistentWatches:          make([]string, 0),
+				PersistentRecursiveWatches: make([]string, 0),
 			}
 		}
 		sizeSoFar += addlLen
@@ -625,34 +1462,77 @@ func (c *Conn) sendSetWatches() {
 			req.ExistWatches = append(req.ExistWatches, pathType.path)
 		case watchTypeChild:
 			req.ChildWatches = append(req.ChildWatches, pathType.path)
+		case watchTypePersistent:
+			req.PersistentWatches = append(req.PersistentWatches, pathType.path)
+		case watchTypePersistentRecursive:
+			req.PersistentRecursiveWatches = append(req.PersistentRecursiveWatches, pathType.path)
 		}
-		n++
 	}
-	if n == 0 {
-		return
+
+	for pathType, watchers := range c.watchers {
+		if len(watchers) > 0 {
+			add(pathType)
+		}
+	}
+	if persistent {
+		for pathType, watchers := range c.persistentWatchers {
+			if len(watchers) > 0 {
+				add(pathType)
+			}
+		}
 	}
 	if req != nil { // don't forget any trailing packet we were building
 		reqs = append(reqs, req)
 	}
+	return reqs
+}
 
-	if c.setWatchCallback != nil {
-		c.setWatchCallback(reqs)
+// resendSetWatches sends the setWatches requests, stopping at the first
+// failure.
+func (c *Conn) resendSetWatches(reqs []*setWatchesRequest) {
+	res := &setWatchesResponse{}
+	// TODO: Pipeline these so queue all of them up before waiting on any
+	// response. That will require some investigation to make sure there
+	// aren't failure modes where a blocking write to the channel of requests
+	// could hang indefinitely and cause this goroutine to leak...
+	for _, req := range reqs {
+		_, err := c.request(opSetWatches, req, res, nil)
+		if err != nil {
+			c.logger.Warn("failed to set previous watches", "error", err)
+			break
+		}
 	}
+}
 
-	go func() {
-		res := &setWatchesResponse{}
-		// TODO: Pipeline these so queue all of them up before waiting on any
-		// response. That will require some investigation to make sure there
-		// aren't failure modes where a blocking write to the channel of requests
-		// could hang indefinitely and cause this goroutine to leak...
-		for _, req := range reqs {
-			_, err := c.request(opSetWatches, req, res, nil)
-			if err != nil {
-				c.logger.Printf("Failed to set previous watches: %v", err)
-				break
-			}
+// persistentWatchRequests returns the requests to add the persistent watches
+// again, for servers that don't support setWatches2. Callers must hold
+// c.watchersLock.
+func (c *Conn) persistentWatchRequests() []*addWatchRequest {
+	var reqs []*addWatchRequest
+	for pathType, watchers := range c.persistentWatchers {
+		if len(watchers) == 0 {
+			continue
 		}
-	}()
+		switch pathType.wType {
+		case watchTypePersistent:
+			reqs = append(reqs, &addWatchRequest{Path: pathType.path, Mode: AddWatchModePersistent})
+		case watchTypePersistentRecursive:
+			reqs = append(reqs, &addWatchRequest{Path: pathType.path, Mode: AddWatchModePersistentRecursive})
+		}
+	}
+	return reqs
+}
+
+// resendPersistentWatches sends the addWatch requests, stopping at the first
+// failure.
+func (c *Conn) resendPersistentWatches(reqs []*addWatchRequest) {
+	for _, req := range reqs {
+		_, err := c.request(opAddWatch, req, &addWatchResponse{}, nil)
+		if err != nil {
+			c.logger.Warn("failed to add previous persistent watches", "error", err)
+			break
+		}
+	}
 }
 
 func (c *Conn) authenticate() error {
@@ -661,18 +1541,29 @@ func (c *Conn) authenticate() error {
 	// Encode and send a connect request.
 	n, err := encodePacket(buf[4:], &connectRequest{
 		ProtocolVersion: protocolVersion,
-		LastZxidSeen:    c.lastZxid,
-		TimeOut:         c.sessionTimeoutMs,
+		LastZxidSeen:    atomic.LoadInt64(&c.lastZxid),
+		TimeOut:         atomic.LoadInt32(&c.sessionTimeoutMs),
 		SessionID:       c.SessionID(),
-		Passwd:          c.passwd,
+		Passwd:          c.SessionPassword(),
 	})
 	if err != nil {
 		return err
 	}
+	if c.canBeReadOnly {
+		// The readOnly flag was added to the protocol after the other
+		// fields, so servers accept requests with and without it.
+		buf[4+n] = 1
+		n++
+	}
 
 	binary.BigEndian.PutUint32(buf[:4], uint32(n))
 
-	c.conn.SetWriteDeadline(time.Now().Add(c.recvTimeout * 10))
+	timeout := c.handshakeTimeout
+	if timeout == 0 {
+		timeout = c.recvTimeout * 10
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(timeout))
 	_, err = c.conn.Write(buf[:n+4])
 	c.conn.SetWriteDeadline(time.Time{})
 	if err != nil {
@@ -680,9 +1571,9 @@ func (c *Conn) authenticate() error {
 	}
 
 	// Receive and decode a connect response.
-	c.conn.SetReadDeadline(time.Now().Add(c.recvTimeout * 10))
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+	defer c.conn.SetReadDeadline(time.Time{})
 	_, err = io.ReadFull(c.conn, buf[:4])
-	c.conn.SetReadDeadline(time.Time{})
 	if err != nil {
 		return err
 	}
@@ -698,37 +1589,71 @@ func (c *Conn) authenticate() error {
 	}
 
 	r := connectResponse{}
-	_, err = decodePacket(buf[:blen], &r)
+	n, err = decodePacket(buf[:blen], &r)
 	if err != nil {
 		return err
 	}
+	readOnly := int32(0)
+	if n < blen && buf[n] != 0 {
+		readOnly = 1
+	}
+	atomic.StoreInt32(&c.readOnly, readOnly)
 	if r.SessionID == 0 {
 		atomic.StoreInt64(&c.sessionID, int64(0))
-		c.passwd = emptyPassword
-		c.lastZxid = 0
+		c.setPassword(emptyPassword)
+		atomic.StoreInt64(&c.lastZxid, 0)
+		c.renewing = true
 		c.setState(StateExpired)
+		if c.ephemerals != nil {
+			c.ephemeralsExpired()
+		}
 		return ErrSessionExpired
 	}
 
 	atomic.StoreInt64(&c.sessionID, r.SessionID)
 	c.setTimeouts(r.TimeOut)
-	c.passwd = r.Passwd
-	c.setState(StateHasSession)
+	c.setPassword(r.Passwd)
+	renewed := int32(0)
+	if c.renewing {
+		renewed = 1
+		c.renewing = false
+	}
+	atomic.StoreInt32(&c.sessionRenewed, renewed)
+	if c.saslClient == nil {
+		// Otherwise the session is usable once SASL succeeded, see loop.
+		c.setSessionState()
+	}
 
 	return nil
 }
 
+// setSessionState moves to StateHasSession, or StateConnectedReadOnly when
+// connected to a read-only server.
+func (c *Conn) setSessionState() {
+	if atomic.LoadInt32(&c.readOnly) != 0 {
+		c.setState(StateConnectedReadOnly)
+	} else {
+		c.setState(StateHasSession)
+	}
+}
+
 func (c *Conn) sendData(req *request) error {
+	if atomic.LoadInt32(&req.canceled) != 0 {
+		// Nobody is waiting for the response, so don't bother the server.
+		c.releaseSlot(req)
+		return nil
+	}
+
 	header := &requestHeader{req.xid, req.opcode}
 	n, err := encodePacket(c.buf[4:], header)
 	if err != nil {
-		req.recvChan <- response{-1, err}
+		c.respond(req, response{-1, err})
 		return nil
 	}
 
 	n2, err := encodePacket(c.buf[4+n:], req.pkt)
 	if err != nil {
-		req.recvChan <- response{-1, err}
+		c.respond(req, response{-1, err})
 		return nil
 	}
 
@@ -739,11 +1664,14 @@ func (c *Conn) sendData(req *request) error {
 	c.requestsLock.Lock()
 	select {
 	case <-c.closeChan:
-		req.recvChan <- response{-1, ErrConnectionClosed}
+		c.respond(req, response{-1, ErrConnectionClosed})
 		c.requestsLock.Unlock()
 		return ErrConnectionClosed
 	default:
 	}
+	if c.metrics != nil {
+		req.sent = time.Now()
+	}
 	c.requests[req.xid] = req
 	c.requestsLock.Unlock()
 
@@ -751,7 +1679,7 @@ func (c *Conn) sendData(req *request) error {
 	_, err = c.conn.Write(c.buf[:n+4])
 	c.conn.SetWriteDeadline(time.Time{})
 	if err != nil {
-		req.recvChan <- response{-1, err}
+		c.respond(req, response{-1, err})
 		c.conn.Close()
 		return err
 	}
@@ -760,16 +1688,20 @@ func (c *Conn) sendData(req *request) error {
 }
 
 func (c *Conn) sendLoop() error {
-	pingTicker := time.NewTicker(c.pingInterval)
-	defer pingTicker.Stop()
+	// The ping interval is only ever shortened, so pings still arrive in time.
+	pingC, stop := c.newPingTicker(jitter(c.pingInterval, -c.jitter/2, 0))
+	defer stop()
 
 	for {
 		select {
 		case req := <-c.sendChan:
-			if err := c.sendData(req); err != nil {
+			err := c.sendData(req)
+			// The request is now in c.requests, if it is still pending.
+			atomic.AddInt32(&c.unsent, -1)
+			if err != nil {
 				return err
 			}
-		case <-pingTicker.C:
+		case <-pingC:
 			n, err := encodePacket(c.buf[4:], &requestHeader{Xid: -2, Opcode: opPing})
 			if err != nil {
 				panic("zk: opPing should never fail to serialize")
@@ -784,12 +1716,25 @@ func (c *Conn) sendLoop() error {
 				c.conn.Close()
 				return err
 			}
+		case server := <-c.reconnect:
+			if server == c.serverAddr() {
+				c.conn.Close()
+				return errServerRemoved
+			}
 		case <-c.closeChan:
 			return nil
 		}
 	}
 }
 
+func (c *Conn) newPingTicker(d time.Duration) (<-chan time.Time, func()) {
+	if c.pingTickerFn != nil {
+		return c.pingTickerFn(d)
+	}
+	t := time.NewTicker(d)
+	return t.C, t.Stop
+}
+
 func (c *Conn) recvLoop(conn net.Conn) error {
 	sz := bufferSize
 	if c.maxBufferSize > 0 && sz > c.maxBufferSize {
@@ -799,7 +1744,7 @@ func (c *Conn) recvLoop(conn net.Conn) error {
 	for {
 		// package length
 		if err := conn.SetReadDeadline(time.Now().Add(c.recvTimeout)); err != nil {
-			c.logger.Printf("failed to set connection deadline: %v", err)
+			c.logger.Warn("failed to set connection deadline", "error", err)
 		}
 		_, err := io.ReadFull(conn, buf[:4])
 		if err != nil {
@@ -843,10 +1788,10 @@ func (c *Conn) recvLoop(conn net.Conn) error {
 		} else if res.Xid == -2 {
 			// Ping response. Ignore.
 		} else if res.Xid < 0 {
-			c.logger.Printf("Xid < 0 (%d) but not ping or watcher event", res.Xid)
+			c.logger.Warn("xid < 0 but not ping or watcher event", "xid", res.Xid)
 		} else {
 			if res.Zxid > 0 {
-				c.lastZxid = res.Zxid
+				atomic.StoreInt64(&c.lastZxid, res.Zxid)
 			}
 
 			c.requestsLock.Lock()
@@ -857,7 +1802,7 @@ func (c *Conn) recvLoop(conn net.Conn) error {
 			c.requestsLock.Unlock()
 
 			if !ok {
-				c.logger.Printf("Response for unknown request with xid %d", res.Xid)
+				c.logger.Warn("response for unknown request", "xid", res.Xid)
 			} else {
 				if res.Err != 0 {
 					err = res.Err.toError()
@@ -867,10 +1812,22 @@ func (c *Conn) recvLoop(conn net.Conn) error {
 				if req.recvFunc != nil {
 					req.recvFunc(req, &res, err)
 				}
-				req.recvChan <- response{res.Zxid, err}
+				if c.ephemerals != nil {
+					c.ephemerals.track(req, err)
+				}
+				c.recordRequest(req, err)
+				if res.Err != 0 {
+					err = wrapServerError(req.opcode, req.pkt, res.Err)
+				}
+				c.respond(req, response{res.Zxid, err})
 				if req.opcode == opClose {
 					return io.EOF
 				}
+				if res.Err == errSessionMoved {
+					// The server no longer owns the session, so nothing
+					// else sent on this connection will be served.
+					return fmt.Errorf("request %d: %w", res.Xid, ErrSessionMoved)
+				}
 			}
 		}
 	}
@@ -880,18 +1837,196 @@ func (c *Conn) nextXid() int32 {
 	return int32(atomic.AddUint32(&c.xid, 1) & 0x7fffffff)
 }
 
-func (c *Conn) addWatcher(path string, watchType watchType) <-chan Event {
+// watchRequest sends a request that sets a watch on path and returns the
+// channel of the watch. newReq creates the request, with or without the watch
+// flag, and watchType tells which watch the server set, if any, from the
+// error of the request. With WithCoalescedWatches, the request is sent
+// without the flag if the client already has a watch of one of the given
+// types on path; if that watch turns out to have fired before the server
+// answered, the request is sent again with the flag.
+func (c *Conn) watchRequest(opcode int32, path string, types []watchType, newReq func(watch bool) interface{}, res interface{}, watchType func(error) (watchType, bool)) (<-chan Event, error) {
+	shared := false
+	if c.coalesceWatches {
+		c.watchersLock.Lock()
+		for _, t := range types {
+			shared = shared || len(c.watchers[watchPathType{path, t}]) > 0
+		}
+		c.watchersLock.Unlock()
+	}
+	for {
+		var ech <-chan Event
+		_, err := c.request(opcode, newReq(!shared), res, func(req *request, _ *responseHeader, err error) {
+			if t, ok := watchType(err); ok {
+				ech = c.addWatcher(path, t, shared)
+			}
+		})
+		if abandoned(context.Background(), err) {
+			return nil, err
+		}
+		if shared && ech == nil {
+			if _, ok := watchType(err); ok {
+				shared = false
+				continue
+			}
+		}
+		return ech, err
+	}
+}
+
+// addWatcher adds a channel for a watch of the given type on path. If
+// existing is set, it is only added if the client already has such a watch;
+// otherwise nil is returned.
+func (c *Conn) addWatcher(path string, watchType watchType, existing bool) <-chan Event {
 	c.watchersLock.Lock()
 	defer c.watchersLock.Unlock()
 
-	ch := make(chan Event, 1)
 	wpt := watchPathType{path, watchType}
+	if existing && len(c.watchers[wpt]) == 0 {
+		return nil
+	}
+	ch := make(chan Event, 1)
 	c.watchers[wpt] = append(c.watchers[wpt], ch)
 	return ch
 }
 
+func (c *Conn) addPersistentWatcher(path string, watchType watchType) <-chan Event {
+	c.watchersLock.Lock()
+	defer c.watchersLock.Unlock()
+
+	w := newPersistentWatcher()
+	wpt := watchPathType{path, watchType}
+	if c.persistentWatchers == nil {
+		c.persistentWatchers = make(map[watchPathType][]*persistentWatcher)
+	}
+	c.persistentWatchers[wpt] = append(c.persistentWatchers[wpt], w)
+	return w.ch
+}
+
+// watchTypesFor returns the watch types selected by t, or nil if t is invalid.
+func watchTypesFor(t WatcherType) []watchType {
+	switch t {
+	case WatcherTypeChildren:
+		return []watchType{watchTypeChild}
+	case WatcherTypeData:
+		return []watchType{watchTypeData, watchTypeExist}
+	case WatcherTypeAny:
+		return []watchType{watchTypeData, watchTypeExist, watchTypeChild, watchTypePersistent, watchTypePersistentRecursive}
+	case WatcherTypePersistent:
+		return []watchType{watchTypePersistent}
+	case WatcherTypePersistentRecursive:
+		return []watchType{watchTypePersistentRecursive}
+	}
+	return nil
+}
+
+func (c *Conn) hasWatchers(path string, watchTypes []watchType) bool {
+	c.watchersLock.Lock()
+	defer c.watchersLock.Unlock()
+
+	for _, t := range watchTypes {
+		wpt := watchPathType{path, t}
+		if len(c.watchers[wpt]) > 0 || len(c.persistentWatchers[wpt]) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// removeWatchers sends EventNotWatching to the watchers of the given types
+// on path and closes them.
+func (c *Conn) removeWatchers(path string, watchTypes []watchType) {
+	c.watchersLock.Lock()
+	defer c.watchersLock.Unlock()
+
+	ev := Event{Type: EventNotWatching, State: c.State(), Path: path}
+	for _, t := range watchTypes {
+		wpt := watchPathType{path, t}
+		for _, ch := range c.watchers[wpt] {
+			ch <- ev
+			close(ch)
+		}
+		delete(c.watchers, wpt)
+		for _, w := range c.persistentWatchers[wpt] {
+			w.push(ev)
+			w.close()
+		}
+		delete(c.persistentWatchers, wpt)
+	}
+}
+
+// persistentWatcher delivers the events of a persistent watch. The events
+// are queued, so a slow consumer does not block the receive loop.
+type persistentWatcher struct {
+	ch chan Event
+
+	mu     sync.Mutex
+	queue  []Event
+	closed bool
+	wake   chan struct{}
+}
+
+func newPersistentWatcher() *persistentWatcher {
+	w := &persistentWatcher{
+		ch:   make(chan Event),
+		wake: make(chan struct{}, 1),
+	}
+	go w.run()
+	return w
+}
+
+func (w *persistentWatcher) push(ev Event) {
+	w.mu.Lock()
+	if !w.closed {
+		w.queue = append(w.queue, ev)
+	}
+	w.mu.Unlock()
+	w.signal()
+}
+
+// close closes the channel once all queued events are delivered.
+func (w *persistentWatcher) close() {
+	w.mu.Lock()
+	w.closed = true
+	w.mu.Unlock()
+	w.signal()
+}
+
+func (w *persistentWatcher) signal() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (w *persistentWatcher) run() {
+	for {
+		w.mu.Lock()
+		for len(w.queue) == 0 && !w.closed {
+			w.mu.Unlock()
+			<-w.wake
+			w.mu.Lock()
+		}
+		if len(w.queue) == 0 {
+			w.mu.Unlock()
+			close(w.ch)
+			return
+		}
+		ev := w.queue[0]
+		w.queue = w.queue[1:]
+		w.mu.Unlock()
+
+		w.ch <- ev
+	}
+}
+
 func (c *Conn) queueRequest(opcode int32, req interface{}, res interface{}, recvFunc func(*request, *responseHeader, error)) <-chan response {
-	rq := &request{
+	rq := c.newRequest(opcode, req, res, recvFunc)
+	c.enqueueRequest(context.Background(), rq)
+	return rq.recvChan
+}
+
+func (c *Conn) newRequest(opcode int32, req interface{}, res interface{}, recvFunc func(*request, *responseHeader, error)) *request {
+	return &request{
 		xid:        c.nextXid(),
 		opcode:     opcode,
 		pkt:        req,
@@ -899,37 +2034,156 @@ func (c *Conn) queueRequest(opcode int32, req interface{}, res interface{}, recv
 		recvChan:   make(chan response, 2),
 		recvFunc:   recvFunc,
 	}
+}
 
-	switch opcode {
+// enqueueRequest hands rq to the send loop. If ctx is done before there is
+// room in the send queue, ctx.Err() is sent on rq.recvChan.
+func (c *Conn) enqueueRequest(ctx context.Context, rq *request) {
+	// Counted before checking c.draining, so CloseGracefully either waits for
+	// the request or it is rejected.
+	atomic.AddInt32(&c.unsent, 1)
+	switch rq.opcode {
 	case opClose:
 		// always attempt to send close ops.
 		select {
 		case c.sendChan <- rq:
 		case <-time.After(c.connectTimeout * 2):
-			c.logger.Printf("gave up trying to send opClose to server")
-			rq.recvChan <- response{-1, ErrConnectionClosed}
+			c.logger.Warn("gave up trying to send opClose to server")
+			c.reject(rq, ErrConnectionClosed)
 		}
 	default:
+		if c.ReadOnly() && isWriteOp(rq.opcode) {
+			// The server would reject it anyway.
+			c.reject(rq, ErrNotReadOnlyOp)
+			return
+		}
+		select {
+		case <-c.draining:
+			c.reject(rq, ErrClosing)
+			return
+		default:
+		}
+		if err := c.waitRateLimit(ctx); err != nil {
+			c.reject(rq, err)
+			return
+		}
+		if err := c.acquireSlot(ctx, rq); err != nil {
+			c.reject(rq, err)
+			return
+		}
 		// otherwise avoid deadlocks for dumb clients who aren't aware that
 		// the ZK connection is closed yet.
 		select {
 		case <-c.shouldQuit:
-			rq.recvChan <- response{-1, ErrConnectionClosed}
+			c.reject(rq, c.closeErr(ErrConnectionClosed))
+		case <-ctx.Done():
+			c.reject(rq, ctx.Err())
 		case c.sendChan <- rq:
 			// check for a tie
 			select {
 			case <-c.shouldQuit:
 				// maybe the caller gets this, maybe not- we tried.
-				rq.recvChan <- response{-1, ErrConnectionClosed}
+				c.respond(rq, response{-1, c.closeErr(ErrConnectionClosed)})
 			default:
 			}
 		}
 	}
-	return rq.recvChan
 }
 
-func (c *Conn) request(opcode int32, req interface{}, res interface{}, recvFunc func(*request, *responseHeader, error)) (int64, error) {
-	recv := c.queueRequest(opcode, req, res, recvFunc)
+// reject answers a request that was not queued for the send loop.
+func (c *Conn) reject(rq *request, err error) {
+	atomic.AddInt32(&c.unsent, -1)
+	c.respond(rq, response{-1, err})
+}
+
+// respond sends the response of a request to its caller.
+func (c *Conn) respond(rq *request, r response) {
+	c.releaseSlot(rq)
+	rq.recvChan <- r
+}
+
+// acquireSlot counts rq against the limit set by WithMaxPendingRequests,
+// waiting for an earlier request to complete if it is reached.
+func (c *Conn) acquireSlot(ctx context.Context, rq *request) error {
+	if c.pendingSlots == nil {
+		return nil
+	}
+	if c.pendingFailFast {
+		select {
+		case c.pendingSlots <- struct{}{}:
+		default:
+			return ErrTooManyRequests
+		}
+	} else {
+		select {
+		case c.pendingSlots <- struct{}{}:
+		case <-c.shouldQuit:
+			return c.closeErr(ErrConnectionClosed)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	atomic.StoreInt32(&rq.holdsSlot, 1)
+	return nil
+}
+
+// releaseSlot frees the slot held by rq, if any. It may be called more than
+// once for the same request.
+func (c *Conn) releaseSlot(rq *request) {
+	if atomic.CompareAndSwapInt32(&rq.holdsSlot, 1, 0) {
+		<-c.pendingSlots
+	}
+}
+
+// pendingRequests returns the number of requests that are queued or sent
+// and not answered yet.
+func (c *Conn) pendingRequests() int {
+	c.requestsLock.Lock()
+	defer c.requestsLock.Unlock()
+	return int(atomic.LoadInt32(&c.unsent)) + len(c.requests)
+}
+
+// isWriteOp reports whether the opcode modifies the tree, and so is
+// rejected by read-only servers.
+func isWriteOp(opcode int32) bool {
+	switch opcode {
+	case opCreate, opCreateContainer, opCreateTTL, opDelete, opSetData, opSetAcl, opMulti, opReconfig:
+		return true
+	}
+	return false
+}
+
+func (c *Conn) request(opcode int32, req interface{}, res interface{}, recvFunc func(*request, *responseHeader, error)) (_ int64, err error) {
+	if _, end := c.trace(context.Background(), opcode, req); end != nil {
+		defer func() { end(err) }()
+	}
+	done, err := c.breakerAllow()
+	if err != nil {
+		return -1, err
+	}
+	defer func() { done(err) }()
+	for attempt := 0; ; attempt++ {
+		var zxid int64
+		var err error
+		if c.requestTimeout > 0 {
+			zxid, err = c.requestTimeoutOnce(context.Background(), opcode, req, res, recvFunc)
+		} else {
+			zxid, err = c.wait(c.queueRequest(opcode, req, res, recvFunc))
+		}
+		retry, delay := c.shouldRetry(opcode, err, attempt)
+		if !retry {
+			return zxid, err
+		}
+		select {
+		case <-time.After(delay):
+		case <-c.shouldQuit:
+			return zxid, err
+		}
+	}
+}
+
+// wait waits for the response of a queued request.
+func (c *Conn) wait(recv <-chan response) (int64, error) {
 	select {
 	case r := <-recv:
 		return r.zxid, r.err
@@ -939,13 +2193,122 @@ func (c *Conn) request(opcode int32, req interface{}, res interface{}, recvFunc
 		// access `res` fields concurrently w/ the async response processor.
 		// NOTE: callers of this func should check for (at least) ErrConnectionClosed
 		// and avoid accessing fields of the response object if such error is present.
-		return -1, ErrConnectionClosed
+		return -1, c.closeErr(ErrConnectionClosed)
+	}
+}
+
+// requestCtx is like request, but stops waiting for the response once ctx is
+// done and returns ctx.Err(). The request is removed from the pending
+// requests, so a late response is dropped. If it was already sent, the server
+// may still apply it.
+func (c *Conn) requestCtx(ctx context.Context, opcode int32, req interface{}, res interface{}, recvFunc func(*request, *responseHeader, error)) (_ int64, err error) {
+	var end func(error)
+	if ctx, end = c.trace(ctx, opcode, req); end != nil {
+		defer func() { end(err) }()
+	}
+	done, err := c.breakerAllow()
+	if err != nil {
+		return -1, err
+	}
+	defer func() { done(err) }()
+	for attempt := 0; ; attempt++ {
+		zxid, err := c.requestTimeoutOnce(ctx, opcode, req, res, recvFunc)
+		retry, delay := c.shouldRetry(opcode, err, attempt)
+		if !retry {
+			return zxid, err
+		}
+		select {
+		case <-time.After(delay):
+		case <-c.shouldQuit:
+			return zxid, err
+		case <-ctx.Done():
+			return -1, ctx.Err()
+		}
+	}
+}
+
+// requestTimeoutOnce is like requestCtxOnce, but returns ErrRequestTimeout if
+// the timeout set by WithRequestTimeout elapses, unless ctx has a deadline.
+func (c *Conn) requestTimeoutOnce(ctx context.Context, opcode int32, req interface{}, res interface{}, recvFunc func(*request, *responseHeader, error)) (int64, error) {
+	if _, ok := ctx.Deadline(); ok || c.requestTimeout <= 0 {
+		return c.requestCtxOnce(ctx, opcode, req, res, recvFunc)
+	}
+	tctx, cancel := context.WithTimeout(ctx, c.requestTimeout)
+	defer cancel()
+	zxid, err := c.requestCtxOnce(tctx, opcode, req, res, recvFunc)
+	if err == context.DeadlineExceeded && ctx.Err() == nil {
+		err = ErrRequestTimeout
+	}
+	return zxid, err
+}
+
+func (c *Conn) requestCtxOnce(ctx context.Context, opcode int32, req interface{}, res interface{}, recvFunc func(*request, *responseHeader, error)) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return -1, err
+	}
+	rq := c.newRequest(opcode, req, res, recvFunc)
+	c.enqueueRequest(ctx, rq)
+	select {
+	case r := <-rq.recvChan:
+		return r.zxid, r.err
+	case <-c.shouldQuit:
+		// See request.
+		return -1, c.closeErr(ErrConnectionClosed)
+	case <-ctx.Done():
+		atomic.StoreInt32(&rq.canceled, 1)
+		c.requestsLock.Lock()
+		if c.requests[rq.xid] == rq {
+			delete(c.requests, rq.xid)
+			c.releaseSlot(rq)
+		}
+		c.requestsLock.Unlock()
+		return -1, ctx.Err()
+	}
+}
+
+// abandoned reports whether the caller stopped waiting for the response of a
+// request before it arrived: the connection was closed, ctx is done or the
+// request timed out. The recv loop may still decode a late response into the
+// response struct then, so its fields must not be read.
+func abandoned(ctx context.Context, err error) bool {
+	return err == ErrConnectionClosed || err == ErrRequestTimeout || canceled(ctx, err)
+}
+
+// canceled reports whether err is the error of ctx, as returned by requestCtx
+// when ctx is done before the response arrives.
+func canceled(ctx context.Context, err error) bool {
+	return err != nil && err == ctx.Err()
+}
+
+// mayHaveApplied wraps the error of a write request that was canceled by its
+// context or timed out, as the server may have applied the request regardless.
+func mayHaveApplied(ctx context.Context, opcode int32, err error) error {
+	switch {
+	case canceled(ctx, err):
+		return fmt.Errorf("zk: %s canceled, but it may have been applied by the server: %w", opNames[opcode], err)
+	case err == ErrRequestTimeout:
+		return fmt.Errorf("zk: %s timed out, but it may have been applied by the server: %w", opNames[opcode], err)
 	}
+	return err
 }
 
-// AddAuth adds an authentication config to the connection.
+// AddAuth adds an authentication config to the connection. It is sent again
+// after every reconnect, before any other request. If the server rejects it
+// then, the state goes to StateAuthFailed and the client reconnects.
+//
+// Like other requests, it may be called before the client is connected, e.g.
+// right after Connect: it is then sent as soon as the session is established,
+// before the requests made after it.
 func (c *Conn) AddAuth(scheme string, auth []byte) error {
-	_, err := c.request(opSetAuth, &setAuthRequest{Type: 0, Scheme: scheme, Auth: auth}, &setAuthResponse{}, nil)
+	return c.AddAuthCtx(context.Background(), scheme, auth)
+}
+
+// AddAuthCtx is like AddAuth, but stops waiting if ctx is done before the
+// server accepted the authentication config, e.g. because the client could not
+// connect meanwhile. The returned error then wraps ctx.Err(), and the config
+// is not sent again after reconnecting.
+func (c *Conn) AddAuthCtx(ctx context.Context, scheme string, auth []byte) error {
+	_, err := c.requestCtx(ctx, opSetAuth, &setAuthRequest{Type: 0, Scheme: scheme, Auth: auth}, &setAuthResponse{}, nil)
 
 	if err != nil {
 		return err
@@ -972,13 +2335,19 @@ func (c *Conn) AddAuth(scheme string, auth []byte) error {
 
 // Children returns the children of a znode.
 func (c *Conn) Children(path string) ([]string, *Stat, error) {
+	return c.ChildrenCtx(context.Background(), path)
+}
+
+// ChildrenCtx is like Children, but returns ctx.Err() if ctx is done before
+// the response arrives.
+func (c *Conn) ChildrenCtx(ctx context.Context, path string) ([]string, *Stat, error) {
 	if err := validatePath(path, false); err != nil {
 		return nil, nil, err
 	}
 
 	res := &getChildren2Response{}
-	_, err := c.request(opGetChildren2, &getChildren2Request{Path: path, Watch: false}, res, nil)
-	if err == ErrConnectionClosed {
+	_, err := c.requestCtx(ctx, opGetChildren2, &getChildren2Request{Path: path, Watch: false}, res, nil)
+	if abandoned(ctx, err) {
 		return nil, nil, err
 	}
 	return res.Children, &res.Stat, err
@@ -990,12 +2359,11 @@ func (c *Conn) ChildrenW(path string) ([]string, *Stat, <-chan Event, error) {
 		return nil, nil, nil, err
 	}
 
-	var ech <-chan Event
 	res := &getChildren2Response{}
-	_, err := c.request(opGetChildren2, &getChildren2Request{Path: path, Watch: true}, res, func(req *request, res *responseHeader, err error) {
-		if err == nil {
-			ech = c.addWatcher(path, watchTypeChild)
-		}
+	ech, err := c.watchRequest(opGetChildren2, path, []watchType{watchTypeChild}, func(watch bool) interface{} {
+		return &getChildren2Request{Path: path, Watch: watch}
+	}, res, func(err error) (watchType, bool) {
+		return watchTypeChild, err == nil
 	})
 	if err != nil {
 		return nil, nil, nil, err
@@ -1003,18 +2371,76 @@ func (c *Conn) ChildrenW(path string) ([]string, *Stat, <-chan Event, error) {
 	return res.Children, &res.Stat, ech, err
 }
 
+// AllChildrenNumber returns the number of all descendants of a znode,
+// counted by the server. It requires ZooKeeper 3.6+; older servers answer
+// with ErrUnimplemented or drop the connection.
+func (c *Conn) AllChildrenNumber(path string) (int, error) {
+	if err := validatePath(path, false); err != nil {
+		return 0, err
+	}
+
+	res := &getAllChildrenNumberResponse{}
+	_, err := c.request(opGetAllChildrenNumber, &getAllChildrenNumberRequest{Path: path}, res, nil)
+	if err != nil {
+		return 0, err
+	}
+	return int(res.TotalNumber), nil
+}
+
+// GetEphemerals returns the paths of the ephemeral znodes created by this
+// session whose path starts with prefixPath. Use "/" to get all of them. It
+// requires ZooKeeper 3.6+.
+func (c *Conn) GetEphemerals(prefixPath string) ([]string, error) {
+	if err := validatePath(prefixPath, false); err != nil {
+		return nil, err
+	}
+
+	res := &getEphemeralsResponse{}
+	_, err := c.request(opGetEphemerals, &getEphemeralsRequest{PrefixPath: prefixPath}, res, nil)
+	if err != nil {
+		return nil, err
+	}
+	if res.Ephemerals == nil {
+		return []string{}, nil
+	}
+	return res.Ephemerals, nil
+}
+
+// WhoAmI returns the auth identities the server associates with this session,
+// e.g. the IP address and any credentials added with AddAuth. It requires
+// ZooKeeper 3.7+; older servers answer with ErrUnimplemented or drop the
+// connection.
+func (c *Conn) WhoAmI() ([]AuthInfo, error) {
+	res := &whoAmIResponse{}
+	_, err := c.request(opWhoAmI, &whoAmIRequest{}, res, nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.ClientInfo, nil
+}
+
 // Get gets the contents of a znode.
 func (c *Conn) Get(path string) ([]byte, *Stat, error) {
+	return c.GetCtx(context.Background(), path)
+}
+
+// GetCtx is like Get, but returns ctx.Err() if ctx is done before the
+// response arrives.
+func (c *Conn) GetCtx(ctx context.Context, path string) ([]byte, *Stat, error) {
 	if err := validatePath(path, false); err != nil {
 		return nil, nil, err
 	}
 
 	res := &getDataResponse{}
-	_, err := c.request(opGetData, &getDataRequest{Path: path, Watch: false}, res, nil)
-	if err == ErrConnectionClosed {
+	_, err := c.requestCtx(ctx, opGetData, &getDataRequest{Path: path, Watch: false}, res, nil)
+	if abandoned(ctx, err) {
 		return nil, nil, err
 	}
-	return res.Data, &res.Stat, err
+	if err != nil {
+		return res.Data, &res.Stat, err
+	}
+	data, err := c.decompress(res.Data)
+	return data, &res.Stat, err
 }
 
 // GetW returns the contents of a znode and sets a watch
@@ -1023,65 +2449,175 @@ func (c *Conn) GetW(path string) ([]byte, *Stat, <-chan Event, error) {
 		return nil, nil, nil, err
 	}
 
-	var ech <-chan Event
 	res := &getDataResponse{}
-	_, err := c.request(opGetData, &getDataRequest{Path: path, Watch: true}, res, func(req *request, res *responseHeader, err error) {
-		if err == nil {
-			ech = c.addWatcher(path, watchTypeData)
-		}
+	ech, err := c.watchRequest(opGetData, path, []watchType{watchTypeData}, func(watch bool) interface{} {
+		return &getDataRequest{Path: path, Watch: watch}
+	}, res, func(err error) (watchType, bool) {
+		return watchTypeData, err == nil
 	})
 	if err != nil {
 		return nil, nil, nil, err
 	}
-	return res.Data, &res.Stat, ech, err
+	data, err := c.decompress(res.Data)
+	return data, &res.Stat, ech, err
 }
 
 // Set updates the contents of a znode.
 func (c *Conn) Set(path string, data []byte, version int32) (*Stat, error) {
+	return c.SetCtx(context.Background(), path, data, version)
+}
+
+// SetCtx is like Set, but stops waiting for the response if ctx is done
+// before it arrives. The returned error then wraps ctx.Err(); the update may
+// still have been applied by the server.
+func (c *Conn) SetCtx(ctx context.Context, path string, data []byte, version int32) (*Stat, error) {
 	if err := validatePath(path, false); err != nil {
 		return nil, err
 	}
 
-	res := &setDataResponse{}
-	_, err := c.request(opSetData, &SetDataRequest{path, data, version}, res, nil)
-	if err == ErrConnectionClosed {
+	data, err := c.compress(data)
+	if err != nil {
 		return nil, err
 	}
+	res := &setDataResponse{}
+	_, err = c.requestCtx(ctx, opSetData, &SetDataRequest{path, data, version}, res, nil)
+	if abandoned(ctx, err) {
+		return nil, mayHaveApplied(ctx, opSetData, err)
+	}
 	return &res.Stat, err
 }
 
+// CompareAndSet sets the data of the znode at path to newData if its current
+// data is expected. It reports whether the data was set: false means the data
+// didn't match, or was changed by someone else before it could be set.
+func (c *Conn) CompareAndSet(path string, expected, newData []byte) (bool, error) {
+	data, stat, err := c.Get(path)
+	if err != nil {
+		return false, err
+	}
+	if !bytes.Equal(data, expected) {
+		return false, nil
+	}
+	_, err = c.Set(path, newData, stat.Version)
+	if errors.Is(err, ErrBadVersion) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 // Create creates a znode.
 // The returned path is the new path assigned by the server, it may not be the
 // same as the input, for example when creating a sequence znode the returned path
 // will be the input path with a sequence number appended.
 func (c *Conn) Create(path string, data []byte, flags int32, acl []ACL) (string, error) {
+	return c.CreateCtx(context.Background(), path, data, flags, acl)
+}
+
+// CreateCtx is like Create, but stops waiting for the response if ctx is done
+// before it arrives. The returned error then wraps ctx.Err(); the znode may
+// still have been created by the server.
+func (c *Conn) CreateCtx(ctx context.Context, path string, data []byte, flags int32, acl []ACL) (string, error) {
 	if err := validatePath(path, flags&FlagSequence == FlagSequence); err != nil {
 		return "", err
 	}
 
-	res := &createResponse{}
-	_, err := c.request(opCreate, &CreateRequest{path, data, acl, flags}, res, nil)
-	if err == ErrConnectionClosed {
+	data, err := c.compress(data)
+	if err != nil {
 		return "", err
 	}
+	res := &createResponse{}
+	_, err = c.requestCtx(ctx, opCreate, &CreateRequest{path, data, acl, flags}, res, nil)
+	if abandoned(ctx, err) {
+		return "", mayHaveApplied(ctx, opCreate, err)
+	}
 	return res.Path, err
 }
 
-// CreateContainer creates a container znode and returns the path.
-func (c *Conn) CreateContainer(path string, data []byte, flags int32, acl []ACL) (string, error) {
+// CreateRecursive creates a znode like Create, first creating any missing
+// parents as empty persistent znodes with the same ACL. The flags only apply
+// to the znode at path.
+func (c *Conn) CreateRecursive(path string, data []byte, flags int32, acl []ACL) (string, error) {
 	if err := validatePath(path, flags&FlagSequence == FlagSequence); err != nil {
 		return "", err
 	}
-	if flags&FlagTTL != FlagTTL {
+	createdPath, err := c.Create(path, data, flags, acl)
+	if !errors.Is(err, ErrNoNode) {
+		return createdPath, err
+	}
+	if err := createParentNodes(c, parentPath(path), acl); err != nil {
+		return "", err
+	}
+	return c.Create(path, data, flags, acl)
+}
+
+// CreateIfNotExists creates a znode like Create, unless it already exists.
+// It reports whether the znode was created; if it already existed the
+// returned path is empty.
+func (c *Conn) CreateIfNotExists(path string, data []byte, flags int32, acl []ACL) (string, bool, error) {
+	createdPath, err := c.Create(path, data, flags, acl)
+	if errors.Is(err, ErrNodeExists) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	return createdPath, true, nil
+}
+
+// Upsert sets the data of the znode at path, whatever its version, or creates
+// it with acl, along with any missing parents, if it doesn't exist. If another
+// client creates the znode between the two, Upsert sets it once more. The
+// returned Stat of a created znode is read with Exists right after creating
+// it.
+func (c *Conn) Upsert(path string, data []byte, acl []ACL) (*Stat, error) {
+	for attempt := 0; ; attempt++ {
+		stat, err := c.Set(path, data, -1)
+		if !errors.Is(err, ErrNoNode) {
+			return stat, err
+		}
+		_, err = c.CreateRecursive(path, data, 0, acl)
+		if errors.Is(err, ErrNodeExists) && attempt == 0 {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		_, stat, err = c.Exists(path)
+		return stat, err
+	}
+}
+
+// CreateContainer creates a container znode and returns the path. Containers
+// are automatically deleted by the server some time after their last child is
+// deleted, which makes them a good parent for recipe nodes like locks and
+// queues. The flags must be FlagContainer, as containers can be neither
+// ephemeral nor sequential. Servers before 3.5 reject the request with
+// ErrUnimplemented.
+func (c *Conn) CreateContainer(path string, data []byte, flags int32, acl []ACL) (string, error) {
+	if err := validatePath(path, false); err != nil {
+		return "", err
+	}
+	if flags != FlagContainer {
 		return "", ErrInvalidFlags
 	}
 
+	data, err := c.compress(data)
+	if err != nil {
+		return "", err
+	}
 	res := &createResponse{}
-	_, err := c.request(opCreateContainer, &CreateContainerRequest{path, data, acl, flags}, res, nil)
+	_, err = c.request(opCreateContainer, &CreateContainerRequest{path, data, acl, flags}, res, nil)
+	if abandoned(context.Background(), err) {
+		return "", mayHaveApplied(context.Background(), opCreateContainer, err)
+	}
 	return res.Path, err
 }
 
-// CreateTTL creates a TTL znode, which will be automatically deleted by server after the TTL.
+// CreateTTL creates a TTL znode, which will be automatically deleted by server
+// once it was not modified for the TTL and has no children. TTL nodes are
+// persistent; the flags must contain FlagTTL, and may contain FlagSequence.
+// FlagEphemeral is ignored. The TTL is rounded down to milliseconds and must be
+// at most MaxTTL. Servers need extendedTypesEnabled to support TTL nodes.
 func (c *Conn) CreateTTL(path string, data []byte, flags int32, acl []ACL, ttl time.Duration) (string, error) {
 	if err := validatePath(path, flags&FlagSequence == FlagSequence); err != nil {
 		return "", err
@@ -1089,9 +2625,26 @@ func (c *Conn) CreateTTL(path string, data []byte, flags int32, acl []ACL, ttl t
 	if flags&FlagTTL != FlagTTL {
 		return "", ErrInvalidFlags
 	}
+	if ttl < time.Millisecond || ttl > MaxTTL {
+		return "", ErrInvalidTTL
+	}
+
+	// The server knows TTL nodes by the flags 5 (persistent) and 6
+	// (persistent sequential).
+	mode := int32(FlagTTL | FlagEphemeral)
+	if flags&FlagSequence == FlagSequence {
+		mode = FlagTTL | FlagSequence
+	}
 
+	data, err := c.compress(data)
+	if err != nil {
+		return "", err
+	}
 	res := &createResponse{}
-	_, err := c.request(opCreateTTL, &CreateTTLRequest{path, data, acl, flags, ttl.Milliseconds()}, res, nil)
+	_, err = c.request(opCreateTTL, &CreateTTLRequest{path, data, acl, mode, ttl.Milliseconds()}, res, nil)
+	if abandoned(context.Background(), err) {
+		return "", mayHaveApplied(context.Background(), opCreateTTL, err)
+	}
 	return res.Path, err
 }
 
@@ -1104,38 +2657,46 @@ func (c *Conn) CreateProtectedEphemeralSequential(path string, data []byte, acl
 		return "", err
 	}
 
-	var guid [16]byte
-	_, err := io.ReadFull(rand.Reader, guid[:16])
+	guid, err := newProtectedGUID()
 	if err != nil {
 		return "", err
 	}
-	guidStr := fmt.Sprintf("%x", guid)
+	return c.createProtectedEphemeralSequential(path, guid, data, acl)
+}
 
+// newProtectedGUID returns a random GUID for a protected node name. It comes
+// from crypto/rand, so other clients cannot guess it and claim the node.
+func newProtectedGUID() (string, error) {
+	var guid [16]byte
+	if _, err := io.ReadFull(rand.Reader, guid[:16]); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", guid), nil
+}
+
+// createProtectedEphemeralSequential is like CreateProtectedEphemeralSequential,
+// but with the given GUID, so callers that retry with the same GUID find the
+// node of an earlier attempt instead of creating another one.
+func (c *Conn) createProtectedEphemeralSequential(path, guid string, data []byte, acl []ACL) (string, error) {
 	parts := strings.Split(path, "/")
-	parts[len(parts)-1] = fmt.Sprintf("%s%s-%s", protectedPrefix, guidStr, parts[len(parts)-1])
-	rootPath := strings.Join(parts[:len(parts)-1], "/")
+	parts[len(parts)-1] = fmt.Sprintf("%s%s-%s", protectedPrefix, guid, parts[len(parts)-1])
 	protectedPath := strings.Join(parts, "/")
 
 	var newPath string
+	var err error
 	for i := 0; i < 3; i++ {
 		newPath, err = c.Create(protectedPath, data, FlagEphemeral|FlagSequence, acl)
-		switch err {
-		case ErrSessionExpired:
+		switch {
+		case errors.Is(err, ErrSessionExpired):
 			// No need to search for the node since it can't exist. Just try again.
-		case ErrConnectionClosed:
-			children, _, err := c.Children(rootPath)
-			if err != nil {
+		case err == ErrConnectionClosed || errors.Is(err, ErrRequestTimeout):
+			p, err := c.FindProtectedNode(path, guid)
+			if err == nil {
+				return p, nil
+			} else if !errors.Is(err, ErrNoNode) {
 				return "", err
 			}
-			for _, p := range children {
-				parts := strings.Split(p, "/")
-				if pth := parts[len(parts)-1]; strings.HasPrefix(pth, protectedPrefix) {
-					if g := pth[len(protectedPrefix) : len(protectedPrefix)+32]; g == guidStr {
-						return rootPath + "/" + p, nil
-					}
-				}
-			}
-		case nil:
+		case err == nil:
 			return newPath, nil
 		default:
 			return "", err
@@ -1144,29 +2705,118 @@ func (c *Conn) CreateProtectedEphemeralSequential(path string, data []byte, acl
 	return "", err
 }
 
+// FindProtectedNode returns the node created by CreateProtectedEphemeralSequential
+// for path whose name contains guid, by listing the parent of path. It finds
+// out whether a create that failed because the connection was lost was applied
+// by the server after all. If there is no such node, ErrNoNode is returned.
+func (c *Conn) FindProtectedNode(path, guid string) (string, error) {
+	if err := validatePath(path, true); err != nil {
+		return "", err
+	}
+
+	rootPath := path[:strings.LastIndex(path, "/")]
+	parent := rootPath
+	if parent == "" {
+		parent = "/"
+	}
+	children, _, err := c.Children(parent)
+	if err != nil {
+		return "", err
+	}
+	for _, p := range children {
+		if strings.HasPrefix(p, protectedPrefix+guid+"-") {
+			return rootPath + "/" + p, nil
+		}
+	}
+	return "", ErrNoNode
+}
+
 // Delete deletes a znode.
 func (c *Conn) Delete(path string, version int32) error {
+	return c.DeleteCtx(context.Background(), path, version)
+}
+
+// DeleteCtx is like Delete, but stops waiting for the response if ctx is done
+// before it arrives. The returned error then wraps ctx.Err(); the znode may
+// still have been deleted by the server.
+func (c *Conn) DeleteCtx(ctx context.Context, path string, version int32) error {
 	if err := validatePath(path, false); err != nil {
 		return err
 	}
 
-	_, err := c.request(opDelete, &DeleteRequest{path, version}, &deleteResponse{}, nil)
-	return err
+	_, err := c.requestCtx(ctx, opDelete, &DeleteRequest{path, version}, &deleteResponse{}, nil)
+	return mayHaveApplied(ctx, opDelete, err)
+}
+
+// DeleteIfExists deletes a znode like Delete, unless it doesn't exist. It
+// reports whether the znode was deleted.
+func (c *Conn) DeleteIfExists(path string, version int32) (bool, error) {
+	err := c.Delete(path, version)
+	if errors.Is(err, ErrNoNode) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// DeleteRecursive deletes a znode and all its descendants, depth-first. The
+// version only applies to the znode itself; descendants are deleted whatever
+// their version. It is checked before deleting anything, so a version
+// mismatch leaves the subtree alone. Children created concurrently are
+// deleted as well. It returns nil if the znode, or any descendant, is already
+// gone.
+func (c *Conn) DeleteRecursive(path string, version int32) error {
+	if err := validatePath(path, false); err != nil {
+		return err
+	}
+	for {
+		children, stat, err := c.Children(path)
+		if errors.Is(err, ErrNoNode) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if version != -1 && stat.Version != version {
+			// The error the server would reply to the delete with.
+			return wrapServerError(opDelete, &DeleteRequest{Path: path, Version: version}, errBadVersion)
+		}
+		for _, child := range children {
+			if err := c.DeleteRecursive(joinPath(path, child), -1); err != nil {
+				return err
+			}
+		}
+		switch err := c.Delete(path, version); {
+		case errors.Is(err, ErrNotEmpty):
+			// A child was created in the meantime.
+			continue
+		case errors.Is(err, ErrNoNode):
+			return nil
+		default:
+			return err
+		}
+	}
 }
 
 // Exists tells the existence of a znode.
 func (c *Conn) Exists(path string) (bool, *Stat, error) {
+	return c.ExistsCtx(context.Background(), path)
+}
+
+// ExistsCtx is like Exists, but returns ctx.Err() if ctx is done before the
+// response arrives.
+func (c *Conn) ExistsCtx(ctx context.Context, path string) (bool, *Stat, error) {
 	if err := validatePath(path, false); err != nil {
 		return false, nil, err
 	}
 
 	res := &existsResponse{}
-	_, err := c.request(opExists, &existsRequest{Path: path, Watch: false}, res, nil)
-	if err == ErrConnectionClosed {
+	_, err := c.requestCtx(ctx, opExists, &existsRequest{Path: path, Watch: false}, res, nil)
+	if abandoned(ctx, err) {
 		return false, nil, err
 	}
 	exists := true
-	if err == ErrNoNode {
+	if errors.Is(err, ErrNoNode) {
 		exists = false
 		err = nil
 	}
@@ -1179,17 +2829,18 @@ func (c *Conn) ExistsW(path string) (bool, *Stat, <-chan Event, error) {
 		return false, nil, nil, err
 	}
 
-	var ech <-chan Event
 	res := &existsResponse{}
-	_, err := c.request(opExists, &existsRequest{Path: path, Watch: true}, res, func(req *request, res *responseHeader, err error) {
+	ech, err := c.watchRequest(opExists, path, []watchType{watchTypeData, watchTypeExist}, func(watch bool) interface{} {
+		return &existsRequest{Path: path, Watch: watch}
+	}, res, func(err error) (watchType, bool) {
 		if err == nil {
-			ech = c.addWatcher(path, watchTypeData)
-		} else if err == ErrNoNode {
-			ech = c.addWatcher(path, watchTypeExist)
+			return watchTypeData, true
 		}
+		// The server sets a watch for the znode to be created.
+		return watchTypeExist, errors.Is(err, ErrNoNode)
 	})
 	exists := true
-	if err == ErrNoNode {
+	if errors.Is(err, ErrNoNode) {
 		exists = false
 		err = nil
 	}
@@ -1199,6 +2850,70 @@ func (c *Conn) ExistsW(path string) (bool, *Stat, <-chan Event, error) {
 	return exists, &res.Stat, ech, err
 }
 
+// AddWatch sets a watch on a znode that is not removed when it fires, so the
+// returned channel keeps receiving events until the session expires or the
+// connection is closed. With AddWatchModePersistentRecursive, the watch also
+// fires for changes of all descendants of the znode. The watch is restored
+// after reconnecting. Events are queued until the channel is read, which must
+// be done until it is closed. Requires ZooKeeper 3.6 or later.
+func (c *Conn) AddWatch(path string, mode AddWatchMode) (<-chan Event, error) {
+	if err := validatePath(path, false); err != nil {
+		return nil, err
+	}
+
+	var watchType watchType
+	switch mode {
+	case AddWatchModePersistent:
+		watchType = watchTypePersistent
+	case AddWatchModePersistentRecursive:
+		watchType = watchTypePersistentRecursive
+	default:
+		return nil, ErrBadArguments
+	}
+
+	var ech <-chan Event
+	_, err := c.request(opAddWatch, &addWatchRequest{Path: path, Mode: mode}, &addWatchResponse{}, func(req *request, res *responseHeader, err error) {
+		if err == nil {
+			ech = c.addPersistentWatcher(path, watchType)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ech, nil
+}
+
+// RemoveWatches removes the watches of the given type on a znode, both on the
+// server and in the client. The channels of the removed watches receive an
+// EventNotWatching event and are closed. ErrNoWatcher is returned if there is
+// no such watch. Requires ZooKeeper 3.5 or later.
+func (c *Conn) RemoveWatches(path string, watcherType WatcherType) error {
+	if err := validatePath(path, false); err != nil {
+		return err
+	}
+	watchTypes := watchTypesFor(watcherType)
+	if watchTypes == nil {
+		return ErrBadArguments
+	}
+	if !c.hasWatchers(path, watchTypes) {
+		return ErrNoWatcher
+	}
+
+	_, err := c.request(opRemoveWatches, &removeWatchesRequest{Path: path, Type: watcherType}, &removeWatchesResponse{}, func(req *request, res *responseHeader, err error) {
+		if err == nil || errors.Is(err, ErrNoWatcher) {
+			// The server doesn't know the watches either way.
+			c.removeWatchers(path, watchTypes)
+		}
+	})
+	return err
+}
+
+// RemoveAllWatches removes all watches on a znode, like RemoveWatches with
+// WatcherTypeAny.
+func (c *Conn) RemoveAllWatches(path string) error {
+	return c.RemoveWatches(path, WatcherTypeAny)
+}
+
 // GetACL gets the ACLs of a znode.
 func (c *Conn) GetACL(path string) ([]ACL, *Stat, error) {
 	if err := validatePath(path, false); err != nil {
@@ -1207,7 +2922,7 @@ func (c *Conn) GetACL(path string) ([]ACL, *Stat, error) {
 
 	res := &getAclResponse{}
 	_, err := c.request(opGetAcl, &getAclRequest{Path: path}, res, nil)
-	if err == ErrConnectionClosed {
+	if abandoned(context.Background(), err) {
 		return nil, nil, err
 	}
 	return res.Acl, &res.Stat, err
@@ -1221,8 +2936,8 @@ func (c *Conn) SetACL(path string, acl []ACL, version int32) (*Stat, error) {
 
 	res := &setAclResponse{}
 	_, err := c.request(opSetAcl, &setAclRequest{Path: path, Acl: acl, Version: version}, res, nil)
-	if err == ErrConnectionClosed {
-		return nil, err
+	if abandoned(context.Background(), err) {
+		return nil, mayHaveApplied(context.Background(), opSetAcl, err)
 	}
 	return &res.Stat, err
 }
@@ -1230,6 +2945,11 @@ func (c *Conn) SetACL(path string, acl []ACL, version int32) (*Stat, error) {
 // Sync flushes the channel between process and the leader of a given znode,
 // you may need it if you want identical views of ZooKeeper data for 2 client instances.
 // Please refer to the "Consistency Guarantees" section of ZK document for more details.
+//
+// Once Sync returns, reads on this connection see all writes to path that the
+// leader acknowledged before the sync, including ones made by other clients.
+// It returns the path echoed by the server. See SyncAndGet to read a znode
+// right after syncing.
 func (c *Conn) Sync(path string) (string, error) {
 	if err := validatePath(path, false); err != nil {
 		return "", err
@@ -1237,12 +2957,22 @@ func (c *Conn) Sync(path string) (string, error) {
 
 	res := &syncResponse{}
 	_, err := c.request(opSync, &syncRequest{Path: path}, res, nil)
-	if err == ErrConnectionClosed {
+	if abandoned(context.Background(), err) {
 		return "", err
 	}
 	return res.Path, err
 }
 
+// SyncAndGet syncs path, as Sync does, and then gets its data, so the result
+// reflects all writes the leader acknowledged before the call, even if this
+// client is connected to a follower that lags behind.
+func (c *Conn) SyncAndGet(path string) ([]byte, *Stat, error) {
+	if _, err := c.Sync(path); err != nil {
+		return nil, nil, err
+	}
+	return c.Get(path)
+}
+
 // MultiResponse is the result of a Multi call.
 type MultiResponse struct {
 	Stat   *Stat
@@ -1276,8 +3006,8 @@ func (c *Conn) Multi(ops ...interface{}) ([]MultiResponse, error) {
 	}
 	res := &multiResponse{}
 	_, err := c.request(opMulti, req, res, nil)
-	if err == ErrConnectionClosed {
-		return nil, err
+	if abandoned(context.Background(), err) {
+		return nil, mayHaveApplied(context.Background(), opMulti, err)
 	}
 	mr := make([]MultiResponse, len(res.Ops))
 	for i, op := range res.Ops {
@@ -1286,6 +3016,88 @@ func (c *Conn) Multi(ops ...interface{}) ([]MultiResponse, error) {
 	return mr, err
 }
 
+// ReadOp is a read operation of MultiRead, created with GetDataOp,
+// GetChildrenOp or ExistsOp.
+type ReadOp struct {
+	opcode int32
+	path   string
+	exists bool
+}
+
+// GetDataOp returns an operation that reads the data and stat of a znode,
+// like Get.
+func GetDataOp(path string) ReadOp {
+	return ReadOp{opcode: opGetData, path: path}
+}
+
+// GetChildrenOp returns an operation that reads the children of a znode,
+// like Children. Its response has no stat.
+func GetChildrenOp(path string) ReadOp {
+	return ReadOp{opcode: opGetChildren, path: path}
+}
+
+// ExistsOp returns an operation that reads the stat of a znode, like Exists.
+// Its response has a nil stat and no error if the znode doesn't exist. As
+// servers only batch getData and getChildren, it reads the data of the znode
+// too, but doesn't return it.
+func ExistsOp(path string) ReadOp {
+	return ReadOp{opcode: opGetData, path: path, exists: true}
+}
+
+// MultiReadResponse is the result of an operation of a MultiRead call. Error
+// is set if the operation failed.
+type MultiReadResponse struct {
+	Data     []byte
+	Children []string
+	Stat     *Stat
+	Error    error
+}
+
+// MultiRead executes multiple read operations in a single round trip. Unlike
+// Multi, the operations are independent: each of them can fail on its own,
+// in which case the Error of its response is set. Requires ZooKeeper 3.6 or
+// later.
+func (c *Conn) MultiRead(ops ...ReadOp) ([]MultiReadResponse, error) {
+	req := &multiRequest{
+		Ops:        make([]multiRequestOp, 0, len(ops)),
+		DoneHeader: multiHeader{Type: -1, Done: true, Err: -1},
+	}
+	for _, op := range ops {
+		if err := validatePath(op.path, false); err != nil {
+			return nil, err
+		}
+		var body interface{}
+		switch op.opcode {
+		case opGetData:
+			body = &getDataRequest{Path: op.path}
+		case opGetChildren:
+			body = &getChildrenRequest{Path: op.path}
+		default:
+			return nil, ErrBadArguments
+		}
+		req.Ops = append(req.Ops, multiRequestOp{multiHeader{op.opcode, false, -1}, body})
+	}
+	res := &multiReadResponse{}
+	_, err := c.request(opMultiRead, req, res, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Ops) != len(ops) {
+		return nil, ErrAPIError
+	}
+	mr := make([]MultiReadResponse, len(res.Ops))
+	for i, op := range res.Ops {
+		mr[i] = MultiReadResponse{Data: op.Data, Children: op.Children, Stat: op.Stat, Error: op.Err.toError()}
+		if ops[i].exists {
+			mr[i].Data = nil
+			if errors.Is(mr[i].Error, ErrNoNode) {
+				mr[i].Error = nil
+			}
+		}
+	}
+	return mr, nil
+}
+
 // IncrementalReconfig is the zookeeper reconfiguration api that allows adding and removing servers
 // by lists of members. For more info refer to the ZK documentation.
 //
@@ -1318,19 +3130,165 @@ func (c *Conn) Reconfig(members []string, version int64) (*Stat, error) {
 	return c.internalReconfig(request)
 }
 
+// GetConfig returns the contents of the configuration znode, which holds the
+// current dynamic configuration of the ensemble. Use ParseConfig to parse it.
+func (c *Conn) GetConfig() ([]byte, *Stat, error) {
+	return c.Get(configNode)
+}
+
+// GetConfigW is like GetConfig, but sets a watch that fires when the
+// configuration changes.
+func (c *Conn) GetConfigW() ([]byte, *Stat, <-chan Event, error) {
+	return c.GetW(configNode)
+}
+
 func (c *Conn) internalReconfig(request *reconfigRequest) (*Stat, error) {
 	response := &reconfigReponse{}
 	_, err := c.request(opReconfig, request, response, nil)
+	if abandoned(context.Background(), err) {
+		return nil, mayHaveApplied(context.Background(), opReconfig, err)
+	}
 	return &response.Stat, err
 }
 
-// Server returns the current or last-connected server name.
+// Server returns the address of the server the client is connected to, as
+// host:port, or an empty string while it is not connected.
 func (c *Conn) Server() string {
+	switch c.State() {
+	case StateConnected, StateHasSession, StateConnectedReadOnly, StateSaslAuthenticated:
+		return c.serverAddr()
+	}
+	return ""
+}
+
+// serverAddr returns the current or last-connected server.
+func (c *Conn) serverAddr() string {
 	c.serverMu.Lock()
 	defer c.serverMu.Unlock()
 	return c.server
 }
 
+// UpdateServers replaces the servers the client connects to, like the
+// updateServerList method of the Java client, by calling Init of the
+// HostProvider again. The HostProvider must allow this while the client is
+// using it; the DNSHostProvider does. If the client has a session, with a
+// read-write or a read-only server, and the HostProvider no longer hands out
+// that server, it disconnects and connects to one of the new servers, keeping
+// its session. Otherwise it stays connected. Servers are compared by the
+// addresses the HostProvider resolved them to, if it does so.
+func (c *Conn) UpdateServers(servers []string) error {
+	if len(servers) == 0 {
+		return errors.New("zk: server list must not be empty")
+	}
+	srvs := FormatServers(servers)
+	if err := c.initHostProvider(srvs); err != nil {
+		return err
+	}
+
+	server := c.serverAddr()
+	if s := c.State(); s != StateHasSession && s != StateConnectedReadOnly || c.providesServer(server, srvs) {
+		return nil
+	}
+	select {
+	case <-c.reconnect:
+		// Drop a stale request, only the current server matters.
+	default:
+	}
+	select {
+	case c.reconnect <- server:
+	default:
+	}
+	return nil
+}
+
+// serverOrderer is implemented by host providers that decide the order in
+// which the servers given to Init are tried, such as the DNSHostProvider.
+type serverOrderer interface {
+	ordersServers()
+}
+
+// initHostProvider calls Init of the host provider with servers. Unless the
+// provider orders the servers itself, their order is randomized first to
+// avoid creating hotspots.
+func (c *Conn) initHostProvider(servers []string) error {
+	if _, ok := c.hostProvider.(serverOrderer); !ok {
+		stringShuffle(servers)
+	}
+	return c.hostProvider.Init(servers)
+}
+
+// addrProvider is implemented by host providers that resolve the servers
+// given to Init, such as the DNSHostProvider.
+type addrProvider interface {
+	// hasAddr reports whether addr is one of the addresses handed out by Next.
+	hasAddr(addr string) bool
+}
+
+// providesServer reports whether server, as handed out by Next, is still
+// provided by the host provider after Init was called with servers. The
+// addresses are not looked up again: a provider that resolves the servers is
+// asked for the ones it found, others must have server in the list.
+func (c *Conn) providesServer(server string, servers []string) bool {
+	if p, ok := c.hostProvider.(addrProvider); ok {
+		return p.hasAddr(server)
+	}
+	for _, s := range servers {
+		if s == server {
+			return true
+		}
+	}
+	return false
+}
+
+// saslFailed stops the client after the server rejected its SASL
+// credentials, as they would be rejected again after reconnecting. The state
+// stays StateAuthFailed, and requests fail with ErrAuthFailed.
+func (c *Conn) saslFailed() {
+	atomic.StoreInt32(&c.saslRejected, 1)
+	c.setState(StateAuthFailed)
+	c.shouldQuitOnce.Do(func() { close(c.shouldQuit) })
+}
+
+// saslAuthenticate runs the SASL exchange on a new connection. Like
+// resendZkAuth it bypasses the send loop, which is not running yet.
+func (c *Conn) saslAuthenticate(ctx context.Context) error {
+	token, err := c.saslClient.Start()
+	if err != nil {
+		return err
+	}
+	for done := false; ; {
+		res := &saslResponse{}
+		resChan, err := c.sendRequest(opSasl, &saslRequest{Token: token}, res, nil)
+		if err != nil {
+			return err
+		}
+
+		select {
+		case r := <-resChan:
+			if r.err != nil {
+				return r.err
+			}
+		case <-c.closeChan:
+			return ErrConnectionClosed
+		case <-c.shouldQuit:
+			return ErrClosing
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if done {
+			// The server accepted the last response.
+			return nil
+		}
+
+		if token, done, err = c.saslClient.Next(res.Token); err != nil {
+			return err
+		}
+		if done && token == nil {
+			return nil
+		}
+	}
+}
+
 func resendZkAuth(ctx context.Context, c *Conn) error {
 	shouldCancel := func() bool {
 		select {
@@ -1347,7 +3305,7 @@ func resendZkAuth(ctx context.Context, c *Conn) error {
 	defer c.credsMu.Unlock()
 
 	if c.logInfo {
-		c.logger.Printf("re-submitting `%d` credentials after reconnect", len(c.creds))
+		c.logger.Info("re-submitting credentials after reconnect", "count", len(c.creds))
 	}
 
 	for _, cred := range c.creds {
@@ -1367,23 +3325,23 @@ func resendZkAuth(ctx context.Context, c *Conn) error {
 			nil, /* recvFunc*/
 		)
 		if err != nil {
-			return fmt.Errorf("failed to send auth request: %v", err)
+			return fmt.Errorf("failed to send auth request: %w", err)
 		}
 
 		var res response
 		select {
 		case res = <-resChan:
 		case <-c.closeChan:
-			c.logger.Printf("recv closed, cancel re-submitting credentials")
+			c.logger.Debug("recv closed, cancel re-submitting credentials")
 			return nil
 		case <-c.shouldQuit:
-			c.logger.Printf("should quit, cancel re-submitting credentials")
+			c.logger.Debug("should quit, cancel re-submitting credentials")
 			return nil
 		case <-ctx.Done():
 			return ctx.Err()
 		}
 		if res.err != nil {
-			return fmt.Errorf("failed connection setAuth request: %v", res.err)
+			return fmt.Errorf("failed connection setAuth request: %w", res.err)
 		}
 	}
 
@@ -2,9 +2,22 @@ package zk
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"math/big"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -87,12 +100,2022 @@ func TestConcurrentReadAndClose(t *testing.T) {
 	})
 }
 
+func TestConnectContextTimeout(t *testing.T) {
+	WithListenServer(t, func(server string) {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		conn, evtC, err := ConnectContext(ctx, []string{server}, 15*time.Second)
+		if err != context.DeadlineExceeded {
+			t.Fatalf("ConnectContext returned %v; want %v", err, context.DeadlineExceeded)
+		}
+		if conn != nil || evtC != nil {
+			t.Fatal("ConnectContext returned a connection along with an error")
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Fatalf("ConnectContext took %v to return", d)
+		}
+	})
+}
+
+func TestConnectContextCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, _, err := ConnectContext(ctx, []string{"127.0.0.1:1"}, 15*time.Second); err != context.Canceled {
+		t.Fatalf("ConnectContext returned %v; want %v", err, context.Canceled)
+	}
+}
+
+func TestRequestCtxSlowServer(t *testing.T) {
+	fs := newFakeServer(t, func(opcode int32, body []byte) (interface{}, ErrCode) {
+		switch opcode {
+		case opGetData:
+			req := &getDataRequest{}
+			decodePacket(body, req)
+			if req.Path == "/slow" {
+				time.Sleep(500 * time.Millisecond)
+			}
+			return &getDataResponse{Data: []byte(req.Path)}, 0
+		case opCreate:
+			time.Sleep(500 * time.Millisecond)
+			return &createResponse{Path: "/created"}, 0
+		}
+		return nil, errUnimplemented
+	})
+	defer fs.Close()
+
+	conn := connectFake(t, fs)
+
+	reqCtx, reqCancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer reqCancel()
+	start := time.Now()
+	if _, _, err := conn.GetCtx(reqCtx, "/slow"); err != context.DeadlineExceeded {
+		t.Fatalf("GetCtx returned %v; want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > 400*time.Millisecond {
+		t.Fatalf("GetCtx returned after %v", d)
+	}
+	conn.requestsLock.Lock()
+	pending := len(conn.requests)
+	conn.requestsLock.Unlock()
+	if pending != 0 {
+		t.Fatalf("%d requests still pending after GetCtx was canceled", pending)
+	}
+
+	// The late response for /slow must not be delivered to this request.
+	if data, _, err := conn.Get("/fast"); err != nil || string(data) != "/fast" {
+		t.Fatalf("Get returned %q, %v; want %q, nil", data, err, "/fast")
+	}
+
+	reqCtx, reqCancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer reqCancel()
+	_, err := conn.CreateCtx(reqCtx, "/created", nil, 0, WorldACL(PermAll))
+	if !errors.Is(err, context.DeadlineExceeded) || err == context.DeadlineExceeded {
+		t.Fatalf("CreateCtx returned %v; want an error wrapping %v", err, context.DeadlineExceeded)
+	}
+	if !strings.Contains(err.Error(), "may have been applied") {
+		t.Fatalf("CreateCtx error %q does not say the create may have been applied", err)
+	}
+}
+
+func TestAddWatchPersistent(t *testing.T) {
+	addWatches := make(chan addWatchRequest, 10)
+	fs := newFakeServer(t, func(opcode int32, body []byte) (interface{}, ErrCode) {
+		if opcode == opAddWatch {
+			req := addWatchRequest{}
+			decodePacket(body, &req)
+			addWatches <- req
+			return &addWatchResponse{}, 0
+		}
+		return nil, errUnimplemented
+	})
+	defer fs.Close()
+
+	conn := connectFake(t, fs)
+
+	ech, err := conn.AddWatch("/a", AddWatchModePersistent)
+	if err != nil {
+		t.Fatalf("AddWatch returned error: %v", err)
+	}
+	if req := <-addWatches; req.Path != "/a" || req.Mode != AddWatchModePersistent {
+		t.Fatalf("server got %+v", req)
+	}
+
+	expectEvent := func(typ EventType, path string) {
+		t.Helper()
+		select {
+		case ev := <-ech:
+			if ev.Type != typ || ev.Path != path {
+				t.Fatalf("got event %+v; want %s for %s", ev, typ, path)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %s event for %s", typ, path)
+		}
+	}
+
+	// The watch keeps firing, and ignores other paths.
+	for i := 0; i < 3; i++ {
+		fs.SendEvent(watcherEvent{Type: EventNodeDataChanged, State: StateConnected, Path: "/b"})
+		fs.SendEvent(watcherEvent{Type: EventNodeDataChanged, State: StateConnected, Path: "/a"})
+	}
+	for i := 0; i < 3; i++ {
+		expectEvent(EventNodeDataChanged, "/a")
+	}
+
+	// And is added again after reconnecting.
+	fs.DropConns()
+	select {
+	case req := <-addWatches:
+		if req.Path != "/a" || req.Mode != AddWatchModePersistent {
+			t.Fatalf("server got %+v after reconnect", req)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("persistent watch was not added again after reconnect")
+	}
+	fs.SendEvent(watcherEvent{Type: EventNodeDeleted, State: StateConnected, Path: "/a"})
+	expectEvent(EventNodeDeleted, "/a")
+
+	conn.Close()
+	expectEvent(EventNotWatching, "/a")
+	if _, ok := <-ech; ok {
+		t.Fatal("watch channel not closed after Close")
+	}
+}
+
+func TestAddWatchPersistentRecursive(t *testing.T) {
+	fs := newFakeServer(t, func(opcode int32, body []byte) (interface{}, ErrCode) {
+		if opcode == opAddWatch {
+			return &addWatchResponse{}, 0
+		}
+		return nil, errUnimplemented
+	})
+	defer fs.Close()
+
+	conn := connectFake(t, fs)
+
+	ech, err := conn.AddWatch("/a", AddWatchModePersistentRecursive)
+	if err != nil {
+		t.Fatalf("AddWatch returned error: %v", err)
+	}
+	rootEch, err := conn.AddWatch("/", AddWatchModePersistentRecursive)
+	if err != nil {
+		t.Fatalf("AddWatch returned error: %v", err)
+	}
+
+	fs.SendEvent(watcherEvent{Type: EventNodeChildrenChanged, State: StateConnected, Path: "/a"})
+	fs.SendEvent(watcherEvent{Type: EventNodeDataChanged, State: StateConnected, Path: "/ab"})
+	fs.SendEvent(watcherEvent{Type: EventNodeCreated, State: StateConnected, Path: "/a/b/c"})
+	fs.SendEvent(watcherEvent{Type: EventNodeDataChanged, State: StateConnected, Path: "/a"})
+
+	for _, want := range []Event{
+		{Type: EventNodeCreated, Path: "/a/b/c"},
+		{Type: EventNodeDataChanged, Path: "/a"},
+	} {
+		select {
+		case ev := <-ech:
+			if ev.Type != want.Type || ev.Path != want.Path {
+				t.Fatalf("got event %+v; want %s for %s", ev, want.Type, want.Path)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %s event for %s", want.Type, want.Path)
+		}
+	}
+	for _, want := range []string{"/ab", "/a/b/c", "/a"} {
+		select {
+		case ev := <-rootEch:
+			if ev.Path != want {
+				t.Fatalf("got event %+v on root watch; want one for %s", ev, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no event for %s on root watch", want)
+		}
+	}
+}
+
+func TestRemoveWatches(t *testing.T) {
+	removes := make(chan removeWatchesRequest, 10)
+	fs := newFakeServer(t, func(opcode int32, body []byte) (interface{}, ErrCode) {
+		switch opcode {
+		case opGetData:
+			return &getDataResponse{}, 0
+		case opAddWatch:
+			return &addWatchResponse{}, 0
+		case opRemoveWatches:
+			req := removeWatchesRequest{}
+			decodePacket(body, &req)
+			removes <- req
+			if req.Path == "/gone" {
+				return nil, errNoWatcher
+			}
+			return &removeWatchesResponse{}, 0
+		}
+		return nil, errUnimplemented
+	})
+	defer fs.Close()
+
+	conn := connectFake(t, fs)
+
+	expectRemoved := func(ech <-chan Event, path string) {
+		t.Helper()
+		select {
+		case ev := <-ech:
+			if ev.Type != EventNotWatching || ev.Path != path {
+				t.Fatalf("got event %+v; want %s for %s", ev, EventNotWatching, path)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %s event for %s", EventNotWatching, path)
+		}
+		if _, ok := <-ech; ok {
+			t.Fatalf("watch channel for %s not closed", path)
+		}
+	}
+
+	// Nothing to remove, so the server isn't asked.
+	if err := conn.RemoveWatches("/a", WatcherTypeData); !errors.Is(err, ErrNoWatcher) {
+		t.Fatalf("RemoveWatches returned %v; want %v", err, ErrNoWatcher)
+	}
+
+	_, _, dataEch, err := conn.GetW("/a")
+	if err != nil {
+		t.Fatalf("GetW returned error: %v", err)
+	}
+	persistentEch, err := conn.AddWatch("/a", AddWatchModePersistentRecursive)
+	if err != nil {
+		t.Fatalf("AddWatch returned error: %v", err)
+	}
+	if err := conn.RemoveWatches("/a", WatcherTypeChildren); !errors.Is(err, ErrNoWatcher) {
+		t.Fatalf("RemoveWatches returned %v; want %v", err, ErrNoWatcher)
+	}
+	if err := conn.RemoveWatches("/a", WatcherTypeData); err != nil {
+		t.Fatalf("RemoveWatches returned error: %v", err)
+	}
+	if req := <-removes; req.Path != "/a" || req.Type != WatcherTypeData {
+		t.Fatalf("server got %+v", req)
+	}
+	expectRemoved(dataEch, "/a")
+
+	if err := conn.RemoveAllWatches("/a"); err != nil {
+		t.Fatalf("RemoveAllWatches returned error: %v", err)
+	}
+	if req := <-removes; req.Path != "/a" || req.Type != WatcherTypeAny {
+		t.Fatalf("server got %+v", req)
+	}
+	expectRemoved(persistentEch, "/a")
+
+	// A watch the server no longer has is removed anyway.
+	_, _, goneEch, err := conn.GetW("/gone")
+	if err != nil {
+		t.Fatalf("GetW returned error: %v", err)
+	}
+	if err := conn.RemoveAllWatches("/gone"); !errors.Is(err, ErrNoWatcher) {
+		t.Fatalf("RemoveAllWatches returned %v; want %v", err, ErrNoWatcher)
+	}
+	expectRemoved(goneEch, "/gone")
+}
+
+func TestAllChildrenNumber(t *testing.T) {
+	fs := newFakeTreeServer(t)
+	defer fs.Close()
+
+	conn := connectFake(t, fs)
+
+	for _, p := range []string{"/count", "/count/a", "/count/a/b", "/count/c", "/counter"} {
+		if _, err := conn.Create(p, nil, 0, WorldACL(PermAll)); err != nil {
+			t.Fatalf("Create returned error: %v", err)
+		}
+	}
+	if n, err := conn.AllChildrenNumber("/count"); err != nil || n != 3 {
+		t.Fatalf("AllChildrenNumber returned %d, %v; want 3", n, err)
+	}
+	if _, err := conn.AllChildrenNumber("/missing"); !errors.Is(err, ErrNoNode) {
+		t.Fatalf("AllChildrenNumber returned %v; want %v", err, ErrNoNode)
+	}
+
+	// Servers before 3.6 don't know the opcode.
+	old := newFakeServer(t, func(opcode int32, body []byte) (interface{}, ErrCode) {
+		return nil, errUnimplemented
+	})
+	defer old.Close()
+	oldConn := connectFake(t, old)
+	if _, err := oldConn.AllChildrenNumber("/count"); !errors.Is(err, ErrUnimplemented) {
+		t.Fatalf("AllChildrenNumber returned %v; want %v", err, ErrUnimplemented)
+	}
+}
+
+func TestGetEphemerals(t *testing.T) {
+	fs := newFakeTreeServer(t)
+	defer fs.Close()
+
+	conn := connectFake(t, fs)
+	other := connectFake(t, fs)
+
+	if ephemerals, err := conn.GetEphemerals("/"); err != nil || ephemerals == nil || len(ephemerals) != 0 {
+		t.Fatalf("GetEphemerals returned %#v, %v; want an empty slice", ephemerals, err)
+	}
+
+	acl := WorldACL(PermAll)
+	if _, err := conn.Create("/app", nil, 0, acl); err != nil {
+		t.Fatalf("Create returned error: %v", err)
+	}
+	for _, p := range []string{"/app/a", "/app/b", "/other"} {
+		if _, err := conn.Create(p, nil, FlagEphemeral, acl); err != nil {
+			t.Fatalf("Create returned error: %v", err)
+		}
+	}
+	if _, err := other.Create("/app/c", nil, FlagEphemeral, acl); err != nil {
+		t.Fatalf("Create returned error: %v", err)
+	}
+
+	ephemerals, err := conn.GetEphemerals("/app")
+	if err != nil {
+		t.Fatalf("GetEphemerals returned error: %v", err)
+	}
+	if want := []string{"/app/a", "/app/b"}; !reflect.DeepEqual(ephemerals, want) {
+		t.Fatalf("GetEphemerals returned %q; want %q", ephemerals, want)
+	}
+}
+
+func TestMultiRead(t *testing.T) {
+	fs := newFakeTreeServer(t)
+	defer fs.Close()
+
+	conn := connectFake(t, fs)
+
+	acl := WorldACL(PermAll)
+	for _, p := range []string{"/a", "/a/b", "/a/c"} {
+		if _, err := conn.Create(p, []byte(p), 0, acl); err != nil {
+			t.Fatalf("Create returned error: %v", err)
+		}
+	}
+	res, err := conn.MultiRead(
+		GetDataOp("/a/b"),
+		GetChildrenOp("/a"),
+		ExistsOp("/a/c"),
+		GetDataOp("/missing"),
+		GetChildrenOp("/missing"),
+		ExistsOp("/missing"),
+	)
+	if err != nil {
+		t.Fatalf("MultiRead returned error: %v", err)
+	}
+	if len(res) != 6 {
+		t.Fatalf("MultiRead returned %d responses; want 6", len(res))
+	}
+	if r := res[0]; r.Error != nil || string(r.Data) != "/a/b" || r.Stat == nil {
+		t.Fatalf("getData response is %+v", r)
+	}
+	if r := res[1]; r.Error != nil || !reflect.DeepEqual(r.Children, []string{"b", "c"}) {
+		t.Fatalf("getChildren response is %+v", r)
+	}
+	if r := res[2]; r.Error != nil || r.Data != nil || r.Stat == nil || r.Stat.DataLength != 4 {
+		t.Fatalf("exists response is %+v", r)
+	}
+	for _, r := range res[3:5] {
+		if !errors.Is(r.Error, ErrNoNode) {
+			t.Fatalf("response for a missing znode is %+v; want error %v", r, ErrNoNode)
+		}
+	}
+	if r := res[5]; r.Error != nil || r.Stat != nil {
+		t.Fatalf("exists response for a missing znode is %+v; want no stat and no error", r)
+	}
+
+	if _, err := conn.MultiRead(GetDataOp("invalid")); !errors.Is(err, ErrInvalidPath) {
+		t.Fatalf("MultiRead with an invalid path returned %v; want %v", err, ErrInvalidPath)
+	}
+}
+
+func TestCreateContainer(t *testing.T) {
+	reqs := make(chan *CreateContainerRequest, 1)
+	fs := newFakeServer(t, func(opcode int32, body []byte) (interface{}, ErrCode) {
+		if opcode != opCreateContainer {
+			return nil, errUnimplemented
+		}
+		req := &CreateContainerRequest{}
+		decodePacket(body, req)
+		reqs <- req
+		return &createResponse{Path: req.Path}, 0
+	})
+	defer fs.Close()
+
+	conn := connectFake(t, fs)
+
+	for _, flags := range []int32{0, FlagContainer | FlagEphemeral, FlagContainer | FlagSequence} {
+		if _, err := conn.CreateContainer("/container", nil, flags, WorldACL(PermAll)); !errors.Is(err, ErrInvalidFlags) {
+			t.Fatalf("CreateContainer with flags %d returned %v; want %v", flags, err, ErrInvalidFlags)
+		}
+	}
+	if p, err := conn.CreateContainer("/container", []byte("data"), FlagContainer, WorldACL(PermAll)); err != nil || p != "/container" {
+		t.Fatalf("CreateContainer returned %q, %v", p, err)
+	}
+	if req := <-reqs; req.Flags != FlagContainer || string(req.Data) != "data" {
+		t.Fatalf("server got %+v", req)
+	}
+
+	// Servers before 3.5 don't know the opcode.
+	old := newFakeServer(t, func(opcode int32, body []byte) (interface{}, ErrCode) {
+		return nil, errUnimplemented
+	})
+	defer old.Close()
+	oldConn := connectFake(t, old)
+	if _, err := oldConn.CreateContainer("/container", nil, FlagContainer, WorldACL(PermAll)); !errors.Is(err, ErrUnimplemented) {
+		t.Fatalf("CreateContainer returned %v; want %v", err, ErrUnimplemented)
+	}
+}
+
+func TestCreateTTL(t *testing.T) {
+	reqs := make(chan *CreateTTLRequest, 1)
+	fs := newFakeServer(t, func(opcode int32, body []byte) (interface{}, ErrCode) {
+		if opcode != opCreateTTL {
+			return nil, errUnimplemented
+		}
+		req := &CreateTTLRequest{}
+		decodePacket(body, req)
+		reqs <- req
+		return &createResponse{Path: req.Path}, 0
+	})
+	defer fs.Close()
+
+	conn := connectFake(t, fs)
+
+	for _, ttl := range []time.Duration{0, time.Microsecond, MaxTTL + time.Millisecond} {
+		if _, err := conn.CreateTTL("/ttl", nil, FlagTTL, WorldACL(PermAll), ttl); !errors.Is(err, ErrInvalidTTL) {
+			t.Fatalf("CreateTTL with TTL %v returned %v; want %v", ttl, err, ErrInvalidTTL)
+		}
+	}
+
+	tests := []struct {
+		flags int32
+		mode  int32
+	}{
+		{FlagTTL, 5},
+		{FlagTTL | FlagEphemeral, 5},
+		{FlagTTL | FlagSequence, 6},
+	}
+	for _, tt := range tests {
+		if _, err := conn.CreateTTL("/ttl", nil, tt.flags, WorldACL(PermAll), time.Minute); err != nil {
+			t.Fatalf("CreateTTL returned error: %v", err)
+		}
+		if req := <-reqs; req.Flags != tt.mode || req.Ttl != 60000 {
+			t.Fatalf("CreateTTL with flags %d sent flags %d and TTL %d; want %d and 60000", tt.flags, req.Flags, req.Ttl, tt.mode)
+		}
+	}
+}
+
+func TestWhoAmI(t *testing.T) {
+	fs := newFakeServer(t, func(opcode int32, body []byte) (interface{}, ErrCode) {
+		if opcode != opWhoAmI {
+			return nil, errUnimplemented
+		}
+		return &whoAmIResponse{ClientInfo: []AuthInfo{{"ip", "127.0.0.1"}, {"digest", "user"}}}, 0
+	})
+	defer fs.Close()
+
+	conn := connectFake(t, fs)
+
+	infos, err := conn.WhoAmI()
+	if err != nil {
+		t.Fatalf("WhoAmI returned error: %v", err)
+	}
+	if want := []AuthInfo{{"ip", "127.0.0.1"}, {"digest", "user"}}; !reflect.DeepEqual(infos, want) {
+		t.Fatalf("WhoAmI returned %+v; want %+v", infos, want)
+	}
+}
+
+func TestEventCallbackStates(t *testing.T) {
+	fs := newFakeTreeServer(t)
+	defer fs.Close()
+
+	var mu sync.Mutex
+	var states []State
+	cb := func(ev Event) {
+		if ev.Type == EventSession {
+			mu.Lock()
+			states = append(states, ev.State)
+			mu.Unlock()
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn := connectFake(t, fs, WithLogger(&testLogger{}), WithEventCallback(cb))
+
+	oldSession := conn.SessionID()
+	fs.ExpireSession(oldSession)
+	if err := conn.waitForState(ctx, func(s State) bool { return s == StateHasSession && conn.SessionID() != oldSession }); err != nil {
+		t.Fatalf("waiting for a new session: %v", err)
+	}
+	conn.Close()
+
+	want := []State{
+		StateConnecting, StateConnected, StateHasSession,
+		StateDisconnected, StateConnecting, StateConnected, StateExpired,
+		StateDisconnected, StateConnecting, StateConnected, StateHasSession,
+		StateDisconnected,
+	}
+	// The connection loop reports the final StateDisconnected after Close
+	// returned.
+	for {
+		mu.Lock()
+		got := append([]State(nil), states...)
+		mu.Unlock()
+		if reflect.DeepEqual(got, want) {
+			break
+		}
+		if len(got) >= len(want) || ctx.Err() != nil {
+			t.Fatalf("callback saw states %v; want %v", got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSessionRenewed(t *testing.T) {
+	fs := newFakeTreeServer(t)
+	defer fs.Close()
+
+	// The flag is already set when the StateHasSession event is delivered.
+	renewed := make(chan bool, 10)
+	ready := make(chan struct{})
+	var conn *Conn
+	cb := func(ev Event) {
+		if ev.Type == EventSession && ev.State == StateHasSession {
+			<-ready
+			renewed <- conn.SessionRenewed()
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, _, err := Connect([]string{fs.Addr()}, 15*time.Second, WithLogInfo(false),
+		WithReconnectBackoff(time.Millisecond, time.Millisecond, 1), WithEventCallback(cb))
+	if err != nil {
+		t.Fatalf("Connect returned error: %v", err)
+	}
+	close(ready)
+	defer conn.Close()
+	next := func(what string, want bool) {
+		t.Helper()
+		select {
+		case got := <-renewed:
+			if got != want {
+				t.Fatalf("SessionRenewed after %s returned %v; want %v", what, got, want)
+			}
+		case <-ctx.Done():
+			t.Fatalf("no session after %s", what)
+		}
+	}
+
+	next("the first connect", false)
+	id := conn.SessionID()
+
+	fs.DropConns()
+	next("resuming the session", false)
+	if conn.SessionID() != id {
+		t.Fatalf("session id changed from %#x to %#x after reconnecting", id, conn.SessionID())
+	}
+
+	fs.ExpireSession(id)
+	next("the session expired", true)
+	if conn.SessionID() == id {
+		t.Fatal("session id did not change after the session expired")
+	}
+	if !conn.SessionRenewed() {
+		t.Fatal("SessionRenewed returned false for the new session")
+	}
+
+	fs.DropConns()
+	next("resuming the new session", false)
+}
+
+func TestBackoff(t *testing.T) {
+	b := backoff{initial: 100 * time.Millisecond, max: time.Second, factor: 2.5}
+	want := []time.Duration{100 * time.Millisecond, 250 * time.Millisecond, 625 * time.Millisecond, time.Second, time.Second}
+	for i, w := range want {
+		if d := b.next(); d != w {
+			t.Fatalf("delay %d is %v; want %v", i, d, w)
+		}
+	}
+	b.reset()
+	if d := b.next(); d != 100*time.Millisecond {
+		t.Fatalf("delay after reset is %v; want %v", d, 100*time.Millisecond)
+	}
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	fs := newFakeTreeServer(t)
+	defer fs.Close()
+
+	var mu sync.Mutex
+	var delays []time.Duration
+	failures := 5
+	dialer := func(network, address string, timeout time.Duration) (net.Conn, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			return nil, errors.New("connection refused")
+		}
+		return net.DialTimeout(network, address, timeout)
+	}
+	connectFake(t, fs,
+		WithLogger(&testLogger{}), WithDialer(dialer),
+		WithReconnectBackoff(time.Millisecond, 8*time.Millisecond, 2),
+		func(c *Conn) {
+			c.reconnectDelayFn = func(d time.Duration) {
+				mu.Lock()
+				delays = append(delays, d)
+				mu.Unlock()
+			}
+		})
+
+	ms := time.Millisecond
+	mu.Lock()
+	if want := []time.Duration{ms, 2 * ms, 4 * ms, 8 * ms, 8 * ms}; !reflect.DeepEqual(delays, want) {
+		t.Fatalf("reconnect delays are %v; want %v", delays, want)
+	}
+	delays = nil
+	failures = 2
+	mu.Unlock()
+
+	// The backoff starts over after a successful connection. With a single
+	// server, every reconnect attempt starts a new pass over the servers.
+	fs.DropConns()
+	for deadline := time.Now().Add(5 * time.Second); fs.Connects() < 2; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("client did not reconnect")
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []time.Duration{ms, 2 * ms, 4 * ms}; !reflect.DeepEqual(delays, want) {
+		t.Fatalf("reconnect delays after reconnecting are %v; want %v", delays, want)
+	}
+}
+
+func TestReconnectJitter(t *testing.T) {
+	fs := newFakeTreeServer(t)
+	defer fs.Close()
+
+	var mu sync.Mutex
+	var delays []time.Duration
+	failures := 20
+	dialer := func(network, address string, timeout time.Duration) (net.Conn, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			return nil, errors.New("connection refused")
+		}
+		return net.DialTimeout(network, address, timeout)
+	}
+	connectFake(t, fs,
+		WithLogger(&testLogger{}), WithDialer(dialer),
+		WithReconnectBackoff(2*time.Millisecond, 2*time.Millisecond, 1), WithReconnectJitter(0.5),
+		func(c *Conn) {
+			c.reconnectDelayFn = func(d time.Duration) {
+				mu.Lock()
+				delays = append(delays, d)
+				mu.Unlock()
+			}
+		})
+
+	mu.Lock()
+	defer mu.Unlock()
+	distinct := make(map[time.Duration]bool)
+	for _, d := range delays {
+		if d < time.Millisecond || d >= 3*time.Millisecond {
+			t.Fatalf("reconnect delay %v is not within 50%% of 2ms", d)
+		}
+		distinct[d] = true
+	}
+	if len(distinct) < 2 {
+		t.Fatalf("reconnect delays %v are not randomized", delays)
+	}
+}
+
+func TestMaxReconnectAttempts(t *testing.T) {
+	var dials int32
+	dialer := func(network, address string, timeout time.Duration) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		return nil, errors.New("connection refused")
+	}
+	conn, ech, err := Connect([]string{"127.0.0.1:1", "127.0.0.1:2"}, 15*time.Second,
+		WithLogInfo(false), WithLogger(&testLogger{}), WithDialer(dialer),
+		WithReconnectBackoff(time.Millisecond, time.Millisecond, 1), WithMaxReconnectAttempts(3))
+	if err != nil {
+		t.Fatalf("Connect returned error: %v", err)
+	}
+	defer conn.Close()
+
+	timeout := time.After(5 * time.Second)
+	for closed := false; !closed; {
+		select {
+		case _, ok := <-ech:
+			closed = !ok
+		case <-timeout:
+			t.Fatal("event channel not closed after giving up")
+		}
+	}
+	if n := atomic.LoadInt32(&dials); n != 3 {
+		t.Fatalf("dialed %d times; want 3", n)
+	}
+	if _, _, err := conn.Get("/foo"); !errors.Is(err, ErrGaveUp) {
+		t.Fatalf("Get returned %v; want %v", err, ErrGaveUp)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, _, err := ConnectContext(ctx, []string{"127.0.0.1:1"}, 15*time.Second,
+		WithLogInfo(false), WithLogger(&testLogger{}), WithDialer(dialer), WithMaxReconnectAttempts(1)); !errors.Is(err, ErrGaveUp) {
+		t.Fatalf("ConnectContext returned %v; want %v", err, ErrGaveUp)
+	}
+}
+
+func TestMaxReconnectAttemptsHandshake(t *testing.T) {
+	// The server accepts connections, but closes them without answering
+	// the handshake.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen returned error: %v", err)
+	}
+	defer l.Close()
+	var accepts int32
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepts, 1)
+			c.Close()
+		}
+	}()
+
+	conn, ech, err := Connect([]string{l.Addr().String()}, 15*time.Second,
+		WithLogInfo(false), WithLogger(&testLogger{}),
+		WithReconnectBackoff(time.Millisecond, time.Millisecond, 1), WithMaxReconnectAttempts(3))
+	if err != nil {
+		t.Fatalf("Connect returned error: %v", err)
+	}
+	defer conn.Close()
+
+	timeout := time.After(5 * time.Second)
+	for closed := false; !closed; {
+		select {
+		case _, ok := <-ech:
+			closed = !ok
+		case <-timeout:
+			t.Fatal("event channel not closed after failed handshakes")
+		}
+	}
+	if n := atomic.LoadInt32(&accepts); n != 3 {
+		t.Fatalf("server accepted %d connections; want 3", n)
+	}
+	if _, _, err := conn.Get("/foo"); !errors.Is(err, ErrGaveUp) {
+		t.Fatalf("Get returned %v; want %v", err, ErrGaveUp)
+	}
+}
+
+// leveledLogger records the messages logged through a StructuredLogger.
+type leveledLogger struct {
+	mu      sync.Mutex
+	entries []leveledEntry
+}
+
+type leveledEntry struct {
+	level, msg    string
+	keysAndValues []interface{}
+}
+
+func (l *leveledLogger) log(level, msg string, keysAndValues []interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, leveledEntry{level, msg, keysAndValues})
+}
+
+func (l *leveledLogger) Debug(msg string, kv ...interface{}) { l.log("debug", msg, kv) }
+func (l *leveledLogger) Info(msg string, kv ...interface{})  { l.log("info", msg, kv) }
+func (l *leveledLogger) Warn(msg string, kv ...interface{})  { l.log("warn", msg, kv) }
+func (l *leveledLogger) Error(msg string, kv ...interface{}) { l.log("error", msg, kv) }
+
+func TestConnectTimeout(t *testing.T) {
+	// The first server accepts connections, but never answers the handshake.
+	hang, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hang.Close()
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, c := range conns {
+				c.Close()
+			}
+		}()
+		for {
+			c, err := hang.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, c)
+		}
+	}()
+	fs := newFakeTreeServer(t)
+	defer fs.Close()
+
+	var dials int32
+	dialer := func(network, address string, timeout time.Duration) (net.Conn, error) {
+		if timeout != 200*time.Millisecond {
+			t.Errorf("dialed with timeout %v; want 200ms", timeout)
+		}
+		if atomic.AddInt32(&dials, 1) == 1 {
+			return net.DialTimeout(network, hang.Addr().String(), timeout)
+		}
+		return net.DialTimeout(network, fs.Addr(), timeout)
+	}
+
+	// Without a connect timeout, the handshake would only time out after
+	// ten times the read timeout, that is 200s.
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, _, err := ConnectContext(ctx, []string{"127.0.0.1:1", "127.0.0.1:2"}, 30*time.Second, WithLogInfo(false),
+		WithLogger(&testLogger{}), WithDialer(dialer), WithConnectTimeout(200*time.Millisecond))
+	if err != nil {
+		t.Fatalf("ConnectContext returned error: %v", err)
+	}
+	defer conn.Close()
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("connecting took %v", d)
+	}
+	if n := atomic.LoadInt32(&dials); n != 2 {
+		t.Fatalf("dialed %d times; want 2", n)
+	}
+	if conn.SessionTimeout() != 30*time.Second {
+		t.Fatalf("session timeout is %v; want 30s", conn.SessionTimeout())
+	}
+}
+
+// recordingTCPConn records how configureTCP set up a connection.
+type recordingTCPConn struct {
+	calls []string
+}
+
+func (c *recordingTCPConn) SetKeepAlive(keepalive bool) error {
+	c.calls = append(c.calls, fmt.Sprintf("keepalive=%v", keepalive))
+	return nil
+}
+
+func (c *recordingTCPConn) SetKeepAlivePeriod(d time.Duration) error {
+	c.calls = append(c.calls, fmt.Sprintf("period=%v", d))
+	return nil
+}
+
+func (c *recordingTCPConn) SetNoDelay(noDelay bool) error {
+	c.calls = append(c.calls, fmt.Sprintf("nodelay=%v", noDelay))
+	return nil
+}
+
+func TestTCPOptions(t *testing.T) {
+	tests := []struct {
+		opts []connOption
+		want []string
+	}{
+		{nil, nil},
+		{[]connOption{WithKeepAlive(5 * time.Second)}, []string{"keepalive=true", "period=5s"}},
+		{[]connOption{WithKeepAlive(-1)}, []string{"keepalive=false"}},
+		{[]connOption{WithTCPNoDelay(false)}, []string{"nodelay=false"}},
+		{[]connOption{WithKeepAlive(time.Second), WithTCPNoDelay(true)}, []string{"keepalive=true", "period=1s", "nodelay=true"}},
+	}
+	for _, tt := range tests {
+		c := &Conn{}
+		for _, opt := range tt.opts {
+			opt(c)
+		}
+		tc := &recordingTCPConn{}
+		if err := c.configureTCP(tc); err != nil {
+			t.Fatalf("configureTCP returned error: %v", err)
+		}
+		if !reflect.DeepEqual(tc.calls, tt.want) {
+			t.Errorf("configureTCP made calls %q; want %q", tc.calls, tt.want)
+		}
+	}
+
+	// The default dialer applies them to real connections.
+	fs := newFakeTreeServer(t)
+	defer fs.Close()
+	conn := connectFake(t, fs, WithKeepAlive(time.Second), WithTCPNoDelay(false))
+	if _, _, err := conn.Get("/"); err != nil {
+		t.Fatalf("Get returned error: %v", err)
+	}
+}
+
+func TestStructuredLogger(t *testing.T) {
+	dialer := func(network, address string, timeout time.Duration) (net.Conn, error) {
+		return nil, errors.New("connection refused")
+	}
+	connect := func(opt connOption) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if _, _, err := ConnectContext(ctx, []string{"127.0.0.1:1"}, 15*time.Second, opt, WithDialer(dialer),
+			WithReconnectBackoff(time.Millisecond, time.Millisecond, 1), WithMaxReconnectAttempts(2)); !errors.Is(err, ErrGaveUp) {
+			t.Fatalf("ConnectContext returned %v; want %v", err, ErrGaveUp)
+		}
+	}
+
+	l := &leveledLogger{}
+	connect(WithStructuredLogger(l))
+	l.mu.Lock()
+	want := []leveledEntry{
+		{"warn", "failed to connect", []interface{}{"server", "127.0.0.1:1", "error", errors.New("connection refused"), "attempt", 1}},
+		{"warn", "failed to connect", []interface{}{"server", "127.0.0.1:1", "error", errors.New("connection refused"), "attempt", 2}},
+		{"error", "giving up connecting", []interface{}{"attempts", 2}},
+	}
+	if !reflect.DeepEqual(l.entries, want) {
+		t.Fatalf("logged %+v; want %+v", l.entries, want)
+	}
+	l.mu.Unlock()
+
+	// A Logger gets the keys and values after the message.
+	tl := &testLogger{}
+	connect(WithLogger(tl))
+	if events := tl.Reset(); len(events) == 0 || events[0] != "failed to connect server=127.0.0.1:1 error=connection refused attempt=1" {
+		t.Fatalf("logged %q", events)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	fs := newFakeTreeServer(t)
+	defer fs.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn := connectFake(t, fs, WithReadOnly(true))
+	if conn.ReadOnly() || conn.State() != StateHasSession {
+		t.Fatalf("connection to a read-write server is in state %v, read-only %v", conn.State(), conn.ReadOnly())
+	}
+	if _, err := conn.Create("/ro", []byte("data"), 0, WorldACL(PermAll)); err != nil {
+		t.Fatalf("Create returned error: %v", err)
+	}
+
+	// The server loses quorum and serves reads only.
+	fs.mu.Lock()
+	fs.readOnly = true
+	fs.mu.Unlock()
+	fs.DropConns()
+	for fs.Connects() < 2 {
+		if ctx.Err() != nil {
+			t.Fatal("client did not reconnect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := conn.waitForState(ctx, func(s State) bool { return s == StateConnectedReadOnly }); err != nil {
+		t.Fatalf("waiting for StateConnectedReadOnly: %v", err)
+	}
+	if !conn.ReadOnly() {
+		t.Fatal("ReadOnly returned false for a connection to a read-only server")
+	}
+	if data, _, err := conn.Get("/ro"); err != nil || string(data) != "data" {
+		t.Fatalf("Get returned %q, %v; want %q", data, err, "data")
+	}
+	if _, err := conn.Set("/ro", nil, -1); !errors.Is(err, ErrNotReadOnlyOp) {
+		t.Fatalf("Set returned %v; want %v", err, ErrNotReadOnlyOp)
+	}
+	if err := conn.Delete("/ro", -1); !errors.Is(err, ErrNotReadOnlyOp) {
+		t.Fatalf("Delete returned %v; want %v", err, ErrNotReadOnlyOp)
+	}
+}
+
+func TestWithSession(t *testing.T) {
+	fs := newFakeTreeServer(t)
+	defer fs.Close()
+
+	first := connectFake(t, fs)
+	if _, err := first.Create("/ephemeral", nil, FlagEphemeral, WorldACL(PermAll)); err != nil {
+		t.Fatalf("Create returned error: %v", err)
+	}
+	id, passwd := first.SessionID(), first.SessionPassword()
+
+	// A new connection resumes the session, with its ephemeral nodes.
+	resumed := connectFake(t, fs, WithSession(id, passwd))
+	if resumed.SessionID() != id {
+		t.Fatalf("resumed session id is %#x; want %#x", resumed.SessionID(), id)
+	}
+	if ephemerals, err := resumed.GetEphemerals("/"); err != nil || len(ephemerals) != 1 {
+		t.Fatalf("GetEphemerals returned %q, %v; want the ephemeral node of the session", ephemerals, err)
+	}
+
+	// A session that can't be resumed is replaced with a new one.
+	expectNewSession := func(passwd []byte) {
+		t.Helper()
+		zk, events, err := Connect([]string{fs.Addr()}, 15*time.Second, WithLogInfo(false), WithSession(id, passwd))
+		if err != nil {
+			t.Fatalf("Connect returned error: %v", err)
+		}
+		defer zk.Close()
+		expired := false
+		for ev := range events {
+			if ev.State == StateExpired {
+				expired = true
+			}
+			if ev.State == StateHasSession {
+				break
+			}
+		}
+		if !expired {
+			t.Fatalf("state did not go to %s before the new session", StateExpired)
+		}
+		if zk.SessionID() == id {
+			t.Fatalf("session id is %#x; want a new session", zk.SessionID())
+		}
+	}
+	expectNewSession([]byte("wrong password"))
+	fs.ExpireSession(id)
+	expectNewSession(passwd)
+}
+
+func TestServerAddress(t *testing.T) {
+	fs := newFakeTreeServer(t)
+	defer fs.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn := connectFake(t, fs)
+
+	if s := conn.Server(); s != fs.Addr() {
+		t.Fatalf("Server returned %q; want %q", s, fs.Addr())
+	}
+
+	// Closing the server keeps the client from reconnecting.
+	fs.Close()
+	if err := conn.waitForState(ctx, func(s State) bool { return s != StateHasSession }); err != nil {
+		t.Fatalf("client did not notice the disconnect: %v", err)
+	}
+	if s := conn.Server(); s != "" {
+		t.Fatalf("Server returned %q while disconnected; want an empty string", s)
+	}
+}
+
+func TestUpdateServers(t *testing.T) {
+	fs1 := newFakeTreeServer(t)
+	defer fs1.Close()
+	fs2 := newFakeTreeServer(t)
+	defer fs2.Close()
+
+	conn := connectFake(t, fs1, WithReconnectBackoff(time.Millisecond, time.Millisecond, 1))
+	sessionID := conn.SessionID()
+
+	if err := conn.UpdateServers(nil); err == nil {
+		t.Fatal("UpdateServers accepted an empty list")
+	}
+
+	// The current server is still in the list, so the client stays put.
+	if err := conn.UpdateServers([]string{fs2.Addr(), fs1.Addr()}); err != nil {
+		t.Fatalf("UpdateServers returned error: %v", err)
+	}
+	if _, _, err := conn.Get("/"); err != nil {
+		t.Fatalf("Get returned error: %v", err)
+	}
+	if conn.Server() != fs1.Addr() || fs1.Connects() != 1 || fs2.Connects() != 0 {
+		t.Fatalf("client reconnected although its server %s is still in the list", fs1.Addr())
+	}
+
+	// Otherwise it moves to one of the new servers, keeping its session.
+	if err := conn.UpdateServers([]string{fs2.Addr()}); err != nil {
+		t.Fatalf("UpdateServers returned error: %v", err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); fs2.Connects() == 0 || conn.State() != StateHasSession; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("client did not move to the new server")
+		}
+	}
+	if conn.Server() != fs2.Addr() || conn.SessionID() != sessionID {
+		t.Fatalf("client is connected to %s with session %x; want %s with session %x", conn.Server(), conn.SessionID(), fs2.Addr(), sessionID)
+	}
+	if _, _, err := conn.Get("/"); err != nil {
+		t.Fatalf("Get returned error after moving: %v", err)
+	}
+	if fs1.Connects() != 1 {
+		t.Fatalf("client connected to the removed server %d times", fs1.Connects())
+	}
+}
+
+func TestUpdateServersReadOnly(t *testing.T) {
+	fs1 := newFakeTreeServer(t)
+	defer fs1.Close()
+	fs1.readOnly = true
+	fs2 := newFakeTreeServer(t)
+	defer fs2.Close()
+	fs2.readOnly = true
+
+	conn := connectFake(t, fs1, WithReadOnly(true), WithReconnectBackoff(time.Millisecond, time.Millisecond, 1))
+	if conn.State() != StateConnectedReadOnly {
+		t.Fatalf("connection to a read-only server is in state %v", conn.State())
+	}
+
+	// A read-only client leaves a removed server just like a read-write one.
+	if err := conn.UpdateServers([]string{fs2.Addr()}); err != nil {
+		t.Fatalf("UpdateServers returned error: %v", err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); fs2.Connects() == 0 || conn.State() != StateConnectedReadOnly; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("client did not move to the new server")
+		}
+	}
+	if conn.Server() != fs2.Addr() {
+		t.Fatalf("client is connected to %s; want %s", conn.Server(), fs2.Addr())
+	}
+	if fs1.Connects() != 1 {
+		t.Fatalf("client connected to the removed server %d times", fs1.Connects())
+	}
+}
+
+func TestUpdateServersHostProviderLookup(t *testing.T) {
+	fs1 := newFakeTreeServer(t)
+	defer fs1.Close()
+	fs2 := newFakeTreeServer(t)
+	defer fs2.Close()
+	_, port1, _ := net.SplitHostPort(fs1.Addr())
+	_, port2, _ := net.SplitHostPort(fs2.Addr())
+
+	// The names only resolve through the host provider, not the system resolver.
+	hp := &DNSHostProvider{lookupHost: func(host string) ([]string, error) {
+		switch host {
+		case "zk1.invalid", "zk1-alias.invalid", "zk2.invalid":
+			return []string{"127.0.0.1"}, nil
+		}
+		return nil, fmt.Errorf("unknown host %q", host)
+	}}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, _, err := ConnectContext(ctx, []string{net.JoinHostPort("zk1.invalid", port1)}, 15*time.Second,
+		WithLogInfo(false), WithHostProvider(hp), WithReconnectBackoff(time.Millisecond, time.Millisecond, 1))
+	if err != nil {
+		t.Fatalf("ConnectContext returned error: %v", err)
+	}
+	defer conn.Close()
+
+	// The alias resolves to the current server, so the client stays put.
+	if err := conn.UpdateServers([]string{net.JoinHostPort("zk1-alias.invalid", port1)}); err != nil {
+		t.Fatalf("UpdateServers returned error: %v", err)
+	}
+	if _, _, err := conn.Get("/"); err != nil {
+		t.Fatalf("Get returned error: %v", err)
+	}
+	if conn.Server() != fs1.Addr() || fs1.Connects() != 1 {
+		t.Fatalf("client reconnected although an alias of its server %s is in the list", fs1.Addr())
+	}
+
+	if err := conn.UpdateServers([]string{net.JoinHostPort("zk2.invalid", port2)}); err != nil {
+		t.Fatalf("UpdateServers returned error: %v", err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); fs2.Connects() == 0 || conn.State() != StateHasSession; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("client did not move to the new server")
+		}
+	}
+	if conn.Server() != fs2.Addr() {
+		t.Fatalf("client is connected to %s; want %s", conn.Server(), fs2.Addr())
+	}
+}
+
+func TestNegotiatedSessionTimeout(t *testing.T) {
+	fs := newFakeTreeServer(t)
+	defer fs.Close()
+	fs.maxTimeout = 6000
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, _, err := ConnectContext(ctx, []string{fs.Addr()}, 30*time.Second, WithLogInfo(false))
+	if err != nil {
+		t.Fatalf("ConnectContext returned error: %v", err)
+	}
+	defer conn.Close()
+
+	if d := conn.SessionTimeout(); d != 6*time.Second {
+		t.Fatalf("SessionTimeout returned %v; want %v", d, 6*time.Second)
+	}
+	if conn.recvTimeout != 4*time.Second || conn.pingInterval != 2*time.Second {
+		t.Fatalf("receive timeout %v and ping interval %v are not derived from the negotiated timeout", conn.recvTimeout, conn.pingInterval)
+	}
+}
+
+func TestWaitForConnection(t *testing.T) {
+	fs := newFakeTreeServer(t)
+	defer fs.Close()
+
+	dial := make(chan struct{})
+	dialer := func(network, address string, timeout time.Duration) (net.Conn, error) {
+		<-dial
+		return net.DialTimeout(network, address, timeout)
+	}
+	conn, _, err := Connect([]string{fs.Addr()}, 15*time.Second, WithLogInfo(false), WithDialer(dialer))
+	if err != nil {
+		t.Fatalf("Connect returned error: %v", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	waited := make(chan error, 1)
+	go func() { waited <- conn.WaitForConnection(ctx) }()
+	select {
+	case err := <-waited:
+		t.Fatalf("WaitForConnection returned %v before the session was established", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(dial)
+	if err := <-waited; err != nil {
+		t.Fatalf("WaitForConnection returned error: %v", err)
+	}
+	if s := conn.State(); s != StateHasSession {
+		t.Fatalf("state is %v after WaitForConnection; want %v", s, StateHasSession)
+	}
+
+	// It returns right away once connected.
+	if err := conn.WaitForConnection(ctx); err != nil {
+		t.Fatalf("WaitForConnection returned error: %v", err)
+	}
+
+	// And fails once the connection is closed.
+	conn.Close()
+	if err := conn.WaitForConnection(ctx); !errors.Is(err, ErrClosing) {
+		t.Fatalf("WaitForConnection on a closed connection returned %v; want %v", err, ErrClosing)
+	}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	conn2, _, err := Connect([]string{"127.0.0.1:1"}, 15*time.Second, WithLogInfo(false), WithLogger(&testLogger{}))
+	if err != nil {
+		t.Fatalf("Connect returned error: %v", err)
+	}
+	defer conn2.Close()
+	if err := conn2.WaitForConnection(canceled); err != context.Canceled {
+		t.Fatalf("WaitForConnection returned %v; want %v", err, context.Canceled)
+	}
+}
+
+func TestPingInterval(t *testing.T) {
+	fs := newFakeTreeServer(t)
+	defer fs.Close()
+
+	var mu sync.Mutex
+	var intervals []time.Duration
+	ticks := make(chan time.Time)
+	connect := func(interval time.Duration) *Conn {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		conn, _, err := ConnectContext(ctx, []string{fs.Addr()}, 30*time.Second,
+			WithLogInfo(false), WithPingInterval(interval),
+			func(c *Conn) {
+				c.pingTickerFn = func(d time.Duration) (<-chan time.Time, func()) {
+					mu.Lock()
+					intervals = append(intervals, d)
+					mu.Unlock()
+					return ticks, func() {}
+				}
+			})
+		if err != nil {
+			t.Fatalf("ConnectContext returned error: %v", err)
+		}
+		return conn
+	}
+
+	conn := connect(100 * time.Millisecond)
+	defer conn.Close()
+	for i := 1; i <= 3; i++ {
+		ticks <- time.Now()
+		deadline := time.Now().Add(5 * time.Second)
+		for fs.Pings() < i {
+			if time.Now().After(deadline) {
+				t.Fatalf("server answered %d pings after %d ticks", fs.Pings(), i)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	mu.Lock()
+	if want := []time.Duration{100 * time.Millisecond}; !reflect.DeepEqual(intervals, want) {
+		t.Fatalf("ping intervals are %v; want %v", intervals, want)
+	}
+	intervals = nil
+	mu.Unlock()
+
+	// Intervals longer than the default are ignored, or the session would
+	// expire between pings.
+	conn2 := connect(time.Minute)
+	defer conn2.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(intervals)
+		mu.Unlock()
+		if n > 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []time.Duration{10 * time.Second}; !reflect.DeepEqual(intervals, want) {
+		t.Fatalf("ping intervals are %v; want %v", intervals, want)
+	}
+}
+
+func TestSetWatches2(t *testing.T) {
+	for _, supported := range []bool{true, false} {
+		t.Run(fmt.Sprintf("supported=%t", supported), func(t *testing.T) {
+			var (
+				mu       sync.Mutex
+				restored *setWatches2Request
+				legacy   *setWatchesRequest
+				added    []addWatchRequest
+			)
+			fs := newFakeServer(t, func(opcode int32, body []byte) (interface{}, ErrCode) {
+				mu.Lock()
+				defer mu.Unlock()
+				switch opcode {
+				case opGetData:
+					return &getDataResponse{}, 0
+				case opExists:
+					return nil, errNoNode
+				case opGetChildren2:
+					return &getChildren2Response{}, 0
+				case opAddWatch:
+					req := &addWatchRequest{}
+					decodePacket(body, req)
+					added = append(added, *req)
+					return &addWatchResponse{}, 0
+				case opSetWatches2:
+					if !supported {
+						return nil, errUnimplemented
+					}
+					restored = &setWatches2Request{}
+					if _, err := decodePacket(body, restored); err != nil {
+						t.Errorf("failed to decode setWatches2 request: %v", err)
+					}
+					return &setWatchesResponse{}, 0
+				case opSetWatches:
+					legacy = &setWatchesRequest{}
+					if _, err := decodePacket(body, legacy); err != nil {
+						t.Errorf("failed to decode setWatches request: %v", err)
+					}
+					return &setWatchesResponse{}, 0
+				}
+				return nil, errUnimplemented
+			})
+			defer fs.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conn := connectFake(t, fs, WithReconnectBackoff(time.Millisecond, time.Millisecond, 1))
+
+			if _, _, _, err := conn.GetW("/data"); err != nil {
+				t.Fatalf("GetW returned error: %v", err)
+			}
+			if _, _, _, err := conn.ExistsW("/missing"); err != nil {
+				t.Fatalf("ExistsW returned error: %v", err)
+			}
+			if _, _, _, err := conn.ChildrenW("/parent"); err != nil {
+				t.Fatalf("ChildrenW returned error: %v", err)
+			}
+			if _, err := conn.AddWatch("/persistent", AddWatchModePersistent); err != nil {
+				t.Fatalf("AddWatch returned error: %v", err)
+			}
+			if _, err := conn.AddWatch("/recursive", AddWatchModePersistentRecursive); err != nil {
+				t.Fatalf("AddWatch returned error: %v", err)
+			}
+			mu.Lock()
+			added = nil
+			mu.Unlock()
+
+			fs.DropConns()
+			for {
+				mu.Lock()
+				done := restored != nil || (legacy != nil && len(added) == 2)
+				mu.Unlock()
+				if done {
+					break
+				}
+				select {
+				case <-ctx.Done():
+					t.Fatal("watches were not restored")
+				case <-time.After(10 * time.Millisecond):
+				}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if supported {
+				want := &setWatches2Request{
+					RelativeZxid:               restored.RelativeZxid,
+					DataWatches:                []string{"/data"},
+					ExistWatches:               []string{"/missing"},
+					ChildWatches:               []string{"/parent"},
+					PersistentWatches:          []string{"/persistent"},
+					PersistentRecursiveWatches: []string{"/recursive"},
+				}
+				if !reflect.DeepEqual(restored, want) {
+					t.Fatalf("setWatches2 request is %+v; want %+v", restored, want)
+				}
+				if legacy != nil || len(added) != 0 {
+					t.Fatalf("watches also restored with setWatches %+v or addWatch %+v", legacy, added)
+				}
+				return
+			}
+			want := &setWatchesRequest{
+				RelativeZxid: legacy.RelativeZxid,
+				DataWatches:  []string{"/data"},
+				ExistWatches: []string{"/missing"},
+				ChildWatches: []string{"/parent"},
+			}
+			if !reflect.DeepEqual(legacy, want) {
+				t.Fatalf("setWatches request is %+v; want %+v", legacy, want)
+			}
+			sort.Slice(added, func(i, j int) bool { return added[i].Path < added[j].Path })
+			wantAdded := []addWatchRequest{
+				{Path: "/persistent", Mode: AddWatchModePersistent},
+				{Path: "/recursive", Mode: AddWatchModePersistentRecursive},
+			}
+			if !reflect.DeepEqual(added, wantAdded) {
+				t.Fatalf("persistent watches added again with %+v; want %+v", added, wantAdded)
+			}
+		})
+	}
+}
+
+func TestSetWatchesBatches(t *testing.T) {
+	const maxBufferSize = 2048
+	var (
+		mu      sync.Mutex
+		batches int
+		watches = make(map[string]bool)
+	)
+	fs := newFakeServer(t, func(opcode int32, body []byte) (interface{}, ErrCode) {
+		switch opcode {
+		case opGetData:
+			return &getDataResponse{}, 0
+		case opSetWatches:
+			req := &setWatchesRequest{}
+			if _, err := decodePacket(body, req); err != nil {
+				t.Errorf("failed to decode setWatches request: %v", err)
+				return nil, errMarshallingError
+			}
+			// The packet also holds the 8 byte request header.
+			if len(body)+8 > maxBufferSize {
+				t.Errorf("setWatches packet is %d bytes; want at most %d", len(body)+8, maxBufferSize)
+			}
+			mu.Lock()
+			batches++
+			for _, p := range req.DataWatches {
+				watches[p] = true
+			}
+			mu.Unlock()
+			return nil, 0
+		}
+		return nil, errUnimplemented
+	})
+	defer fs.Close()
+
+	conn := connectFake(t, fs, WithMaxBufferSize(maxBufferSize), WithReconnectBackoff(time.Millisecond, time.Millisecond, 1))
+
+	const n = 200
+	for i := 0; i < n; i++ {
+		if _, _, _, err := conn.GetW(fmt.Sprintf("/watched/node-%04d", i)); err != nil {
+			t.Fatalf("GetW returned error: %v", err)
+		}
+	}
+
+	fs.DropConns()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		got := len(watches)
+		mu.Unlock()
+		if got == n {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d watches were set again after reconnecting", got, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if batches < 2 {
+		t.Fatalf("watches were set again in %d requests; want them split up", batches)
+	}
+}
+
+func TestCompareAndSet(t *testing.T) {
+	fs := newFakeTreeServer(t)
+	defer fs.Close()
+
+	conn := connectFake(t, fs)
+
+	if _, err := conn.Create("/foo", []byte("one"), 0, WorldACL(PermAll)); err != nil {
+		t.Fatalf("Create returned error: %v", err)
+	}
+	if ok, err := conn.CompareAndSet("/foo", []byte("two"), []byte("three")); err != nil || ok {
+		t.Fatalf("CompareAndSet with the wrong data returned %v, %v; want false, nil", ok, err)
+	}
+	if ok, err := conn.CompareAndSet("/foo", []byte("one"), []byte("two")); err != nil || !ok {
+		t.Fatalf("CompareAndSet returned %v, %v; want true, nil", ok, err)
+	}
+	if data, _, err := conn.Get("/foo"); err != nil || string(data) != "two" {
+		t.Fatalf("Get returned %q, %v; want %q", data, err, "two")
+	}
+	if _, err := conn.CompareAndSet("/missing", nil, nil); !errors.Is(err, ErrNoNode) {
+		t.Fatalf("CompareAndSet of a missing znode returned %v; want %v", err, ErrNoNode)
+	}
+}
+
+func TestCompareAndSetContention(t *testing.T) {
+	// Another client sets the data between the read and the write.
+	fs := newFakeServer(t, func(opcode int32, body []byte) (interface{}, ErrCode) {
+		switch opcode {
+		case opGetData:
+			return &getDataResponse{Data: []byte("one"), Stat: Stat{Version: 3}}, 0
+		case opSetData:
+			req := &SetDataRequest{}
+			if _, err := decodePacket(body, req); err != nil {
+				t.Errorf("failed to decode set request: %v", err)
+			}
+			if req.Version != 3 {
+				t.Errorf("set request has version %d; want 3", req.Version)
+			}
+			return nil, errBadVersion
+		}
+		return nil, errUnimplemented
+	})
+	defer fs.Close()
+
+	conn := connectFake(t, fs)
+
+	if ok, err := conn.CompareAndSet("/foo", []byte("one"), []byte("two")); err != nil || ok {
+		t.Fatalf("CompareAndSet returned %v, %v; want false, nil", ok, err)
+	}
+}
+
+func TestUpsert(t *testing.T) {
+	fs := newFakeTreeServer(t)
+	defer fs.Close()
+
+	conn := connectFake(t, fs)
+
+	// The znode and its parents are created.
+	stat, err := conn.Upsert("/a/b", []byte("one"), WorldACL(PermAll))
+	if err != nil {
+		t.Fatalf("Upsert of a missing znode returned error: %v", err)
+	}
+	if stat.Version != 0 || stat.DataLength != 3 {
+		t.Fatalf("Upsert of a missing znode returned %+v; want version 0 with 3 bytes", stat)
+	}
+	if data, _, err := conn.Get("/a/b"); err != nil || string(data) != "one" {
+		t.Fatalf("Get returned %q, %v; want %q", data, err, "one")
+	}
+
+	// An existing znode is set, whatever its version.
+	if _, err := conn.Set("/a/b", []byte("two"), -1); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	stat, err = conn.Upsert("/a/b", []byte("three"), WorldACL(PermAll))
+	if err != nil {
+		t.Fatalf("Upsert of an existing znode returned error: %v", err)
+	}
+	if stat.Version != 2 {
+		t.Fatalf("Upsert of an existing znode returned version %d; want 2", stat.Version)
+	}
+	if data, _, err := conn.Get("/a/b"); err != nil || string(data) != "three" {
+		t.Fatalf("Get returned %q, %v; want %q", data, err, "three")
+	}
+}
+
+func TestUpsertCreateRace(t *testing.T) {
+	// Another client creates the znode between the Set and the Create.
+	var sets, creates int32
+	var missing int32 = 1 // the number of sets that find no znode
+	fs := newFakeServer(t, func(opcode int32, body []byte) (interface{}, ErrCode) {
+		switch opcode {
+		case opSetData:
+			atomic.AddInt32(&sets, 1)
+			if atomic.AddInt32(&missing, -1) >= 0 {
+				return nil, errNoNode
+			}
+			return &setDataResponse{Stat: Stat{Version: 1}}, 0
+		case opCreate:
+			atomic.AddInt32(&creates, 1)
+			return nil, errNodeExists
+		}
+		return nil, errUnimplemented
+	})
+	defer fs.Close()
+
+	conn := connectFake(t, fs)
+
+	stat, err := conn.Upsert("/foo", []byte("one"), WorldACL(PermAll))
+	if err != nil {
+		t.Fatalf("Upsert returned error: %v", err)
+	}
+	if n, m := atomic.LoadInt32(&sets), atomic.LoadInt32(&creates); stat.Version != 1 || n != 2 || m != 1 {
+		t.Fatalf("Upsert returned version %d after %d sets and %d creates; want version 1 after 2 sets and 1 create",
+			stat.Version, n, m)
+	}
+
+	// The race is only retried once.
+	atomic.StoreInt32(&missing, 2)
+	if _, err := conn.Upsert("/foo", []byte("one"), WorldACL(PermAll)); !errors.Is(err, ErrNodeExists) {
+		t.Fatalf("Upsert losing twice returned %v; want %v", err, ErrNodeExists)
+	}
+}
+
+func TestCreateRecursive(t *testing.T) {
+	fs := newFakeTreeServer(t)
+	defer fs.Close()
+
+	conn := connectFake(t, fs)
+
+	acl := WorldACL(PermAll)
+	path, err := conn.CreateRecursive("/a/b/c/d-", []byte("leaf"), FlagEphemeral|FlagSequence, acl)
+	if err != nil {
+		t.Fatalf("CreateRecursive returned error: %v", err)
+	}
+	if path != "/a/b/c/d-0000000000" {
+		t.Fatalf("CreateRecursive returned path %q", path)
+	}
+	for _, p := range []string{"/a", "/a/b", "/a/b/c"} {
+		data, stat, err := conn.Get(p)
+		if err != nil {
+			t.Fatalf("Get(%q) returned error: %v", p, err)
+		}
+		if len(data) != 0 || stat.EphemeralOwner != 0 {
+			t.Fatalf("parent %q has data %q and ephemeral owner %d; want an empty persistent znode", p, data, stat.EphemeralOwner)
+		}
+	}
+	data, stat, err := conn.Get(path)
+	if err != nil {
+		t.Fatalf("Get returned error: %v", err)
+	}
+	if string(data) != "leaf" || stat.EphemeralOwner != conn.SessionID() {
+		t.Fatalf("leaf has data %q and ephemeral owner %d", data, stat.EphemeralOwner)
+	}
+
+	// Existing parents are fine, an existing leaf is not.
+	if _, err := conn.CreateRecursive("/a/b/e", nil, 0, acl); err != nil {
+		t.Fatalf("CreateRecursive returned error: %v", err)
+	}
+	if _, err := conn.CreateRecursive("/a/b/e", nil, 0, acl); !errors.Is(err, ErrNodeExists) {
+		t.Fatalf("CreateRecursive of an existing znode returned %v; want %v", err, ErrNodeExists)
+	}
+}
+
+func TestCreateAndDeleteIfExists(t *testing.T) {
+	fs := newFakeTreeServer(t)
+	defer fs.Close()
+
+	conn := connectFake(t, fs)
+
+	acl := WorldACL(PermAll)
+	if path, created, err := conn.CreateIfNotExists("/foo", []byte("one"), 0, acl); err != nil || !created || path != "/foo" {
+		t.Fatalf("CreateIfNotExists returned %q, %v, %v; want %q, true, nil", path, created, err, "/foo")
+	}
+	if path, created, err := conn.CreateIfNotExists("/foo", []byte("two"), 0, acl); err != nil || created || path != "" {
+		t.Fatalf("CreateIfNotExists of an existing znode returned %q, %v, %v; want \"\", false, nil", path, created, err)
+	}
+	if data, _, err := conn.Get("/foo"); err != nil || string(data) != "one" {
+		t.Fatalf("Get returned %q, %v; want %q", data, err, "one")
+	}
+	if _, _, err := conn.CreateIfNotExists("/missing/foo", nil, 0, acl); !errors.Is(err, ErrNoNode) {
+		t.Fatalf("CreateIfNotExists without a parent returned %v; want %v", err, ErrNoNode)
+	}
+
+	if deleted, err := conn.DeleteIfExists("/foo", 5); !errors.Is(err, ErrBadVersion) || deleted {
+		t.Fatalf("DeleteIfExists with a wrong version returned %v, %v; want false, %v", deleted, err, ErrBadVersion)
+	}
+	if deleted, err := conn.DeleteIfExists("/foo", -1); err != nil || !deleted {
+		t.Fatalf("DeleteIfExists returned %v, %v; want true, nil", deleted, err)
+	}
+	if deleted, err := conn.DeleteIfExists("/foo", -1); err != nil || deleted {
+		t.Fatalf("DeleteIfExists of a missing znode returned %v, %v; want false, nil", deleted, err)
+	}
+}
+
+func TestCreateProtectedEphemeralSequential(t *testing.T) {
+	fs := newFakeTreeServer(t)
+	defer fs.Close()
+
+	conn := connectFake(t, fs, WithReconnectBackoff(time.Millisecond, time.Millisecond, 1))
+
+	if _, err := conn.Create("/queue", nil, 0, WorldACL(PermAll)); err != nil {
+		t.Fatalf("Create returned error: %v", err)
+	}
+	if _, err := conn.FindProtectedNode("/queue/item-", "0123456789abcdef0123456789abcdef"); !errors.Is(err, ErrNoNode) {
+		t.Fatalf("FindProtectedNode returned %v for a missing node; want %v", err, ErrNoNode)
+	}
+
+	// The server applies the first create, but the connection is lost
+	// before the client gets the response.
+	fs.mu.Lock()
+	fs.dropReply = func(opcode int32) bool {
+		if opcode == opCreate {
+			fs.dropReply = nil
+			return true
+		}
+		return false
+	}
+	fs.mu.Unlock()
+
+	path, err := conn.CreateProtectedEphemeralSequential("/queue/item-", nil, WorldACL(PermAll))
+	if err != nil {
+		t.Fatalf("CreateProtectedEphemeralSequential returned error: %v", err)
+	}
+	children, _, err := conn.Children("/queue")
+	if err != nil {
+		t.Fatalf("Children returned error: %v", err)
+	}
+	if len(children) != 1 || "/queue/"+children[0] != path {
+		t.Fatalf("queue has nodes %v; want only the created %s", children, path)
+	}
+	if fs.Connects() != 2 {
+		t.Fatalf("client connected %d times; want the create to be recovered after reconnecting", fs.Connects())
+	}
+
+	guid := strings.TrimPrefix(children[0], protectedPrefix)[:32]
+	if p, err := conn.FindProtectedNode("/queue/item-", guid); err != nil || p != path {
+		t.Fatalf("FindProtectedNode returned %q, %v; want %q", p, err, path)
+	}
+}
+
+func TestOperationError(t *testing.T) {
+	fs := newFakeTreeServer(t)
+	defer fs.Close()
+
+	conn := connectFake(t, fs)
+
+	check := func(err error, op, path string, code ErrCode, want error) {
+		t.Helper()
+		if !errors.Is(err, want) {
+			t.Fatalf("got error %v; want %v", err, want)
+		}
+		var opErr *OperationError
+		if !errors.As(err, &opErr) {
+			t.Fatalf("got error %T; want an *OperationError", err)
+		}
+		if opErr.Op != op || opErr.Path != path || opErr.Code != code {
+			t.Fatalf("got %+v; want op %q, path %q and code %d", opErr, op, path, code)
+		}
+		if msg := op + " " + path + ": " + want.Error(); err.Error() != msg {
+			t.Fatalf("got message %q; want %q", err.Error(), msg)
+		}
+	}
+
+	_, _, err := conn.Get("/missing")
+	check(err, "getData", "/missing", errNoNode, ErrNoNode)
+	_, err = conn.Create("/missing/child", nil, 0, WorldACL(PermAll))
+	check(err, "create", "/missing/child", errNoNode, ErrNoNode)
+	if _, err := conn.Create("/a", nil, 0, WorldACL(PermAll)); err != nil {
+		t.Fatalf("Create returned error: %v", err)
+	}
+	_, err = conn.Set("/a", nil, 3)
+	check(err, "setData", "/a", errBadVersion, ErrBadVersion)
+	check(<-conn.DeleteAsync("/b", -1), "delete", "/b", errNoNode, ErrNoNode)
+
+	// Errors that did not come from the server are not wrapped.
+	if _, _, err := conn.Get("invalid"); err != ErrInvalidPath {
+		t.Fatalf("Get with an invalid path returned %v; want %v", err, ErrInvalidPath)
+	}
+	conn.Close()
+	if _, _, err := conn.Get("/a"); err != ErrConnectionClosed {
+		t.Fatalf("Get after Close returned %v; want %v", err, ErrConnectionClosed)
+	}
+}
+
+func TestDeleteRecursive(t *testing.T) {
+	fs := newFakeTreeServer(t)
+	defer fs.Close()
+
+	conn := connectFake(t, fs)
+
+	acl := WorldACL(PermAll)
+	for _, p := range []string{"/tree", "/tree/a", "/tree/a/b", "/tree/a/b/c", "/tree/d", "/treehouse"} {
+		if _, err := conn.Create(p, nil, 0, acl); err != nil {
+			t.Fatalf("Create returned error: %v", err)
+		}
+	}
+	if err := conn.DeleteRecursive("/tree", 5); !errors.Is(err, ErrBadVersion) {
+		t.Fatalf("DeleteRecursive with a wrong version returned %v; want %v", err, ErrBadVersion)
+	}
+	if ok, _, err := conn.Exists("/tree/a/b/c"); err != nil || !ok {
+		t.Fatalf("DeleteRecursive with a wrong version deleted descendants")
+	}
+	if err := conn.DeleteRecursive("/tree", 0); err != nil {
+		t.Fatalf("DeleteRecursive returned error: %v", err)
+	}
+	if ok, _, err := conn.Exists("/tree"); err != nil || ok {
+		t.Fatalf("Exists returned %v, %v after DeleteRecursive", ok, err)
+	}
+	if ok, _, err := conn.Exists("/treehouse"); err != nil || !ok {
+		t.Fatalf("DeleteRecursive deleted a sibling with the same prefix")
+	}
+	if err := conn.DeleteRecursive("/tree", -1); err != nil {
+		t.Fatalf("DeleteRecursive of a missing node returned error: %v", err)
+	}
+
+	// Children created while deleting are deleted too.
+	if _, err := conn.Create("/race", nil, 0, acl); err != nil {
+		t.Fatalf("Create returned error: %v", err)
+	}
+	other := connectFake(t, fs)
+	created := make(chan int)
+	go func() {
+		n := 0
+		for ; n < 100; n++ {
+			if _, err := other.Create("/race/child-", nil, FlagSequence, acl); err != nil {
+				if !errors.Is(err, ErrNoNode) {
+					t.Errorf("Create returned error: %v", err)
+				}
+				break
+			}
+		}
+		created <- n
+	}()
+	for {
+		children, _, err := conn.Children("/race")
+		if err != nil {
+			t.Fatalf("Children returned error: %v", err)
+		}
+		if len(children) >= 10 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := conn.DeleteRecursive("/race", -1); err != nil {
+		t.Fatalf("DeleteRecursive returned error: %v", err)
+	}
+	if n := <-created; n < 10 {
+		t.Fatalf("only %d children were created", n)
+	}
+	if ok, _, err := conn.Exists("/race"); err != nil || ok {
+		t.Fatalf("Exists returned %v, %v after DeleteRecursive", ok, err)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	ca, caKey := newTestCert(t, "ca", nil, nil)
+	serverCert, serverKey := newTestCert(t, "server", ca, caKey)
+	clientCert, clientKey := newTestCert(t, "client", ca, caKey)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{serverCert.Raw}, PrivateKey: serverKey}},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	fs := serveFake(t, l, nil)
+	fs.tree = newFakeTree()
+	defer fs.Close()
+
+	// Without a client certificate the handshake fails.
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	logger := &testLogger{}
+	if _, _, err := ConnectContext(ctx, []string{fs.Addr()}, 15*time.Second, WithLogInfo(false), WithLogger(logger),
+		WithTLSConfig(&tls.Config{RootCAs: pool})); err != context.DeadlineExceeded {
+		t.Fatalf("ConnectContext without a client certificate returned %v; want %v", err, context.DeadlineExceeded)
+	}
+	// With TLS 1.3 the server rejects the client after the client side of the
+	// handshake completed, so the error surfaces on the first read.
+	if events := logger.Reset(); len(events) == 0 || !strings.Contains(events[0], "certificate required") {
+		t.Fatalf("expected the rejected client certificate to be logged, got %q", events)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn := connectFake(t, fs, WithTLSConfig(&tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{clientCert.Raw}, PrivateKey: clientKey}},
+		RootCAs:      pool,
+	}))
+
+	if _, err := conn.Create("/tls", []byte("data"), 0, WorldACL(PermAll)); err != nil {
+		t.Fatalf("Create returned error: %v", err)
+	}
+
+	// The client redoes the TLS handshake when it reconnects.
+	fs.DropConns()
+	for fs.Connects() < 2 {
+		if ctx.Err() != nil {
+			t.Fatal("client did not reconnect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := conn.waitForState(ctx, func(s State) bool { return s == StateHasSession }); err != nil {
+		t.Fatalf("waiting for the session to be re-established: %v", err)
+	}
+	if data, _, err := conn.Get("/tls"); err != nil || string(data) != "data" {
+		t.Fatalf("Get returned %q, %v; want %q", data, err, "data")
+	}
+}
+
+// newTestCert creates a certificate for 127.0.0.1 signed by parent, or a
+// self-signed CA certificate if parent is nil.
+func newTestCert(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+	return cert, key
+}
+
+func TestCloseGracefully(t *testing.T) {
+	release := make(chan struct{})
+	fs := newFakeServer(t, func(opcode int32, body []byte) (interface{}, ErrCode) {
+		switch opcode {
+		case opSetData:
+			time.Sleep(20 * time.Millisecond)
+			return &setDataResponse{}, 0
+		case opSync:
+			<-release
+			return &syncResponse{}, 0
+		}
+		return nil, errUnimplemented
+	})
+	defer fs.Close()
+	defer close(release)
+
+	conn := connectFake(t, fs)
+	var sets []<-chan SetResponse
+	for i := 0; i < 5; i++ {
+		sets = append(sets, conn.SetAsync("/a", nil, -1))
+	}
+	closed := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		closed <- conn.CloseGracefully(ctx)
+	}()
+	<-conn.draining
+	if _, err := conn.Set("/a", nil, -1); !errors.Is(err, ErrClosing) {
+		t.Fatalf("Set while closing returned %v; want %v", err, ErrClosing)
+	}
+	if err := <-closed; err != nil {
+		t.Fatalf("CloseGracefully returned error: %v", err)
+	}
+	for i, ch := range sets {
+		if res := <-ch; res.Err != nil {
+			t.Fatalf("Set %d returned error: %v", i, res.Err)
+		}
+	}
+
+	// Requests that are not answered in time fail once the connection is
+	// closed.
+	conn2 := connectFake(t, fs)
+	synced := make(chan error, 1)
+	go func() {
+		synced <- func() error { _, err := conn2.Sync("/a"); return err }()
+	}()
+	for conn2.pendingRequests() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := conn2.CloseGracefully(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("CloseGracefully returned %v; want %v", err, context.DeadlineExceeded)
+	}
+	if err := <-synced; err != ErrConnectionClosed {
+		t.Fatalf("Sync returned %v; want %v", err, ErrConnectionClosed)
+	}
+}
+
 func TestDeadlockInClose(t *testing.T) {
 	c := &Conn{
 		shouldQuit:     make(chan struct{}),
 		connectTimeout: 1 * time.Second,
 		sendChan:       make(chan *request, sendChanSize),
-		logger:         DefaultLogger,
+		logger:         printfLogger{DefaultLogger},
 	}
 
 	for i := 0; i < sendChanSize; i++ {
@@ -172,7 +2195,7 @@ func TestNotifyWatches(t *testing.T) {
 
 			var idx int
 			for wpt, expectEvent := range c.watches {
-				ch := conn.addWatcher(wpt.path, wpt.wType)
+				ch := conn.addWatcher(wpt.path, wpt.wType, false)
 				notifications[idx].path = wpt.path
 				notifications[idx].notify = expectEvent
 				notifications[idx].ch = ch
@@ -196,3 +2219,592 @@ func TestNotifyWatches(t *testing.T) {
 		})
 	}
 }
+
+func TestMaxPendingRequests(t *testing.T) {
+	release := make(chan struct{})
+	fs := newFakeServer(t, func(opcode int32, body []byte) (interface{}, ErrCode) {
+		switch opcode {
+		case opSync:
+			<-release
+			return &syncResponse{}, 0
+		case opGetData:
+			return &getDataResponse{}, 0
+		}
+		return nil, errUnimplemented
+	})
+	defer fs.Close()
+
+	conn := connectFake(t, fs, WithMaxPendingRequests(2))
+	sync := func(conn *Conn) <-chan error {
+		synced := make(chan error, 1)
+		go func() {
+			_, err := conn.Sync("/a")
+			synced <- err
+		}()
+		for conn.pendingRequests() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		return synced
+	}
+	synced := sync(conn)
+	got := conn.GetAsync("/a")
+	third := make(chan error, 1)
+	go func() {
+		_, _, err := conn.Get("/a")
+		third <- err
+	}()
+	select {
+	case err := <-third:
+		t.Fatalf("third request returned %v while two were pending; want it to block", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, _, err := conn.GetCtx(ctx, "/a"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("GetCtx while two requests were pending returned %v; want %v", err, context.DeadlineExceeded)
+	}
+
+	release <- struct{}{}
+	if err := <-synced; err != nil {
+		t.Fatalf("Sync returned error: %v", err)
+	}
+	if res := <-got; res.Err != nil {
+		t.Fatalf("Get returned error: %v", res.Err)
+	}
+	if err := <-third; err != nil {
+		t.Fatalf("third request returned error: %v", err)
+	}
+	if n := len(conn.pendingSlots); n != 0 {
+		t.Fatalf("%d slots held after all requests completed; want 0", n)
+	}
+
+	failFast := connectFake(t, fs, WithMaxPendingRequests(1), WithPendingRequestsFailFast())
+	synced = sync(failFast)
+	if _, _, err := failFast.Get("/a"); !errors.Is(err, ErrTooManyRequests) {
+		t.Fatalf("Get while a request was pending returned %v; want %v", err, ErrTooManyRequests)
+	}
+	release <- struct{}{}
+	if err := <-synced; err != nil {
+		t.Fatalf("Sync returned error: %v", err)
+	}
+	if _, _, err := failFast.Get("/a"); err != nil {
+		t.Fatalf("Get after the pending request completed returned error: %v", err)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	stall := make(chan struct{})
+	var stalled int32
+	fs := newFakeServer(t, func(opcode int32, body []byte) (interface{}, ErrCode) {
+		if opcode != opGetData {
+			return nil, errUnimplemented
+		}
+		if atomic.AddInt32(&stalled, 1) == 1 {
+			<-stall
+		}
+		return &getDataResponse{Data: []byte("data")}, 0
+	})
+	defer fs.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn := connectFake(t, fs, WithRequestTimeout(50*time.Millisecond))
+
+	// The timeout is the client's, so the error is not an *OperationError.
+	start := time.Now()
+	if _, _, err := conn.Get("/a"); err != ErrRequestTimeout {
+		t.Fatalf("Get on a stalled server returned %v; want %v", err, ErrRequestTimeout)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Get on a stalled server returned after %v; want about 50ms", d)
+	}
+	if n := conn.pendingRequests(); n != 0 {
+		t.Fatalf("%d requests pending after the timeout; want 0", n)
+	}
+
+	// The context deadline takes the place of the default timeout.
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, _, err := conn.GetCtx(ctx, "/a"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("GetCtx with a deadline returned %v; want %v", err, context.DeadlineExceeded)
+	}
+
+	close(stall)
+	data, _, err := conn.Get("/a")
+	if err != nil {
+		t.Fatalf("Get after the server recovered returned error: %v", err)
+	}
+	if string(data) != "data" {
+		t.Fatalf("Get returned %q; want %q", data, "data")
+	}
+	if s := conn.State(); s != StateHasSession {
+		t.Fatalf("state is %v after the timeout; want %v", s, StateHasSession)
+	}
+	if n := fs.Connects(); n != 1 {
+		t.Fatalf("client connected %d times; want 1", n)
+	}
+}
+
+func TestRequestTimeoutLateResponse(t *testing.T) {
+	// The responses arrive around the time the requests time out, so the
+	// recv loop is often decoding one while the caller gives up on it. Run
+	// with -race.
+	const timeout = 10 * time.Millisecond
+	var n int32
+	fs := newFakeServer(t, func(opcode int32, body []byte) (interface{}, ErrCode) {
+		i := atomic.AddInt32(&n, 1)
+		time.Sleep(timeout - time.Millisecond + time.Duration(i%5)*time.Millisecond/2)
+		stat := Stat{Version: 1, DataLength: 4}
+		switch opcode {
+		case opGetData:
+			return &getDataResponse{Data: []byte("data"), Stat: stat}, 0
+		case opGetChildren2:
+			return &getChildren2Response{Children: []string{"a"}, Stat: stat}, 0
+		case opExists:
+			return &existsResponse{Stat: stat}, 0
+		case opSetData:
+			return &setDataResponse{Stat: stat}, 0
+		case opCreate:
+			return &createResponse{Path: "/a"}, 0
+		}
+		return nil, errUnimplemented
+	})
+	defer fs.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn := connectFake(t, fs, WithRequestTimeout(timeout))
+
+	read := func(op string, err error, results ...interface{}) {
+		t.Helper()
+		if err == nil {
+			return
+		}
+		if err != ErrRequestTimeout {
+			t.Fatalf("%s returned %v; want nil or %v", op, err, ErrRequestTimeout)
+		}
+		for _, r := range results {
+			if !reflect.ValueOf(r).IsNil() {
+				t.Fatalf("%s timed out, but returned %v", op, r)
+			}
+		}
+	}
+	write := func(op string, err error, result interface{}) {
+		t.Helper()
+		if err == nil {
+			return
+		}
+		if !errors.Is(err, ErrRequestTimeout) || !strings.Contains(err.Error(), "may have been applied") {
+			t.Fatalf("%s returned %v; want nil or %v, saying it may have been applied", op, err, ErrRequestTimeout)
+		}
+		if result != nil && !reflect.ValueOf(result).IsNil() {
+			t.Fatalf("%s timed out, but returned %v", op, result)
+		}
+	}
+	timedOut := false
+	for i := 0; i < 20 || !timedOut && ctx.Err() == nil; i++ {
+		data, stat, err := conn.Get("/a")
+		read("Get", err, data, stat)
+		timedOut = timedOut || err != nil
+		children, stat, err := conn.Children("/a")
+		read("Children", err, children, stat)
+		_, stat, err = conn.Exists("/a")
+		read("Exists", err, stat)
+		stat, err = conn.Set("/a", []byte("data"), -1)
+		write("Set", err, stat)
+		path, err := conn.Create("/a", nil, 0, WorldACL(PermAll))
+		if err != nil && path != "" {
+			t.Fatalf("Create timed out, but returned %q", path)
+		}
+		write("Create", err, nil)
+	}
+	if !timedOut {
+		t.Fatal("no request timed out")
+	}
+}
+
+func TestEventString(t *testing.T) {
+	tests := []struct {
+		ev    Event
+		want  string
+		watch bool
+	}{
+		{
+			Event{Type: EventNodeDataChanged, State: StateHasSession, Path: "/foo"},
+			"Event{Type:EventNodeDataChanged State:StateHasSession Path:/foo}",
+			true,
+		},
+		{
+			Event{Type: EventSession, State: StateConnected, Server: "127.0.0.1:2181"},
+			"Event{Type:EventSession State:StateConnected Server:127.0.0.1:2181}",
+			false,
+		},
+		{
+			Event{Type: EventNotWatching, State: StateDisconnected, Path: "/foo", Err: ErrSessionExpired},
+			"Event{Type:EventNotWatching State:StateDisconnected Path:/foo Err:zk: session has been expired by the server}",
+			true,
+		},
+		{
+			Event{Type: EventType(42), State: State(42)},
+			"Event{Type:Unknown State:Unknown}",
+			true,
+		},
+	}
+	for _, tt := range tests {
+		if got := fmt.Sprint(tt.ev); got != tt.want {
+			t.Errorf("Event formatted as %q; want %q", got, tt.want)
+		}
+		if got := tt.ev.IsWatchEvent(); got != tt.watch {
+			t.Errorf("%v.IsWatchEvent() = %v; want %v", tt.ev, got, tt.watch)
+		}
+		if got := tt.ev.IsStateEvent(); got == tt.watch {
+			t.Errorf("%v.IsStateEvent() = %v; want %v", tt.ev, got, !tt.watch)
+		}
+	}
+}
+
+func TestAddAuthReplay(t *testing.T) {
+	var mu sync.Mutex
+	var auths []setAuthRequest
+	reject := false
+	fs := newFakeServer(t, func(opcode int32, body []byte) (interface{}, ErrCode) {
+		if opcode != opSetAuth {
+			return nil, errUnimplemented
+		}
+		req := setAuthRequest{}
+		if _, err := decodePacket(body, &req); err != nil {
+			return nil, errMarshallingError
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		auths = append(auths, req)
+		if reject {
+			return nil, errAuthFailed
+		}
+		return &setAuthResponse{}, 0
+	})
+	defer fs.Close()
+	setAuths := func() []setAuthRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]setAuthRequest(nil), auths...)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, events, err := ConnectContext(ctx, []string{fs.Addr()}, 15*time.Second, WithLogInfo(false))
+	if err != nil {
+		t.Fatalf("ConnectContext returned error: %v", err)
+	}
+	defer conn.Close()
+	if err := conn.AddAuth("digest", []byte("user:secret")); err != nil {
+		t.Fatalf("AddAuth returned error: %v", err)
+	}
+
+	fs.DropConns()
+	for len(setAuths()) < 2 {
+		if ctx.Err() != nil {
+			t.Fatal("client did not resend the credentials after reconnecting")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := setAuths()[1]; got.Scheme != "digest" || string(got.Auth) != "user:secret" {
+		t.Fatalf("client resent %s %q; want digest %q", got.Scheme, got.Auth, "user:secret")
+	}
+
+	// Drain the events so far, so the state is seen as it changes.
+	for len(events) > 0 {
+		<-events
+	}
+	mu.Lock()
+	reject = true
+	mu.Unlock()
+	fs.DropConns()
+	for {
+		select {
+		case ev := <-events:
+			if ev.State == StateAuthFailed {
+				return
+			}
+		case <-ctx.Done():
+			t.Fatal("no StateAuthFailed event after the server rejected the credentials")
+		}
+	}
+}
+
+func TestSyncAndGet(t *testing.T) {
+	fs := newFakeTreeServer(t)
+	defer fs.Close()
+
+	conn := connectFake(t, fs)
+
+	if _, err := conn.Create("/a", []byte("data"), 0, WorldACL(PermAll)); err != nil {
+		t.Fatalf("Create returned error: %v", err)
+	}
+	path, err := conn.Sync("/a")
+	if err != nil {
+		t.Fatalf("Sync returned error: %v", err)
+	}
+	if path != "/a" {
+		t.Fatalf("Sync returned the path %q; want %q", path, "/a")
+	}
+
+	data, stat, err := conn.SyncAndGet("/a")
+	if err != nil {
+		t.Fatalf("SyncAndGet returned error: %v", err)
+	}
+	if string(data) != "data" || stat.DataLength != 4 {
+		t.Fatalf("SyncAndGet returned %q, %+v; want %q", data, stat, "data")
+	}
+	if _, _, err := conn.SyncAndGet("/b"); !errors.Is(err, ErrNoNode) {
+		t.Fatalf("SyncAndGet of a missing znode returned %v; want %v", err, ErrNoNode)
+	}
+	if _, _, err := conn.SyncAndGet("b"); !errors.Is(err, ErrInvalidPath) {
+		t.Fatalf("SyncAndGet of an invalid path returned %v; want %v", err, ErrInvalidPath)
+	}
+}
+
+func TestLastZxid(t *testing.T) {
+	fs := newFakeTreeServer(t)
+	defer fs.Close()
+
+	conn := connectFake(t, fs)
+
+	before := conn.LastZxid()
+	if _, err := conn.Create("/a", nil, 0, WorldACL(PermAll)); err != nil {
+		t.Fatalf("Create returned error: %v", err)
+	}
+	created := conn.LastZxid()
+	if created <= before {
+		t.Fatalf("LastZxid is %d after Create; want more than %d", created, before)
+	}
+	stat, err := conn.Set("/a", []byte("data"), -1)
+	if err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if got := conn.LastZxid(); got <= created || got < stat.Mzxid {
+		t.Fatalf("LastZxid is %d after Set; want more than %d and at least %d", got, created, stat.Mzxid)
+	}
+}
+
+func TestSessionMovedReconnects(t *testing.T) {
+	var moved int32 = 1
+	fs := newFakeServer(t, func(opcode int32, body []byte) (interface{}, ErrCode) {
+		if opcode != opGetData {
+			return nil, errUnimplemented
+		}
+		if atomic.CompareAndSwapInt32(&moved, 1, 0) {
+			return nil, errSessionMoved
+		}
+		return &getDataResponse{Data: []byte("data")}, 0
+	})
+	defer fs.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn := connectFake(t, fs)
+
+	if _, _, err := conn.Get("/a"); !errors.Is(err, ErrSessionMoved) {
+		t.Fatalf("Get on a server that lost the session returned %v; want %v", err, ErrSessionMoved)
+	}
+	for fs.Connects() < 2 {
+		select {
+		case <-ctx.Done():
+			t.Fatal("client did not reconnect after the session moved")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if data, _, err := conn.Get("/a"); err != nil || string(data) != "data" {
+		t.Fatalf("Get after reconnecting returned %q, %v; want %q", data, err, "data")
+	}
+}
+
+func TestPing(t *testing.T) {
+	fs := newFakeServer(t, func(opcode int32, body []byte) (interface{}, ErrCode) {
+		if opcode == opExists {
+			return &existsResponse{}, 0
+		}
+		return nil, errUnimplemented
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn := connectFake(t, fs)
+
+	if err := conn.Ping(ctx); err != nil {
+		t.Fatalf("Ping while connected returned error: %v", err)
+	}
+
+	// Once the server is gone, Ping fails right away.
+	fs.Close()
+	for conn.State() == StateHasSession {
+		select {
+		case <-ctx.Done():
+			t.Fatal("client did not notice the server was gone")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	start := time.Now()
+	if err := conn.Ping(ctx); err != ErrConnectionClosed {
+		t.Fatalf("Ping while disconnected returned %v; want %v", err, ErrConnectionClosed)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Ping while disconnected returned after %v", d)
+	}
+
+	conn.Close()
+	if err := conn.Ping(ctx); !errors.Is(err, ErrClosing) {
+		t.Fatalf("Ping after Close returned %v; want %v", err, ErrClosing)
+	}
+}
+
+func TestAddAuthBeforeConnected(t *testing.T) {
+	var mu sync.Mutex
+	var auths []string
+	fs := newFakeServer(t, func(opcode int32, body []byte) (interface{}, ErrCode) {
+		if opcode != opSetAuth {
+			return nil, errUnimplemented
+		}
+		req := setAuthRequest{}
+		if _, err := decodePacket(body, &req); err != nil {
+			return nil, errMarshallingError
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		auths = append(auths, string(req.Auth))
+		return &setAuthResponse{}, 0
+	})
+	defer fs.Close()
+	setAuths := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return fmt.Sprint(auths)
+	}
+
+	// The server can't be reached until up is closed.
+	up := make(chan struct{})
+	dialer := func(network, address string, timeout time.Duration) (net.Conn, error) {
+		<-up
+		return net.DialTimeout(network, address, timeout)
+	}
+	conn, _, err := Connect([]string{fs.Addr()}, 15*time.Second, WithLogInfo(false), WithDialer(dialer))
+	if err != nil {
+		t.Fatalf("Connect returned error: %v", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := conn.AddAuthCtx(ctx, "digest", []byte("user:late")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("AddAuthCtx while disconnected returned %v; want %v", err, context.DeadlineExceeded)
+	}
+
+	added := make(chan error, 1)
+	go func() { added <- conn.AddAuth("digest", []byte("user:secret")) }()
+	select {
+	case err := <-added:
+		t.Fatalf("AddAuth returned %v before the client connected", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(up)
+	select {
+	case err := <-added:
+		if err != nil {
+			t.Fatalf("AddAuth returned error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("AddAuth did not return once the client connected")
+	}
+	if got, want := setAuths(), "[user:secret]"; got != want {
+		t.Fatalf("server got the auths %s; want %s", got, want)
+	}
+
+	// Only the config that was accepted is sent again.
+	fs.DropConns()
+	deadline := time.Now().Add(5 * time.Second)
+	for setAuths() == "[user:secret]" {
+		if time.Now().After(deadline) {
+			t.Fatal("client did not resend the credentials after reconnecting")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got, want := setAuths(), "[user:secret user:secret]"; got != want {
+		t.Fatalf("server got the auths %s; want %s", got, want)
+	}
+}
+
+func TestAutoResetWatchesDisabled(t *testing.T) {
+	var resets int32
+	fs := newFakeServer(t, func(opcode int32, body []byte) (interface{}, ErrCode) {
+		switch opcode {
+		case opGetData:
+			return &getDataResponse{}, 0
+		case opAddWatch:
+			return &addWatchResponse{}, 0
+		case opSetWatches, opSetWatches2:
+			atomic.AddInt32(&resets, 1)
+			return &setWatchesResponse{}, 0
+		}
+		return nil, errUnimplemented
+	})
+	defer fs.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, events, err := ConnectContext(ctx, []string{fs.Addr()}, 15*time.Second, WithLogInfo(false),
+		WithReconnectBackoff(time.Millisecond, time.Millisecond, 1), WithAutoResetWatches(false), WithEventChannelSize(32))
+	if err != nil {
+		t.Fatalf("ConnectContext returned error: %v", err)
+	}
+	defer conn.Close()
+
+	_, _, watch, err := conn.GetW("/a")
+	if err != nil {
+		t.Fatalf("GetW returned error: %v", err)
+	}
+	persistent, err := conn.AddWatch("/b", AddWatchModePersistent)
+	if err != nil {
+		t.Fatalf("AddWatch returned error: %v", err)
+	}
+
+	fs.DropConns()
+	for _, ch := range []<-chan Event{watch, persistent} {
+		select {
+		case ev := <-ch:
+			if ev.Type != EventNotWatching || ev.Err != ErrWatchesNotReset {
+				t.Fatalf("watch got %v; want %v with %v", ev, EventNotWatching, ErrWatchesNotReset)
+			}
+		case <-ctx.Done():
+			t.Fatal("watch was not dropped after reconnecting")
+		}
+		if _, ok := <-ch; ok {
+			t.Fatal("watch channel not closed after the watch was dropped")
+		}
+	}
+	for {
+		ev := <-events
+		if ev.Type == EventNotWatching {
+			if ev.Path != "" || ev.Err != ErrWatchesNotReset {
+				t.Fatalf("got %v for the dropped watches; want one without path, with %v", ev, ErrWatchesNotReset)
+			}
+			break
+		}
+	}
+
+	// Requests are sent in order, so any setWatches would be answered
+	// before this Get.
+	time.Sleep(50 * time.Millisecond)
+	if _, _, err := conn.Get("/a"); err != nil {
+		t.Fatalf("Get returned error: %v", err)
+	}
+	if n := atomic.LoadInt32(&resets); n != 0 {
+		t.Fatalf("client sent %d requests to reset watches; want none", n)
+	}
+	select {
+	case ev := <-events:
+		if ev.Type == EventNotWatching {
+			t.Fatalf("got another event %v for the dropped watches", ev)
+		}
+	default:
+	}
+}
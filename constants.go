@@ -3,6 +3,8 @@ package zk
 import (
 	"errors"
 	"fmt"
+	"reflect"
+	"time"
 )
 
 const (
@@ -27,12 +29,21 @@ const (
 	opCheck           = 13
 	opMulti           = 14
 	opReconfig        = 16
+	opRemoveWatches   = 18
 	opCreateContainer = 19
 	opCreateTTL       = 21
+	opMultiRead       = 22
 	opClose           = -11
 	opSetAuth         = 100
 	opSetWatches      = 101
-	opError           = -1
+	opSasl            = 102
+	// opGetEphemerals and opGetAllChildrenNumber are only supported by ZooKeeper 3.6+.
+	opGetEphemerals        = 103
+	opGetAllChildrenNumber = 104
+	opSetWatches2          = 105
+	opAddWatch             = 106
+	opWhoAmI               = 107
+	opError                = -1
 	// Not in protocol, used internally
 	opWatcherEvent = -2
 )
@@ -79,8 +90,15 @@ const (
 	FlagEphemeral = 1
 	FlagSequence  = 2
 	FlagTTL       = 4
+	// FlagContainer means the node is a container, which the server deletes
+	// once its last child is deleted. It has the same value as FlagTTL, as
+	// containers and TTL nodes are created with distinct requests.
+	FlagContainer = 4
 )
 
+// MaxTTL is the longest TTL of a TTL node supported by the server.
+const MaxTTL = 0xffffffffff * time.Millisecond
+
 var (
 	stateNames = map[State]string{
 		StateUnknown:           "StateUnknown",
@@ -113,6 +131,7 @@ var (
 	// ErrConnectionClosed means the connection has been closed.
 	ErrConnectionClosed        = errors.New("zk: connection closed")
 	ErrUnknown                 = errors.New("zk: unknown error")
+	ErrUnimplemented           = errors.New("zk: operation is not implemented by the server")
 	ErrAPIError                = errors.New("zk: api error")
 	ErrNoNode                  = errors.New("zk: node does not exist")
 	ErrNoAuth                  = errors.New("zk: not authenticated")
@@ -123,13 +142,46 @@ var (
 	ErrSessionExpired          = errors.New("zk: session has been expired by the server")
 	ErrInvalidACL              = errors.New("zk: invalid ACL specified")
 	ErrInvalidFlags            = errors.New("zk: invalid flags specified")
+	ErrInvalidTTL              = errors.New("zk: TTL must be between 1ms and MaxTTL")
 	ErrAuthFailed              = errors.New("zk: client authentication failed")
 	ErrClosing                 = errors.New("zk: zookeeper is closing")
 	ErrNothing                 = errors.New("zk: no server responses to process")
+	// ErrSessionMoved means the server no longer owns the session, because
+	// the client has reconnected to another server meanwhile, e.g. when an
+	// old connection lingers. The server ignored the request. The client
+	// drops the connection and reconnects; the other requests sent on it fail
+	// with ErrConnectionClosed, and non-idempotent ones, such as sequential
+	// creates, may or may not have been applied.
 	ErrSessionMoved            = errors.New("zk: session moved to another server, so operation is ignored")
+	ErrNotReadOnlyOp           = errors.New("zk: write operation on a read-only connection")
+	ErrTooManyRequests         = errors.New("zk: too many pending requests")
+	ErrRateLimited             = errors.New("zk: request rate limit exceeded")
 	ErrReconfigDisabled        = errors.New("attempts to perform a reconfiguration operation when reconfiguration feature is disabled")
 	ErrBadArguments            = errors.New("invalid arguments")
-	// ErrInvalidCallback         = errors.New("zk: invalid callback specified")
+	ErrNewConfigNoQuorum       = errors.New("zk: no quorum of new config is connected and up-to-date with the leader of last committed config")
+	ErrNoWatcher               = errors.New("zk: no watcher for the given path and watcher type")
+	ErrInvalidCallback         = errors.New("zk: invalid callback specified")
+	ErrSystemError             = errors.New("zk: system error")
+	ErrRuntimeInconsistency    = errors.New("zk: runtime inconsistency found")
+	ErrDataInconsistency       = errors.New("zk: data inconsistency found")
+	ErrConnectionLoss          = errors.New("zk: connection to the server has been lost")
+	ErrMarshallingError        = errors.New("zk: error while marshalling or unmarshalling data")
+	ErrOperationTimeout        = errors.New("zk: operation timeout")
+	ErrInvalidState            = errors.New("zk: invalid state")
+	ErrUnknownSession          = errors.New("zk: unknown session")
+	ErrReconfigInProgress      = errors.New("zk: another reconfiguration is in progress")
+	ErrEphemeralOnLocalSession = errors.New("zk: ephemeral nodes may not be created by a local session")
+	ErrQuotaExceeded           = errors.New("zk: quota exceeded")
+	ErrThrottled               = errors.New("zk: operation was throttled by the server")
+	// ErrRequestTimeout means the client gave up waiting for the response,
+	// see WithRequestTimeout.
+	ErrRequestTimeout = errors.New("zk: request not completed within the max allowed time")
+	// ErrServerRequestTimeout means the server did not complete the request
+	// within the max allowed time.
+	ErrServerRequestTimeout = errors.New("zk: server did not complete the request within the max allowed time")
+	// ErrSessionClosedRequireSASLAuth means the server closed the session
+	// because SASL authentication is required.
+	ErrSessionClosedRequireSASLAuth = errors.New("zk: session closed because the client failed to authenticate with SASL")
 
 	errCodeToError = map[ErrCode]error{
 		0:                          nil,
@@ -141,14 +193,34 @@ var (
 		errNodeExists:              ErrNodeExists,
 		errNotEmpty:                ErrNotEmpty,
 		errSessionExpired:          ErrSessionExpired,
-		// errInvalidCallback:         ErrInvalidCallback,
-		errInvalidAcl:        ErrInvalidACL,
-		errAuthFailed:        ErrAuthFailed,
-		errClosing:           ErrClosing,
-		errNothing:           ErrNothing,
-		errSessionMoved:      ErrSessionMoved,
-		errZReconfigDisabled: ErrReconfigDisabled,
-		errBadArguments:      ErrBadArguments,
+		errInvalidCallback:         ErrInvalidCallback,
+		errInvalidAcl:              ErrInvalidACL,
+		errAuthFailed:              ErrAuthFailed,
+		errClosing:                 ErrClosing,
+		errNothing:                 ErrNothing,
+		errSessionMoved:            ErrSessionMoved,
+		errNotReadOnly:             ErrNotReadOnlyOp,
+		errZReconfigDisabled:       ErrReconfigDisabled,
+		errUnimplemented:           ErrUnimplemented,
+		errBadArguments:            ErrBadArguments,
+		errNewConfigNoQuorum:       ErrNewConfigNoQuorum,
+		errNoWatcher:               ErrNoWatcher,
+
+		errSystemError:             ErrSystemError,
+		errRuntimeInconsistency:    ErrRuntimeInconsistency,
+		errDataInconsistency:       ErrDataInconsistency,
+		errConnectionLoss:          ErrConnectionLoss,
+		errMarshallingError:        ErrMarshallingError,
+		errOperationTimeout:        ErrOperationTimeout,
+		errInvalidState:            ErrInvalidState,
+		errUnknownSession:          ErrUnknownSession,
+		errReconfigInProgress:      ErrReconfigInProgress,
+		errEphemeralOnLocalSession: ErrEphemeralOnLocalSession,
+		errRequestTimeout:          ErrServerRequestTimeout,
+		errQuotaExceeded:           ErrQuotaExceeded,
+		errThrottledOp:             ErrThrottled,
+
+		errSessionClosedRequireSASLAuth: ErrSessionClosedRequireSASLAuth,
 	}
 )
 
@@ -159,6 +231,50 @@ func (e ErrCode) toError() error {
 	return fmt.Errorf("unknown error: %v", e)
 }
 
+// OperationError is returned by the methods of Conn when the server fails a
+// request. It records the operation and path that caused Err, one of the
+// exported sentinel errors, so use errors.Is to check for a specific one:
+// comparing the error with a sentinel using == does not match.
+type OperationError struct {
+	Op   string // name of the operation, e.g. "create"
+	Path string // path of the znode, if the operation has one
+	Code ErrCode
+	Err  error
+}
+
+func (e *OperationError) Error() string {
+	if e.Path == "" {
+		return e.Op + ": " + e.Err.Error()
+	}
+	return e.Op + " " + e.Path + ": " + e.Err.Error()
+}
+
+// Unwrap returns the sentinel error of the code.
+func (e *OperationError) Unwrap() error {
+	return e.Err
+}
+
+// wrapServerError returns the error the server replied to req with, as an
+// *OperationError. Only codes found in the header of a reply are wrapped;
+// errors of the client, such as ErrConnectionClosed or a request timing out,
+// are returned as they are.
+func wrapServerError(opcode int32, req interface{}, code ErrCode) error {
+	return &OperationError{Op: opNames[opcode], Path: requestPath(req), Code: code, Err: code.toError()}
+}
+
+// requestPath returns the Path field of a request struct, or "" if it has
+// none.
+func requestPath(req interface{}) string {
+	v := reflect.Indirect(reflect.ValueOf(req))
+	if v.Kind() != reflect.Struct {
+		return ""
+	}
+	if f := v.FieldByName("Path"); f.IsValid() && f.Kind() == reflect.String {
+		return f.String()
+	}
+	return ""
+}
+
 const (
 	errOk = 0
 	// System and server-side errors
@@ -171,6 +287,9 @@ const (
 	errOperationTimeout     = -7
 	errBadArguments         = -8
 	errInvalidState         = -9
+	errUnknownSession       = -12
+	errNewConfigNoQuorum    = -13
+	errReconfigInProgress   = -14
 	// API errors
 	errAPIError                ErrCode = -100
 	errNoNode                  ErrCode = -101 // *
@@ -186,8 +305,16 @@ const (
 	errClosing                 ErrCode = -116
 	errNothing                 ErrCode = -117
 	errSessionMoved            ErrCode = -118
+	errNotReadOnly             ErrCode = -119
+	errEphemeralOnLocalSession ErrCode = -120
+	errNoWatcher               ErrCode = -121
+	errRequestTimeout          ErrCode = -122
 	// Attempts to perform a reconfiguration operation when reconfiguration feature is disabled
 	errZReconfigDisabled ErrCode = -123
+	// The session was closed because SASL authentication is required
+	errSessionClosedRequireSASLAuth ErrCode = -124
+	errQuotaExceeded                ErrCode = -125
+	errThrottledOp                  ErrCode = -127
 )
 
 // Constants for ACL permissions
@@ -204,26 +331,34 @@ const (
 var (
 	emptyPassword = []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
 	opNames       = map[int32]string{
-		opNotify:          "notify",
-		opCreate:          "create",
-		opCreateContainer: "createContainer",
-		opCreateTTL:       "createTTL",
-		opDelete:          "delete",
-		opExists:          "exists",
-		opGetData:         "getData",
-		opSetData:         "setData",
-		opGetAcl:          "getACL",
-		opSetAcl:          "setACL",
-		opGetChildren:     "getChildren",
-		opSync:            "sync",
-		opPing:            "ping",
-		opGetChildren2:    "getChildren2",
-		opCheck:           "check",
-		opMulti:           "multi",
-		opReconfig:        "reconfig",
-		opClose:           "close",
-		opSetAuth:         "setAuth",
-		opSetWatches:      "setWatches",
+		opNotify:               "notify",
+		opCreate:               "create",
+		opCreateContainer:      "createContainer",
+		opCreateTTL:            "createTTL",
+		opDelete:               "delete",
+		opExists:               "exists",
+		opGetData:              "getData",
+		opSetData:              "setData",
+		opGetAcl:               "getACL",
+		opSetAcl:               "setACL",
+		opGetChildren:          "getChildren",
+		opSync:                 "sync",
+		opPing:                 "ping",
+		opGetChildren2:         "getChildren2",
+		opCheck:                "check",
+		opMulti:                "multi",
+		opMultiRead:            "multiRead",
+		opReconfig:             "reconfig",
+		opRemoveWatches:        "removeWatches",
+		opClose:                "close",
+		opSetAuth:              "setAuth",
+		opSetWatches:           "setWatches",
+		opSasl:                 "sasl",
+		opGetEphemerals:        "getEphemerals",
+		opGetAllChildrenNumber: "getAllChildrenNumber",
+		opSetWatches2:          "setWatches2",
+		opAddWatch:             "addWatch",
+		opWhoAmI:               "whoAmI",
 
 		opWatcherEvent: "watcherEvent",
 	}
@@ -239,7 +374,7 @@ func (t EventType) String() string {
 	return "Unknown"
 }
 
-// Mode is used to build custom server modes (leader|follower|standalone).
+// Mode is used to build custom server modes (leader|follower|standalone|observer).
 type Mode uint8
 
 func (m Mode) String() string {
@@ -254,6 +389,7 @@ const (
 	ModeLeader     Mode = iota
 	ModeFollower   Mode = iota
 	ModeStandalone Mode = iota
+	ModeObserver   Mode = iota
 )
 
 var (
@@ -261,5 +397,38 @@ var (
 		ModeLeader:     "leader",
 		ModeFollower:   "follower",
 		ModeStandalone: "standalone",
+		ModeObserver:   "observer",
 	}
 )
+
+// AddWatchMode is the mode of a watch added with AddWatch.
+type AddWatchMode int32
+
+const (
+	// AddWatchModePersistent sets a watch on a znode that is not removed
+	// when it is triggered. It fires for data and children changes of the
+	// znode, and for its creation and deletion.
+	AddWatchModePersistent AddWatchMode = 0
+	// AddWatchModePersistentRecursive sets a persistent watch on a znode and
+	// all of its descendants. It fires for data changes, creation and deletion
+	// of any of these znodes, but not for children changes. The Path of the
+	// events is the znode that changed.
+	AddWatchModePersistentRecursive AddWatchMode = 1
+)
+
+// WatcherType selects the watches removed by RemoveWatches.
+type WatcherType int32
+
+const (
+	// WatcherTypeChildren selects watches set by ChildrenW.
+	WatcherTypeChildren WatcherType = 1
+	// WatcherTypeData selects watches set by GetW and ExistsW.
+	WatcherTypeData WatcherType = 2
+	// WatcherTypeAny selects all watches.
+	WatcherTypeAny WatcherType = 3
+	// WatcherTypePersistent selects watches added with AddWatchModePersistent.
+	WatcherTypePersistent WatcherType = 4
+	// WatcherTypePersistentRecursive selects watches added with
+	// AddWatchModePersistentRecursive.
+	WatcherTypePersistentRecursive WatcherType = 5
+)
@@ -1,6 +1,7 @@
 package zk
 
 import (
+	"errors"
 	"fmt"
 	"testing"
 )
@@ -22,3 +23,55 @@ func TestModeString(t *testing.T) {
 		t.Errorf("standlone value should be 'standalone'")
 	}
 }
+
+func TestErrCodeToError(t *testing.T) {
+	tests := []struct {
+		code ErrCode
+		want error
+	}{
+		{errOk, nil},
+		{errSystemError, ErrSystemError},
+		{errRuntimeInconsistency, ErrRuntimeInconsistency},
+		{errDataInconsistency, ErrDataInconsistency},
+		{errConnectionLoss, ErrConnectionLoss},
+		{errMarshallingError, ErrMarshallingError},
+		{errUnimplemented, ErrUnimplemented},
+		{errOperationTimeout, ErrOperationTimeout},
+		{errBadArguments, ErrBadArguments},
+		{errInvalidState, ErrInvalidState},
+		{errUnknownSession, ErrUnknownSession},
+		{errNewConfigNoQuorum, ErrNewConfigNoQuorum},
+		{errReconfigInProgress, ErrReconfigInProgress},
+		{errAPIError, ErrAPIError},
+		{errNoNode, ErrNoNode},
+		{errNoAuth, ErrNoAuth},
+		{errBadVersion, ErrBadVersion},
+		{errNoChildrenForEphemerals, ErrNoChildrenForEphemerals},
+		{errNodeExists, ErrNodeExists},
+		{errNotEmpty, ErrNotEmpty},
+		{errSessionExpired, ErrSessionExpired},
+		{errInvalidCallback, ErrInvalidCallback},
+		{errInvalidAcl, ErrInvalidACL},
+		{errAuthFailed, ErrAuthFailed},
+		{errClosing, ErrClosing},
+		{errNothing, ErrNothing},
+		{errSessionMoved, ErrSessionMoved},
+		{errNotReadOnly, ErrNotReadOnlyOp},
+		{errEphemeralOnLocalSession, ErrEphemeralOnLocalSession},
+		{errNoWatcher, ErrNoWatcher},
+		{errRequestTimeout, ErrServerRequestTimeout},
+		{errZReconfigDisabled, ErrReconfigDisabled},
+		{errSessionClosedRequireSASLAuth, ErrSessionClosedRequireSASLAuth},
+		{errQuotaExceeded, ErrQuotaExceeded},
+		{errThrottledOp, ErrThrottled},
+	}
+	for _, tt := range tests {
+		if err := tt.code.toError(); !errors.Is(err, tt.want) {
+			t.Errorf("ErrCode(%d).toError() = %v; want %v", tt.code, err, tt.want)
+		}
+	}
+
+	if err := ErrCode(-99999).toError(); err == nil || errors.Is(err, ErrUnknown) {
+		t.Errorf("unknown code returned %v; want an error mentioning the code", err)
+	}
+}
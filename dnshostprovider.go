@@ -2,46 +2,183 @@ package zk
 
 import (
 	"fmt"
+	"math/rand"
 	"net"
+	"sort"
 	"sync"
+	"time"
 )
 
+// inetAddress is a single resolved address of one of the hosts given in
+// the connection string.
+type inetAddress struct {
+	host     string // host name as given in the connection string
+	port     string
+	addr     string // resolved address/port handed out by Next
+	resolved bool   // false if addr must be looked up again before use
+}
+
 // DNSHostProvider is the default HostProvider. It currently matches
 // the Java StaticHostProvider, resolving hosts from DNS once during
-// the call to Init.  It could be easily extended to re-query DNS
-// periodically or if there is trouble connecting.
+// the call to Init. A host is looked up again the next time it is
+// handed out after ConnectFailed was called for its address, and all
+// hosts are looked up again periodically if a refresh interval is set.
 type DNSHostProvider struct {
 	mu         sync.Mutex // Protects everything, so we can add asynchronous updates later.
-	servers    []string
+	hosts      []string   // servers as passed to Init
+	gen        int        // incremented by every Init
+	servers    []inetAddress
 	curr       int
 	last       int
 	lookupHost func(string) ([]string, error) // Override of net.LookupHost, for testing.
+	rand       *rand.Rand                     // nil for the global source
+	ordered    bool                           // keep the servers in the given order
+	probe      func(addr string) error        // nil unless WithHealthProbe is set
+
+	statRole  func(addr string) (Mode, error) // nil unless WithPreferObservers is set
+	roleTTL   time.Duration
+	roles     map[string]serverRole // by address
+	connected bool                  // Connected was called since Next last handed out a server
+
+	refreshInterval time.Duration
+	refreshing      bool
+	closeOnce       sync.Once
+	stop            chan struct{}
+}
+
+// dnsHostProviderOption represents a DNSHostProvider option.
+type dnsHostProviderOption func(hp *DNSHostProvider)
+
+// WithRefreshInterval returns a DNSHostProvider option that looks up all
+// hosts again every interval, until Close is called. Addresses that are no
+// longer returned by DNS are dropped and new ones are added. If looking up a
+// host fails, its previously resolved addresses are kept.
+func WithRefreshInterval(interval time.Duration) dnsHostProviderOption {
+	return func(hp *DNSHostProvider) {
+		hp.refreshInterval = interval
+	}
+}
+
+// WithShuffleRand returns a DNSHostProvider option that shuffles the
+// addresses with r instead of the global source of math/rand. With a seeded
+// source, the order in which the servers are tried is the same on every run,
+// e.g. for tests. The provider uses r with its lock held, so r must not be
+// used elsewhere.
+func WithShuffleRand(r *rand.Rand) dnsHostProviderOption {
+	return func(hp *DNSHostProvider) {
+		hp.rand = r
+	}
+}
+
+// WithShuffle returns a DNSHostProvider option that sets whether the
+// addresses are shuffled, which they are by default to spread the clients
+// over the servers. Without shuffling, Next hands out the servers in the
+// order given to Init, and the addresses of each server in the order DNS
+// returned them, e.g. to prefer a nearby server or for deterministic failover
+// in tests. Addresses found by a later refresh are added at the end.
+func WithShuffle(shuffle bool) dnsHostProviderOption {
+	return func(hp *DNSHostProvider) {
+		hp.ordered = !shuffle
+	}
+}
+
+// WithHealthProbe returns a DNSHostProvider option that makes Next check that
+// a server accepts TCP connections within timeout before handing it out, and
+// skip it otherwise, so the client doesn't spend a whole connection attempt
+// on a server that is down. If no server passes, Next hands out the next one
+// anyway, with retryStart set once all servers were tried. The probes run
+// with the lock of the provider held, so Next may take up to timeout per
+// server. Probes dial the servers directly, so they are not suitable when
+// connecting through a proxy, see WithProxyDialer.
+func WithHealthProbe(timeout time.Duration) dnsHostProviderOption {
+	return func(hp *DNSHostProvider) {
+		hp.probe = func(addr string) error {
+			conn, err := net.DialTimeout("tcp", addr, timeout)
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		}
+	}
+}
+
+// WithPreferObservers returns a DNSHostProvider option that hands out
+// observers before the voting members of the ensemble, so read-heavy clients
+// keep the load off the followers and the leader. Next asks the servers for
+// their role with the stat command, see FLWStat, waiting up to timeout for
+// each, and caches the roles for ttl. The servers are then tried in order of
+// preference: observers first, then the other servers, then the ones that
+// couldn't tell their role. After losing a connection, Next starts over with
+// the first observer, so a client that failed over to a follower goes back to
+// an observer once it reconnects.
+//
+// Like WithHealthProbe, the lookups run with the lock of the provider held,
+// and need the servers to allow the stat command. Roles are not looked up by
+// default.
+func WithPreferObservers(ttl, timeout time.Duration) dnsHostProviderOption {
+	return func(hp *DNSHostProvider) {
+		hp.roleTTL = ttl
+		hp.statRole = func(addr string) (Mode, error) {
+			stats, _ := FLWStat([]string{addr}, timeout)
+			return stats[0].Mode, stats[0].Error
+		}
+	}
+}
+
+// serverRole is the cached role of a server, see WithPreferObservers.
+type serverRole struct {
+	mode    Mode
+	unknown bool // the server did not tell its role
+	at      time.Time
+}
+
+// rank returns the order of preference of the role, lowest first.
+func (r serverRole) rank() int {
+	switch {
+	case r.unknown:
+		return 2
+	case r.mode == ModeObserver:
+		return 0
+	default:
+		return 1
+	}
+}
+
+// NewDNSHostProvider creates a DNSHostProvider with the given options.
+// The zero value DNSHostProvider is also ready to use and resolves hosts
+// once during Init.
+func NewDNSHostProvider(options ...dnsHostProviderOption) *DNSHostProvider {
+	hp := &DNSHostProvider{}
+	for _, option := range options {
+		option(hp)
+	}
+	return hp
 }
 
 // Init is called first, with the servers specified in the connection
 // string. It uses DNS to look up addresses for each server, then
-// shuffles them all together.
+// shuffles them all together, unless WithShuffle(false) is set.
 func (hp *DNSHostProvider) Init(servers []string) error {
 	hp.mu.Lock()
 	defer hp.mu.Unlock()
 
-	lookupHost := hp.lookupHost
-	if lookupHost == nil {
-		lookupHost = net.LookupHost
-	}
-
-	found := []string{}
+	found := []inetAddress{}
 	for _, server := range servers {
 		host, port, err := net.SplitHostPort(server)
 		if err != nil {
 			return err
 		}
-		addrs, err := lookupHost(host)
+		addrs, err := hp.lookup(host)
 		if err != nil {
 			return err
 		}
 		for _, addr := range addrs {
-			found = append(found, net.JoinHostPort(addr, port))
+			found = append(found, inetAddress{
+				host:     host,
+				port:     port,
+				addr:     net.JoinHostPort(addr, port),
+				resolved: true,
+			})
 		}
 	}
 
@@ -50,15 +187,162 @@ func (hp *DNSHostProvider) Init(servers []string) error {
 	}
 
 	// Randomize the order of the servers to avoid creating hotspots
-	stringShuffle(found)
+	hp.shuffle(found)
 
+	hp.hosts = servers
+	hp.gen++
 	hp.servers = found
 	hp.curr = -1
 	hp.last = -1
 
+	if hp.refreshInterval > 0 && !hp.refreshing {
+		if hp.stop == nil {
+			hp.stop = make(chan struct{})
+		}
+		hp.refreshing = true
+		go hp.refreshLoop(hp.refreshInterval, hp.stop)
+	}
+
 	return nil
 }
 
+// Close stops the periodic refresh, if any. Conn calls it once the
+// connection is closed.
+func (hp *DNSHostProvider) Close() error {
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+	hp.closeOnce.Do(func() {
+		if hp.stop == nil {
+			hp.stop = make(chan struct{})
+		}
+		close(hp.stop)
+	})
+	return nil
+}
+
+func (hp *DNSHostProvider) refreshLoop(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			hp.refresh()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// refresh looks up all hosts again and swaps in the new set of addresses.
+// Addresses that are still valid keep their position, so the rotation in
+// Next is not disturbed more than necessary.
+func (hp *DNSHostProvider) refresh() {
+	hp.mu.Lock()
+	hosts, gen := hp.hosts, hp.gen
+	hp.mu.Unlock()
+
+	// Look the hosts up without holding the lock, so Next isn't blocked on DNS.
+	resolved := make(map[string]map[string]bool, len(hosts))
+	for _, server := range hosts {
+		host, port, err := net.SplitHostPort(server)
+		if err != nil {
+			continue
+		}
+		addrs, err := hp.lookup(host)
+		if err != nil || len(addrs) == 0 {
+			continue
+		}
+		set := make(map[string]bool, len(addrs))
+		for _, addr := range addrs {
+			set[net.JoinHostPort(addr, port)] = true
+		}
+		resolved[net.JoinHostPort(host, port)] = set
+	}
+
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+	if gen != hp.gen {
+		// Init was called with a new set of servers in the meantime.
+		return
+	}
+
+	servers := make([]inetAddress, 0, len(hp.servers))
+	seen := make(map[string]bool, len(hp.servers))
+	for _, a := range hp.servers {
+		if set, ok := resolved[net.JoinHostPort(a.host, a.port)]; ok {
+			if !set[a.addr] {
+				continue
+			}
+			a.resolved = true
+			delete(set, a.addr)
+		}
+		servers = append(servers, a)
+		seen[a.addr] = true
+	}
+	var added []inetAddress
+	for _, server := range hosts {
+		host, port, _ := net.SplitHostPort(server)
+		var addrs []string
+		for addr := range resolved[net.JoinHostPort(host, port)] {
+			addrs = append(addrs, addr)
+		}
+		sort.Strings(addrs)
+		for _, addr := range addrs {
+			if !seen[addr] {
+				added = append(added, inetAddress{host: host, port: port, addr: addr, resolved: true})
+				seen[addr] = true
+			}
+		}
+	}
+	hp.shuffle(added)
+	servers = append(servers, added...)
+	if len(servers) == 0 {
+		return
+	}
+
+	hp.curr = indexOfAddr(servers, hp.servers, hp.curr)
+	hp.last = indexOfAddr(servers, hp.servers, hp.last)
+	hp.servers = servers
+}
+
+// shuffle randomizes the order of addrs. They are sorted first, so the result
+// only depends on the source of randomness and not on the order in which the
+// addresses were given or found. With WithShuffle(false), addrs are left as
+// they are.
+func (hp *DNSHostProvider) shuffle(addrs []inetAddress) {
+	if hp.ordered {
+		return
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i].addr < addrs[j].addr })
+	swap := func(i, j int) { addrs[i], addrs[j] = addrs[j], addrs[i] }
+	if hp.rand != nil {
+		hp.rand.Shuffle(len(addrs), swap)
+	} else {
+		rand.Shuffle(len(addrs), swap)
+	}
+}
+
+// indexOfAddr returns the index in servers of the address found at index i
+// of old, or -1 if it is gone.
+func indexOfAddr(servers, old []inetAddress, i int) int {
+	if i < 0 || i >= len(old) {
+		return -1
+	}
+	for j, a := range servers {
+		if a.addr == old[i].addr {
+			return j
+		}
+	}
+	return -1
+}
+
+func (hp *DNSHostProvider) lookup(host string) ([]string, error) {
+	if hp.lookupHost != nil {
+		return hp.lookupHost(host)
+	}
+	return net.LookupHost(host)
+}
+
 // Len returns the number of servers available
 func (hp *DNSHostProvider) Len() int {
 	hp.mu.Lock()
@@ -72,12 +356,121 @@ func (hp *DNSHostProvider) Len() int {
 func (hp *DNSHostProvider) Next() (server string, retryStart bool) {
 	hp.mu.Lock()
 	defer hp.mu.Unlock()
-	hp.curr = (hp.curr + 1) % len(hp.servers)
-	retryStart = hp.curr == hp.last
+	if hp.statRole != nil {
+		hp.rankByRole()
+	}
+	first := (hp.curr + 1) % len(hp.servers)
+	if hp.connected && hp.roles[hp.servers[0].addr].rank() == 0 {
+		// Go back to the preferred observer, starting a new round there.
+		first, hp.last = 0, -1
+	}
+	hp.connected = false
+	for i := 0; i < len(hp.servers); i++ {
+		hp.curr = (first + i) % len(hp.servers)
+		if hp.curr == hp.last {
+			retryStart = true
+		}
+		if !hp.servers[hp.curr].resolved {
+			hp.resolve(hp.curr)
+		}
+		if hp.probe == nil || hp.probe(hp.servers[hp.curr].addr) == nil {
+			break
+		}
+		// Look the host up again the next time, as after ConnectFailed.
+		hp.servers[hp.curr].resolved = false
+		if i == len(hp.servers)-1 {
+			// All servers are down; hand out the first one anyway.
+			hp.curr = first
+		}
+	}
 	if hp.last == -1 {
 		hp.last = 0
 	}
-	return hp.servers[hp.curr], retryStart
+	return hp.servers[hp.curr].addr, retryStart
+}
+
+// rankByRole looks up the roles that are not cached, and orders the servers
+// by preference, see WithPreferObservers. Servers of the same rank keep their
+// order.
+func (hp *DNSHostProvider) rankByRole() {
+	if hp.roles == nil {
+		hp.roles = make(map[string]serverRole, len(hp.servers))
+	}
+	now := time.Now()
+	current := make(map[string]bool, len(hp.servers))
+	for _, a := range hp.servers {
+		current[a.addr] = true
+		if r, ok := hp.roles[a.addr]; ok && now.Sub(r.at) < hp.roleTTL {
+			continue
+		}
+		mode, err := hp.statRole(a.addr)
+		hp.roles[a.addr] = serverRole{mode: mode, unknown: err != nil || mode == ModeUnknown, at: now}
+	}
+	for addr := range hp.roles {
+		if !current[addr] {
+			// Dropped by a refresh.
+			delete(hp.roles, addr)
+		}
+	}
+
+	servers := append([]inetAddress(nil), hp.servers...)
+	sort.SliceStable(servers, func(i, j int) bool {
+		return hp.roles[servers[i].addr].rank() < hp.roles[servers[j].addr].rank()
+	})
+	hp.curr = indexOfAddr(servers, hp.servers, hp.curr)
+	hp.last = indexOfAddr(servers, hp.servers, hp.last)
+	hp.servers = servers
+}
+
+// resolve looks up the host of the server at index i again. The current
+// address is kept if it is still valid or the lookup fails; otherwise it is
+// replaced with one of the new addresses, preferring one that no other entry
+// of the same host is using.
+func (hp *DNSHostProvider) resolve(i int) {
+	a := &hp.servers[i]
+	addrs, err := hp.lookup(a.host)
+	if err != nil || len(addrs) == 0 {
+		return
+	}
+	a.resolved = true
+
+	inUse := make(map[string]bool, len(hp.servers))
+	for j, other := range hp.servers {
+		if j != i && other.host == a.host && other.port == a.port {
+			inUse[other.addr] = true
+		}
+	}
+	var candidate string
+	for _, addr := range addrs {
+		addr = net.JoinHostPort(addr, a.port)
+		if addr == a.addr {
+			return
+		}
+		if candidate == "" && !inUse[addr] {
+			candidate = addr
+		}
+	}
+	if candidate == "" {
+		candidate = net.JoinHostPort(addrs[0], a.port)
+	}
+	a.addr = candidate
+}
+
+// ordersServers tells the Conn not to shuffle the servers given to Init, as
+// Init does so itself unless WithShuffle(false) is set.
+func (hp *DNSHostProvider) ordersServers() {}
+
+// hasAddr reports whether addr is one of the resolved addresses, see
+// Conn.UpdateServers.
+func (hp *DNSHostProvider) hasAddr(addr string) bool {
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+	for _, a := range hp.servers {
+		if a.addr == addr {
+			return true
+		}
+	}
+	return false
 }
 
 // Connected notifies the HostProvider of a successful connection.
@@ -85,4 +478,18 @@ func (hp *DNSHostProvider) Connected() {
 	hp.mu.Lock()
 	defer hp.mu.Unlock()
 	hp.last = hp.curr
+	hp.connected = true
+}
+
+// ConnectFailed notifies the HostProvider that connecting to server failed.
+// The host the address was resolved from is looked up again the next time
+// the address would be returned by Next.
+func (hp *DNSHostProvider) ConnectFailed(server string) {
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+	for i := range hp.servers {
+		if hp.servers[i].addr == server {
+			hp.servers[i].resolved = false
+		}
+	}
 }
@@ -1,8 +1,13 @@
 package zk
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
 	"testing"
 	"time"
 )
@@ -33,7 +38,7 @@ func TestIntegration_DNSHostProviderCreate(t *testing.T) {
 
 	path := "/gozk-test"
 
-	if err := zk.Delete(path, -1); err != nil && err != ErrNoNode {
+	if err := zk.Delete(path, -1); err != nil && !errors.Is(err, ErrNoNode) {
 		t.Fatalf("Delete returned error: %+v", err)
 	}
 	if p, err := zk.Create(path, []byte{1, 2, 3, 4}, 0, WorldACL(PermAll)); err != nil {
@@ -121,7 +126,7 @@ func TestIntegration_DNSHostProviderReconnect(t *testing.T) {
 	path := "/gozk-test"
 
 	// Initial operation to force connection.
-	if err := zk.Delete(path, -1); err != nil && err != ErrNoNode {
+	if err := zk.Delete(path, -1); err != nil && !errors.Is(err, ErrNoNode) {
 		t.Fatalf("Delete returned error: %+v", err)
 	}
 
@@ -222,3 +227,410 @@ func TestDNSHostProviderRetryStart(t *testing.T) {
 		}
 	}
 }
+
+// TestDNSHostProviderConnectFailed tests that a host whose address
+// changed is looked up again after connecting to it failed.
+func TestDNSHostProviderConnectFailed(t *testing.T) {
+	t.Parallel()
+
+	addrs := []string{"192.0.2.1"}
+	lookups := 0
+	hp := &DNSHostProvider{lookupHost: func(host string) ([]string, error) {
+		lookups++
+		if addrs == nil {
+			return nil, fmt.Errorf("no such host %q", host)
+		}
+		return addrs, nil
+	}}
+
+	if err := hp.Init([]string{"foo.example.com:12345"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The IP changes mid-session; nothing failed yet so the cached address is used.
+	addrs = []string{"192.0.2.2"}
+	if server, _ := hp.Next(); server != "192.0.2.1:12345" {
+		t.Fatalf("Next returned %q; want %q", server, "192.0.2.1:12345")
+	}
+	if lookups != 1 {
+		t.Fatalf("lookupHost called %d times; want 1", lookups)
+	}
+
+	hp.ConnectFailed("192.0.2.1:12345")
+	if server, _ := hp.Next(); server != "192.0.2.2:12345" {
+		t.Fatalf("Next returned %q after ConnectFailed; want %q", server, "192.0.2.2:12345")
+	}
+	if lookups != 2 {
+		t.Fatalf("lookupHost called %d times; want 2", lookups)
+	}
+
+	// A failed lookup keeps the previously good address.
+	addrs = nil
+	hp.ConnectFailed("192.0.2.2:12345")
+	if server, _ := hp.Next(); server != "192.0.2.2:12345" {
+		t.Fatalf("Next returned %q after failed lookup; want %q", server, "192.0.2.2:12345")
+	}
+
+	// And it is retried on the following call.
+	addrs = []string{"192.0.2.3"}
+	if server, _ := hp.Next(); server != "192.0.2.3:12345" {
+		t.Fatalf("Next returned %q after lookup recovered; want %q", server, "192.0.2.3:12345")
+	}
+}
+
+// TestDNSHostProviderRefresh tests that the periodic refresh picks up
+// added and removed addresses, and keeps them if the lookup fails.
+func TestDNSHostProviderRefresh(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	addrs := []string{"192.0.2.1", "192.0.2.2"}
+	setAddrs := func(a []string) {
+		mu.Lock()
+		defer mu.Unlock()
+		addrs = a
+	}
+	hp := NewDNSHostProvider(WithRefreshInterval(time.Millisecond))
+	hp.lookupHost = func(host string) ([]string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if addrs == nil {
+			return nil, fmt.Errorf("no such host %q", host)
+		}
+		return addrs, nil
+	}
+	defer hp.Close()
+
+	if err := hp.Init([]string{"foo.example.com:12345"}); err != nil {
+		t.Fatal(err)
+	}
+	servers := func() []string {
+		hp.mu.Lock()
+		defer hp.mu.Unlock()
+		var s []string
+		for _, a := range hp.servers {
+			s = append(s, a.addr)
+		}
+		sort.Strings(s)
+		return s
+	}
+	waitFor := func(want string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for fmt.Sprint(servers()) != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("servers=%v; want %s", servers(), want)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	setAddrs([]string{"192.0.2.2", "192.0.2.3"})
+	waitFor("[192.0.2.2:12345 192.0.2.3:12345]")
+
+	// A failing lookup keeps the addresses we have.
+	setAddrs(nil)
+	time.Sleep(20 * time.Millisecond)
+	waitFor("[192.0.2.2:12345 192.0.2.3:12345]")
+
+	setAddrs([]string{"192.0.2.4"})
+	waitFor("[192.0.2.4:12345]")
+	if server, _ := hp.Next(); server != "192.0.2.4:12345" {
+		t.Fatalf("Next returned %q; want %q", server, "192.0.2.4:12345")
+	}
+
+	// No more refreshes after Close.
+	hp.Close()
+	time.Sleep(20 * time.Millisecond)
+	setAddrs([]string{"192.0.2.5"})
+	time.Sleep(20 * time.Millisecond)
+	waitFor("[192.0.2.4:12345]")
+}
+
+// TestDNSHostProviderRefreshKeepsPosition tests that addresses that are
+// still valid after a refresh keep their place in the rotation.
+func TestDNSHostProviderRefreshKeepsPosition(t *testing.T) {
+	t.Parallel()
+
+	addrs := []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}
+	hp := &DNSHostProvider{lookupHost: func(host string) ([]string, error) {
+		return addrs, nil
+	}}
+	if err := hp.Init([]string{"foo.example.com:12345"}); err != nil {
+		t.Fatal(err)
+	}
+
+	first, _ := hp.Next()
+	hp.Connected()
+	second, _ := hp.Next()
+
+	// Drop whichever address would be handed out third.
+	var third string
+	for _, a := range addrs {
+		if a+":12345" != first && a+":12345" != second {
+			third = a
+		}
+	}
+	addrs = []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4"}
+	for i, a := range addrs {
+		if a == third {
+			addrs = append(addrs[:i:i], addrs[i+1:]...)
+			break
+		}
+	}
+	hp.refresh()
+
+	if server, retryStart := hp.Next(); server != "192.0.2.4:12345" || retryStart {
+		t.Fatalf("Next returned %q, %v; want %q, false", server, retryStart, "192.0.2.4:12345")
+	}
+	if server, retryStart := hp.Next(); server != first || !retryStart {
+		t.Fatalf("Next returned %q, %v; want %q, true", server, retryStart, first)
+	}
+}
+
+// TestDNSHostProviderAllAddresses tests that every address a host name
+// resolves to is handed out by Next.
+func TestDNSHostProviderAllAddresses(t *testing.T) {
+	t.Parallel()
+
+	hp := &DNSHostProvider{lookupHost: func(host string) ([]string, error) {
+		if host == "bar.example.com" {
+			return []string{"192.0.2.4"}, nil
+		}
+		return []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}, nil
+	}}
+	if err := hp.Init([]string{"foo.example.com:12345", "bar.example.com:12345"}); err != nil {
+		t.Fatal(err)
+	}
+	if hp.Len() != 4 {
+		t.Fatalf("Len()=%d; want 4", hp.Len())
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < hp.Len(); i++ {
+		server, _ := hp.Next()
+		seen[server] = true
+	}
+	for _, want := range []string{"192.0.2.1:12345", "192.0.2.2:12345", "192.0.2.3:12345", "192.0.2.4:12345"} {
+		if !seen[want] {
+			t.Errorf("Next never returned %q; got %v", want, seen)
+		}
+	}
+}
+
+func TestDNSHostProviderShuffleRand(t *testing.T) {
+	t.Parallel()
+
+	lookupHost := func(host string) ([]string, error) {
+		return []string{host}, nil
+	}
+	order := func(seed int64, servers []string) []string {
+		hp := NewDNSHostProvider(WithShuffleRand(rand.New(rand.NewSource(seed))))
+		hp.lookupHost = lookupHost
+		if err := hp.Init(servers); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for i := 0; i < hp.Len(); i++ {
+			server, _ := hp.Next()
+			got = append(got, server)
+		}
+		return got
+	}
+
+	servers := []string{"192.0.2.1:2181", "192.0.2.2:2181", "192.0.2.3:2181", "192.0.2.4:2181", "192.0.2.5:2181", "192.0.2.6:2181"}
+	reversed := make([]string, len(servers))
+	for i, server := range servers {
+		reversed[len(servers)-1-i] = server
+	}
+	want := order(42, servers)
+	if got := order(42, reversed); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("providers seeded identically tried %v and %v; want the same order", want, got)
+	}
+
+	// Some other seed gives another order.
+	for seed := int64(0); seed < 10; seed++ {
+		if fmt.Sprint(order(seed, servers)) != fmt.Sprint(want) {
+			return
+		}
+	}
+	t.Fatalf("all seeds gave the order %v", want)
+}
+
+func TestDNSHostProviderWithoutShuffle(t *testing.T) {
+	t.Parallel()
+
+	hp := NewDNSHostProvider(WithShuffle(false))
+	hp.lookupHost = func(host string) ([]string, error) {
+		if host == "zk-b" {
+			return []string{"192.0.2.20", "192.0.2.10"}, nil
+		}
+		return []string{host}, nil
+	}
+	servers := []string{"192.0.2.9:2181", "zk-b:2181", "192.0.2.1:2181"}
+	if err := hp.Init(servers); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"192.0.2.9:2181", "192.0.2.20:2181", "192.0.2.10:2181", "192.0.2.1:2181", "192.0.2.9:2181"}
+	var got []string
+	for range want {
+		server, _ := hp.Next()
+		got = append(got, server)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("unshuffled provider tried %v; want %v", got, want)
+	}
+}
+
+func TestDNSHostProviderWithoutShuffleConnect(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	var dialed []string
+	dialer := func(network, address string, timeout time.Duration) (net.Conn, error) {
+		mu.Lock()
+		dialed = append(dialed, address)
+		mu.Unlock()
+		return nil, errors.New("connection refused")
+	}
+	servers := []string{"127.0.0.1:6", "127.0.0.1:2", "127.0.0.1:5", "127.0.0.1:1", "127.0.0.1:4", "127.0.0.1:3"}
+	conn, ech, err := Connect(servers, 15*time.Second,
+		WithLogInfo(false), WithLogger(&testLogger{}), WithDialer(dialer),
+		WithHostProvider(NewDNSHostProvider(WithShuffle(false))),
+		WithReconnectBackoff(time.Millisecond, time.Millisecond, 1), WithMaxReconnectAttempts(len(servers)))
+	if err != nil {
+		t.Fatalf("Connect returned error: %v", err)
+	}
+	defer conn.Close()
+
+	timeout := time.After(5 * time.Second)
+	for closed := false; !closed; {
+		select {
+		case _, ok := <-ech:
+			closed = !ok
+		case <-timeout:
+			t.Fatal("event channel not closed after giving up")
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if fmt.Sprint(dialed) != fmt.Sprint(servers) {
+		t.Fatalf("unshuffled provider dialed %v; want %v", dialed, servers)
+	}
+}
+
+func TestDNSHostProviderHealthProbe(t *testing.T) {
+	t.Parallel()
+
+	var up, down []string
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		up = append(up, l.Addr().String())
+
+		closed, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		down = append(down, closed.Addr().String())
+		closed.Close()
+	}
+
+	hp := NewDNSHostProvider(WithShuffle(false), WithHealthProbe(time.Second))
+	if err := hp.Init([]string{down[0], up[0], down[1], up[1]}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{up[0], up[1], up[0], up[1]}
+	for i, want := range want {
+		if server, _ := hp.Next(); server != want {
+			t.Fatalf("Next %d returned %s; want %s, skipping the servers that are down", i, server, want)
+		}
+	}
+
+	// With all servers down, Next still hands them out in turn and signals
+	// the start of another round.
+	hp = NewDNSHostProvider(WithShuffle(false), WithHealthProbe(time.Second))
+	if err := hp.Init(down); err != nil {
+		t.Fatal(err)
+	}
+	retried := false
+	for i, want := range []string{down[0], down[1], down[0]} {
+		server, retryStart := hp.Next()
+		if server != want {
+			t.Fatalf("Next %d with all servers down returned %s; want %s", i, server, want)
+		}
+		retried = retried || retryStart
+	}
+	if !retried {
+		t.Fatal("Next never returned retryStart with all servers down")
+	}
+}
+
+func TestDNSHostProviderPreferObservers(t *testing.T) {
+	t.Parallel()
+
+	// A fake ensemble with a follower, an observer, a leader and a server
+	// that doesn't answer stat.
+	var servers []string
+	for _, thing := range []string{"follower", "observer", "", "dead"} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		go tcpServer(l, thing)
+		servers = append(servers, l.Addr().String())
+	}
+	follower, observer, leader, dead := servers[0], servers[1], servers[2], servers[3]
+
+	hp := NewDNSHostProvider(WithShuffle(false), WithPreferObservers(time.Hour, time.Second))
+	probes := 0
+	statRole := hp.statRole
+	hp.statRole = func(addr string) (Mode, error) {
+		probes++
+		return statRole(addr)
+	}
+	if err := hp.Init([]string{dead, follower, leader, observer}); err != nil {
+		t.Fatal(err)
+	}
+	next := func(want string) {
+		t.Helper()
+		if server, _ := hp.Next(); server != want {
+			t.Fatalf("Next returned %s; want %s", server, want)
+		}
+	}
+
+	// The observer is preferred; if connecting to it fails, the other
+	// servers are tried in turn, the one of unknown role last.
+	next(observer)
+	if probes != 4 {
+		t.Fatalf("looked up %d roles; want 4", probes)
+	}
+	hp.ConnectFailed(observer)
+	next(follower)
+	next(leader)
+	next(dead)
+
+	// After a connection to a follower is lost, the observer is tried again.
+	next(observer)
+	next(follower)
+	hp.Connected()
+	next(observer)
+	hp.Connected()
+	next(observer)
+	if probes != 4 {
+		t.Fatalf("looked up %d roles; want them to be cached", probes)
+	}
+
+	// Once the roles expire, they are looked up again.
+	hp.Connected()
+	hp.roleTTL = 0
+	next(observer)
+	if probes != 8 {
+		t.Fatalf("looked up %d roles; want 8 after the roles expired", probes)
+	}
+}
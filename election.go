@@ -0,0 +1,242 @@
+package zk
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrElectionStarted is returned by Start when the elector already takes part in the election.
+	ErrElectionStarted = errors.New("zk: election already started")
+	// ErrElectionNotStarted is returned by Resign when the elector does not take part in the election.
+	ErrElectionNotStarted = errors.New("zk: election not started")
+	// ErrNoLeader is returned by Leader when there are no candidates.
+	ErrNoLeader = errors.New("zk: no leader")
+)
+
+// LeaderElector takes part in a leader election. Each candidate creates an
+// ephemeral sequential node under the election path, and the candidate with
+// the lowest sequence number is the leader. Every other candidate watches the
+// node just before its own, so only one of them is woken up when the leader
+// goes away. The node names match those of Lock, as used by Curator's
+// LeaderSelector.
+type LeaderElector struct {
+	c    *Conn
+	path string
+	id   []byte
+	acl  []ACL
+
+	mu       sync.Mutex
+	nodePath string
+	leader   chan struct{}
+	lost     chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewLeaderElector creates a new elector for the election at path, using the
+// provided connection. id is stored in the elector's node and returned by
+// Leader while it is the leader. The path must be a node that is only used
+// for this election.
+func NewLeaderElector(c *Conn, path string, id []byte) *LeaderElector {
+	return &LeaderElector{
+		c:    c,
+		path: path,
+		id:   id,
+		acl:  WorldACL(PermAll),
+	}
+}
+
+// Start enters the election. It returns once the elector's node is created;
+// IsLeader is closed when the elector becomes the leader.
+func (e *LeaderElector) Start() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.done != nil {
+		select {
+		case <-e.done:
+		default:
+			return ErrElectionStarted
+		}
+	}
+
+	path, err := createLockNode(e.c, e.path, "lock-", e.id, e.acl)
+	if err != nil {
+		return err
+	}
+	seq, err := parseSeq(path)
+	if err != nil {
+		e.c.Delete(path, -1)
+		return err
+	}
+
+	e.nodePath = path
+	e.leader = make(chan struct{})
+	e.lost = make(chan struct{})
+	e.stop = make(chan struct{})
+	e.done = make(chan struct{})
+	go e.run(path, seq, e.leader, e.lost, e.stop, e.done)
+	return nil
+}
+
+// IsLeader returns a channel that is closed when the elector becomes the
+// leader. It must be called after Start.
+func (e *LeaderElector) IsLeader() <-chan struct{} {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leader
+}
+
+// Lost returns a channel that is closed when the elector leaves the election
+// after Start: because Resign was called, its node was deleted, the session
+// expired or the connection was closed. A leader must stop acting as leader
+// once it is closed. It must be called after Start.
+func (e *LeaderElector) Lost() <-chan struct{} {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.lost
+}
+
+// Resign leaves the election, deleting the elector's node. If the elector is
+// the leader, the next candidate becomes the leader. Start can be called
+// again afterwards.
+func (e *LeaderElector) Resign() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.done == nil {
+		return ErrElectionNotStarted
+	}
+	close(e.stop)
+	<-e.done
+	e.done = nil
+
+	err := e.c.Delete(e.nodePath, -1)
+	e.nodePath = ""
+	if errors.Is(err, ErrNoNode) {
+		err = nil
+	}
+	return err
+}
+
+// Leader returns the id of the current leader.
+func (e *LeaderElector) Leader() (string, error) {
+	children, _, err := e.c.Children(e.path)
+	if errors.Is(err, ErrNoNode) {
+		return "", ErrNoLeader
+	} else if err != nil {
+		return "", err
+	}
+	children, err = sortBySeq(children)
+	if err != nil {
+		return "", err
+	}
+	for _, child := range children {
+		data, _, err := e.c.Get(e.path + "/" + child)
+		if errors.Is(err, ErrNoNode) {
+			// The leader just went away; its successor is next.
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	}
+	return "", ErrNoLeader
+}
+
+func (e *LeaderElector) run(path string, seq int, leader, lost, stop, done chan struct{}) {
+	defer close(done)
+	defer close(lost)
+
+	isLeader := false
+	for {
+		children, _, err := e.c.Children(e.path)
+		if err != nil {
+			if !e.retry(err, stop) {
+				return
+			}
+			continue
+		}
+		found := false
+		for _, child := range children {
+			if e.path+"/"+child == path {
+				found = true
+			}
+		}
+		if !found {
+			// Our node is gone, e.g. because the session expired.
+			return
+		}
+
+		prev, err := rwLockPredecessor(children, seq, true)
+		if err != nil {
+			e.c.logger.Warn("leader election failed", "path", e.path, "error", err)
+			return
+		}
+
+		// The leader watches its own node, the others their predecessor.
+		watch := path
+		if prev != "" {
+			watch = e.path + "/" + prev
+		} else if !isLeader {
+			isLeader = true
+			close(leader)
+		}
+
+		exists, _, ch, err := e.c.ExistsW(watch)
+		if err != nil {
+			if !e.retry(err, stop) {
+				return
+			}
+			continue
+		}
+		if !exists {
+			continue
+		}
+
+		select {
+		case ev := <-ch:
+			if ev.Err != nil {
+				// Session expired or connection closed.
+				return
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// retry reports whether the election should go on after err. Errors caused
+// by a lost connection are retried once reconnected, unless the session
+// expired or stop is closed.
+func (e *LeaderElector) retry(err error, stop chan struct{}) bool {
+	if errors.Is(err, ErrSessionExpired) || errors.Is(err, ErrClosing) {
+		return false
+	}
+	select {
+	case <-stop:
+		return false
+	case <-e.c.shouldQuit:
+		return false
+	case <-time.After(100 * time.Millisecond):
+		return true
+	}
+}
+
+// sortBySeq sorts lock node names by their sequence number.
+func sortBySeq(children []string) ([]string, error) {
+	seqs := make(map[string]int, len(children))
+	for _, child := range children {
+		seq, err := parseSeq(child)
+		if err != nil {
+			return nil, err
+		}
+		seqs[child] = seq
+	}
+	sorted := append([]string(nil), children...)
+	sort.Slice(sorted, func(i, j int) bool { return seqs[sorted[i]] < seqs[sorted[j]] })
+	return sorted, nil
+}
@@ -0,0 +1,90 @@
+package zk
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestLeaderElector(t *testing.T) {
+	fs := newFakeTreeServer(t)
+	defer fs.Close()
+
+	zk := connectFake(t, fs)
+
+	electors := make([]*LeaderElector, 3)
+	for i := range electors {
+		electors[i] = NewLeaderElector(zk, "/test-election", []byte(fmt.Sprintf("candidate-%d", i)))
+		if err := electors[i].Start(); err != nil {
+			t.Fatalf("Start returned error: %v", err)
+		}
+	}
+	if err := electors[0].Start(); !errors.Is(err, ErrElectionStarted) {
+		t.Fatalf("Start twice returned %v; want %v", err, ErrElectionStarted)
+	}
+
+	// waitForLeader returns the only elector that is the leader.
+	waitForLeader := func(candidates []*LeaderElector) *LeaderElector {
+		t.Helper()
+		deadline := time.After(5 * time.Second)
+		for {
+			var leaders []*LeaderElector
+			for _, e := range candidates {
+				select {
+				case <-e.IsLeader():
+					leaders = append(leaders, e)
+				default:
+				}
+			}
+			if len(leaders) > 1 {
+				t.Fatalf("%d leaders at the same time", len(leaders))
+			}
+			if len(leaders) == 1 {
+				return leaders[0]
+			}
+			select {
+			case <-deadline:
+				t.Fatal("no leader elected")
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+
+	leader := waitForLeader(electors)
+	if leader != electors[0] {
+		t.Fatalf("leader is %q; want the first candidate", leader.id)
+	}
+	if id, err := electors[2].Leader(); err != nil || id != "candidate-0" {
+		t.Fatalf("Leader returned %q, %v; want %q", id, err, "candidate-0")
+	}
+
+	// The next candidate takes over when the leader resigns.
+	if err := leader.Resign(); err != nil {
+		t.Fatalf("Resign returned error: %v", err)
+	}
+	select {
+	case <-leader.Lost():
+	default:
+		t.Fatal("Lost not closed after Resign")
+	}
+	leader = waitForLeader(electors[1:])
+	if leader != electors[1] {
+		t.Fatalf("leader is %q; want the second candidate", leader.id)
+	}
+	time.Sleep(50 * time.Millisecond)
+	waitForLeader(electors[1:])
+	if id, err := electors[0].Leader(); err != nil || id != "candidate-1" {
+		t.Fatalf("Leader returned %q, %v; want %q", id, err, "candidate-1")
+	}
+
+	// Everybody loses when the session expires.
+	fs.ExpireSession(zk.SessionID())
+	for _, e := range electors[1:] {
+		select {
+		case <-e.Lost():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q did not lose after the session expired", e.id)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package zk
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+)
+
+// LostEphemeralsCallback is a function that is called with the paths of the
+// ephemeral nodes deleted by the server when the session expired.
+type LostEphemeralsCallback func(paths []string)
+
+// WithLostEphemeralsCallback returns a connection option that keeps track of
+// the ephemeral nodes created by the session, and calls cb with their paths
+// when the session expires, right after the StateExpired event, so the
+// application can create them again in the new session, unless
+// WithEphemeralRecovery does. It is not called if the session had no
+// ephemeral nodes.
+//
+// The client tracks the nodes it saw created by Create and its variants or by
+// Multi, and forgets them once it saw them deleted by Delete and its variants
+// or by Multi, or once they are lost. Nodes created before the connection
+// was lost, whose response never arrived, are not tracked, nor are the nodes
+// of a session resumed with WithSession, or deleted by other clients.
+//
+// As with WithEventCallback, cb is called synchronously from the ZK go
+// routines, so it must not block, nor wait for requests on the connection.
+func WithLostEphemeralsCallback(cb LostEphemeralsCallback) connOption {
+	return func(c *Conn) {
+		c.trackEphemerals().cb = cb
+	}
+}
+
+// WithEphemeralRecovery returns a connection option that sets whether the
+// ephemeral nodes lost when the session expired are created again once the
+// new session is established, with the data and ACL they last had, as far as
+// the client knows: it tracks the nodes as WithLostEphemeralsCallback does,
+// along with the changes made by Set and SetACL. Sequential nodes are not
+// recreated, as they would get another name; use WithLostEphemeralsCallback
+// to learn about them. Nodes that can't be created, e.g. because another
+// session created them meanwhile, are skipped and logged.
+//
+// Requests of the application may go before the recreated nodes, so they
+// must not rely on the nodes being back right after the new session is
+// established.
+func WithEphemeralRecovery(recover bool) connOption {
+	return func(c *Conn) {
+		c.trackEphemerals().recover = recover
+	}
+}
+
+func (c *Conn) trackEphemerals() *ephemeralTracker {
+	if c.ephemerals == nil {
+		c.ephemerals = &ephemeralTracker{nodes: make(map[string]*CreateRequest)}
+	}
+	return c.ephemerals
+}
+
+type ephemeralTracker struct {
+	cb      LostEphemeralsCallback // may be nil
+	recover bool
+
+	mu    sync.Mutex                // protects nodes
+	nodes map[string]*CreateRequest // the last known data and ACL by path
+}
+
+// track updates the nodes from the response of the request.
+func (t *ephemeralTracker) track(req *request, err error) {
+	if err != nil && (req.opcode != opDelete || !errors.Is(err, ErrNoNode)) {
+		// Nothing changed, or at least not as requested. Multi applies
+		// none of its operations in that case.
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch r := req.pkt.(type) {
+	case *CreateRequest:
+		if res, ok := req.recvStruct.(*createResponse); ok && req.opcode == opCreate {
+			t.created(r, res.Path)
+		}
+	case *DeleteRequest:
+		delete(t.nodes, r.Path)
+	case *SetDataRequest:
+		if n := t.nodes[r.Path]; n != nil {
+			n.Data = r.Data
+		}
+	case *setAclRequest:
+		if n := t.nodes[r.Path]; n != nil {
+			n.Acl = r.Acl
+		}
+	case *multiRequest:
+		res, ok := req.recvStruct.(*multiResponse)
+		if !ok {
+			return
+		}
+		for i := 0; i < len(r.Ops) && i < len(res.Ops); i++ {
+			switch op := r.Ops[i].Op.(type) {
+			case *CreateRequest:
+				t.created(op, res.Ops[i].String)
+			case *DeleteRequest:
+				delete(t.nodes, op.Path)
+			case *SetDataRequest:
+				if n := t.nodes[op.Path]; n != nil {
+					n.Data = op.Data
+				}
+			}
+		}
+	}
+}
+
+// created tracks the node created by r at path, if it is ephemeral. Callers
+// must hold t.mu.
+func (t *ephemeralTracker) created(r *CreateRequest, path string) {
+	if r.Flags&FlagEphemeral == FlagEphemeral && r.Flags&FlagTTL == 0 {
+		t.nodes[path] = &CreateRequest{Path: path, Data: r.Data, Acl: r.Acl, Flags: r.Flags}
+	}
+}
+
+// ephemeralsExpired is called when the session expired. It reports the lost
+// nodes to the callback and starts recreating them if requested.
+func (c *Conn) ephemeralsExpired() {
+	t := c.ephemerals
+	t.mu.Lock()
+	lost := make([]*CreateRequest, 0, len(t.nodes))
+	for _, n := range t.nodes {
+		lost = append(lost, n)
+	}
+	t.nodes = make(map[string]*CreateRequest)
+	t.mu.Unlock()
+
+	if len(lost) == 0 {
+		return
+	}
+	sort.Slice(lost, func(i, j int) bool { return lost[i].Path < lost[j].Path })
+	if t.cb != nil {
+		paths := make([]string, len(lost))
+		for i, n := range lost {
+			paths[i] = n.Path
+		}
+		t.cb(paths)
+	}
+	if t.recover {
+		go c.recoverEphemerals(lost)
+	}
+}
+
+// recoverEphemerals creates the lost non-sequential nodes again once the new
+// session is established.
+func (c *Conn) recoverEphemerals(lost []*CreateRequest) {
+	err := c.waitForState(context.Background(), func(s State) bool { return s == StateHasSession })
+	if err != nil {
+		return
+	}
+	for _, n := range lost {
+		if n.Flags&FlagSequence == FlagSequence {
+			continue
+		}
+		// The data is sent as stored, as it was compressed already.
+		_, err := c.request(opCreate, &CreateRequest{n.Path, n.Data, n.Acl, n.Flags}, &createResponse{}, nil)
+		if err != nil {
+			c.logger.Warn("failed to recreate ephemeral node", "path", n.Path, "error", err)
+		} else if c.logInfo {
+			c.logger.Info("recreated ephemeral node", "path", n.Path)
+		}
+	}
+}
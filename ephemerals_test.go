@@ -0,0 +1,141 @@
+package zk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestLostEphemeralsCallback(t *testing.T) {
+	fs := newFakeTreeServer(t)
+	defer fs.Close()
+
+	var sawExpired, expiredFirst bool
+	lost := make(chan []string, 2)
+	events := func(ev Event) {
+		if ev.Type == EventSession && ev.State == StateExpired {
+			sawExpired = true
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn := connectFake(t, fs,
+		WithEventCallback(events), WithLostEphemeralsCallback(func(paths []string) {
+			// Both callbacks run on the connection loop.
+			expiredFirst = sawExpired
+			lost <- paths
+		}))
+
+	acl := WorldACL(PermAll)
+	mustCreate := func(path string, flags int32) string {
+		t.Helper()
+		p, err := conn.Create(path, nil, flags, acl)
+		if err != nil {
+			t.Fatalf("Create(%q) returned error: %v", path, err)
+		}
+		return p
+	}
+	mustCreate("/app", 0)
+	mustCreate("/app/persistent", 0)
+	mustCreate("/app/a", FlagEphemeral)
+	seq := mustCreate("/app/seq-", FlagEphemeral|FlagSequence)
+	mustCreate("/app/deleted", FlagEphemeral)
+	if err := conn.Delete("/app/deleted", -1); err != nil {
+		t.Fatalf("Delete returned error: %v", err)
+	}
+	if _, err := conn.Multi(
+		&CreateRequest{Path: "/app/multi", Acl: acl, Flags: FlagEphemeral},
+		&CreateRequest{Path: "/app/multi-persistent", Acl: acl},
+	); err != nil {
+		t.Fatalf("Multi returned error: %v", err)
+	}
+	if res := <-conn.CreateAsync("/app/async", nil, FlagEphemeral, acl); res.Err != nil {
+		t.Fatalf("CreateAsync returned error: %v", res.Err)
+	}
+	if err := <-conn.DeleteAsync("/app/async", -1); err != nil {
+		t.Fatalf("DeleteAsync returned error: %v", err)
+	}
+
+	firstSession := conn.SessionID()
+	fs.ExpireSession(firstSession)
+	select {
+	case paths := <-lost:
+		want := []string{"/app/a", "/app/multi", seq}
+		if fmt.Sprint(paths) != fmt.Sprint(want) {
+			t.Fatalf("lost ephemerals %v; want %v", paths, want)
+		}
+		if !expiredFirst {
+			t.Fatal("lost ephemerals reported before the StateExpired event")
+		}
+	case <-ctx.Done():
+		t.Fatal("lost ephemerals were not reported")
+	}
+
+	// The new session starts without any.
+	if err := conn.waitForState(ctx, func(s State) bool { return s == StateHasSession && conn.SessionID() != firstSession }); err != nil {
+		t.Fatalf("waiting for a new session: %v", err)
+	}
+	oldSession := conn.SessionID()
+	fs.ExpireSession(oldSession)
+	if err := conn.waitForState(ctx, func(s State) bool { return s == StateHasSession && conn.SessionID() != oldSession }); err != nil {
+		t.Fatalf("waiting for another session: %v", err)
+	}
+	select {
+	case paths := <-lost:
+		t.Fatalf("lost ephemerals %v reported for a session without any", paths)
+	default:
+	}
+}
+
+func TestEphemeralRecovery(t *testing.T) {
+	fs := newFakeTreeServer(t)
+	defer fs.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn := connectFake(t, fs, WithEphemeralRecovery(true))
+
+	acl := WorldACL(PermAll)
+	if _, err := conn.Create("/app", nil, 0, acl); err != nil {
+		t.Fatalf("Create returned error: %v", err)
+	}
+	if _, err := conn.Create("/app/a", []byte("old"), FlagEphemeral, acl); err != nil {
+		t.Fatalf("Create returned error: %v", err)
+	}
+	if _, err := conn.Set("/app/a", []byte("new"), -1); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if _, err := conn.Create("/app/seq-", nil, FlagEphemeral|FlagSequence, acl); err != nil {
+		t.Fatalf("Create returned error: %v", err)
+	}
+
+	oldSession := conn.SessionID()
+	fs.ExpireSession(oldSession)
+	if err := conn.waitForState(ctx, func(s State) bool { return s == StateHasSession && conn.SessionID() != oldSession }); err != nil {
+		t.Fatalf("waiting for a new session: %v", err)
+	}
+
+	for {
+		data, stat, err := conn.Get("/app/a")
+		if err == nil {
+			if string(data) != "new" || stat.EphemeralOwner != conn.SessionID() {
+				t.Fatalf("recreated node has data %q and owner %#x; want %q and %#x", data, stat.EphemeralOwner, "new", conn.SessionID())
+			}
+			break
+		}
+		if !errors.Is(err, ErrNoNode) || ctx.Err() != nil {
+			t.Fatalf("Get of the recreated node returned error: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Sequential nodes are not recreated.
+	children, _, err := conn.Children("/app")
+	if err != nil {
+		t.Fatalf("Children returned error: %v", err)
+	}
+	if fmt.Sprint(children) != "[a]" {
+		t.Fatalf("children after recovery are %v; want [a]", children)
+	}
+}
@@ -0,0 +1,110 @@
+package zk
+
+import "sync/atomic"
+
+// EventOverflowPolicy tells what happens to an event when the event channel
+// returned by Connect is full.
+type EventOverflowPolicy int
+
+const (
+	// EventOverflowDropNewest drops the event, keeping the events already in
+	// the channel. This is the default.
+	EventOverflowDropNewest EventOverflowPolicy = iota
+	// EventOverflowDropOldest drops the oldest event in the channel to make
+	// room for the event, so the channel holds the latest events.
+	EventOverflowDropOldest
+	// EventOverflowBlock waits until the channel has room for the event. As
+	// events are sent from the goroutines of the connection, a consumer that
+	// stops reading the channel stalls the connection: no responses are
+	// received, and the session eventually expires.
+	EventOverflowBlock
+)
+
+var eventOverflowPolicyNames = map[EventOverflowPolicy]string{
+	EventOverflowDropNewest: "EventOverflowDropNewest",
+	EventOverflowDropOldest: "EventOverflowDropOldest",
+	EventOverflowBlock:      "EventOverflowBlock",
+}
+
+func (p EventOverflowPolicy) String() string {
+	if name := eventOverflowPolicyNames[p]; name != "" {
+		return name
+	}
+	return "Unknown"
+}
+
+// DefaultEventChannelSize is the size of the event channel returned by
+// Connect, unless set otherwise with WithEventChannelSize.
+const DefaultEventChannelSize = eventChanSize
+
+// EventDropRecorder can be implemented by a MetricsRecorder passed to
+// WithMetrics to be notified of the events dropped because the event channel
+// was full.
+type EventDropRecorder interface {
+	RecordEventDropped(ev Event)
+}
+
+// WithEventChannelSize returns a connection option that sets the size of the
+// buffer of the event channel returned by Connect. If the application doesn't
+// keep up with the events, the channel fills up and new events are handled
+// according to WithEventOverflowPolicy.
+func WithEventChannelSize(n int) connOption {
+	return func(c *Conn) {
+		if n >= 0 {
+			c.eventChanSize = n
+		}
+	}
+}
+
+// WithEventOverflowPolicy returns a connection option that sets what happens
+// to an event when the event channel is full. With the drop policies, the
+// dropped events are reported to the MetricsRecorder if it implements
+// EventDropRecorder, and a warning is logged when the channel becomes full.
+// The callback set by WithEventCallback gets all events regardless.
+func WithEventOverflowPolicy(policy EventOverflowPolicy) connOption {
+	return func(c *Conn) {
+		c.eventOverflow = policy
+	}
+}
+
+// overflowEvent handles evt when the event channel is full.
+func (c *Conn) overflowEvent(evt Event) {
+	switch c.eventOverflow {
+	case EventOverflowBlock:
+		select {
+		case c.eventChan <- evt:
+			return
+		case <-c.shouldQuit:
+			// Nobody might read the channel anymore.
+		}
+	case EventOverflowDropOldest:
+		select {
+		case old := <-c.eventChan:
+			select {
+			case c.eventChan <- evt:
+				evt = old
+			default:
+				// Another event took the room.
+			}
+		default:
+			// The channel was emptied meanwhile.
+			select {
+			case c.eventChan <- evt:
+				return
+			default:
+			}
+		}
+	}
+	c.eventDropped(evt)
+}
+
+// eventDropped reports that evt was dropped. The warning is only logged for
+// the first event dropped since the channel last accepted an event.
+func (c *Conn) eventDropped(evt Event) {
+	if r, ok := c.metrics.(EventDropRecorder); ok {
+		r.RecordEventDropped(evt)
+	}
+	if atomic.CompareAndSwapInt32(&c.eventsDropping, 0, 1) {
+		c.logger.Warn("event channel full, dropping events", "event", evt.String(), "policy", c.eventOverflow.String())
+	}
+}
@@ -0,0 +1,132 @@
+package zk
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// dropRecorder is a testRecorder that also keeps the dropped events.
+type dropRecorder struct {
+	testRecorder
+	dropped []Event
+}
+
+func (r *dropRecorder) RecordEventDropped(ev Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.dropped = append(r.dropped, ev)
+}
+
+func (r *dropRecorder) Dropped() []Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Event(nil), r.dropped...)
+}
+
+// describeEvents describes the events compactly, for comparing them.
+func describeEvents(events []Event) string {
+	names := make([]string, len(events))
+	for i, ev := range events {
+		if ev.Type == EventSession {
+			names[i] = ev.State.String()
+		} else {
+			names[i] = ev.Path
+		}
+	}
+	return fmt.Sprint(names)
+}
+
+func TestEventOverflowPolicy(t *testing.T) {
+	tests := []struct {
+		policy      EventOverflowPolicy
+		wantDropped string
+		wantKept    string
+	}{
+		{EventOverflowDropNewest, "[StateConnected StateHasSession /a /b]", "[StateConnecting]"},
+		{EventOverflowDropOldest, "[StateConnecting StateConnected StateHasSession /a]", "[/b]"},
+	}
+	for _, test := range tests {
+		t.Run(test.policy.String(), func(t *testing.T) {
+			fs := newFakeServer(t, func(opcode int32, body []byte) (interface{}, ErrCode) {
+				return nil, errUnimplemented
+			})
+			defer fs.Close()
+
+			r := &dropRecorder{}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conn, events, err := ConnectContext(ctx, []string{fs.Addr()}, 15*time.Second, WithLogInfo(false),
+				WithMetrics(r), WithEventChannelSize(1), WithEventOverflowPolicy(test.policy))
+			if err != nil {
+				t.Fatalf("ConnectContext returned error: %v", err)
+			}
+			defer conn.Close()
+
+			// Nobody reads the channel meanwhile.
+			fs.SendEvent(watcherEvent{Type: EventNodeCreated, Path: "/a"})
+			fs.SendEvent(watcherEvent{Type: EventNodeCreated, Path: "/b"})
+			for len(r.Dropped()) < 4 {
+				select {
+				case <-ctx.Done():
+					t.Fatalf("dropped only %s", describeEvents(r.Dropped()))
+				case <-time.After(10 * time.Millisecond):
+				}
+			}
+			if got := describeEvents(r.Dropped()); got != test.wantDropped {
+				t.Errorf("dropped %s; want %s", got, test.wantDropped)
+			}
+			if got := describeEvents([]Event{<-events}); got != test.wantKept {
+				t.Errorf("the channel kept %s; want %s", got, test.wantKept)
+			}
+		})
+	}
+
+	t.Run(EventOverflowBlock.String(), func(t *testing.T) {
+		fs := newFakeServer(t, func(opcode int32, body []byte) (interface{}, ErrCode) {
+			return nil, errUnimplemented
+		})
+		defer fs.Close()
+
+		// A slow consumer gets all events.
+		received := make(chan []Event, 1)
+		r := &dropRecorder{}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		conn, events, err := connect([]string{fs.Addr()}, 15*time.Second, WithLogInfo(false),
+			WithMetrics(r), WithEventChannelSize(1), WithEventOverflowPolicy(EventOverflowBlock))
+		if err != nil {
+			t.Fatalf("connect returned error: %v", err)
+		}
+		defer conn.Close()
+		go func() {
+			var got []Event
+			for ev := range events {
+				time.Sleep(10 * time.Millisecond)
+				got = append(got, ev)
+				if ev.Path == "/b" {
+					break
+				}
+			}
+			received <- got
+		}()
+		if err := conn.WaitForConnection(ctx); err != nil {
+			t.Fatalf("WaitForConnection returned error: %v", err)
+		}
+		fs.SendEvent(watcherEvent{Type: EventNodeCreated, Path: "/a"})
+		fs.SendEvent(watcherEvent{Type: EventNodeCreated, Path: "/b"})
+
+		select {
+		case got := <-received:
+			if want := "[StateConnecting StateConnected StateHasSession /a /b]"; describeEvents(got) != want {
+				t.Errorf("received %s; want %s", describeEvents(got), want)
+			}
+		case <-ctx.Done():
+			t.Fatal("events were not received")
+		}
+		if dropped := r.Dropped(); len(dropped) != 0 {
+			t.Errorf("dropped %s with %v", describeEvents(dropped), EventOverflowBlock)
+		}
+	})
+}
@@ -0,0 +1,338 @@
+package zk
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServerHandler answers a single request. It returns the response to
+// encode, or an error code to send instead. A nil response with no error
+// code sends an empty body.
+type fakeServerHandler func(opcode int32, body []byte) (res interface{}, errCode ErrCode)
+
+// fakeServer is a minimal in-process ZooKeeper server for unit tests. It
+// completes the session handshake, answers pings and close requests, and
+// hands every other request to handler, or to an in-memory znode tree if
+// created with newFakeTreeServer. Requests on a connection are answered in
+// order, like a real server does.
+type fakeServer struct {
+	t       *testing.T
+	l       net.Listener
+	handler fakeServerHandler
+	tree    *fakeTree
+
+	mu          sync.Mutex
+	conns       map[net.Conn]int64 // connection -> session id
+	nextSession int64
+	expired     map[int64]bool
+	zxid        int64
+	connects    int
+	pings       int
+	readOnly    bool  // answer handshakes as a read-only server
+	maxTimeout  int32 // if set, the longest session timeout negotiated in ms
+	wg          sync.WaitGroup
+
+	// dropReply, if set, is called with mu held for every request after it
+	// was applied. If it returns true, the connection is closed instead of
+	// answering.
+	dropReply func(opcode int32) bool
+}
+
+// fakeConnectResponse is a connectResponse with the readOnly flag.
+type fakeConnectResponse struct {
+	ProtocolVersion int32
+	TimeOut         int32
+	SessionID       int64
+	Passwd          []byte
+	ReadOnly        bool
+}
+
+// fakePasswd is the password of every session of a fakeServer.
+var fakePasswd = []byte("0123456789abcdef")
+
+func newFakeServer(t *testing.T, handler fakeServerHandler) *fakeServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start fake server: %v", err)
+	}
+	return serveFake(t, l, handler)
+}
+
+// serveFake starts a fakeServer that accepts connections on l.
+func serveFake(t *testing.T, l net.Listener, handler fakeServerHandler) *fakeServer {
+	fs := &fakeServer{
+		t:           t,
+		l:           l,
+		handler:     handler,
+		conns:       make(map[net.Conn]int64),
+		nextSession: 0x1234,
+		expired:     make(map[int64]bool),
+	}
+	fs.wg.Add(1)
+	go fs.accept()
+	return fs
+}
+
+// newFakeTreeServer starts a fakeServer that keeps an in-memory znode tree
+// with ephemeral and sequential nodes and one-shot watches.
+func newFakeTreeServer(t *testing.T) *fakeServer {
+	fs := newFakeServer(t, nil)
+	fs.tree = newFakeTree()
+	return fs
+}
+
+// connectFake connects a client to fs with logging of info messages turned
+// off and the given options, failing the test if no session is established
+// within 5 seconds. The client is closed when the test finishes.
+func connectFake(t *testing.T, fs *fakeServer, opts ...connOption) *Conn {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, _, err := ConnectContext(ctx, []string{fs.Addr()}, 15*time.Second, append([]connOption{WithLogInfo(false)}, opts...)...)
+	if err != nil {
+		t.Fatalf("ConnectContext returned error: %v", err)
+	}
+	t.Cleanup(conn.Close)
+	return conn
+}
+
+// Addr returns the address the server listens on.
+func (fs *fakeServer) Addr() string {
+	return fs.l.Addr().String()
+}
+
+// Connects returns the number of handshakes the server completed.
+func (fs *fakeServer) Connects() int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.connects
+}
+
+// Pings returns the number of pings the server answered.
+func (fs *fakeServer) Pings() int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.pings
+}
+
+// Close stops the server and closes all connections.
+func (fs *fakeServer) Close() {
+	fs.l.Close()
+	fs.DropConns()
+	fs.wg.Wait()
+}
+
+// DropConns closes all client connections, forcing the clients to reconnect.
+func (fs *fakeServer) DropConns() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for conn := range fs.conns {
+		conn.Close()
+	}
+}
+
+// ExpireSession expires the session, deleting its ephemeral nodes and
+// closing its connections. The client learns about it when reconnecting.
+func (fs *fakeServer) ExpireSession(sessionID int64) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.expired[sessionID] = true
+	if fs.tree != nil {
+		fs.zxid++
+		fs.sendNotifications(fs.tree.expire(sessionID, fs.zxid))
+	}
+	for conn, sid := range fs.conns {
+		if sid == sessionID {
+			conn.Close()
+		}
+	}
+}
+
+// SendEvent sends a watch event to all connected clients.
+func (fs *fakeServer) SendEvent(ev watcherEvent) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for conn := range fs.conns {
+		fs.write(conn, &responseHeader{Xid: -1, Zxid: -1}, &ev)
+	}
+}
+
+// sendNotifications sends triggered watch events to the connections of
+// their sessions. Callers must hold fs.mu.
+func (fs *fakeServer) sendNotifications(notifications []fakeNotification) {
+	for _, n := range notifications {
+		for conn, sid := range fs.conns {
+			if sid == n.session {
+				ev := n.ev
+				fs.write(conn, &responseHeader{Xid: -1, Zxid: -1}, &ev)
+			}
+		}
+	}
+}
+
+func (fs *fakeServer) accept() {
+	defer fs.wg.Done()
+	for {
+		conn, err := fs.l.Accept()
+		if err != nil {
+			return
+		}
+		fs.wg.Add(1)
+		go func() {
+			defer fs.wg.Done()
+			defer conn.Close()
+			fs.serve(conn)
+		}()
+	}
+}
+
+func (fs *fakeServer) serve(conn net.Conn) {
+	body, err := fs.read(conn)
+	if err != nil {
+		return
+	}
+	req := connectRequest{}
+	if _, err := decodePacket(body, &req); err != nil {
+		fs.t.Logf("fake server: bad connect request: %v", err)
+		return
+	}
+
+	fs.mu.Lock()
+	sid := req.SessionID
+	if fs.expired[sid] || sid != 0 && !bytes.Equal(req.Passwd, fakePasswd) {
+		fs.writeBody(conn, &connectResponse{TimeOut: req.TimeOut})
+		fs.mu.Unlock()
+		return
+	}
+	if sid == 0 {
+		fs.nextSession++
+		sid = fs.nextSession
+	}
+	fs.conns[conn] = sid
+	fs.connects++
+	timeout := req.TimeOut
+	if fs.maxTimeout > 0 && timeout > fs.maxTimeout {
+		timeout = fs.maxTimeout
+	}
+	fs.writeBody(conn, &fakeConnectResponse{
+		TimeOut:   timeout,
+		SessionID: sid,
+		Passwd:    fakePasswd,
+		ReadOnly:  fs.readOnly,
+	})
+	fs.mu.Unlock()
+	defer func() {
+		fs.mu.Lock()
+		delete(fs.conns, conn)
+		fs.mu.Unlock()
+	}()
+
+	for {
+		body, err := fs.read(conn)
+		if err != nil {
+			return
+		}
+		hdr := requestHeader{}
+		n, err := decodePacket(body, &hdr)
+		if err != nil {
+			fs.t.Logf("fake server: bad request header: %v", err)
+			return
+		}
+
+		var res interface{}
+		var errCode ErrCode
+		fs.mu.Lock()
+		if fs.tree != nil && hdr.Opcode != opPing && hdr.Opcode != opClose {
+			var notifications []fakeNotification
+			fs.zxid++
+			res, errCode, notifications = fs.tree.handle(sid, fs.zxid, hdr.Opcode, body[n:])
+			fs.sendNotifications(notifications)
+		}
+		fs.mu.Unlock()
+
+		switch {
+		case hdr.Opcode == opPing:
+		case hdr.Opcode == opClose:
+			res = &closeResponse{}
+		case fs.tree == nil:
+			res, errCode = fs.handler(hdr.Opcode, body[n:])
+		}
+
+		fs.mu.Lock()
+		if fs.dropReply != nil && fs.dropReply(hdr.Opcode) {
+			fs.mu.Unlock()
+			return
+		}
+		if fs.tree == nil {
+			fs.zxid++
+		}
+		rh := &responseHeader{Xid: hdr.Xid, Zxid: fs.zxid, Err: errCode}
+		if hdr.Opcode == opPing {
+			rh.Zxid = -1
+			fs.pings++
+		}
+		if errCode != 0 {
+			res = nil
+		}
+		fs.write(conn, rh, res)
+		fs.mu.Unlock()
+
+		if hdr.Opcode == opClose {
+			if fs.tree != nil {
+				fs.ExpireSession(sid)
+			}
+			return
+		}
+	}
+}
+
+func (fs *fakeServer) read(conn net.Conn) ([]byte, error) {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(conn, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	body := make([]byte, binary.BigEndian.Uint32(lenBuf[:]))
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// write sends a response with the given header. Callers must hold fs.mu.
+func (fs *fakeServer) write(conn net.Conn, hdr *responseHeader, res interface{}) {
+	buf := make([]byte, 1<<20)
+	n, err := encodePacket(buf[4:], hdr)
+	if err != nil {
+		fs.t.Errorf("fake server: failed to encode header: %v", err)
+		return
+	}
+	if res != nil {
+		n2, err := encodePacket(buf[4+n:], res)
+		if err != nil {
+			fs.t.Errorf("fake server: failed to encode response: %v", err)
+			return
+		}
+		n += n2
+	}
+	binary.BigEndian.PutUint32(buf[:4], uint32(n))
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	conn.Write(buf[:n+4])
+}
+
+// writeBody sends a response without a header. Callers must hold fs.mu.
+func (fs *fakeServer) writeBody(conn net.Conn, res interface{}) {
+	buf := make([]byte, 1<<10)
+	n, err := encodePacket(buf[4:], res)
+	if err != nil {
+		fs.t.Errorf("fake server: failed to encode response: %v", err)
+		return
+	}
+	binary.BigEndian.PutUint32(buf[:4], uint32(n))
+	conn.Write(buf[:n+4])
+}
@@ -0,0 +1,469 @@
+package zk
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// fakeNotification is a watch event for the connections of a session.
+type fakeNotification struct {
+	session int64
+	ev      watcherEvent
+}
+
+type fakeNode struct {
+	data     []byte
+	acl      []ACL
+	stat     Stat
+	children map[string]bool
+}
+
+// fakeTree is the in-memory znode tree of a fakeServer. It supports the
+// basic operations with ephemeral and sequential nodes, one-shot data, exist
+// and child watches, and persistent recursive watches. It is not safe for
+// concurrent use; fakeServer serializes access.
+type fakeTree struct {
+	nodes            map[string]*fakeNode
+	dataWatches      map[string]map[int64]bool
+	existWatches     map[string]map[int64]bool
+	childWatches     map[string]map[int64]bool
+	recursiveWatches map[string]map[int64]bool
+	noAddWatch       bool // answer addWatch like a server before 3.6
+}
+
+func newFakeTree() *fakeTree {
+	return &fakeTree{
+		nodes:            map[string]*fakeNode{"/": {children: make(map[string]bool)}},
+		dataWatches:      make(map[string]map[int64]bool),
+		existWatches:     make(map[string]map[int64]bool),
+		childWatches:     make(map[string]map[int64]bool),
+		recursiveWatches: make(map[string]map[int64]bool),
+	}
+}
+
+func (ft *fakeTree) handle(session, zxid int64, opcode int32, body []byte) (interface{}, ErrCode, []fakeNotification) {
+	req := requestStructForOp(opcode)
+	if req == nil {
+		return nil, errUnimplemented, nil
+	}
+	if _, err := decodePacket(body, req); err != nil {
+		return nil, errMarshallingError, nil
+	}
+	if opcode == opMultiRead {
+		return ft.multiRead(session, zxid, req.(*multiRequest)), 0, nil
+	}
+	return ft.apply(session, zxid, req)
+}
+
+// apply applies a decoded request to the tree.
+func (ft *fakeTree) apply(session, zxid int64, req interface{}) (interface{}, ErrCode, []fakeNotification) {
+	switch r := req.(type) {
+	case *CreateRequest:
+		path, errCode, n := ft.create(session, zxid, r.Path, r.Data, r.Acl, r.Flags)
+		if errCode != 0 {
+			return nil, errCode, nil
+		}
+		return &createResponse{Path: path}, 0, n
+	case *DeleteRequest:
+		errCode, n := ft.delete(zxid, r.Path, r.Version)
+		return &deleteResponse{}, errCode, n
+	case *existsRequest:
+		node := ft.nodes[r.Path]
+		if node == nil {
+			if r.Watch {
+				addFakeWatch(ft.existWatches, r.Path, session)
+			}
+			return nil, errNoNode, nil
+		}
+		if r.Watch {
+			addFakeWatch(ft.dataWatches, r.Path, session)
+		}
+		return &existsResponse{Stat: node.stat}, 0, nil
+	case *getDataRequest:
+		node := ft.nodes[r.Path]
+		if node == nil {
+			return nil, errNoNode, nil
+		}
+		if r.Watch {
+			addFakeWatch(ft.dataWatches, r.Path, session)
+		}
+		return &getDataResponse{Data: node.data, Stat: node.stat}, 0, nil
+	case *SetDataRequest:
+		node := ft.nodes[r.Path]
+		if node == nil {
+			return nil, errNoNode, nil
+		}
+		if r.Version != -1 && r.Version != node.stat.Version {
+			return nil, errBadVersion, nil
+		}
+		node.data = r.Data
+		node.stat.Version++
+		node.stat.Mzxid = zxid
+		node.stat.DataLength = int32(len(r.Data))
+		n := triggerFakeWatches(ft.dataWatches, r.Path, EventNodeDataChanged)
+		n = append(n, ft.triggerRecursiveWatches(r.Path, EventNodeDataChanged)...)
+		return &setDataResponse{Stat: node.stat}, 0, n
+	case *getAclRequest:
+		node := ft.nodes[r.Path]
+		if node == nil {
+			return nil, errNoNode, nil
+		}
+		return &getAclResponse{Acl: node.acl, Stat: node.stat}, 0, nil
+	case *setAclRequest:
+		node := ft.nodes[r.Path]
+		if node == nil {
+			return nil, errNoNode, nil
+		}
+		if r.Version != -1 && r.Version != node.stat.Aversion {
+			return nil, errBadVersion, nil
+		}
+		node.acl = r.Acl
+		node.stat.Aversion++
+		return &setAclResponse{Stat: node.stat}, 0, nil
+	case *getChildren2Request:
+		node := ft.nodes[r.Path]
+		if node == nil {
+			return nil, errNoNode, nil
+		}
+		if r.Watch {
+			addFakeWatch(ft.childWatches, r.Path, session)
+		}
+		children := make([]string, 0, len(node.children))
+		for child := range node.children {
+			children = append(children, child)
+		}
+		sort.Strings(children)
+		return &getChildren2Response{Children: children, Stat: node.stat}, 0, nil
+	case *getChildrenRequest:
+		res, errCode, n := ft.apply(session, zxid, &getChildren2Request{Path: r.Path, Watch: r.Watch})
+		if errCode != 0 {
+			return nil, errCode, n
+		}
+		return &getChildrenResponse{Children: res.(*getChildren2Response).Children}, 0, n
+	case *getEphemeralsRequest:
+		ephemerals := []string{}
+		for path, node := range ft.nodes {
+			if node.stat.EphemeralOwner == session && strings.HasPrefix(path, r.PrefixPath) {
+				ephemerals = append(ephemerals, path)
+			}
+		}
+		sort.Strings(ephemerals)
+		return &getEphemeralsResponse{Ephemerals: ephemerals}, 0, nil
+	case *getAllChildrenNumberRequest:
+		if ft.nodes[r.Path] == nil {
+			return nil, errNoNode, nil
+		}
+		prefix := strings.TrimSuffix(r.Path, "/") + "/"
+		total := 0
+		for path := range ft.nodes {
+			if path != "/" && strings.HasPrefix(path, prefix) {
+				total++
+			}
+		}
+		return &getAllChildrenNumberResponse{TotalNumber: int32(total)}, 0, nil
+	case *syncRequest:
+		return &syncResponse{Path: r.Path}, 0, nil
+	case *CheckVersionRequest:
+		node := ft.nodes[r.Path]
+		if node == nil {
+			return nil, errNoNode, nil
+		}
+		if r.Version != -1 && r.Version != node.stat.Version {
+			return nil, errBadVersion, nil
+		}
+		return nil, 0, nil
+	case *multiRequest:
+		return ft.multi(session, zxid, r)
+	case *addWatchRequest:
+		if ft.noAddWatch || r.Mode != AddWatchModePersistentRecursive {
+			return nil, errUnimplemented, nil
+		}
+		addFakeWatch(ft.recursiveWatches, r.Path, session)
+		return &addWatchResponse{}, 0, nil
+	case *setWatches2Request:
+		if ft.noAddWatch {
+			return nil, errUnimplemented, nil
+		}
+		// Events missed since RelativeZxid are not sent.
+		for _, w := range []struct {
+			watches map[string]map[int64]bool
+			paths   []string
+		}{
+			{ft.dataWatches, r.DataWatches},
+			{ft.existWatches, r.ExistWatches},
+			{ft.childWatches, r.ChildWatches},
+			{ft.recursiveWatches, r.PersistentRecursiveWatches},
+		} {
+			for _, path := range w.paths {
+				addFakeWatch(w.watches, path, session)
+			}
+		}
+		return &setWatchesResponse{}, 0, nil
+	case *removeWatchesRequest:
+		var tables []map[string]map[int64]bool
+		switch r.Type {
+		case WatcherTypeChildren:
+			tables = append(tables, ft.childWatches)
+		case WatcherTypeData:
+			tables = append(tables, ft.dataWatches, ft.existWatches)
+		case WatcherTypeAny:
+			tables = append(tables, ft.dataWatches, ft.existWatches, ft.childWatches, ft.recursiveWatches)
+		case WatcherTypePersistentRecursive:
+			tables = append(tables, ft.recursiveWatches)
+		}
+		removed := false
+		for _, watches := range tables {
+			if watches[r.Path][session] {
+				delete(watches[r.Path], session)
+				removed = true
+			}
+		}
+		if !removed {
+			return nil, errNoWatcher, nil
+		}
+		return &removeWatchesResponse{}, 0, nil
+	}
+	return nil, errUnimplemented, nil
+}
+
+// multi applies all operations of the request or, if one fails, none of
+// them. Like a real server, it answers a failed multi with an error result
+// for every operation.
+func (ft *fakeTree) multi(session, zxid int64, r *multiRequest) (interface{}, ErrCode, []fakeNotification) {
+	// Find out whether all operations succeed on a copy first.
+	dry := ft.clone()
+	for i, op := range r.Ops {
+		if _, errCode, _ := dry.apply(session, zxid, op.Op); errCode != 0 {
+			res := &fakeMultiResponse{}
+			for j := range r.Ops {
+				code := ErrCode(errOk)
+				if j == i {
+					code = errCode
+				} else if j > i {
+					code = errRuntimeInconsistency
+				}
+				res.results = append(res.results, fakeMultiResult{multiHeader{Type: opError, Err: code}, &code})
+			}
+			return res, 0, nil
+		}
+	}
+
+	res := &fakeMultiResponse{}
+	var n []fakeNotification
+	for _, op := range r.Ops {
+		opRes, _, opNotifications := ft.apply(session, zxid, op.Op)
+		n = append(n, opNotifications...)
+		result := fakeMultiResult{header: multiHeader{Type: op.Header.Type}}
+		switch opRes := opRes.(type) {
+		case *createResponse:
+			result.body = &opRes.Path
+		case *setDataResponse:
+			result.body = &opRes.Stat
+		}
+		res.results = append(res.results, result)
+	}
+	return res, 0, n
+}
+
+// multiRead answers every read operation of the request on its own.
+func (ft *fakeTree) multiRead(session, zxid int64, r *multiRequest) *fakeMultiResponse {
+	res := &fakeMultiResponse{}
+	for _, op := range r.Ops {
+		opRes, errCode, _ := ft.apply(session, zxid, op.Op)
+		if errCode != 0 {
+			res.results = append(res.results, fakeMultiResult{multiHeader{Type: opError, Err: errCode}, &errCode})
+			continue
+		}
+		res.results = append(res.results, fakeMultiResult{multiHeader{Type: op.Header.Type}, opRes})
+	}
+	return res
+}
+
+// clone returns a deep copy of the tree.
+func (ft *fakeTree) clone() *fakeTree {
+	c := newFakeTree()
+	for path, node := range ft.nodes {
+		children := make(map[string]bool, len(node.children))
+		for child := range node.children {
+			children[child] = true
+		}
+		c.nodes[path] = &fakeNode{data: node.data, stat: node.stat, children: children}
+	}
+	for _, w := range []struct{ from, to map[string]map[int64]bool }{
+		{ft.dataWatches, c.dataWatches},
+		{ft.existWatches, c.existWatches},
+		{ft.childWatches, c.childWatches},
+		{ft.recursiveWatches, c.recursiveWatches},
+	} {
+		for path, sessions := range w.from {
+			for session := range sessions {
+				addFakeWatch(w.to, path, session)
+			}
+		}
+	}
+	c.noAddWatch = ft.noAddWatch
+	return c
+}
+
+// fakeMultiResult is the result of an operation of a multi request.
+type fakeMultiResult struct {
+	header multiHeader
+	body   interface{} // nil if the operation has no result
+}
+
+// fakeMultiResponse encodes the results of a multi request.
+type fakeMultiResponse struct {
+	results []fakeMultiResult
+}
+
+func (r *fakeMultiResponse) Encode(buf []byte) (int, error) {
+	total := 0
+	for _, result := range r.results {
+		n, err := encodePacketValue(buf[total:], reflect.ValueOf(&result.header))
+		total += n
+		if err != nil {
+			return total, err
+		}
+		if result.body != nil {
+			n, err := encodePacketValue(buf[total:], reflect.ValueOf(result.body))
+			total += n
+			if err != nil {
+				return total, err
+			}
+		}
+	}
+	n, err := encodePacketValue(buf[total:], reflect.ValueOf(&multiHeader{Type: -1, Done: true, Err: -1}))
+	return total + n, err
+}
+
+func (ft *fakeTree) create(session, zxid int64, path string, data []byte, acl []ACL, flags int32) (string, ErrCode, []fakeNotification) {
+	parentPath, name := fakeSplitPath(path)
+	parent := ft.nodes[parentPath]
+	if parent == nil {
+		return "", errNoNode, nil
+	}
+	if parent.stat.EphemeralOwner != 0 {
+		return "", errNoChildrenForEphemerals, nil
+	}
+	if flags&FlagSequence != 0 {
+		name = fmt.Sprintf("%s%010d", name, parent.stat.Cversion)
+		path = strings.TrimSuffix(parentPath, "/") + "/" + name
+	}
+	if ft.nodes[path] != nil {
+		return "", errNodeExists, nil
+	}
+
+	node := &fakeNode{data: data, acl: acl, children: make(map[string]bool)}
+	node.stat.Czxid = zxid
+	node.stat.Mzxid = zxid
+	node.stat.Pzxid = zxid
+	node.stat.DataLength = int32(len(data))
+	if flags&FlagEphemeral != 0 {
+		node.stat.EphemeralOwner = session
+	}
+	ft.nodes[path] = node
+	parent.children[name] = true
+	parent.stat.Cversion++
+	parent.stat.NumChildren++
+	parent.stat.Pzxid = zxid
+
+	n := triggerFakeWatches(ft.existWatches, path, EventNodeCreated)
+	n = append(n, triggerFakeWatches(ft.childWatches, parentPath, EventNodeChildrenChanged)...)
+	n = append(n, ft.triggerRecursiveWatches(path, EventNodeCreated)...)
+	return path, 0, n
+}
+
+func (ft *fakeTree) delete(zxid int64, path string, version int32) (ErrCode, []fakeNotification) {
+	node := ft.nodes[path]
+	if node == nil {
+		return errNoNode, nil
+	}
+	if version != -1 && version != node.stat.Version {
+		return errBadVersion, nil
+	}
+	if len(node.children) > 0 {
+		return errNotEmpty, nil
+	}
+
+	parentPath, name := fakeSplitPath(path)
+	parent := ft.nodes[parentPath]
+	delete(ft.nodes, path)
+	delete(parent.children, name)
+	parent.stat.Cversion++
+	parent.stat.NumChildren--
+	parent.stat.Pzxid = zxid
+
+	n := triggerFakeWatches(ft.dataWatches, path, EventNodeDeleted)
+	n = append(n, triggerFakeWatches(ft.existWatches, path, EventNodeDeleted)...)
+	n = append(n, triggerFakeWatches(ft.childWatches, path, EventNodeDeleted)...)
+	n = append(n, triggerFakeWatches(ft.childWatches, parentPath, EventNodeChildrenChanged)...)
+	n = append(n, ft.triggerRecursiveWatches(path, EventNodeDeleted)...)
+	return 0, n
+}
+
+// expire deletes the ephemeral nodes and watches of the session.
+func (ft *fakeTree) expire(session, zxid int64) []fakeNotification {
+	var paths []string
+	for path, node := range ft.nodes {
+		if node.stat.EphemeralOwner == session {
+			paths = append(paths, path)
+		}
+	}
+	var n []fakeNotification
+	for _, path := range paths {
+		_, notifications := ft.delete(zxid, path, -1)
+		n = append(n, notifications...)
+	}
+	for _, watches := range []map[string]map[int64]bool{ft.dataWatches, ft.existWatches, ft.childWatches, ft.recursiveWatches} {
+		for _, sessions := range watches {
+			delete(sessions, session)
+		}
+	}
+	return n
+}
+
+func fakeSplitPath(path string) (string, string) {
+	i := strings.LastIndexByte(path, '/')
+	if i == 0 {
+		return "/", path[1:]
+	}
+	return path[:i], path[i+1:]
+}
+
+func addFakeWatch(watches map[string]map[int64]bool, path string, session int64) {
+	if watches[path] == nil {
+		watches[path] = make(map[int64]bool)
+	}
+	watches[path][session] = true
+}
+
+func triggerFakeWatches(watches map[string]map[int64]bool, path string, typ EventType) []fakeNotification {
+	var n []fakeNotification
+	for session := range watches[path] {
+		n = append(n, fakeNotification{
+			session: session,
+			ev:      watcherEvent{Type: typ, State: StateConnected, Path: path},
+		})
+	}
+	delete(watches, path)
+	return n
+}
+
+// triggerRecursiveWatches notifies the recursive watches on path and its
+// ancestors. Unlike one-shot watches, they stay set.
+func (ft *fakeTree) triggerRecursiveWatches(path string, typ EventType) []fakeNotification {
+	var n []fakeNotification
+	for p := path; ; p, _ = fakeSplitPath(p) {
+		for session := range ft.recursiveWatches[p] {
+			n = append(n, fakeNotification{
+				session: session,
+				ev:      watcherEvent{Type: typ, State: StateConnected, Path: path},
+			})
+		}
+		if p == "/" {
+			return n
+		}
+	}
+}
@@ -60,17 +60,7 @@ func FLWSrvr(servers []string, timeout time.Duration) ([]*ServerStats, bool) {
 		match := matches[0][1:]
 
 		// determine current server
-		var srvrMode Mode
-		switch match[10] {
-		case "leader":
-			srvrMode = ModeLeader
-		case "follower":
-			srvrMode = ModeFollower
-		case "standalone":
-			srvrMode = ModeStandalone
-		default:
-			srvrMode = ModeUnknown
-		}
+		srvrMode := parseMode(match[10])
 
 		buildTime, err := time.Parse("01/02/2006 15:04 MST", match[1])
 
@@ -126,6 +116,122 @@ func FLWSrvr(servers []string, timeout time.Duration) ([]*ServerStats, bool) {
 	return ss, imOk
 }
 
+// FLWStat is a FourLetterWord helper function. In particular, this function
+// pulls the stat output from each server. It reports the same values as
+// FLWSrvr, and is meant for servers that only allow stat; the list of clients
+// it also prints is ignored, see FLWCons for that. Mode tells the leader apart
+// from the followers and observers, e.g. to check that an ensemble has
+// exactly one leader.
+//
+// As with FLWSrvr, the boolean value indicates whether one of the requests had
+// an issue. The ServerStats struct has an Error value that can be checked.
+func FLWStat(servers []string, timeout time.Duration) ([]*ServerStats, bool) {
+	servers = FormatServers(servers)
+	ss := make([]*ServerStats, len(servers))
+	imOk := true
+
+	for i := range ss {
+		response, err := fourLetterWord(servers[i], "stat", timeout)
+		if err == nil {
+			ss[i], err = parseStat(response)
+		}
+		if err != nil {
+			ss[i] = &ServerStats{Server: servers[i], Error: err}
+			imOk = false
+			continue
+		}
+		ss[i].Server = servers[i]
+	}
+
+	return ss, imOk
+}
+
+// parseStat parses the output of the stat command, which is made of
+// "Key: value" lines. The lines of the clients, which are indented, and keys
+// added by newer servers are skipped. BuildTime is left zero if the server
+// reports it in another format.
+func parseStat(response []byte) (*ServerStats, error) {
+	stats := &ServerStats{}
+	ints := map[string]*int64{
+		"Received":    &stats.Received,
+		"Sent":        &stats.Sent,
+		"Connections": &stats.Connections,
+		"Outstanding": &stats.Outstanding,
+		"Node count":  &stats.NodeCount,
+	}
+
+	hasMode := false
+	scan := bufio.NewScanner(bytes.NewReader(response))
+	for scan.Scan() {
+		line := scan.Text()
+		if strings.TrimSpace(line) == "" || line[0] == ' ' || line[0] == '\t' {
+			continue
+		}
+		key, value, ok := cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("unable to parse fields from zookeeper response (bad line %q)", line)
+		}
+		value = strings.TrimSpace(value)
+
+		var err error
+		switch key {
+		case "Zookeeper version":
+			version, built, _ := cut(value, ", built on ")
+			stats.Version = version
+			if t, err := time.Parse("01/02/2006 15:04 MST", built); err == nil {
+				stats.BuildTime = t
+			}
+		case "Latency min/avg/max":
+			lat := strings.Split(value, "/")
+			if len(lat) != 3 {
+				err = fmt.Errorf("bad value %q", value)
+				break
+			}
+			if stats.MinLatency, err = strconv.ParseInt(lat[0], 10, 64); err != nil {
+				break
+			}
+			if stats.AvgLatency, err = strconv.ParseFloat(lat[1], 64); err != nil {
+				break
+			}
+			stats.MaxLatency, err = strconv.ParseInt(lat[2], 10, 64)
+		case "Zxid":
+			var zxid int64
+			if zxid, err = strconv.ParseInt(value, 0, 64); err == nil {
+				stats.Epoch = int32(zxid >> 32)
+				stats.Counter = int32(zxid & 0xFFFFFFFF)
+			}
+		case "Mode":
+			stats.Mode = parseMode(value)
+			hasMode = true
+		default:
+			if p, ok := ints[key]; ok {
+				*p, err = strconv.ParseInt(value, 10, 64)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse %s from zookeeper response: %v", key, err)
+		}
+	}
+	if err := scan.Err(); err != nil {
+		return nil, err
+	}
+	if !hasMode {
+		return nil, fmt.Errorf("unable to parse fields from zookeeper response (no Mode)")
+	}
+	return stats, nil
+}
+
+// parseMode returns the Mode for the name of a server state, as reported by
+// the four letter words.
+func parseMode(name string) Mode {
+	for mode, n := range modeNames {
+		if n == name {
+			return mode
+		}
+	}
+	return ModeUnknown
+}
+
 // FLWRuok is a FourLetterWord helper function. In particular, this function
 // pulls the ruok output from each server.
 func FLWRuok(servers []string, timeout time.Duration) []bool {
@@ -147,94 +253,465 @@ func FLWRuok(servers []string, timeout time.Duration) []bool {
 }
 
 // FLWCons is a FourLetterWord helper function. In particular, this function
-// pulls the ruok output from each server.
+// pulls the cons output from each server, which lists the connections of its
+// clients. Connections that don't have a session yet only report their
+// address and packet counts; their other fields are left empty.
 //
 // As with FLWSrvr, the boolean value indicates whether one of the requests had
 // an issue. The Clients struct has an Error value that can be checked.
 func FLWCons(servers []string, timeout time.Duration) ([]*ServerClients, bool) {
-	const (
-		zrAddr = `^ /((?:(?:25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)\.){3}(?:25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?):(?:\d+))\[\d+\]`
-		zrPac  = `\(queued=(\d+),recved=(\d+),sent=(\d+),sid=(0x[A-Za-z0-9]+),lop=(\w+),est=(\d+),to=(\d+),`
-		zrSesh = `lcxid=(0x[A-Za-z0-9]+),lzxid=(0x[A-Za-z0-9]+),lresp=(\d+),llat=(\d+),minlat=(\d+),avglat=(\d+),maxlat=(\d+)\)`
-	)
-
-	re, err := regexp.Compile(fmt.Sprintf("%v%v%v", zrAddr, zrPac, zrSesh))
-	if err != nil {
-		return nil, false
-	}
-
 	servers = FormatServers(servers)
 	sc := make([]*ServerClients, len(servers))
 	imOk := true
 
 	for i := range sc {
 		response, err := fourLetterWord(servers[i], "cons", timeout)
-
+		if err == nil {
+			var clients []*ServerClient
+			clients, err = parseCons(response)
+			sc[i] = &ServerClients{Clients: clients}
+		}
 		if err != nil {
 			sc[i] = &ServerClients{Error: err}
 			imOk = false
+		}
+	}
+
+	return sc, imOk
+}
+
+// consLineRe matches a connection of the cons output, such as
+//
+//	/10.42.45.231:45361[1](queued=0,recved=9435,sent=9457,sid=0x94c2989e04716b5,...)
+//
+// The address may be IPv6, and may be preceded by a host name.
+var consLineRe = regexp.MustCompile(`^\s*[^\s/]*/(\S+):(\d+)\[\d+\]\((.*)\)\s*$`)
+
+// parseCons parses the output of cons.
+func parseCons(response []byte) ([]*ServerClient, error) {
+	var clients []*ServerClient
+	scan := bufio.NewScanner(bytes.NewReader(response))
+	for scan.Scan() {
+		line := scan.Text()
+		if strings.TrimSpace(line) == "" {
 			continue
 		}
+		m := consLineRe.FindStringSubmatch(line)
+		if m == nil {
+			return nil, fmt.Errorf("unable to parse fields from zookeeper response (no regex matches)")
+		}
 
-		scan := bufio.NewScanner(bytes.NewReader(response))
+		fields := make(map[string]string)
+		for _, field := range strings.Split(m[3], ",") {
+			if key, value, ok := cut(field, "="); ok {
+				fields[key] = value
+			}
+		}
+		intField := func(key string) int64 {
+			v, _ := parseInt64(fields[key])
+			return v
+		}
 
-		var clients []*ServerClient
+		addr := m[1] + ":" + m[2]
+		if strings.Contains(m[1], ":") {
+			addr = net.JoinHostPort(m[1], m[2])
+		}
+		client := &ServerClient{
+			Queued:        intField("queued"),
+			Received:      intField("recved"),
+			Sent:          intField("sent"),
+			SessionID:     intField("sid"),
+			Lcxid:         intField("lcxid"),
+			Lzxid:         intField("lzxid"),
+			Timeout:       int32(intField("to")),
+			LastLatency:   int32(intField("llat")),
+			MinLatency:    int32(intField("minlat")),
+			AvgLatency:    int32(intField("avglat")),
+			MaxLatency:    int32(intField("maxlat")),
+			Addr:          addr,
+			LastOperation: fields["lop"],
+		}
+		if _, ok := fields["sid"]; ok {
+			client.Established = time.Unix(intField("est"), 0)
+			client.LastResponse = time.Unix(intField("lresp"), 0)
+		}
+		clients = append(clients, client)
+	}
+	return clients, scan.Err()
+}
 
-		for scan.Scan() {
-			line := scan.Bytes()
+// FLWMntr is a FourLetterWord helper function. In particular, this function
+// pulls the mntr output from each server and parses its key/value lines.
+//
+// As with FLWSrvr, the boolean value indicates whether one of the requests had
+// an issue. The MntrStats struct has an Error value that can be checked.
+func FLWMntr(servers []string, timeout time.Duration) ([]*MntrStats, bool) {
+	servers = FormatServers(servers)
+	ms := make([]*MntrStats, len(servers))
+	imOk := true
 
-			if len(line) == 0 {
-				continue
+	for i := range ms {
+		response, err := fourLetterWord(servers[i], "mntr", timeout)
+		if err == nil {
+			ms[i], err = parseMntr(response)
+		}
+		if err != nil {
+			ms[i] = &MntrStats{Server: servers[i], Error: err}
+			imOk = false
+			continue
+		}
+		ms[i].Server = servers[i]
+	}
+
+	return ms, imOk
+}
+
+// parseMntr parses the output of the mntr command.
+func parseMntr(response []byte) (*MntrStats, error) {
+	stats := &MntrStats{Raw: make(map[string]string)}
+	ints := map[string]*int64{
+		"zk_min_latency":                &stats.MinLatency,
+		"zk_max_latency":                &stats.MaxLatency,
+		"zk_packets_received":           &stats.PacketsReceived,
+		"zk_packets_sent":               &stats.PacketsSent,
+		"zk_num_alive_connections":      &stats.NumAliveConnections,
+		"zk_outstanding_requests":       &stats.OutstandingRequests,
+		"zk_znode_count":                &stats.ZnodeCount,
+		"zk_watch_count":                &stats.WatchCount,
+		"zk_ephemerals_count":           &stats.EphemeralsCount,
+		"zk_approximate_data_size":      &stats.ApproximateDataSize,
+		"zk_open_file_descriptor_count": &stats.OpenFileDescriptorCount,
+		"zk_max_file_descriptor_count":  &stats.MaxFileDescriptorCount,
+		"zk_followers":                  &stats.Followers,
+		"zk_synced_followers":           &stats.SyncedFollowers,
+		"zk_pending_syncs":              &stats.PendingSyncs,
+	}
+
+	scan := bufio.NewScanner(bytes.NewReader(response))
+	for scan.Scan() {
+		line := strings.TrimSpace(scan.Text())
+		if line == "" {
+			continue
+		}
+		kv := strings.SplitN(line, "\t", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("unable to parse fields from zookeeper response (bad line %q)", line)
+		}
+		key, value := kv[0], strings.TrimSpace(kv[1])
+		stats.Raw[key] = value
+
+		var err error
+		switch key {
+		case "zk_version":
+			stats.Version = value
+		case "zk_server_state":
+			stats.ServerState = parseMode(value)
+		case "zk_avg_latency":
+			stats.AvgLatency, err = strconv.ParseFloat(value, 64)
+		default:
+			if p, ok := ints[key]; ok {
+				*p, err = strconv.ParseInt(value, 10, 64)
 			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse %s from zookeeper response: %v", key, err)
+		}
+	}
+	if err := scan.Err(); err != nil {
+		return nil, err
+	}
+	if len(stats.Raw) == 0 {
+		return nil, fmt.Errorf("unable to parse fields from zookeeper response (empty response)")
+	}
+	return stats, nil
+}
 
-			m := re.FindAllStringSubmatch(string(line), -1)
+// FLWWatches is a FourLetterWord helper function. In particular, this
+// function pulls the wchs, wchc and wchp outputs from each server, which
+// report the watches of the server. As wchc and wchp can be expensive for
+// servers with many watches, they are often disabled; such commands are
+// listed in Disabled rather than treated as an error.
+//
+// As with FLWSrvr, the boolean value indicates whether one of the requests had
+// an issue. The ServerWatches struct has an Error value that can be checked.
+func FLWWatches(servers []string, timeout time.Duration) ([]*ServerWatches, bool) {
+	re, err := regexp.Compile(`(?m:^(\d+) connections watching (\d+) paths\s*\n^Total watches:\s*(\d+))`)
+	if err != nil {
+		return nil, false
+	}
+
+	servers = FormatServers(servers)
+	sw := make([]*ServerWatches, len(servers))
+	imOk := true
+
+	for i := range sw {
+		w := &ServerWatches{Server: servers[i]}
+		sw[i] = w
 
-			if m == nil {
-				err := fmt.Errorf("unable to parse fields from zookeeper response (no regex matches)")
-				sc[i] = &ServerClients{Error: err}
-				imOk = false
+		for _, command := range []string{"wchs", "wchc", "wchp"} {
+			response, err := fourLetterWord(servers[i], command, timeout)
+			if err != nil {
+				w.Error = err
+				break
+			}
+			if bytes.Contains(response, []byte("is not executed because it is not in the whitelist")) {
+				w.Disabled = append(w.Disabled, command)
 				continue
 			}
 
-			match := m[0][1:]
-
-			queued, _ := strconv.ParseInt(match[1], 0, 64)
-			recvd, _ := strconv.ParseInt(match[2], 0, 64)
-			sent, _ := strconv.ParseInt(match[3], 0, 64)
-			sid, _ := strconv.ParseInt(match[4], 0, 64)
-			est, _ := strconv.ParseInt(match[6], 0, 64)
-			timeout, _ := strconv.ParseInt(match[7], 0, 32)
-			lcxid, _ := parseInt64(match[8])
-			lzxid, _ := parseInt64(match[9])
-			lresp, _ := strconv.ParseInt(match[10], 0, 64)
-			llat, _ := strconv.ParseInt(match[11], 0, 32)
-			minlat, _ := strconv.ParseInt(match[12], 0, 32)
-			avglat, _ := strconv.ParseInt(match[13], 0, 32)
-			maxlat, _ := strconv.ParseInt(match[14], 0, 32)
-
-			clients = append(clients, &ServerClient{
-				Queued:        queued,
-				Received:      recvd,
-				Sent:          sent,
-				SessionID:     sid,
-				Lcxid:         int64(lcxid),
-				Lzxid:         int64(lzxid),
-				Timeout:       int32(timeout),
-				LastLatency:   int32(llat),
-				MinLatency:    int32(minlat),
-				AvgLatency:    int32(avglat),
-				MaxLatency:    int32(maxlat),
-				Established:   time.Unix(est, 0),
-				LastResponse:  time.Unix(lresp, 0),
-				Addr:          match[0],
-				LastOperation: match[5],
-			})
-		}
-
-		sc[i] = &ServerClients{Clients: clients}
+			switch command {
+			case "wchs":
+				m := re.FindSubmatch(response)
+				if m == nil {
+					err = fmt.Errorf("unable to parse fields from zookeeper response (no regex matches)")
+					break
+				}
+				w.Connections, _ = strconv.ParseInt(string(m[1]), 10, 64)
+				w.Paths, _ = strconv.ParseInt(string(m[2]), 10, 64)
+				w.Total, _ = strconv.ParseInt(string(m[3]), 10, 64)
+			case "wchc":
+				w.BySession, err = parseWatchesBySession(response)
+			case "wchp":
+				w.ByPath, err = parseWatchesByPath(response)
+			}
+			if err != nil {
+				w.Error = err
+				break
+			}
+		}
+		if w.Error != nil {
+			imOk = false
+		}
 	}
 
-	return sc, imOk
+	return sw, imOk
+}
+
+// parseWatchesBySession parses the output of wchc.
+func parseWatchesBySession(response []byte) (map[int64][]string, error) {
+	lists, err := parseWatchLists(response)
+	if err != nil {
+		return nil, err
+	}
+	bySession := make(map[int64][]string, len(lists))
+	for session, paths := range lists {
+		id, err := parseInt64(session)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse session %q from zookeeper response: %v", session, err)
+		}
+		bySession[id] = paths
+	}
+	return bySession, nil
+}
+
+// parseWatchesByPath parses the output of wchp.
+func parseWatchesByPath(response []byte) (map[string][]int64, error) {
+	lists, err := parseWatchLists(response)
+	if err != nil {
+		return nil, err
+	}
+	byPath := make(map[string][]int64, len(lists))
+	for path, sessions := range lists {
+		if !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("unable to parse path %q from zookeeper response", path)
+		}
+		ids := make([]int64, len(sessions))
+		for i, session := range sessions {
+			if ids[i], err = parseInt64(session); err != nil {
+				return nil, fmt.Errorf("unable to parse session %q from zookeeper response: %v", session, err)
+			}
+		}
+		byPath[path] = ids
+	}
+	return byPath, nil
+}
+
+// parseWatchLists parses the output of wchc or wchp: each key, a session ID
+// or a path, is on a line of its own, followed by its values on indented
+// lines.
+func parseWatchLists(response []byte) (map[string][]string, error) {
+	lists := make(map[string][]string)
+	var key string
+	scan := bufio.NewScanner(bytes.NewReader(response))
+	for scan.Scan() {
+		line := scan.Text()
+		value := strings.TrimSpace(line)
+		switch {
+		case value == "":
+		case line[0] != ' ' && line[0] != '\t':
+			key = value
+			lists[key] = []string{}
+		case key == "":
+			return nil, fmt.Errorf("unable to parse fields from zookeeper response (value %q without key)", value)
+		default:
+			lists[key] = append(lists[key], value)
+		}
+	}
+	return lists, scan.Err()
+}
+
+// FLWDump is a FourLetterWord helper function. In particular, this function
+// pulls the dump output, which lists the sessions and their ephemeral nodes,
+// e.g. to find the sessions leaking ephemeral nodes. As only the leader tracks
+// all the sessions of the ensemble, the servers are asked in turn until the
+// leader answers. If none of them is the leader, the output of the first one
+// that answered is returned, with Leader set to false.
+//
+// The boolean value is false if no server answered; the DumpInfo then has the
+// Error of the last server asked.
+func FLWDump(servers []string, timeout time.Duration) (*DumpInfo, bool) {
+	servers = FormatServers(servers)
+	var info, last *DumpInfo
+
+	for _, server := range servers {
+		d := &DumpInfo{Server: server}
+		last = d
+		response, err := fourLetterWord(server, "dump", timeout)
+		if err == nil {
+			err = parseDump(response, d)
+		}
+		if err != nil {
+			d.Error = err
+			continue
+		}
+		if d.Leader {
+			return d, true
+		}
+		if info == nil {
+			info = d
+		}
+	}
+
+	if info != nil {
+		return info, true
+	}
+	if last == nil {
+		last = &DumpInfo{Error: fmt.Errorf("no servers")}
+	}
+	return last, false
+}
+
+var (
+	dumpExpireRe  = regexp.MustCompile(`^\d+ expire at (.*):$`)
+	dumpTimeoutRe = regexp.MustCompile(`^(0x[0-9a-fA-F]+)\t(\d+)ms$`)
+)
+
+// parseDump parses the output of dump into d. The leader lists its sessions
+// by when they expire:
+//
+//	SessionTracker dump:
+//	Session Sets (2)/(1):
+//	0 expire at Wed Oct 14 10:00:02 UTC 2026:
+//	1 expire at Wed Oct 14 10:00:04 UTC 2026:
+//		0x10000a1b2c30000
+//
+// while the other servers list the sessions connected to them with their
+// timeouts:
+//
+//	SessionTracker dump:
+//	Global Sessions(1):
+//	0x20000a1b2c30000	30000ms
+//
+// Both go on with the ephemeral nodes of each session:
+//
+//	ephemeral nodes dump:
+//	Sessions with Ephemerals (1):
+//	0x10000a1b2c30000:
+//		/app/members/a
+func parseDump(response []byte, d *DumpInfo) error {
+	const (
+		sectionNone = iota
+		sectionSessions
+		sectionEphemerals
+	)
+	section := sectionNone
+	found := false
+	var expires time.Time
+	var owner int64
+	hasOwner := false
+
+	d.Sessions = make(map[int64]time.Duration)
+	d.Expires = make(map[int64]time.Time)
+	d.Ephemerals = make(map[int64][]string)
+
+	scan := bufio.NewScanner(bytes.NewReader(response))
+	for scan.Scan() {
+		line := scan.Text()
+		value := strings.TrimSpace(line)
+		indented := line != "" && (line[0] == ' ' || line[0] == '\t')
+
+		switch {
+		case value == "":
+			continue
+		case value == "SessionTracker dump:":
+			section, found = sectionSessions, true
+			continue
+		case value == "ephemeral nodes dump:":
+			section = sectionEphemerals
+			continue
+		case !indented && strings.HasSuffix(value, " dump:"):
+			// Connections and any later sections.
+			section = sectionNone
+			continue
+		}
+
+		switch section {
+		case sectionSessions:
+			if strings.Contains(value, "Session Sets (") {
+				d.Leader = true
+				continue
+			}
+			if m := dumpExpireRe.FindStringSubmatch(value); m != nil {
+				// Java's Date.toString; the zero time if it doesn't parse.
+				expires, _ = time.Parse("Mon Jan 02 15:04:05 MST 2006", m[1])
+				continue
+			}
+			if m := dumpTimeoutRe.FindStringSubmatch(value); m != nil {
+				id, err := parseInt64(m[1])
+				if err != nil {
+					return fmt.Errorf("unable to parse session %q from zookeeper response: %v", m[1], err)
+				}
+				ms, _ := strconv.ParseInt(m[2], 10, 64)
+				d.Sessions[id] = time.Duration(ms) * time.Millisecond
+				continue
+			}
+			if indented && strings.HasPrefix(value, "0x") {
+				id, err := parseInt64(value)
+				if err != nil {
+					return fmt.Errorf("unable to parse session %q from zookeeper response: %v", value, err)
+				}
+				if _, ok := d.Sessions[id]; !ok {
+					d.Sessions[id] = 0
+				}
+				if !expires.IsZero() {
+					d.Expires[id] = expires
+				}
+			}
+			// Anything else, such as the headers of the lists, is skipped.
+		case sectionEphemerals:
+			switch {
+			case strings.HasPrefix(value, "Sessions with Ephemerals"):
+			case !indented && strings.HasSuffix(value, ":"):
+				id, err := parseInt64(strings.TrimSuffix(value, ":"))
+				if err != nil {
+					return fmt.Errorf("unable to parse session %q from zookeeper response: %v", value, err)
+				}
+				owner, hasOwner = id, true
+				d.Ephemerals[owner] = []string{}
+			case indented && hasOwner && strings.HasPrefix(value, "/"):
+				d.Ephemerals[owner] = append(d.Ephemerals[owner], value)
+			default:
+				return fmt.Errorf("unable to parse fields from zookeeper response (unexpected line %q)", value)
+			}
+		}
+	}
+	if err := scan.Err(); err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("unable to parse fields from zookeeper response (%q)", strings.TrimSpace(string(response)))
+	}
+	return nil
 }
 
 // parseInt64 is similar to strconv.ParseInt, but it also handles hex values that represent negative numbers
@@ -2,6 +2,8 @@ package zk
 
 import (
 	"net"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -16,12 +18,123 @@ Outstanding: 1
 Zxid: 0x110a7a8f37
 Mode: leader
 Node count: 306
+`
+	zkStatLeaderOut = `Zookeeper version: 3.6.3--6401e4ad2087061bc6b9f80dec2d69f2e3c8660a, built on 04/08/2021 16:35 GMT
+Clients:
+ /10.42.45.231:45361[1](queued=0,recved=9435,sent=9457)
+ /127.0.0.1:50702[0](queued=0,recved=1,sent=0)
+
+Latency min/avg/max: 0/0.4321/27
+Received: 10586
+Sent: 10599
+Connections: 2
+Outstanding: 0
+Zxid: 0x110a7a8f37
+Mode: leader
+Node count: 306
+Proposal sizes last/min/max: 92/36/1337
+`
+	zkStatFollowerOut = `Zookeeper version: 3.4.14-4c25d480e66aadd371de8bd2fd8da255ac140bcf, built on 03/06/2019 16:18 GMT
+Clients:
+ /127.0.0.1:50700[1](queued=0,recved=97,sent=96)
+
+Latency min/avg/max: 0/1/12
+Received: 97
+Sent: 96
+Connections: 1
+Outstanding: 0
+Zxid: 0x1100000004
+Mode: follower
+Node count: 4
 `
 	zkConsOut = ` /10.42.45.231:45361[1](queued=0,recved=9435,sent=9457,sid=0x94c2989e04716b5,lop=PING,est=1427238717217,to=20001,lcxid=0x55120915,lzxid=0xffffffffffffffff,lresp=1427259255908,llat=0,minlat=0,avglat=1,maxlat=17)
  /10.55.33.98:34342[1](queued=0,recved=9338,sent=9350,sid=0x94c2989e0471731,lop=PING,est=1427238849319,to=20001,lcxid=0x55120944,lzxid=0xffffffffffffffff,lresp=1427259252294,llat=0,minlat=0,avglat=1,maxlat=18)
  /10.44.145.114:46556[1](queued=0,recved=109253,sent=109617,sid=0x94c2989e0471709,lop=DELE,est=1427238791305,to=20001,lcxid=0x55139618,lzxid=0x110a7b187d,lresp=1427259257423,llat=2,minlat=0,avglat=1,maxlat=23)
 
 `
+	zkWchsOut = `2 connections watching 3 paths
+Total watches:4
+`
+	zkWchcOut = `0x94c2989e04716b5
+	/foo
+	/bar
+0x1000b1e0d0a0001
+	/foo
+	/baz/qux
+`
+	zkWchpOut = `/foo
+	0x94c2989e04716b5
+	0x1000b1e0d0a0001
+/bar
+	0x94c2989e04716b5
+/baz/qux
+	0x1000b1e0d0a0001
+`
+	zkDumpLeaderOut = `SessionTracker dump:
+Session Sets (3)/(2):
+0 expire at Wed Oct 14 10:00:02 UTC 2026:
+1 expire at Wed Oct 14 10:00:04 UTC 2026:
+	0x94c2989e04716b5
+1 expire at Wed Oct 14 10:00:06 UTC 2026:
+	0x1000b1e0d0a0001
+ephemeral nodes dump:
+Sessions with Ephemerals (2):
+0x94c2989e04716b5:
+	/app/lock/_c_3d1f-lock-0000000001
+	/app/members/a
+0x1000b1e0d0a0001:
+	/app/members/b
+Connections dump:
+Connections Sets (2)/(1):
+0 expire at Wed Oct 14 10:00:02 UTC 2026:
+1 expire at Wed Oct 14 10:00:12 UTC 2026:
+	ip: /127.0.0.1:50700 sessionId: 0x1000b1e0d0a0001
+`
+	zkDumpFollowerOut = `SessionTracker dump:
+Global Sessions(1):
+0x94c2989e04716b5	20000ms
+ephemeral nodes dump:
+Sessions with Ephemerals (2):
+0x94c2989e04716b5:
+	/app/lock/_c_3d1f-lock-0000000001
+	/app/members/a
+0x1000b1e0d0a0001:
+	/app/members/b
+Connections dump:
+Connections Sets (0)/(0):
+`
+	zkMntrLeaderOut = "zk_version\t3.6.3--6401e4ad2087061bc6b9f80dec2d69f2e3c8660a, built on 04/08/2021 16:35 GMT\n" +
+		"zk_server_state\tleader\n" +
+		"zk_avg_latency\t0.4321\n" +
+		"zk_max_latency\t27\n" +
+		"zk_min_latency\t0\n" +
+		"zk_packets_received\t10586\n" +
+		"zk_packets_sent\t10599\n" +
+		"zk_num_alive_connections\t4\n" +
+		"zk_outstanding_requests\t2\n" +
+		"zk_znode_count\t306\n" +
+		"zk_watch_count\t17\n" +
+		"zk_ephemerals_count\t5\n" +
+		"zk_approximate_data_size\t27879\n" +
+		"zk_open_file_descriptor_count\t73\n" +
+		"zk_max_file_descriptor_count\t1048576\n" +
+		"zk_followers\t2\n" +
+		"zk_synced_followers\t2\n" +
+		"zk_pending_syncs\t1\n" +
+		"zk_uptime\t2036713\n"
+	zkMntrFollowerOut = "zk_version\t3.4.14-4c25d480e66aadd371de8bd2fd8da255ac140bcf, built on 03/06/2019 16:18 GMT\n" +
+		"zk_avg_latency\t1\n" +
+		"zk_max_latency\t12\n" +
+		"zk_min_latency\t0\n" +
+		"zk_packets_received\t97\n" +
+		"zk_packets_sent\t96\n" +
+		"zk_num_alive_connections\t1\n" +
+		"zk_outstanding_requests\t0\n" +
+		"zk_server_state\tfollower\n" +
+		"zk_znode_count\t4\n" +
+		"zk_watch_count\t0\n" +
+		"zk_ephemerals_count\t0\n" +
+		"zk_approximate_data_size\t27\n"
 )
 
 func TestFLWRuok(t *testing.T) {
@@ -135,6 +248,329 @@ func TestFLWSrvr(t *testing.T) {
 	}
 }
 
+func TestFLWStat(t *testing.T) {
+	t.Parallel()
+	var addrs []string
+	for _, thing := range []string{"", "follower", "disabled", "dead"} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		go tcpServer(l, thing)
+		addrs = append(addrs, l.Addr().String())
+	}
+
+	stats, ok := FLWStat(addrs[:2], time.Second*10)
+	if !ok {
+		t.Fatalf("failure indicated on 'stat' parsing: %+v, %+v", stats[0], stats[1])
+	}
+	if len(stats) != 2 {
+		t.Fatalf("got %d *ServerStats instances; want 2", len(stats))
+	}
+
+	want := &ServerStats{
+		Server:      addrs[0],
+		Sent:        10599,
+		Received:    10586,
+		NodeCount:   306,
+		MinLatency:  0,
+		AvgLatency:  0.4321,
+		MaxLatency:  27,
+		Connections: 2,
+		Outstanding: 0,
+		Epoch:       17,
+		Counter:     175804215,
+		BuildTime:   time.Date(2021, 4, 8, 16, 35, 0, 0, time.UTC),
+		Mode:        ModeLeader,
+		Version:     "3.6.3--6401e4ad2087061bc6b9f80dec2d69f2e3c8660a",
+	}
+	if l := stats[0]; !l.BuildTime.Equal(want.BuildTime) {
+		t.Errorf("BuildTime is %v; want %v", l.BuildTime, want.BuildTime)
+	} else {
+		l.BuildTime = want.BuildTime
+	}
+	if !reflect.DeepEqual(stats[0], want) {
+		t.Errorf("leader stats are %+v; want %+v", stats[0], want)
+	}
+
+	f := stats[1]
+	if f.Error != nil || f.Mode != ModeFollower || f.Version != "3.4.14-4c25d480e66aadd371de8bd2fd8da255ac140bcf" ||
+		f.Received != 97 || f.Connections != 1 || f.NodeCount != 4 || f.Epoch != 17 || f.Counter != 4 {
+		t.Errorf("unexpected follower stats %+v", f)
+	}
+
+	// Servers that don't answer, or don't serve requests, are reported.
+	stats, ok = FLWStat(addrs, time.Second*10)
+	if ok {
+		t.Errorf("no failure indicated for a dead server")
+	}
+	for i, s := range stats {
+		if failed := s.Error != nil; failed != (i >= 2) || s.Server != addrs[i] {
+			t.Errorf("unexpected stats %+v for server %d", s, i)
+		}
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	for name, want := range map[string]Mode{
+		"leader":     ModeLeader,
+		"follower":   ModeFollower,
+		"standalone": ModeStandalone,
+		"observer":   ModeObserver,
+		"read-only":  ModeUnknown,
+	} {
+		if got := parseMode(name); got != want {
+			t.Errorf("parseMode(%q) = %v; want %v", name, got, want)
+		}
+	}
+}
+
+func TestFLWMntr(t *testing.T) {
+	t.Parallel()
+	leader, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leader.Close()
+	go tcpServer(leader, "")
+
+	follower, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer follower.Close()
+	go tcpServer(follower, "follower")
+
+	stats, ok := FLWMntr([]string{leader.Addr().String(), follower.Addr().String()}, time.Second*10)
+	if !ok {
+		t.Fatalf("failure indicated on 'mntr' parsing: %+v", stats)
+	}
+	if len(stats) != 2 {
+		t.Fatalf("got %d *MntrStats instances; want 2", len(stats))
+	}
+
+	want := &MntrStats{
+		Server:                  leader.Addr().String(),
+		Version:                 "3.6.3--6401e4ad2087061bc6b9f80dec2d69f2e3c8660a, built on 04/08/2021 16:35 GMT",
+		ServerState:             ModeLeader,
+		AvgLatency:              0.4321,
+		MaxLatency:              27,
+		PacketsReceived:         10586,
+		PacketsSent:             10599,
+		NumAliveConnections:     4,
+		OutstandingRequests:     2,
+		ZnodeCount:              306,
+		WatchCount:              17,
+		EphemeralsCount:         5,
+		ApproximateDataSize:     27879,
+		OpenFileDescriptorCount: 73,
+		MaxFileDescriptorCount:  1048576,
+		Followers:               2,
+		SyncedFollowers:         2,
+		PendingSyncs:            1,
+		Raw:                     stats[0].Raw,
+	}
+	if !reflect.DeepEqual(stats[0], want) {
+		t.Errorf("leader stats are %+v; want %+v", stats[0], want)
+	}
+	if len(stats[0].Raw) != 19 || stats[0].Raw["zk_uptime"] != "2036713" {
+		t.Errorf("unknown keys were not kept: %v", stats[0].Raw)
+	}
+
+	f := stats[1]
+	if f.Error != nil || f.ServerState != ModeFollower || f.AvgLatency != 1 || f.PacketsReceived != 97 || f.ZnodeCount != 4 || f.Followers != 0 {
+		t.Errorf("unexpected follower stats %+v", f)
+	}
+
+	// Servers that don't answer, or don't allow mntr, are reported.
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dead.Close()
+	go tcpServer(dead, "dead")
+
+	stats, ok = FLWMntr([]string{leader.Addr().String(), dead.Addr().String()}, time.Second*10)
+	if ok {
+		t.Errorf("no failure indicated for a dead server")
+	}
+	if stats[0].Error != nil || stats[1].Error == nil || stats[1].Server != dead.Addr().String() {
+		t.Errorf("unexpected stats %+v, %+v", stats[0], stats[1])
+	}
+}
+
+func TestFLWWatches(t *testing.T) {
+	t.Parallel()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go tcpServer(l, "")
+
+	watches, ok := FLWWatches([]string{l.Addr().String()}, time.Second*10)
+	if !ok || len(watches) != 1 {
+		t.Fatalf("failure indicated on watches parsing: %+v", watches)
+	}
+	w := watches[0]
+	if w.Error != nil || len(w.Disabled) != 0 {
+		t.Fatalf("unexpected error %v or disabled commands %q", w.Error, w.Disabled)
+	}
+	if w.Connections != 2 || w.Paths != 3 || w.Total != 4 {
+		t.Errorf("wchs parsed as %d connections, %d paths and %d watches; want 2, 3 and 4", w.Connections, w.Paths, w.Total)
+	}
+
+	// The first session ID has the high bit of the packed server ID set.
+	s1, s2 := int64(0x94c2989e04716b5), int64(0x1000b1e0d0a0001)
+	wantByPath := map[string][]int64{
+		"/foo":     {s1, s2},
+		"/bar":     {s1},
+		"/baz/qux": {s2},
+	}
+	if !reflect.DeepEqual(w.ByPath, wantByPath) {
+		t.Errorf("wchp parsed as %v; want %v", w.ByPath, wantByPath)
+	}
+	wantBySession := map[int64][]string{
+		s1: {"/foo", "/bar"},
+		s2: {"/foo", "/baz/qux"},
+	}
+	if !reflect.DeepEqual(w.BySession, wantBySession) {
+		t.Errorf("wchc parsed as %v; want %v", w.BySession, wantBySession)
+	}
+
+	// Disabled commands are reported as such.
+	disabled, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disabled.Close()
+	go tcpServer(disabled, "disabled")
+
+	watches, ok = FLWWatches([]string{disabled.Addr().String()}, time.Second*10)
+	if !ok {
+		t.Fatalf("failure indicated for disabled commands: %v", watches[0].Error)
+	}
+	w = watches[0]
+	if !reflect.DeepEqual(w.Disabled, []string{"wchc", "wchp"}) || w.ByPath != nil || w.BySession != nil || w.Total != 4 {
+		t.Errorf("unexpected watches %+v for a server with wchc and wchp disabled", w)
+	}
+
+	// Anything else is an error rather than a garbage parse.
+	if _, err := parseWatchesByPath([]byte("This ZooKeeper instance is not currently serving requests.")); err == nil {
+		t.Error("parsed an error message as wchp output")
+	}
+}
+
+func TestFLWDump(t *testing.T) {
+	t.Parallel()
+	var listeners []net.Listener
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+	listen := func(thing string) string {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners = append(listeners, l)
+		go tcpServer(l, thing)
+		return l.Addr().String()
+	}
+	leader, follower, dead, disabled := listen(""), listen("follower"), listen("dead"), listen("disabled")
+
+	s1, s2 := int64(0x94c2989e04716b5), int64(0x1000b1e0d0a0001)
+	wantEphemerals := map[int64][]string{
+		s1: {"/app/lock/_c_3d1f-lock-0000000001", "/app/members/a"},
+		s2: {"/app/members/b"},
+	}
+
+	// The leader is preferred over the servers asked before it.
+	d, ok := FLWDump([]string{dead, follower, leader}, time.Second*10)
+	if !ok || d.Error != nil {
+		t.Fatalf("failure indicated on dump parsing: %+v", d)
+	}
+	if d.Server != leader || !d.Leader {
+		t.Errorf("dump taken from %s (leader %t); want the leader %s", d.Server, d.Leader, leader)
+	}
+	if want := map[int64]time.Duration{s1: 0, s2: 0}; !reflect.DeepEqual(d.Sessions, want) {
+		t.Errorf("sessions parsed as %v; want %v", d.Sessions, want)
+	}
+	wantExpires := map[int64]time.Time{
+		s1: time.Date(2026, 10, 14, 10, 0, 4, 0, time.UTC),
+		s2: time.Date(2026, 10, 14, 10, 0, 6, 0, time.UTC),
+	}
+	if len(d.Expires) != len(wantExpires) {
+		t.Errorf("expiry times parsed as %v; want %v", d.Expires, wantExpires)
+	}
+	for id, want := range wantExpires {
+		if got := d.Expires[id]; !got.Equal(want) {
+			t.Errorf("session %#x expires at %v; want %v", id, got, want)
+		}
+	}
+	if !reflect.DeepEqual(d.Ephemerals, wantEphemerals) {
+		t.Errorf("ephemerals parsed as %v; want %v", d.Ephemerals, wantEphemerals)
+	}
+
+	// Without the leader, a follower reports its own sessions, with timeouts.
+	d, ok = FLWDump([]string{disabled, follower}, time.Second*10)
+	if !ok || d.Error != nil {
+		t.Fatalf("failure indicated on follower dump parsing: %+v", d)
+	}
+	if d.Server != follower || d.Leader {
+		t.Errorf("dump taken from %s (leader %t); want the follower %s", d.Server, d.Leader, follower)
+	}
+	if want := map[int64]time.Duration{s1: 20 * time.Second}; !reflect.DeepEqual(d.Sessions, want) {
+		t.Errorf("follower sessions parsed as %v; want %v", d.Sessions, want)
+	}
+	if !reflect.DeepEqual(d.Ephemerals, wantEphemerals) {
+		t.Errorf("follower ephemerals parsed as %v; want %v", d.Ephemerals, wantEphemerals)
+	}
+
+	// Disabled or dead servers are errors.
+	if d, ok := FLWDump([]string{dead, disabled}, time.Second*10); ok || d.Error == nil || d.Server != disabled {
+		t.Errorf("FLWDump without an answer returned %+v, %t; want the error of %s", d, ok, disabled)
+	}
+}
+
+func TestParseCons(t *testing.T) {
+	response := ` /127.0.0.1:52768[0](queued=0,recved=1,sent=0)
+ /0:0:0:0:0:0:0:1:52770[1](queued=2,recved=7,sent=6,sid=0x1000b1e0d0a0001,lop=GETD,est=1427238717,to=30000,lcxid=0x5,lzxid=0x1a,lresp=1427238718,llat=1,minlat=0,avglat=1,maxlat=3)
+ zk-client.example.com/10.0.0.7:40000[1](queued=0,recved=3,sent=3,sid=0x94c2989e04716b5,lop=PING,est=1427238717,to=20001,lcxid=0x1,lzxid=0xffffffffffffffff,lresp=1427238719,llat=0,minlat=0,avglat=0,maxlat=0)
+
+`
+	clients, err := parseCons([]byte(response))
+	if err != nil {
+		t.Fatalf("parseCons returned error: %v", err)
+	}
+	want := []*ServerClient{
+		{Received: 1, Addr: "127.0.0.1:52768"},
+		{
+			Queued: 2, Received: 7, Sent: 6, SessionID: 0x1000b1e0d0a0001, LastOperation: "GETD",
+			Established: time.Unix(1427238717, 0), Timeout: 30000, Lcxid: 5, Lzxid: 0x1a,
+			LastResponse: time.Unix(1427238718, 0), LastLatency: 1, AvgLatency: 1, MaxLatency: 3,
+			Addr: "[0:0:0:0:0:0:0:1]:52770",
+		},
+		{
+			Received: 3, Sent: 3, SessionID: 0x94c2989e04716b5, LastOperation: "PING",
+			Established: time.Unix(1427238717, 0), Timeout: 20001, Lcxid: 1, Lzxid: -1,
+			LastResponse: time.Unix(1427238719, 0), Addr: "10.0.0.7:40000",
+		},
+	}
+	if !reflect.DeepEqual(clients, want) {
+		for i := range clients {
+			t.Logf("client %d: %+v", i, clients[i])
+		}
+		t.Fatalf("parseCons returned unexpected clients")
+	}
+
+	if _, err := parseCons([]byte("This ZooKeeper instance is not currently serving requests.")); err == nil {
+		t.Error("parsed an error message as cons output")
+	}
+}
+
 func TestFLWCons(t *testing.T) {
 	t.Parallel()
 	l, err := net.Listen("tcp", "127.0.0.1:0")
@@ -317,6 +753,48 @@ func connHandler(conn net.Conn, thing string) {
 		default:
 			conn.Write([]byte(zkSrvrOut))
 		}
+	case "stat":
+		switch thing {
+		case "dead":
+			return
+		case "disabled":
+			conn.Write([]byte("This ZooKeeper instance is not currently serving requests\n"))
+		case "follower":
+			conn.Write([]byte(zkStatFollowerOut))
+		case "observer":
+			conn.Write([]byte(strings.Replace(zkStatFollowerOut, "Mode: follower", "Mode: observer", 1)))
+		default:
+			conn.Write([]byte(zkStatLeaderOut))
+		}
+	case "wchs", "wchc", "wchp":
+		switch {
+		case thing == "dead":
+			return
+		case thing == "disabled" && string(data) != "wchs":
+			conn.Write([]byte(string(data) + " is not executed because it is not in the whitelist.\n"))
+		default:
+			conn.Write([]byte(map[string]string{"wchs": zkWchsOut, "wchc": zkWchcOut, "wchp": zkWchpOut}[string(data)]))
+		}
+	case "mntr":
+		switch thing {
+		case "dead":
+			return
+		case "follower":
+			conn.Write([]byte(zkMntrFollowerOut))
+		default:
+			conn.Write([]byte(zkMntrLeaderOut))
+		}
+	case "dump":
+		switch thing {
+		case "dead":
+			return
+		case "follower":
+			conn.Write([]byte(zkDumpFollowerOut))
+		case "disabled":
+			conn.Write([]byte("dump is not executed because it is not in the whitelist.\n"))
+		default:
+			conn.Write([]byte(zkDumpLeaderOut))
+		}
 	case "cons":
 		switch thing {
 		case "dead":
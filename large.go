@@ -0,0 +1,189 @@
+package zk
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	// largeChunkSize is the size of the chunks of a large value, well below
+	// the default jute.maxbuffer of the server of 1MB.
+	largeChunkSize = 256 * 1024
+	// largeBatchSize bounds the chunk data written by a single Multi.
+	largeBatchSize = 3 * largeChunkSize
+	// largeReadRetries is how often GetLarge starts over when the value is
+	// replaced while reading it.
+	largeReadRetries = 3
+)
+
+// ErrLargeValueCorrupt is returned by GetLarge if the chunks of a value don't
+// match its manifest.
+var ErrLargeValueCorrupt = errors.New("zk: large value does not match its manifest")
+
+// largeManifest is the data of the znode of a large value. The chunks are its
+// children named <generation>-<index>.
+type largeManifest struct {
+	Generation string `json:"generation"`
+	Chunks     int    `json:"chunks"`
+	Size       int    `json:"size"`
+	SHA256     string `json:"sha256"`
+}
+
+func (m *largeManifest) chunkPath(path string, i int) string {
+	return fmt.Sprintf("%s/%s-%010d", path, m.Generation, i)
+}
+
+// SetLarge stores data at path, which may exceed the size limit of a znode:
+// it is split into chunks stored in children of path, and path holds a
+// manifest with the number of chunks, the size and the SHA-256 checksum of
+// the data. Missing parents of path are created.
+//
+// The new chunks are written first, and the manifest is replaced last, along
+// with deleting the chunks it replaces, so readers see either the old value
+// or the new one. Values of up to 768KB are written by a single Multi; larger
+// ones take several, and chunks left over by a SetLarge that failed midway
+// are deleted the next time. If another SetLarge replaced the value
+// meanwhile, it fails with ErrBadVersion. Only GetLarge reads the value, and
+// path should not be given other children.
+func (c *Conn) SetLarge(path string, data []byte) error {
+	if err := validatePath(path, false); err != nil {
+		return err
+	}
+	_, err := c.CreateRecursive(path, nil, 0, WorldACL(PermAll))
+	if err != nil && !errors.Is(err, ErrNodeExists) {
+		return err
+	}
+	_, stat, err := c.Get(path)
+	if err != nil {
+		return err
+	}
+	children, _, err := c.Children(path)
+	if err != nil {
+		return err
+	}
+
+	var gen [8]byte
+	if _, err := io.ReadFull(rand.Reader, gen[:]); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	m := &largeManifest{
+		Generation: hex.EncodeToString(gen[:]),
+		Chunks:     (len(data) + largeChunkSize - 1) / largeChunkSize,
+		Size:       len(data),
+		SHA256:     hex.EncodeToString(sum[:]),
+	}
+	manifest, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if manifest, err = c.compress(manifest); err != nil {
+		return err
+	}
+
+	var ops []interface{}
+	batch := 0
+	for i := 0; i < m.Chunks; i++ {
+		end := (i + 1) * largeChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk, err := c.compress(data[i*largeChunkSize : end])
+		if err != nil {
+			return err
+		}
+		if batch+len(chunk) > largeBatchSize {
+			if _, err := c.Multi(ops...); err != nil {
+				c.deleteLargeChunks(path, m.Generation)
+				return err
+			}
+			ops, batch = nil, 0
+		}
+		ops = append(ops, &CreateRequest{Path: m.chunkPath(path, i), Data: chunk, Acl: WorldACL(PermAll)})
+		batch += len(chunk)
+	}
+	ops = append(ops, &SetDataRequest{Path: path, Data: manifest, Version: stat.Version})
+	for _, child := range children {
+		ops = append(ops, &DeleteRequest{Path: path + "/" + child, Version: -1})
+	}
+	if _, err := c.Multi(ops...); err != nil {
+		c.deleteLargeChunks(path, m.Generation)
+		return err
+	}
+	return nil
+}
+
+// deleteLargeChunks deletes the chunks of the given generation of the large
+// value at path, after a failed SetLarge. Errors are ignored; the chunks are
+// deleted by the next SetLarge otherwise.
+func (c *Conn) deleteLargeChunks(path, generation string) {
+	children, _, err := c.Children(path)
+	if err != nil {
+		return
+	}
+	for _, child := range children {
+		if strings.HasPrefix(child, generation+"-") {
+			c.Delete(path+"/"+child, -1)
+		}
+	}
+}
+
+// GetLarge returns the value stored at path by SetLarge. It returns
+// ErrLargeValueCorrupt if the chunks don't match the manifest, e.g. if path
+// was not written by SetLarge.
+func (c *Conn) GetLarge(path string) ([]byte, error) {
+	for attempt := 0; ; attempt++ {
+		data, err := c.getLarge(path)
+		if errors.Is(err, ErrNoNode) && attempt < largeReadRetries {
+			// A chunk was deleted: the value was probably replaced
+			// since the manifest was read.
+			if ok, _, err := c.Exists(path); err == nil && ok {
+				continue
+			}
+		}
+		return data, err
+	}
+}
+
+func (c *Conn) getLarge(path string) ([]byte, error) {
+	manifest, _, err := c.Get(path)
+	if err != nil {
+		return nil, err
+	}
+	m := &largeManifest{}
+	if err := json.Unmarshal(manifest, m); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrLargeValueCorrupt, err)
+	}
+	if m.Chunks < 0 || m.Size < 0 {
+		return nil, ErrLargeValueCorrupt
+	}
+
+	// Ask for all chunks at once, so reading them takes a single round trip.
+	chunks := make([]<-chan GetResponse, m.Chunks)
+	for i := range chunks {
+		chunks[i] = c.GetAsync(m.chunkPath(path, i))
+	}
+	data := make([]byte, 0, m.Size)
+	var firstErr error
+	for _, ch := range chunks {
+		res := <-ch
+		if res.Err != nil && firstErr == nil {
+			firstErr = res.Err
+		}
+		data = append(data, res.Data...)
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	sum := sha256.Sum256(data)
+	if len(data) != m.Size || hex.EncodeToString(sum[:]) != m.SHA256 {
+		return nil, ErrLargeValueCorrupt
+	}
+	return data, nil
+}
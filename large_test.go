@@ -0,0 +1,74 @@
+package zk
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestLargeValue(t *testing.T) {
+	fs := newFakeTreeServer(t)
+	defer fs.Close()
+
+	zk := connectFake(t, fs)
+
+	data := make([]byte, 3*1024*1024+123)
+	rand.New(rand.NewSource(1)).Read(data)
+	if err := zk.SetLarge("/app/large", data); err != nil {
+		t.Fatalf("SetLarge returned error: %v", err)
+	}
+	got, err := zk.GetLarge("/app/large")
+	if err != nil {
+		t.Fatalf("GetLarge returned error: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("GetLarge returned %d bytes that differ from the %d written", len(got), len(data))
+	}
+	children, _, err := zk.Children("/app/large")
+	if err != nil {
+		t.Fatalf("Children returned error: %v", err)
+	}
+	if len(children) != 13 {
+		t.Fatalf("value is stored in %d chunks; want 13", len(children))
+	}
+
+	// A chunk left over by a failed write is deleted by the next one, as
+	// are the chunks of the replaced value.
+	if _, err := zk.Create("/app/large/0000-0000000000", []byte("partial"), 0, WorldACL(PermAll)); err != nil {
+		t.Fatalf("Create returned error: %v", err)
+	}
+	small := []byte(strings.Repeat("small", 10))
+	if err := zk.SetLarge("/app/large", small); err != nil {
+		t.Fatalf("SetLarge of a smaller value returned error: %v", err)
+	}
+	if got, err := zk.GetLarge("/app/large"); err != nil || !bytes.Equal(got, small) {
+		t.Fatalf("GetLarge returned %q, %v; want %q", got, err, small)
+	}
+	if children, _, _ := zk.Children("/app/large"); len(children) != 1 {
+		t.Fatalf("value is stored in %v; want a single chunk", children)
+	}
+
+	if err := zk.SetLarge("/app/empty", nil); err != nil {
+		t.Fatalf("SetLarge of an empty value returned error: %v", err)
+	}
+	if got, err := zk.GetLarge("/app/empty"); err != nil || len(got) != 0 {
+		t.Fatalf("GetLarge of an empty value returned %q, %v", got, err)
+	}
+
+	// The checksum catches chunks that were modified.
+	children, _, _ = zk.Children("/app/large")
+	if _, err := zk.Set("/app/large/"+children[0], []byte(strings.Repeat("SMALL", 10)), -1); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if _, err := zk.GetLarge("/app/large"); !errors.Is(err, ErrLargeValueCorrupt) {
+		t.Fatalf("GetLarge of a modified chunk returned %v; want %v", err, ErrLargeValueCorrupt)
+	}
+	if _, err := zk.GetLarge("/app"); !errors.Is(err, ErrLargeValueCorrupt) {
+		t.Fatalf("GetLarge of a znode not written by SetLarge returned %v; want %v", err, ErrLargeValueCorrupt)
+	}
+	if _, err := zk.GetLarge("/missing"); !errors.Is(err, ErrNoNode) {
+		t.Fatalf("GetLarge of a missing znode returned %v; want %v", err, ErrNoNode)
+	}
+}
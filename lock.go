@@ -1,6 +1,7 @@
 package zk
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"strconv"
@@ -8,19 +9,23 @@ import (
 )
 
 var (
-	// ErrDeadlock is returned by Lock when trying to lock twice without unlocking first
+	// ErrDeadlock is returned by the RWLock methods when trying to lock twice without unlocking first
 	ErrDeadlock = errors.New("zk: trying to acquire a lock twice")
 	// ErrNotLocked is returned by Unlock when trying to release a lock that has not first be acquired.
 	ErrNotLocked = errors.New("zk: not locked")
 )
 
-// Lock is a mutual exclusion lock.
+// Lock is a mutual exclusion lock. It is reentrant: an instance that holds the
+// lock can acquire it again, and releases it once Unlock was called as many
+// times. Reentrancy is per Lock instance, not per session: another instance
+// using the same connection has to wait for the lock like any other.
 type Lock struct {
 	c        *Conn
 	path     string
 	acl      []ACL
 	lockPath string
 	seq      int
+	count    int // number of times the lock was acquired and not released
 }
 
 // NewLock creates a new lock instance using the provided connection, path, and acl.
@@ -43,6 +48,60 @@ func parseSeq(path string) (int, error) {
 	return strconv.Atoi(parts[len(parts)-1])
 }
 
+// createLockNode creates a protected ephemeral sequential node named after
+// prefix in dir, creating dir and its parents first if they don't exist. All
+// attempts use the same GUID, so a node created by an attempt that failed
+// because the connection was lost is found instead of creating another one.
+func createLockNode(c *Conn, dir, prefix string, data []byte, acl []ACL) (string, error) {
+	prefix = fmt.Sprintf("%s/%s", dir, prefix)
+	if err := validatePath(prefix, true); err != nil {
+		return "", err
+	}
+	guid, err := newProtectedGUID()
+	if err != nil {
+		return "", err
+	}
+
+	path := ""
+	for i := 0; i < 3; i++ {
+		path, err = c.createProtectedEphemeralSequential(prefix, guid, data, acl)
+		if err == ErrConnectionClosed {
+			continue
+		} else if errors.Is(err, ErrNoNode) {
+			if err = createParentNodes(c, dir, acl); err != nil {
+				return "", err
+			}
+		} else if err == nil {
+			break
+		} else {
+			return "", err
+		}
+	}
+	return path, err
+}
+
+// createParentNodes creates the node at path and its parents, if they don't
+// exist yet.
+func createParentNodes(c *Conn, path string, acl []ACL) error {
+	parts := strings.Split(path, "/")
+	pth := ""
+	for _, p := range parts[1:] {
+		pth += "/" + p
+		exists, _, err := c.Exists(pth)
+		if err != nil {
+			return err
+		}
+		if exists == true {
+			continue
+		}
+		_, err = c.Create(pth, []byte{}, 0, acl)
+		if err != nil && !errors.Is(err, ErrNodeExists) {
+			return err
+		}
+	}
+	return nil
+}
+
 // Lock attempts to acquire the lock. It works like LockWithData, but it doesn't
 // write any data to the lock node.
 func (l *Lock) Lock() error {
@@ -51,43 +110,28 @@ func (l *Lock) Lock() error {
 
 // LockWithData attempts to acquire the lock, writing data into the lock node.
 // It will wait to return until the lock is acquired or an error occurs. If
-// this instance already has the lock then ErrDeadlock is returned.
+// this instance already has the lock, it is acquired again right away and
+// data is ignored.
 func (l *Lock) LockWithData(data []byte) error {
-	if l.lockPath != "" {
-		return ErrDeadlock
-	}
+	return l.lock(context.Background(), data)
+}
 
-	prefix := fmt.Sprintf("%s/lock-", l.path)
+// LockContext attempts to acquire the lock like Lock. If ctx is done before
+// the lock is acquired, the lock node is removed, so it doesn't block other
+// instances, and ctx.Err() is returned.
+func (l *Lock) LockContext(ctx context.Context) error {
+	return l.lock(ctx, []byte{})
+}
 
-	path := ""
-	var err error
-	for i := 0; i < 3; i++ {
-		path, err = l.c.CreateProtectedEphemeralSequential(prefix, data, l.acl)
-		if err == ErrNoNode {
-			// Create parent node.
-			parts := strings.Split(l.path, "/")
-			pth := ""
-			for _, p := range parts[1:] {
-				var exists bool
-				pth += "/" + p
-				exists, _, err = l.c.Exists(pth)
-				if err != nil {
-					return err
-				}
-				if exists == true {
-					continue
-				}
-				_, err = l.c.Create(pth, []byte{}, 0, l.acl)
-				if err != nil && err != ErrNodeExists {
-					return err
-				}
-			}
-		} else if err == nil {
-			break
-		} else {
-			return err
-		}
+// lock acquires the lock like LockWithData. If ctx is done while waiting, the
+// lock node is deleted and ctx.Err() is returned.
+func (l *Lock) lock(ctx context.Context, data []byte) error {
+	if l.lockPath != "" {
+		l.count++
+		return nil
 	}
+
+	path, err := createLockNode(l.c, l.path, "lock-", data, l.acl)
 	if err != nil {
 		return err
 	}
@@ -103,58 +147,131 @@ func (l *Lock) LockWithData(data []byte) error {
 			return err
 		}
 
-		lowestSeq := seq
-		prevSeq := -1
-		prevSeqPath := ""
-		for _, p := range children {
-			s, err := parseSeq(p)
-			if err != nil {
-				return err
-			}
-			if s < lowestSeq {
-				lowestSeq = s
-			}
-			if s < seq && s > prevSeq {
-				prevSeq = s
-				prevSeqPath = p
-			}
+		prevSeqPath, err := lockPredecessor(children, seq)
+		if err != nil {
+			return err
 		}
-
-		if seq == lowestSeq {
+		if prevSeqPath == "" {
 			// Acquired the lock
 			break
 		}
 
 		// Wait on the node next in line for the lock
 		_, _, ch, err := l.c.GetW(l.path + "/" + prevSeqPath)
-		if err != nil && err != ErrNoNode {
+		if err != nil && !errors.Is(err, ErrNoNode) {
 			return err
-		} else if err != nil && err == ErrNoNode {
+		} else if err != nil && errors.Is(err, ErrNoNode) {
 			// try again
 			continue
 		}
 
-		ev := <-ch
-		if ev.Err != nil {
-			return ev.Err
+		select {
+		case ev := <-ch:
+			if ev.Err != nil {
+				return ev.Err
+			}
+		case <-ctx.Done():
+			l.c.Delete(path, -1)
+			return ctx.Err()
 		}
 	}
 
 	l.seq = seq
 	l.lockPath = path
+	l.count = 1
 	return nil
 }
 
-// Unlock releases an acquired lock. If the lock is not currently acquired by
-// this Lock instance than ErrNotLocked is returned.
+// TryLock attempts to acquire the lock without waiting. It returns false if
+// another instance holds the lock or is waiting for it, after removing the
+// lock node it created. If this instance already has the lock, it is
+// acquired again.
+func (l *Lock) TryLock() (bool, error) {
+	if l.lockPath != "" {
+		l.count++
+		return true, nil
+	}
+
+	path, err := createLockNode(l.c, l.path, "lock-", []byte{}, l.acl)
+	if err != nil {
+		return false, err
+	}
+
+	seq, err := parseSeq(path)
+	if err != nil {
+		l.c.Delete(path, -1)
+		return false, err
+	}
+
+	children, _, err := l.c.Children(l.path)
+	if err != nil {
+		l.c.Delete(path, -1)
+		return false, err
+	}
+	prevSeqPath, err := lockPredecessor(children, seq)
+	if err != nil || prevSeqPath != "" {
+		// Don't keep the node, it would block the instances after us.
+		if delErr := l.c.Delete(path, -1); err == nil {
+			err = delErr
+		}
+		return false, err
+	}
+
+	l.seq = seq
+	l.lockPath = path
+	l.count = 1
+	return true, nil
+}
+
+// Participants returns the names of the lock nodes in the order the lock is
+// acquired: the first one holds the lock, the others wait for it. The data
+// an instance wrote with LockWithData, e.g. to identify its owner, can be
+// read from its node.
+func (l *Lock) Participants() ([]string, error) {
+	children, _, err := l.c.Children(l.path)
+	if errors.Is(err, ErrNoNode) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return sortBySeq(children)
+}
+
+// lockPredecessor returns the child with the highest sequence number lower
+// than seq, which the lock node with seq waits for, or an empty string if seq
+// is the lowest and so holds the lock.
+func lockPredecessor(children []string, seq int) (string, error) {
+	prevSeq := -1
+	prevSeqPath := ""
+	for _, p := range children {
+		s, err := parseSeq(p)
+		if err != nil {
+			return "", err
+		}
+		if s < seq && s > prevSeq {
+			prevSeq = s
+			prevSeqPath = p
+		}
+	}
+	return prevSeqPath, nil
+}
+
+// Unlock releases an acquired lock. If the lock was acquired more than once,
+// it is only released by the last matching Unlock. If the lock is not
+// currently acquired by this Lock instance than ErrNotLocked is returned.
 func (l *Lock) Unlock() error {
 	if l.lockPath == "" {
 		return ErrNotLocked
 	}
+	if l.count > 1 {
+		l.count--
+		return nil
+	}
 	if err := l.c.Delete(l.lockPath, -1); err != nil {
 		return err
 	}
 	l.lockPath = ""
 	l.seq = 0
+	l.count = 0
 	return nil
 }
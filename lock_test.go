@@ -1,6 +1,8 @@
 package zk
 
 import (
+	"context"
+	"errors"
 	"testing"
 	"time"
 )
@@ -94,6 +96,200 @@ func TestIntegration_MultiLevelLock(t *testing.T) {
 	}
 }
 
+func TestTryLock(t *testing.T) {
+	fs := newFakeTreeServer(t)
+	defer fs.Close()
+
+	conns := make([]*Conn, 2)
+	for i := range conns {
+		conns[i] = connectFake(t, fs)
+	}
+
+	acls := WorldACL(PermAll)
+	l1 := NewLock(conns[0], "/test-lock", acls)
+	l2 := NewLock(conns[1], "/test-lock", acls)
+	if ok, err := l1.TryLock(); err != nil || !ok {
+		t.Fatalf("TryLock returned %v, %v; want true, nil", ok, err)
+	}
+	if ok, err := l1.TryLock(); err != nil || !ok {
+		t.Fatalf("TryLock while holding the lock returned %v, %v; want true, nil", ok, err)
+	}
+	if err := l1.Unlock(); err != nil {
+		t.Fatalf("Unlock returned error: %v", err)
+	}
+
+	if ok, err := l2.TryLock(); err != nil || ok {
+		t.Fatalf("TryLock of a held lock returned %v, %v; want false, nil", ok, err)
+	}
+	children, _, err := conns[0].Children("/test-lock")
+	if err != nil {
+		t.Fatalf("Children returned error: %v", err)
+	}
+	if len(children) != 1 {
+		t.Fatalf("lock has nodes %v after a failed TryLock; want only the holder's", children)
+	}
+
+	if err := l1.Unlock(); err != nil {
+		t.Fatalf("Unlock returned error: %v", err)
+	}
+	if ok, err := l2.TryLock(); err != nil || !ok {
+		t.Fatalf("TryLock of a released lock returned %v, %v; want true, nil", ok, err)
+	}
+	if err := l2.Unlock(); err != nil {
+		t.Fatalf("Unlock returned error: %v", err)
+	}
+}
+
+func TestLockContext(t *testing.T) {
+	fs := newFakeTreeServer(t)
+	defer fs.Close()
+
+	conns := make([]*Conn, 2)
+	for i := range conns {
+		conns[i] = connectFake(t, fs)
+	}
+
+	acls := WorldACL(PermAll)
+	l1 := NewLock(conns[0], "/test-lock", acls)
+	if err := l1.LockContext(context.Background()); err != nil {
+		t.Fatalf("LockContext returned error: %v", err)
+	}
+	defer l1.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	locked := make(chan error, 1)
+	go func() {
+		locked <- NewLock(conns[1], "/test-lock", acls).LockContext(ctx)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		children, _, err := conns[0].Children("/test-lock")
+		if err != nil {
+			t.Fatalf("Children returned error: %v", err)
+		}
+		if len(children) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("second locker did not create its lock node")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-locked; err != context.Canceled {
+		t.Fatalf("LockContext returned %v; want %v", err, context.Canceled)
+	}
+	children, _, err := conns[0].Children("/test-lock")
+	if err != nil {
+		t.Fatalf("Children returned error: %v", err)
+	}
+	if len(children) != 1 {
+		t.Fatalf("lock has nodes %v after canceling LockContext; want only the holder's", children)
+	}
+}
+
+func TestReentrantLock(t *testing.T) {
+	fs := newFakeTreeServer(t)
+	defer fs.Close()
+
+	zk := connectFake(t, fs)
+
+	nodes := func() int {
+		children, _, err := zk.Children("/test-lock")
+		if err != nil {
+			t.Fatalf("Children returned error: %v", err)
+		}
+		return len(children)
+	}
+
+	l := NewLock(zk, "/test-lock", WorldACL(PermAll))
+	for i := 0; i < 3; i++ {
+		if err := l.Lock(); err != nil {
+			t.Fatalf("Lock %d returned error: %v", i, err)
+		}
+	}
+	if n := nodes(); n != 1 {
+		t.Fatalf("lock has %d nodes after locking three times; want 1", n)
+	}
+	for i := 0; i < 2; i++ {
+		if err := l.Unlock(); err != nil {
+			t.Fatalf("Unlock %d returned error: %v", i, err)
+		}
+		if n := nodes(); n != 1 {
+			t.Fatalf("lock node was removed by nested Unlock %d", i)
+		}
+	}
+
+	// Another instance on the same session doesn't hold the lock.
+	if ok, err := NewLock(zk, "/test-lock", WorldACL(PermAll)).TryLock(); err != nil || ok {
+		t.Fatalf("TryLock of another instance returned %v, %v; want false, nil", ok, err)
+	}
+
+	if err := l.Unlock(); err != nil {
+		t.Fatalf("Unlock returned error: %v", err)
+	}
+	if n := nodes(); n != 0 {
+		t.Fatalf("lock has %d nodes after the outermost Unlock; want 0", n)
+	}
+	if err := l.Unlock(); !errors.Is(err, ErrNotLocked) {
+		t.Fatalf("Unlock of a released lock returned %v; want %v", err, ErrNotLocked)
+	}
+}
+
+func TestLockParticipants(t *testing.T) {
+	fs := newFakeTreeServer(t)
+	defer fs.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	zk := connectFake(t, fs)
+
+	acls := WorldACL(PermAll)
+	holder := NewLock(zk, "/test-lock", acls)
+	if p, err := holder.Participants(); err != nil || len(p) != 0 {
+		t.Fatalf("Participants of an unused lock returned %v, %v; want none", p, err)
+	}
+	if err := holder.Lock(); err != nil {
+		t.Fatalf("Lock returned error: %v", err)
+	}
+	defer holder.Unlock()
+
+	// Queue waiters one at a time, so their order is known.
+	order := []string{holder.lockPath}
+	waitCtx, stop := context.WithCancel(context.Background())
+	defer stop()
+	for i := 1; i <= 3; i++ {
+		go NewLock(zk, "/test-lock", acls).LockContext(waitCtx)
+		for {
+			p, err := holder.Participants()
+			if err != nil {
+				t.Fatalf("Participants returned error: %v", err)
+			}
+			if len(p) == i+1 {
+				order = append(order, "/test-lock/"+p[i])
+				break
+			}
+			if ctx.Err() != nil {
+				t.Fatalf("waiter %d did not create its lock node", i)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	participants, err := holder.Participants()
+	if err != nil {
+		t.Fatalf("Participants returned error: %v", err)
+	}
+	if len(participants) != len(order) {
+		t.Fatalf("Participants returned %v; want %v", participants, order)
+	}
+	for i, p := range participants {
+		if "/test-lock/"+p != order[i] {
+			t.Fatalf("Participants returned %v; want the holder and waiters in order %v", participants, order)
+		}
+	}
+}
+
 func TestParseSeq(t *testing.T) {
 	const (
 		goLock       = "_c_38553bd6d1d57f710ae70ddcc3d24715-lock-0000000000"
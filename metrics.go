@@ -0,0 +1,35 @@
+package zk
+
+import "time"
+
+// MetricsRecorder is notified about the activity of a connection, e.g. to
+// export it as metrics. Its methods are called from the goroutines of the
+// connection, so they must be safe for concurrent use and return quickly.
+type MetricsRecorder interface {
+	// RecordRequest is called once the response to a request arrived, or the
+	// request failed because the connection was lost. The op is the name of
+	// the operation, e.g. "getData", and the latency is measured from sending
+	// the request.
+	RecordRequest(op string, latency time.Duration, err error)
+	// RecordReconnect is called every time the client connected again after
+	// its first connection, whether or not the session was kept.
+	RecordReconnect()
+	// RecordWatchFired is called for every event on path that triggered at
+	// least one watch.
+	RecordWatchFired(path string)
+}
+
+// WithMetrics returns a connection option that reports to the given
+// recorder. No metrics are recorded by default.
+func WithMetrics(recorder MetricsRecorder) connOption {
+	return func(c *Conn) {
+		c.metrics = recorder
+	}
+}
+
+// recordRequest reports a request that completed with err.
+func (c *Conn) recordRequest(req *request, err error) {
+	if c.metrics != nil {
+		c.metrics.RecordRequest(opNames[req.opcode], time.Since(req.sent), err)
+	}
+}
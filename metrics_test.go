@@ -0,0 +1,109 @@
+package zk
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testRecorder is a MetricsRecorder keeping everything it is told.
+type testRecorder struct {
+	mu         sync.Mutex
+	requests   []recordedRequest
+	reconnects int
+	watches    []string
+}
+
+type recordedRequest struct {
+	op      string
+	latency time.Duration
+	err     error
+}
+
+func (r *testRecorder) RecordRequest(op string, latency time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = append(r.requests, recordedRequest{op, latency, err})
+}
+
+func (r *testRecorder) RecordReconnect() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reconnects++
+}
+
+func (r *testRecorder) RecordWatchFired(path string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.watches = append(r.watches, path)
+}
+
+// reset returns the recorded requests and forgets them.
+func (r *testRecorder) reset() []recordedRequest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	requests := r.requests
+	r.requests = nil
+	return requests
+}
+
+func TestMetrics(t *testing.T) {
+	fs := newFakeTreeServer(t)
+	defer fs.Close()
+
+	r := &testRecorder{}
+	zk := connectFake(t, fs, WithMetrics(r),
+		WithReconnectBackoff(time.Millisecond, time.Millisecond, 1))
+
+	if _, err := zk.Create("/a", nil, 0, WorldACL(PermAll)); err != nil {
+		t.Fatalf("Create returned error: %v", err)
+	}
+	if _, _, err := zk.Get("/missing"); !errors.Is(err, ErrNoNode) {
+		t.Fatalf("Get returned %v; want %v", err, ErrNoNode)
+	}
+	requests := r.reset()
+	if len(requests) != 2 {
+		t.Fatalf("recorded %+v; want 2 requests", requests)
+	}
+	if requests[0].op != "create" || requests[0].err != nil || requests[0].latency <= 0 {
+		t.Fatalf("recorded %+v for Create", requests[0])
+	}
+	if requests[1].op != "getData" || requests[1].err != ErrNoNode {
+		t.Fatalf("recorded %+v for Get of a missing znode; want getData with %v", requests[1], ErrNoNode)
+	}
+
+	_, _, ech, err := zk.GetW("/a")
+	if err != nil {
+		t.Fatalf("GetW returned error: %v", err)
+	}
+	if _, err := zk.Set("/a", []byte("a"), -1); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	select {
+	case <-ech:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch did not fire")
+	}
+	r.mu.Lock()
+	if len(r.watches) != 1 || r.watches[0] != "/a" {
+		t.Fatalf("recorded fired watches %q; want [/a]", r.watches)
+	}
+	if r.reconnects != 0 {
+		t.Fatalf("recorded %d reconnects before the connection was lost", r.reconnects)
+	}
+	r.mu.Unlock()
+
+	fs.DropConns()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		r.mu.Lock()
+		n := r.reconnects
+		r.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("recorded %d reconnects; want 1", n)
+		}
+	}
+}
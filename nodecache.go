@@ -0,0 +1,149 @@
+package zk
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCacheStarted is returned by Start when the cache is already started.
+var ErrCacheStarted = errors.New("zk: cache already started")
+
+// NodeCache keeps a local copy of the data of a single node, updated through
+// watches. It mirrors Curator's NodeCache. The node doesn't need to exist: the
+// cache watches for it to be created, and goes back to that when the node is
+// deleted. Watches are restored on reconnect, and set again on a new session
+// if the session expired.
+type NodeCache struct {
+	c    *Conn
+	path string
+
+	changes chan struct{}
+
+	mu   sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+
+	valueMu sync.Mutex
+	data    []byte
+	stat    *Stat
+}
+
+// NewNodeCache creates a new cache of the node at path, using the provided
+// connection.
+func NewNodeCache(c *Conn, path string) *NodeCache {
+	return &NodeCache{
+		c:       c,
+		path:    path,
+		changes: make(chan struct{}, 1),
+	}
+}
+
+// Start loads the node and keeps the cache updated until Stop is called. The
+// cache is loaded when Start returns.
+func (nc *NodeCache) Start() error {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	if nc.done != nil {
+		return ErrCacheStarted
+	}
+	if err := validatePath(nc.path, false); err != nil {
+		return err
+	}
+	ch, err := nc.load()
+	if err != nil {
+		return err
+	}
+	nc.stop = make(chan struct{})
+	nc.done = make(chan struct{})
+	go nc.run(ch, nc.stop, nc.done)
+	return nil
+}
+
+// Stop stops updating the cache. Start can be called again afterwards.
+func (nc *NodeCache) Stop() {
+	nc.mu.Lock()
+	stop, done := nc.stop, nc.done
+	nc.stop, nc.done = nil, nil
+	nc.mu.Unlock()
+
+	if done != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// Current returns the cached data and stat of the node, or a nil stat if the
+// node doesn't exist.
+func (nc *NodeCache) Current() ([]byte, *Stat) {
+	nc.valueMu.Lock()
+	defer nc.valueMu.Unlock()
+	return nc.data, nc.stat
+}
+
+// Changes returns a channel that receives a value after the cached node
+// changed. Changes that happen before the value is received are coalesced.
+func (nc *NodeCache) Changes() <-chan struct{} {
+	return nc.changes
+}
+
+func (nc *NodeCache) run(ch <-chan Event, stop, done chan struct{}) {
+	defer close(done)
+
+	for {
+		select {
+		case ev := <-ch:
+			if errors.Is(ev.Err, ErrClosing) {
+				return
+			}
+		case <-stop:
+			return
+		}
+
+		for {
+			var err error
+			ch, err = nc.load()
+			if err == nil {
+				break
+			}
+			if errors.Is(err, ErrClosing) {
+				return
+			}
+			select {
+			case <-stop:
+				return
+			case <-nc.c.shouldQuit:
+				return
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+	}
+}
+
+// load reads the node and watches it, or watches for it to be created if it
+// doesn't exist.
+func (nc *NodeCache) load() (<-chan Event, error) {
+	data, stat, ch, err := nc.c.getDataW(nc.path)
+	if err != nil {
+		return nil, err
+	}
+	nc.update(data, stat)
+	return ch, nil
+}
+
+func (nc *NodeCache) update(data []byte, stat *Stat) {
+	nc.valueMu.Lock()
+	changed := (nc.stat == nil) != (stat == nil) ||
+		stat != nil && (*stat != *nc.stat || !bytes.Equal(data, nc.data))
+	nc.data, nc.stat = data, stat
+	nc.valueMu.Unlock()
+
+	if changed {
+		select {
+		case nc.changes <- struct{}{}:
+		default:
+		}
+	}
+}
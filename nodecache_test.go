@@ -0,0 +1,86 @@
+package zk
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNodeCache(t *testing.T) {
+	fs := newFakeTreeServer(t)
+	defer fs.Close()
+
+	conns := make([]*Conn, 2)
+	for i := range conns {
+		conns[i] = connectFake(t, fs)
+	}
+	zk := conns[1]
+
+	nc := NewNodeCache(conns[0], "/test-cache")
+	if err := nc.Start(); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+	defer nc.Stop()
+	if err := nc.Start(); !errors.Is(err, ErrCacheStarted) {
+		t.Fatalf("Start twice returned %v; want %v", err, ErrCacheStarted)
+	}
+	if data, stat := nc.Current(); data != nil || stat != nil {
+		t.Fatalf("Current of a missing node returned %q, %+v", data, stat)
+	}
+
+	// expect waits until the cache holds data, or no node if data is nil.
+	expect := func(data string, exists bool) {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			got, stat := nc.Current()
+			if (stat != nil) == exists && string(got) == data {
+				return
+			}
+			select {
+			case <-nc.Changes():
+			case <-timeout:
+				t.Fatalf("Current returned %q, %+v; want %q, exists %v", got, stat, data, exists)
+			}
+		}
+	}
+
+	acl := WorldACL(PermAll)
+	if _, err := zk.Create("/test-cache", []byte("one"), 0, acl); err != nil {
+		t.Fatalf("Create returned error: %v", err)
+	}
+	expect("one", true)
+	if _, err := zk.Set("/test-cache", []byte("two"), -1); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	expect("two", true)
+	if err := zk.Delete("/test-cache", -1); err != nil {
+		t.Fatalf("Delete returned error: %v", err)
+	}
+	expect("", false)
+
+	// Watches are restored on reconnect...
+	if _, err := zk.Create("/test-cache", []byte("three"), 0, acl); err != nil {
+		t.Fatalf("Create returned error: %v", err)
+	}
+	expect("three", true)
+	fs.DropConns()
+	for fs.Connects() < 2*len(conns) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := zk.Set("/test-cache", []byte("four"), -1); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	expect("four", true)
+
+	// ...and set again on a new session.
+	fs.ExpireSession(conns[0].SessionID())
+	if _, err := zk.Set("/test-cache", []byte("five"), -1); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	expect("five", true)
+	if _, err := zk.Set("/test-cache", []byte("six"), -1); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	expect("six", true)
+}
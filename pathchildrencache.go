@@ -0,0 +1,308 @@
+package zk
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ChildEventType is the type of a ChildEvent.
+type ChildEventType int32
+
+const (
+	// ChildAdded means a child was added to the cache.
+	ChildAdded ChildEventType = 1
+	// ChildUpdated means the data of a cached child changed.
+	ChildUpdated ChildEventType = 2
+	// ChildRemoved means a child was removed from the cache.
+	ChildRemoved ChildEventType = 3
+)
+
+var childEventNames = map[ChildEventType]string{
+	ChildAdded:   "ChildAdded",
+	ChildUpdated: "ChildUpdated",
+	ChildRemoved: "ChildRemoved",
+}
+
+func (t ChildEventType) String() string {
+	if name := childEventNames[t]; name != "" {
+		return name
+	}
+	return "Unknown"
+}
+
+// ChildData is a child cached by a PathChildrenCache. Data and Stat are only
+// set if the cache caches data.
+type ChildData struct {
+	Path string
+	Data []byte
+	Stat *Stat
+}
+
+// ChildEvent is a change of the children cached by a PathChildrenCache. For
+// ChildRemoved, the data is the last one cached.
+type ChildEvent struct {
+	Type ChildEventType
+	ChildData
+}
+
+// errCacheStopped unwinds a cache goroutine when it is stopped.
+var errCacheStopped = errors.New("zk: cache stopped")
+
+// PathChildrenCache keeps a local copy of the children of a node, and
+// optionally of their data, updated through watches. It mirrors Curator's
+// PathChildrenCache. The node doesn't need to exist. Every time the child
+// watch fires, and when the session expired, the full set of children is
+// read again and compared to the cache, so no change is missed.
+type PathChildrenCache struct {
+	c         *Conn
+	path      string
+	cacheData bool
+	events    chan ChildEvent
+
+	mu   sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+
+	valueMu  sync.Mutex
+	children map[string]*ChildData // by path
+
+	// Only used by the cache goroutine.
+	fired   chan Event
+	watched map[string]bool // children with a data watch
+}
+
+// NewPathChildrenCache creates a new cache of the children of the node at
+// path, using the provided connection. If cacheData is true, the data of
+// every child is cached and watched too.
+func NewPathChildrenCache(c *Conn, path string, cacheData bool) *PathChildrenCache {
+	return &PathChildrenCache{
+		c:         c,
+		path:      path,
+		cacheData: cacheData,
+		events:    make(chan ChildEvent, 64),
+		children:  make(map[string]*ChildData),
+	}
+}
+
+// Start starts loading the children in the background, and keeps the cache
+// updated until Stop is called. A ChildAdded event is sent for every child
+// already there.
+func (pc *PathChildrenCache) Start() error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if pc.done != nil {
+		return ErrCacheStarted
+	}
+	if err := validatePath(pc.path, false); err != nil {
+		return err
+	}
+	pc.stop = make(chan struct{})
+	pc.done = make(chan struct{})
+	go pc.run(pc.stop, pc.done)
+	return nil
+}
+
+// Stop stops updating the cache. Start can be called again afterwards.
+func (pc *PathChildrenCache) Stop() {
+	pc.mu.Lock()
+	stop, done := pc.stop, pc.done
+	pc.stop, pc.done = nil, nil
+	pc.mu.Unlock()
+
+	if done != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// Events returns the channel the changes of the cache are sent on. It must
+// be received from, or the cache stops being updated.
+func (pc *PathChildrenCache) Events() <-chan ChildEvent {
+	return pc.events
+}
+
+// Current returns the cached children, sorted by path.
+func (pc *PathChildrenCache) Current() []ChildData {
+	pc.valueMu.Lock()
+	defer pc.valueMu.Unlock()
+
+	children := make([]ChildData, 0, len(pc.children))
+	for _, child := range pc.children {
+		children = append(children, *child)
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].Path < children[j].Path })
+	return children
+}
+
+func (pc *PathChildrenCache) run(stop, done chan struct{}) {
+	defer close(done)
+
+	pc.fired = make(chan Event)
+	pc.watched = make(map[string]bool)
+	refresh := true
+	for {
+		if refresh {
+			err := pc.refresh(stop)
+			if err == errCacheStopped || errors.Is(err, ErrClosing) {
+				return
+			} else if err != nil {
+				select {
+				case <-stop:
+					return
+				case <-pc.c.shouldQuit:
+					return
+				case <-time.After(100 * time.Millisecond):
+				}
+				continue
+			}
+			refresh = false
+		}
+
+		var ev Event
+		select {
+		case ev = <-pc.fired:
+		case <-stop:
+			return
+		}
+		if errors.Is(ev.Err, ErrClosing) {
+			return
+		}
+		if ev.Path == pc.path {
+			refresh = true
+			continue
+		}
+		delete(pc.watched, ev.Path)
+		if err := pc.refreshChild(ev.Path, stop); err == errCacheStopped || errors.Is(err, ErrClosing) {
+			return
+		} else if err != nil {
+			refresh = true
+		}
+	}
+}
+
+// refresh reads the children again and watches them, updating the cache.
+func (pc *PathChildrenCache) refresh(stop chan struct{}) error {
+	var children []string
+	for {
+		var ch <-chan Event
+		var err error
+		children, _, ch, err = pc.c.ChildrenW(pc.path)
+		if err == nil {
+			pc.forward(ch, stop)
+			break
+		} else if !errors.Is(err, ErrNoNode) {
+			return err
+		}
+
+		var exists bool
+		exists, _, ch, err = pc.c.ExistsW(pc.path)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			pc.forward(ch, stop)
+			children = nil
+			break
+		}
+		// The node was created in the meantime.
+	}
+
+	current := make(map[string]bool, len(children))
+	for _, child := range children {
+		current[joinPath(pc.path, child)] = true
+	}
+	pc.valueMu.Lock()
+	var removed []*ChildData
+	for path, child := range pc.children {
+		if !current[path] {
+			removed = append(removed, child)
+			delete(pc.children, path)
+		}
+	}
+	pc.valueMu.Unlock()
+	sort.Slice(removed, func(i, j int) bool { return removed[i].Path < removed[j].Path })
+	for _, child := range removed {
+		if err := pc.emit(ChildRemoved, child, stop); err != nil {
+			return err
+		}
+	}
+
+	for _, child := range children {
+		if err := pc.refreshChild(joinPath(pc.path, child), stop); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refreshChild adds the child to the cache if it's not there yet, and reads
+// its data again if it isn't watched. Children that are gone are left to the
+// next refresh.
+func (pc *PathChildrenCache) refreshChild(path string, stop chan struct{}) error {
+	pc.valueMu.Lock()
+	cached := pc.children[path]
+	pc.valueMu.Unlock()
+
+	if !pc.cacheData {
+		if cached != nil {
+			return nil
+		}
+		child := &ChildData{Path: path}
+		pc.valueMu.Lock()
+		pc.children[path] = child
+		pc.valueMu.Unlock()
+		return pc.emit(ChildAdded, child, stop)
+	}
+
+	if pc.watched[path] {
+		return nil
+	}
+	data, stat, ch, err := pc.c.GetW(path)
+	if errors.Is(err, ErrNoNode) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	pc.watched[path] = true
+	pc.forward(ch, stop)
+
+	typ := ChildAdded
+	if cached != nil {
+		if *cached.Stat == *stat && bytes.Equal(cached.Data, data) {
+			return nil
+		}
+		typ = ChildUpdated
+	}
+	child := &ChildData{Path: path, Data: data, Stat: stat}
+	pc.valueMu.Lock()
+	pc.children[path] = child
+	pc.valueMu.Unlock()
+	return pc.emit(typ, child, stop)
+}
+
+// forward sends the event of the watch to the cache goroutine.
+func (pc *PathChildrenCache) forward(ch <-chan Event, stop chan struct{}) {
+	go func() {
+		select {
+		case ev := <-ch:
+			select {
+			case pc.fired <- ev:
+			case <-stop:
+			}
+		case <-stop:
+		}
+	}()
+}
+
+func (pc *PathChildrenCache) emit(typ ChildEventType, child *ChildData, stop chan struct{}) error {
+	select {
+	case pc.events <- ChildEvent{Type: typ, ChildData: *child}:
+		return nil
+	case <-stop:
+		return errCacheStopped
+	}
+}
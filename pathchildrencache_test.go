@@ -0,0 +1,126 @@
+package zk
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPathChildrenCache(t *testing.T) {
+	fs := newFakeTreeServer(t)
+	defer fs.Close()
+
+	conns := make([]*Conn, 2)
+	for i := range conns {
+		conns[i] = connectFake(t, fs)
+	}
+	zk := conns[1]
+
+	acl := WorldACL(PermAll)
+	if _, err := zk.Create("/test-cache", nil, 0, acl); err != nil {
+		t.Fatalf("Create returned error: %v", err)
+	}
+	if _, err := zk.Create("/test-cache/a", []byte("a1"), 0, acl); err != nil {
+		t.Fatalf("Create returned error: %v", err)
+	}
+
+	pc := NewPathChildrenCache(conns[0], "/test-cache", true)
+	if err := pc.Start(); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+	defer pc.Stop()
+
+	expect := func(typ ChildEventType, path, data string) {
+		t.Helper()
+		select {
+		case ev := <-pc.Events():
+			if ev.Type != typ || ev.Path != path || string(ev.Data) != data {
+				t.Fatalf("got event %s %s %q; want %s %s %q", ev.Type, ev.Path, ev.Data, typ, path, data)
+			}
+			if ev.Stat == nil {
+				t.Fatalf("event %s %s has no stat", ev.Type, ev.Path)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no event; want %s %s %q", typ, path, data)
+		}
+	}
+
+	expect(ChildAdded, "/test-cache/a", "a1")
+	if _, err := zk.Create("/test-cache/b", []byte("b1"), 0, acl); err != nil {
+		t.Fatalf("Create returned error: %v", err)
+	}
+	expect(ChildAdded, "/test-cache/b", "b1")
+	if _, err := zk.Set("/test-cache/a", []byte("a2"), -1); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	expect(ChildUpdated, "/test-cache/a", "a2")
+	if err := zk.Delete("/test-cache/b", -1); err != nil {
+		t.Fatalf("Delete returned error: %v", err)
+	}
+	expect(ChildRemoved, "/test-cache/b", "b1")
+	if children := pc.Current(); len(children) != 1 || children[0].Path != "/test-cache/a" || string(children[0].Data) != "a2" {
+		t.Fatalf("Current returned %+v", children)
+	}
+
+	// Changes made while the session is gone are picked up by the new one.
+	fs.ExpireSession(conns[0].SessionID())
+	if _, err := zk.Create("/test-cache/c", []byte("c1"), 0, acl); err != nil {
+		t.Fatalf("Create returned error: %v", err)
+	}
+	expect(ChildAdded, "/test-cache/c", "c1")
+	if _, err := zk.Set("/test-cache/c", []byte("c2"), -1); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	expect(ChildUpdated, "/test-cache/c", "c2")
+
+	// Deleting the node removes all children.
+	if err := zk.DeleteRecursive("/test-cache", -1); err != nil {
+		t.Fatalf("DeleteRecursive returned error: %v", err)
+	}
+	expect(ChildRemoved, "/test-cache/a", "a2")
+	expect(ChildRemoved, "/test-cache/c", "c2")
+	if children := pc.Current(); len(children) != 0 {
+		t.Fatalf("Current returned %+v after the node was deleted", children)
+	}
+	select {
+	case ev := <-pc.Events():
+		t.Fatalf("got unexpected event %s %s", ev.Type, ev.Path)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestPathChildrenCacheWithoutData(t *testing.T) {
+	fs := newFakeTreeServer(t)
+	defer fs.Close()
+
+	zk := connectFake(t, fs)
+
+	// The node doesn't exist yet.
+	pc := NewPathChildrenCache(zk, "/test-cache", false)
+	if err := pc.Start(); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+	defer pc.Stop()
+
+	acl := WorldACL(PermAll)
+	if _, err := zk.CreateRecursive("/test-cache/a", []byte("data"), 0, acl); err != nil {
+		t.Fatalf("CreateRecursive returned error: %v", err)
+	}
+	select {
+	case ev := <-pc.Events():
+		if ev.Type != ChildAdded || ev.Path != "/test-cache/a" || ev.Data != nil || ev.Stat != nil {
+			t.Fatalf("got event %+v; want %s /test-cache/a without data", ev, ChildAdded)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event for the new child")
+	}
+
+	// Data changes are not watched.
+	if _, err := zk.Set("/test-cache/a", []byte("other"), -1); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	select {
+	case ev := <-pc.Events():
+		t.Fatalf("got unexpected event %s %s", ev.Type, ev.Path)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
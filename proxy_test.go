@@ -0,0 +1,203 @@
+package zk
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeProxy is a SOCKS5 or HTTP CONNECT proxy that requires the user name
+// "user" and the password "secret".
+type fakeProxy struct {
+	t       *testing.T
+	l       net.Listener
+	useHTTP bool
+
+	mu      sync.Mutex
+	targets []string // addresses the clients asked to connect to
+}
+
+func newFakeProxy(t *testing.T, useHTTP bool) *fakeProxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen returned error: %v", err)
+	}
+	p := &fakeProxy{t: t, l: l, useHTTP: useHTTP}
+	go p.accept()
+	return p
+}
+
+func (p *fakeProxy) Close() {
+	p.l.Close()
+}
+
+func (p *fakeProxy) Targets() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.targets...)
+}
+
+func (p *fakeProxy) accept() {
+	for {
+		conn, err := p.l.Accept()
+		if err != nil {
+			return
+		}
+		go p.serve(conn)
+	}
+}
+
+func (p *fakeProxy) serve(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	var target string
+	var err error
+	if p.useHTTP {
+		target, err = p.handshakeHTTP(conn, br)
+	} else {
+		target, err = p.handshakeSOCKS5(conn, br)
+	}
+	if err != nil {
+		p.t.Logf("fake proxy: %v", err)
+		return
+	}
+	p.mu.Lock()
+	p.targets = append(p.targets, target)
+	p.mu.Unlock()
+
+	server, err := net.Dial("tcp", target)
+	if err != nil {
+		p.t.Logf("fake proxy: %v", err)
+		return
+	}
+	defer server.Close()
+	go io.Copy(server, br)
+	io.Copy(conn, server)
+}
+
+func (p *fakeProxy) handshakeSOCKS5(conn net.Conn, br *bufio.Reader) (string, error) {
+	buf := make([]byte, 256)
+	if _, err := io.ReadFull(br, buf[:2]); err != nil {
+		return "", err
+	}
+	methods := buf[1]
+	if _, err := io.ReadFull(br, buf[:methods]); err != nil {
+		return "", err
+	}
+	conn.Write([]byte{socks5Version, socks5UserPassword})
+
+	readString := func() string {
+		io.ReadFull(br, buf[:1])
+		n := buf[0]
+		io.ReadFull(br, buf[:n])
+		return string(buf[:n])
+	}
+	io.ReadFull(br, buf[:1])
+	user, password := readString(), readString()
+	if user != "user" || password != "secret" {
+		conn.Write([]byte{1, 1})
+		return "", io.ErrUnexpectedEOF
+	}
+	conn.Write([]byte{1, 0})
+
+	if _, err := io.ReadFull(br, buf[:4]); err != nil {
+		return "", err
+	}
+	if buf[3] != socks5DomainName && buf[3] != socks5IPv4 {
+		return "", io.ErrUnexpectedEOF
+	}
+	var host string
+	if buf[3] == socks5DomainName {
+		host = readString()
+	} else {
+		io.ReadFull(br, buf[:4])
+		host = net.IP(buf[:4]).String()
+	}
+	io.ReadFull(br, buf[:2])
+	port := binary.BigEndian.Uint16(buf[:2])
+	conn.Write([]byte{socks5Version, 0, 0, socks5IPv4, 127, 0, 0, 1, 0, 0})
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+func (p *fakeProxy) handshakeHTTP(conn net.Conn, br *bufio.Reader) (string, error) {
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return "", err
+	}
+	if user, password, ok := parseBasicAuth(req.Header.Get("Proxy-Authorization")); !ok || user != "user" || password != "secret" {
+		io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+		return "", io.ErrUnexpectedEOF
+	}
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	return req.Host, nil
+}
+
+func parseBasicAuth(auth string) (string, string, bool) {
+	req := &http.Request{Header: http.Header{"Authorization": {auth}}}
+	return req.BasicAuth()
+}
+
+func TestProxyDialer(t *testing.T) {
+	for _, useHTTP := range []bool{false, true} {
+		scheme := "socks5"
+		if useHTTP {
+			scheme = "http"
+		}
+		t.Run(scheme, func(t *testing.T) {
+			fs := newFakeServer(t, func(opcode int32, body []byte) (interface{}, ErrCode) {
+				return &existsResponse{}, 0
+			})
+			defer fs.Close()
+			proxy := newFakeProxy(t, useHTTP)
+			defer proxy.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			proxyURL := scheme + "://user:secret@" + proxy.l.Addr().String()
+			conn := connectFake(t, fs, WithProxyDialer(proxyURL))
+			if _, _, err := conn.Exists("/a"); err != nil {
+				t.Fatalf("Exists returned error: %v", err)
+			}
+
+			fs.DropConns()
+			for fs.Connects() < 2 {
+				if ctx.Err() != nil {
+					t.Fatal("client did not reconnect")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if _, _, err := conn.Exists("/a"); err != nil {
+				t.Fatalf("Exists after reconnecting returned error: %v", err)
+			}
+			targets := proxy.Targets()
+			if len(targets) != 2 || targets[0] != fs.Addr() || targets[1] != fs.Addr() {
+				t.Fatalf("proxy connected to %v; want %s twice", targets, fs.Addr())
+			}
+		})
+	}
+}
+
+func TestProxyDialerErrors(t *testing.T) {
+	proxy := newFakeProxy(t, false)
+	defer proxy.Close()
+
+	c := &Conn{connectTimeout: time.Second}
+	WithProxyDialer("socks5://user:wrong@" + proxy.l.Addr().String())(c)
+	if _, err := c.dialer("tcp", "127.0.0.1:2181", time.Second); err == nil {
+		t.Fatalf("dialing with a wrong password succeeded")
+	}
+
+	for _, proxyURL := range []string{"ftp://proxy:21", "socks5://", ":"} {
+		WithProxyDialer(proxyURL)(c)
+		if _, err := c.dialer("tcp", "127.0.0.1:2181", time.Second); err == nil {
+			t.Fatalf("dialing with the proxy URL %q succeeded", proxyURL)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package zk
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+const queueNodePrefix = "qn-"
+
+// Queue is a distributed FIFO queue. Entries are sequential children of the
+// queue path, so they are taken in the order they were offered.
+type Queue struct {
+	c    *Conn
+	path string
+	acl  []ACL
+}
+
+// NewQueue creates a new queue instance using the provided connection, path,
+// and acl. The path must be a node that is only used by this queue.
+func NewQueue(c *Conn, path string, acl []ACL) *Queue {
+	return &Queue{
+		c:    c,
+		path: path,
+		acl:  acl,
+	}
+}
+
+// Offer adds an entry with the given data to the end of the queue.
+func (q *Queue) Offer(data []byte) error {
+	prefix := q.path + "/" + queueNodePrefix
+	_, err := q.c.Create(prefix, data, FlagSequence, q.acl)
+	if errors.Is(err, ErrNoNode) {
+		if err = createParentNodes(q.c, q.path, q.acl); err != nil {
+			return err
+		}
+		_, err = q.c.Create(prefix, data, FlagSequence, q.acl)
+	}
+	return err
+}
+
+// Take removes the entry at the head of the queue and returns its data. It
+// waits until an entry is available.
+func (q *Queue) Take() ([]byte, error) {
+	for {
+		children, _, err := q.c.Children(q.path)
+		if errors.Is(err, ErrNoNode) {
+			if err = createParentNodes(q.c, q.path, q.acl); err != nil {
+				return nil, err
+			}
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		var ch <-chan Event
+		if len(queueEntries(children)) == 0 {
+			// Watch for new entries. ChildrenW returns any that were added
+			// in the meantime, so none can be missed.
+			children, _, ch, err = q.c.ChildrenW(q.path)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		for _, entry := range queueEntries(children) {
+			data, ok, err := q.take(entry)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				return data, nil
+			}
+		}
+
+		if ch != nil {
+			if ev := <-ch; ev.Err != nil {
+				return nil, ev.Err
+			}
+		}
+	}
+}
+
+// take reads and deletes the entry. It returns false if another consumer
+// took the entry first.
+func (q *Queue) take(entry string) ([]byte, bool, error) {
+	path := q.path + "/" + entry
+	data, _, err := q.c.Get(path)
+	if errors.Is(err, ErrNoNode) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	if err := q.c.Delete(path, -1); errors.Is(err, ErrNoNode) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
+// queueEntries returns the queue entries among children, head first.
+func queueEntries(children []string) []string {
+	entries := make([]string, 0, len(children))
+	for _, child := range children {
+		if strings.HasPrefix(child, queueNodePrefix) {
+			entries = append(entries, child)
+		}
+	}
+	// The sequence numbers have a fixed width, so they sort as strings.
+	sort.Strings(entries)
+	return entries
+}
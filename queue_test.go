@@ -0,0 +1,84 @@
+package zk
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQueue(t *testing.T) {
+	fs := newFakeTreeServer(t)
+	defer fs.Close()
+
+	const (
+		workers = 3
+		items   = 20
+	)
+	conns := make([]*Conn, workers)
+	for i := range conns {
+		conns[i] = connectFake(t, fs)
+	}
+
+	acls := WorldACL(PermAll)
+
+	// FIFO order with a single producer and consumer.
+	q := NewQueue(conns[0], "/test-queue", acls)
+	for i := 0; i < 3; i++ {
+		if err := q.Offer([]byte{byte(i)}); err != nil {
+			t.Fatalf("Offer returned error: %v", err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		data, err := q.Take()
+		if err != nil {
+			t.Fatalf("Take returned error: %v", err)
+		}
+		if len(data) != 1 || data[0] != byte(i) {
+			t.Fatalf("Take returned %v; want [%d]", data, i)
+		}
+	}
+
+	// Multiple producers and consumers; consumers start on an empty queue.
+	var mu sync.Mutex
+	taken := make(map[string]int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			q := NewQueue(conns[i], "/test-queue", acls)
+			for j := 0; j < items; j++ {
+				data, err := q.Take()
+				if err != nil {
+					t.Errorf("Take returned error: %v", err)
+					return
+				}
+				mu.Lock()
+				taken[string(data)]++
+				mu.Unlock()
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			time.Sleep(50 * time.Millisecond)
+			q := NewQueue(conns[i], "/test-queue", acls)
+			for j := 0; j < items; j++ {
+				if err := q.Offer([]byte(fmt.Sprintf("%d-%d", i, j))); err != nil {
+					t.Errorf("Offer returned error: %v", err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if len(taken) != workers*items {
+		t.Fatalf("took %d distinct items; want %d", len(taken), workers*items)
+	}
+	for item, n := range taken {
+		if n != 1 {
+			t.Errorf("item %q taken %d times", item, n)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package zk
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// quotaNode is the znode under which the server keeps the quotas, at
+	// the path of the znode they apply to.
+	quotaNode = "/zookeeper/quota"
+	// quotaLimitsNode and quotaStatsNode are the children of the quota
+	// znode of a path that hold its limits and its current usage.
+	quotaLimitsNode = "zookeeper_limits"
+	quotaStatsNode  = "zookeeper_stats"
+)
+
+// ErrNoQuota is returned by GetQuota and DeleteQuota if no quota is set on
+// the path.
+var ErrNoQuota = errors.New("zk: no quota set on the path")
+
+// Quota is the quota of a subtree, or its usage: the number of znodes,
+// counting the root of the subtree, and the total bytes of their data. -1
+// means there is no limit. By default the server only logs a warning when a
+// quota is exceeded.
+type Quota struct {
+	Count int64
+	Bytes int64
+}
+
+// String returns the quota in the format of the quota znodes, e.g.
+// "count=10,bytes=1000".
+func (q Quota) String() string {
+	return fmt.Sprintf("count=%d,bytes=%d", q.Count, q.Bytes)
+}
+
+// parseQuota parses the data of a quota znode. Other fields, such as the
+// hard limits written by ZooKeeper 3.7+, are ignored.
+func parseQuota(data []byte) (Quota, error) {
+	q := Quota{Count: -1, Bytes: -1}
+	for _, field := range strings.Split(string(data), ",") {
+		key, value, ok := cut(strings.TrimSpace(field), "=")
+		if !ok {
+			return Quota{}, fmt.Errorf("zk: invalid quota %q", data)
+		}
+		var dst *int64
+		switch key {
+		case "count":
+			dst = &q.Count
+		case "bytes":
+			dst = &q.Bytes
+		default:
+			continue
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return Quota{}, fmt.Errorf("zk: invalid quota %q: %v", data, err)
+		}
+		*dst = n
+	}
+	return q, nil
+}
+
+// SetQuota sets the quota of the subtree at path, replacing any quota
+// already set on it. The server tracks the usage from then on; see GetQuota.
+func (c *Conn) SetQuota(path string, q Quota) error {
+	if err := validateQuotaPath(path); err != nil {
+		return err
+	}
+	limits := quotaNode + path + "/" + quotaLimitsNode
+	_, err := c.CreateRecursive(limits, []byte(q.String()), 0, WorldACL(PermAll))
+	if errors.Is(err, ErrNodeExists) {
+		_, err = c.Set(limits, []byte(q.String()), -1)
+		return err
+	} else if err != nil {
+		return err
+	}
+	// Creating the stats node makes the server count the current usage.
+	_, err = c.Create(quotaNode+path+"/"+quotaStatsNode, []byte(Quota{}.String()), 0, WorldACL(PermAll))
+	if errors.Is(err, ErrNodeExists) {
+		return nil
+	}
+	return err
+}
+
+// GetQuota returns the quota of the subtree at path and its current usage.
+// It returns ErrNoQuota if no quota is set on path.
+func (c *Conn) GetQuota(path string) (limit Quota, usage Quota, err error) {
+	if err := validateQuotaPath(path); err != nil {
+		return Quota{}, Quota{}, err
+	}
+	data, _, err := c.Get(quotaNode + path + "/" + quotaLimitsNode)
+	if errors.Is(err, ErrNoNode) {
+		return Quota{}, Quota{}, ErrNoQuota
+	} else if err != nil {
+		return Quota{}, Quota{}, err
+	}
+	if limit, err = parseQuota(data); err != nil {
+		return Quota{}, Quota{}, err
+	}
+	data, _, err = c.Get(quotaNode + path + "/" + quotaStatsNode)
+	if errors.Is(err, ErrNoNode) {
+		return limit, Quota{}, nil
+	} else if err != nil {
+		return Quota{}, Quota{}, err
+	}
+	if usage, err = parseQuota(data); err != nil {
+		return Quota{}, Quota{}, err
+	}
+	return limit, usage, nil
+}
+
+// DeleteQuota removes the quota of the subtree at path, along with the quota
+// znodes of its parents that are left empty. It returns ErrNoQuota if no
+// quota is set on path.
+func (c *Conn) DeleteQuota(path string) error {
+	if err := validateQuotaPath(path); err != nil {
+		return err
+	}
+	node := quotaNode + path
+	err := c.Delete(node+"/"+quotaLimitsNode, -1)
+	if errors.Is(err, ErrNoNode) {
+		return ErrNoQuota
+	} else if err != nil {
+		return err
+	}
+	if err := c.Delete(node+"/"+quotaStatsNode, -1); err != nil && !errors.Is(err, ErrNoNode) {
+		return err
+	}
+	for ; node != quotaNode; node = node[:strings.LastIndex(node, "/")] {
+		err := c.Delete(node, -1)
+		if errors.Is(err, ErrNotEmpty) {
+			break
+		} else if err != nil && !errors.Is(err, ErrNoNode) {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateQuotaPath checks that quotas can be set on path, i.e. it is valid
+// and not the root or a znode of the server.
+func validateQuotaPath(path string) error {
+	if err := validatePath(path, false); err != nil {
+		return err
+	}
+	if path == "/" || path == "/zookeeper" || strings.HasPrefix(path, "/zookeeper/") {
+		return fmt.Errorf("zk: cannot set a quota on %s: %w", path, ErrInvalidPath)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package zk
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseQuota(t *testing.T) {
+	tests := []struct {
+		data string
+		want Quota
+	}{
+		{"count=10,bytes=1000", Quota{Count: 10, Bytes: 1000}},
+		{"count=-1,bytes=1000", Quota{Count: -1, Bytes: 1000}},
+		{"count=5,bytes=-1,countHardLimit=-1,byteHardLimit=-1", Quota{Count: 5, Bytes: -1}},
+		{"bytes=7", Quota{Count: -1, Bytes: 7}},
+	}
+	for _, tt := range tests {
+		got, err := parseQuota([]byte(tt.data))
+		if err != nil {
+			t.Errorf("parseQuota(%q) returned error: %v", tt.data, err)
+		} else if got != tt.want {
+			t.Errorf("parseQuota(%q) = %+v; want %+v", tt.data, got, tt.want)
+		}
+	}
+	for _, data := range []string{"", "count", "count=x,bytes=1"} {
+		if _, err := parseQuota([]byte(data)); err == nil {
+			t.Errorf("parseQuota(%q) succeeded; want an error", data)
+		}
+	}
+}
+
+func TestQuota(t *testing.T) {
+	fs := newFakeTreeServer(t)
+	defer fs.Close()
+
+	zk := connectFake(t, fs)
+
+	if _, _, err := zk.GetQuota("/app"); !errors.Is(err, ErrNoQuota) {
+		t.Fatalf("GetQuota without a quota returned %v; want %v", err, ErrNoQuota)
+	}
+	limit := Quota{Count: 10, Bytes: -1}
+	if err := zk.SetQuota("/app", limit); err != nil {
+		t.Fatalf("SetQuota returned error: %v", err)
+	}
+	data, _, err := zk.Get("/zookeeper/quota/app/zookeeper_limits")
+	if err != nil {
+		t.Fatalf("Get of the limits node returned error: %v", err)
+	}
+	if string(data) != "count=10,bytes=-1" {
+		t.Fatalf("limits node holds %q; want %q", data, "count=10,bytes=-1")
+	}
+
+	// The server updates the stats node as the subtree changes.
+	if _, err := zk.Set("/zookeeper/quota/app/zookeeper_stats", []byte("count=3,bytes=42"), -1); err != nil {
+		t.Fatalf("Set of the stats node returned error: %v", err)
+	}
+	gotLimit, usage, err := zk.GetQuota("/app")
+	if err != nil {
+		t.Fatalf("GetQuota returned error: %v", err)
+	}
+	if gotLimit != limit || usage != (Quota{Count: 3, Bytes: 42}) {
+		t.Fatalf("GetQuota returned %+v, %+v; want %+v, {Count:3 Bytes:42}", gotLimit, usage, limit)
+	}
+
+	limit = Quota{Count: 20, Bytes: 4096}
+	if err := zk.SetQuota("/app", limit); err != nil {
+		t.Fatalf("SetQuota of an existing quota returned error: %v", err)
+	}
+	if gotLimit, usage, err = zk.GetQuota("/app"); err != nil || gotLimit != limit || usage.Count != 3 {
+		t.Fatalf("GetQuota after updating returned %+v, %+v, %v; want %+v and the same usage", gotLimit, usage, err, limit)
+	}
+
+	if err := zk.DeleteQuota("/app"); err != nil {
+		t.Fatalf("DeleteQuota returned error: %v", err)
+	}
+	if _, _, err := zk.GetQuota("/app"); !errors.Is(err, ErrNoQuota) {
+		t.Fatalf("GetQuota after DeleteQuota returned %v; want %v", err, ErrNoQuota)
+	}
+	if ok, _, err := zk.Exists("/zookeeper/quota/app"); err != nil || ok {
+		t.Fatalf("quota node exists after DeleteQuota: %v, %v", ok, err)
+	}
+	if err := zk.DeleteQuota("/app"); !errors.Is(err, ErrNoQuota) {
+		t.Fatalf("DeleteQuota without a quota returned %v; want %v", err, ErrNoQuota)
+	}
+
+	for _, path := range []string{"/", "/zookeeper/quota", "app"} {
+		if err := zk.SetQuota(path, limit); !errors.Is(err, ErrInvalidPath) {
+			t.Errorf("SetQuota(%q) returned %v; want %v", path, err, ErrInvalidPath)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package zk
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// WithRateLimit returns a connection option that limits the requests sent to
+// the servers to rps per second on average, with bursts of up to burst
+// requests, e.g. to protect a shared ensemble. Requests over the limit block
+// until they may be sent, or fail with ErrRateLimited if
+// WithRateLimitFailFast is set. Requests with a context stop waiting once it
+// is done, with ctx.Err(). All kinds of requests count, even the Async ones;
+// pings and closing the session don't. Requests are not limited by default.
+func WithRateLimit(rps int, burst int) connOption {
+	return func(c *Conn) {
+		if rps <= 0 {
+			c.rateLimiter = nil
+			return
+		}
+		if burst < 1 {
+			burst = 1
+		}
+		c.rateLimiter = &rateLimiter{
+			rate:   float64(rps),
+			burst:  float64(burst),
+			tokens: float64(burst),
+			now:    time.Now,
+			after:  time.After,
+		}
+	}
+}
+
+// WithRateLimitFailFast returns a connection option that makes requests over
+// the limit set by WithRateLimit fail with ErrRateLimited right away, instead
+// of blocking.
+func WithRateLimitFailFast() connOption {
+	return func(c *Conn) {
+		c.rateFailFast = true
+	}
+}
+
+// rateLimiter is a token bucket. A request takes a token, and tokens are
+// added at rate per second, up to burst.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+	now   func() time.Time                     // replaced by tests
+	after func(time.Duration) <-chan time.Time // replaced by tests
+
+	mu     sync.Mutex // protects the fields below
+	tokens float64    // may be negative when requests wait for tokens
+	last   time.Time  // when tokens were last added
+}
+
+// reserve takes a token and returns how long to wait until it is available.
+// If wait is false and no token is available now, it takes none and returns
+// false.
+func (l *rateLimiter) reserve(wait bool) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0, true
+	}
+	if !wait {
+		return 0, false
+	}
+	d := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+	l.tokens--
+	return d, true
+}
+
+// cancel returns a token taken by reserve that was not used.
+func (l *rateLimiter) cancel() {
+	l.mu.Lock()
+	l.tokens++
+	l.mu.Unlock()
+}
+
+// waitRateLimit blocks until the request may be sent according to the limit
+// set by WithRateLimit.
+func (c *Conn) waitRateLimit(ctx context.Context) error {
+	if c.rateLimiter == nil {
+		return nil
+	}
+	d, ok := c.rateLimiter.reserve(!c.rateFailFast)
+	if !ok {
+		return ErrRateLimited
+	}
+	if d == 0 {
+		return nil
+	}
+	select {
+	case <-c.rateLimiter.after(d):
+		return nil
+	case <-c.shouldQuit:
+		c.rateLimiter.cancel()
+		return c.closeErr(ErrConnectionClosed)
+	case <-ctx.Done():
+		c.rateLimiter.cancel()
+		return ctx.Err()
+	}
+}
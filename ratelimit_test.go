@@ -0,0 +1,95 @@
+package zk
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock for rateLimiter whose timers fire right away,
+// advancing the clock, and that keeps the durations waited for.
+type fakeClock struct {
+	mu    sync.Mutex
+	now   time.Time
+	waits []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	c.waits = append(c.waits, d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+func (c *fakeClock) Waits() []time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]time.Duration(nil), c.waits...)
+}
+
+func TestRateLimit(t *testing.T) {
+	fs := newFakeServer(t, func(opcode int32, body []byte) (interface{}, ErrCode) {
+		return &existsResponse{}, 0
+	})
+	defer fs.Close()
+
+	conn := connectFake(t, fs, WithRateLimit(10, 2))
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	conn.rateLimiter.now = clock.Now
+	conn.rateLimiter.after = clock.After
+
+	// The burst goes through, the rest is paced at 10 per second.
+	start := clock.Now()
+	for i := 0; i < 5; i++ {
+		if _, _, err := conn.Exists("/a"); err != nil {
+			t.Fatalf("Exists %d returned error: %v", i, err)
+		}
+	}
+	waits := clock.Waits()
+	if len(waits) != 3 {
+		t.Fatalf("requests waited %v; want 3 waits", waits)
+	}
+	for _, d := range waits {
+		if d < 99*time.Millisecond || d > 101*time.Millisecond {
+			t.Fatalf("requests waited %v; want 100ms each", waits)
+		}
+	}
+	if d := clock.Now().Sub(start); d < 299*time.Millisecond {
+		t.Fatalf("5 requests took %v; want at least 300ms", d)
+	}
+
+	// Async requests count as well.
+	if res := <-conn.ExistsAsync("/a"); res.Err != nil {
+		t.Fatalf("ExistsAsync returned error: %v", res.Err)
+	}
+	if n := len(clock.Waits()); n != 4 {
+		t.Fatalf("ExistsAsync did not wait for the rate limit")
+	}
+
+	// A throttled request stops waiting once its context is done.
+	conn.rateLimiter.after = func(time.Duration) <-chan time.Time { return nil }
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := conn.GetCtx(ctx, "/a"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("GetCtx over the rate limit returned %v; want %v", err, context.Canceled)
+	}
+
+	failFast := connectFake(t, fs, WithRateLimit(1, 1), WithRateLimitFailFast())
+	if _, _, err := failFast.Exists("/a"); err != nil {
+		t.Fatalf("Exists within the burst returned error: %v", err)
+	}
+	if _, _, err := failFast.Exists("/a"); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("Exists over the rate limit returned %v; want %v", err, ErrRateLimited)
+	}
+}
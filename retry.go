@@ -0,0 +1,99 @@
+package zk
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy decides whether a read request that failed because the
+// connection was lost is sent again, once reconnected. Writes are never
+// retried, as the server may have applied them before the connection was
+// lost: retrying a Create could create the znode twice.
+type RetryPolicy interface {
+	// ShouldRetry is called with the error of the request and the number of
+	// retries already made. It returns whether to retry, and how long to
+	// wait before doing so.
+	ShouldRetry(err error, attempt int) (bool, time.Duration)
+}
+
+// WithRetryPolicy returns a connection option that retries reads according to
+// the given policy. By default they are not retried.
+func WithRetryPolicy(policy RetryPolicy) connOption {
+	return func(c *Conn) {
+		c.retryPolicy = policy
+	}
+}
+
+// NoRetry is a RetryPolicy that never retries.
+type NoRetry struct{}
+
+// ShouldRetry implements RetryPolicy.
+func (NoRetry) ShouldRetry(err error, attempt int) (bool, time.Duration) {
+	return false, 0
+}
+
+// RetryNTimes is a RetryPolicy that retries up to N times, waiting Sleep
+// before every retry.
+type RetryNTimes struct {
+	N     int
+	Sleep time.Duration
+}
+
+// ShouldRetry implements RetryPolicy.
+func (r RetryNTimes) ShouldRetry(err error, attempt int) (bool, time.Duration) {
+	return attempt < r.N, r.Sleep
+}
+
+// ExponentialBackoffRetry is a RetryPolicy that retries up to MaxRetries
+// times, waiting a random duration between BaseSleep and BaseSleep*2^n for
+// retry n, capped at MaxSleep if it is set. It mirrors Curator's policy of
+// the same name.
+type ExponentialBackoffRetry struct {
+	BaseSleep  time.Duration
+	MaxSleep   time.Duration
+	MaxRetries int
+}
+
+// ShouldRetry implements RetryPolicy.
+func (r ExponentialBackoffRetry) ShouldRetry(err error, attempt int) (bool, time.Duration) {
+	if attempt >= r.MaxRetries {
+		return false, 0
+	}
+	if attempt > 30 {
+		attempt = 30
+	}
+	sleep := r.BaseSleep * time.Duration(1+rand.Int63n(1<<uint(attempt+1)))
+	if sleep <= 0 || r.MaxSleep > 0 && sleep > r.MaxSleep {
+		sleep = r.MaxSleep
+	}
+	return true, sleep
+}
+
+// shouldRetry reports whether a request that failed with err is sent again
+// after waiting the returned delay.
+func (c *Conn) shouldRetry(opcode int32, err error, attempt int) (bool, time.Duration) {
+	if c.retryPolicy == nil || !isIdempotentOp(opcode) {
+		return false, 0
+	}
+	if err != ErrConnectionClosed && !errors.Is(err, ErrSessionExpired) {
+		return false, 0
+	}
+	select {
+	case <-c.shouldQuit:
+		return false, 0
+	default:
+	}
+	return c.retryPolicy.ShouldRetry(err, attempt)
+}
+
+// isIdempotentOp reports whether the opcode can be sent again without
+// changing the outcome if the first request was applied by the server.
+func isIdempotentOp(opcode int32) bool {
+	switch opcode {
+	case opExists, opGetData, opGetAcl, opGetChildren, opGetChildren2, opSync,
+		opGetEphemerals, opGetAllChildrenNumber, opWhoAmI, opMultiRead:
+		return true
+	}
+	return false
+}
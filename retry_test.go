@@ -0,0 +1,112 @@
+package zk
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	// The server drops the connection instead of answering the first two
+	// requests of each kind.
+	var (
+		fs      *fakeServer
+		mu      sync.Mutex
+		counts  = make(map[int32]int)
+		dropped = make(map[int32]int)
+	)
+	fs = newFakeServer(t, func(opcode int32, body []byte) (interface{}, ErrCode) {
+		mu.Lock()
+		counts[opcode]++
+		drop := dropped[opcode] < 2
+		if drop {
+			dropped[opcode]++
+		}
+		mu.Unlock()
+		if drop {
+			fs.DropConns()
+		}
+		switch opcode {
+		case opGetData:
+			return &getDataResponse{Data: []byte("data")}, 0
+		case opCreate:
+			return &createResponse{Path: "/a"}, 0
+		}
+		return nil, errUnimplemented
+	})
+	defer fs.Close()
+
+	connect := func(opts ...connOption) *Conn {
+		return connectFake(t, fs, append(opts, WithReconnectBackoff(time.Millisecond, time.Millisecond, 1))...)
+	}
+
+	zk := connect(WithRetryPolicy(RetryNTimes{N: 3, Sleep: time.Millisecond}))
+
+	data, _, err := zk.Get("/a")
+	if err != nil || string(data) != "data" {
+		t.Fatalf("Get returned %q, %v; want the data after retrying", data, err)
+	}
+	mu.Lock()
+	if counts[opGetData] != 3 {
+		t.Fatalf("server got %d getData requests; want 3", counts[opGetData])
+	}
+	mu.Unlock()
+
+	// The create may have been applied before the connection was lost, so
+	// it is not sent again.
+	if _, err := zk.Create("/a", nil, 0, WorldACL(PermAll)); err != ErrConnectionClosed {
+		t.Fatalf("Create returned %v; want %v", err, ErrConnectionClosed)
+	}
+	mu.Lock()
+	if counts[opCreate] != 1 {
+		t.Fatalf("server got %d create requests; want 1", counts[opCreate])
+	}
+	mu.Unlock()
+
+	// Without a policy, the error is returned right away.
+	mu.Lock()
+	delete(dropped, opGetData)
+	mu.Unlock()
+	zk2 := connect()
+	if _, _, err := zk2.Get("/a"); err != ErrConnectionClosed {
+		t.Fatalf("Get without a retry policy returned %v; want %v", err, ErrConnectionClosed)
+	}
+
+	// Nor once the policy gives up.
+	mu.Lock()
+	delete(dropped, opGetData)
+	mu.Unlock()
+	zk3 := connect(WithRetryPolicy(RetryNTimes{N: 1}))
+	if _, _, err := zk3.Get("/a"); err != ErrConnectionClosed {
+		t.Fatalf("Get returned %v after the policy gave up; want %v", err, ErrConnectionClosed)
+	}
+}
+
+func TestRetryPolicies(t *testing.T) {
+	if ok, _ := (NoRetry{}).ShouldRetry(ErrConnectionClosed, 0); ok {
+		t.Fatal("NoRetry retried")
+	}
+
+	n := RetryNTimes{N: 2, Sleep: time.Second}
+	for attempt, want := range []bool{true, true, false} {
+		ok, sleep := n.ShouldRetry(ErrConnectionClosed, attempt)
+		if ok != want || ok && sleep != time.Second {
+			t.Fatalf("RetryNTimes(%d) returned %v, %v; want %v, %v", attempt, ok, sleep, want, time.Second)
+		}
+	}
+
+	e := ExponentialBackoffRetry{BaseSleep: time.Millisecond, MaxSleep: 50 * time.Millisecond, MaxRetries: 10}
+	for attempt := 0; attempt < 10; attempt++ {
+		ok, sleep := e.ShouldRetry(ErrConnectionClosed, attempt)
+		max := time.Millisecond << uint(attempt+1)
+		if max > e.MaxSleep {
+			max = e.MaxSleep
+		}
+		if !ok || sleep < time.Millisecond || sleep > max {
+			t.Fatalf("ExponentialBackoffRetry(%d) returned %v, %v; want a sleep in [1ms, %v]", attempt, ok, sleep, max)
+		}
+	}
+	if ok, _ := e.ShouldRetry(ErrConnectionClosed, 10); ok {
+		t.Fatal("ExponentialBackoffRetry retried more than MaxRetries times")
+	}
+}
@@ -0,0 +1,155 @@
+package zk
+
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	// Lock node prefixes, matching Curator's InterProcessReadWriteLock.
+	readLockPrefix  = "__READ__"
+	writeLockPrefix = "__WRIT__"
+)
+
+// RWLock is a reader/writer mutual exclusion lock. Any number of readers
+// can hold the lock at the same time, while a writer holds it exclusively.
+// Readers queue behind writers that asked for the lock earlier, so writers
+// are not starved.
+type RWLock struct {
+	c         *Conn
+	path      string
+	acl       []ACL
+	rlockPath string
+	wlockPath string
+}
+
+// NewRWLock creates a new reader/writer lock instance using the provided
+// connection, path, and acl. The path must be a node that is only used by
+// this lock. A lock instance starts unlocked until RLock() or Lock() is called.
+func NewRWLock(c *Conn, path string, acl []ACL) *RWLock {
+	return &RWLock{
+		c:    c,
+		path: path,
+		acl:  acl,
+	}
+}
+
+// RLock acquires the lock for reading. It waits until no writer that asked
+// for the lock earlier holds or waits for it. If this instance already has
+// the lock then ErrDeadlock is returned.
+func (l *RWLock) RLock() error {
+	if l.rlockPath != "" || l.wlockPath != "" {
+		return ErrDeadlock
+	}
+	path, err := l.lock(readLockPrefix)
+	if err != nil {
+		return err
+	}
+	l.rlockPath = path
+	return nil
+}
+
+// RUnlock releases a lock acquired with RLock. If this instance does not
+// hold the read lock then ErrNotLocked is returned.
+func (l *RWLock) RUnlock() error {
+	if l.rlockPath == "" {
+		return ErrNotLocked
+	}
+	if err := l.c.Delete(l.rlockPath, -1); err != nil {
+		return err
+	}
+	l.rlockPath = ""
+	return nil
+}
+
+// Lock acquires the lock for writing. It waits until all readers and writers
+// that asked for the lock earlier released it. If this instance already has
+// the lock then ErrDeadlock is returned.
+func (l *RWLock) Lock() error {
+	if l.rlockPath != "" || l.wlockPath != "" {
+		return ErrDeadlock
+	}
+	path, err := l.lock(writeLockPrefix)
+	if err != nil {
+		return err
+	}
+	l.wlockPath = path
+	return nil
+}
+
+// Unlock releases a lock acquired with Lock. If this instance does not hold
+// the write lock then ErrNotLocked is returned.
+func (l *RWLock) Unlock() error {
+	if l.wlockPath == "" {
+		return ErrNotLocked
+	}
+	if err := l.c.Delete(l.wlockPath, -1); err != nil {
+		return err
+	}
+	l.wlockPath = ""
+	return nil
+}
+
+func (l *RWLock) lock(prefix string) (string, error) {
+	path, err := createLockNode(l.c, l.path, prefix, []byte{}, l.acl)
+	if err != nil {
+		return "", err
+	}
+
+	seq, err := parseSeq(path)
+	if err != nil {
+		return "", err
+	}
+
+	for {
+		children, _, err := l.c.Children(l.path)
+		if err != nil {
+			return "", err
+		}
+
+		prev, err := rwLockPredecessor(children, seq, prefix == writeLockPrefix)
+		if err != nil {
+			return "", err
+		}
+		if prev == "" {
+			// Acquired the lock
+			return path, nil
+		}
+
+		// Wait on the node we have to wait for
+		_, _, ch, err := l.c.GetW(l.path + "/" + prev)
+		if err != nil && !errors.Is(err, ErrNoNode) {
+			return "", err
+		} else if err != nil && errors.Is(err, ErrNoNode) {
+			// try again
+			continue
+		}
+
+		ev := <-ch
+		if ev.Err != nil {
+			return "", ev.Err
+		}
+	}
+}
+
+// rwLockPredecessor returns the child the lock node with sequence number seq
+// has to wait for, or "" if the lock is acquired. A writer waits for the
+// closest earlier node of any kind, a reader for the closest earlier writer.
+func rwLockPredecessor(children []string, seq int, write bool) (string, error) {
+	prevSeq := -1
+	prev := ""
+	for _, p := range children {
+		s, err := parseSeq(p)
+		if err != nil {
+			return "", err
+		}
+		if !write && strings.Contains(p, readLockPrefix) {
+			continue
+		}
+		if s < seq && s > prevSeq {
+			prevSeq = s
+			prev = p
+		}
+	}
+	return prev, nil
+}
@@ -0,0 +1,138 @@
+package zk
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestIntegration_RWLock(t *testing.T) {
+	ts, err := StartTestCluster(t, 1, nil, logWriter{t: t, p: "[ZKERR] "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Stop()
+	zk, _, err := ts.ConnectAll()
+	if err != nil {
+		t.Fatalf("Connect returned error: %+v", err)
+	}
+	defer zk.Close()
+
+	acls := WorldACL(PermAll)
+
+	r1 := NewRWLock(zk, "/test-rwlock", acls)
+	r2 := NewRWLock(zk, "/test-rwlock", acls)
+	w := NewRWLock(zk, "/test-rwlock", acls)
+
+	// Readers don't block each other.
+	if err := r1.RLock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r2.RLock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r1.RLock(); !errors.Is(err, ErrDeadlock) {
+		t.Fatalf("RLock twice returned %v; want %v", err, ErrDeadlock)
+	}
+
+	// But they block a writer.
+	locked := make(chan error, 1)
+	go func() {
+		locked <- w.Lock()
+	}()
+	select {
+	case err := <-locked:
+		t.Fatalf("Lock returned %v while readers hold the lock", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if err := r1.RUnlock(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-locked:
+		t.Fatalf("Lock returned %v while a reader holds the lock", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// And a reader queues behind the pending writer.
+	r3 := NewRWLock(zk, "/test-rwlock", acls)
+	rlocked := make(chan error, 1)
+	go func() {
+		rlocked <- r3.RLock()
+	}()
+
+	if err := r2.RUnlock(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-locked:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Lock did not return after the readers released the lock")
+	}
+	select {
+	case err := <-rlocked:
+		t.Fatalf("RLock returned %v while a writer holds the lock", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if err := w.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-rlocked:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("RLock did not return after the writer released the lock")
+	}
+	if err := r3.RUnlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r3.RUnlock(); !errors.Is(err, ErrNotLocked) {
+		t.Fatalf("RUnlock twice returned %v; want %v", err, ErrNotLocked)
+	}
+}
+
+func TestRWLockPredecessor(t *testing.T) {
+	children := []string{
+		"_c_0a-__READ__0000000000",
+		"_c_0b-__WRIT__0000000001",
+		"_c_0c-__READ__0000000002",
+		"_c_0d-__READ__0000000003",
+		"_c_0e-__WRIT__0000000004",
+	}
+	cases := []struct {
+		seq   int
+		write bool
+		want  string
+	}{
+		{0, false, ""},
+		{1, true, "_c_0a-__READ__0000000000"},
+		{2, false, "_c_0b-__WRIT__0000000001"},
+		{3, false, "_c_0b-__WRIT__0000000001"},
+		{4, true, "_c_0d-__READ__0000000003"},
+	}
+	for _, c := range cases {
+		got, err := rwLockPredecessor(children, c.seq, c.write)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c.want {
+			t.Errorf("rwLockPredecessor(%d, %v)=%q; want %q", c.seq, c.write, got, c.want)
+		}
+	}
+
+	// Readers don't wait for earlier readers at all.
+	got, err := rwLockPredecessor(children[2:4], 3, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "" {
+		t.Errorf("reader waits for %q; want nothing", got)
+	}
+}
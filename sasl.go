@@ -0,0 +1,160 @@
+package zk
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// SASLClient performs the client side of a SASL authentication exchange. It
+// is run on every (re)connect, before any other request is sent on the
+// connection. Implementations must support being restarted.
+type SASLClient interface {
+	// Start begins a new exchange and returns the initial response to send
+	// to the server, which may be empty.
+	Start() ([]byte, error)
+	// Next processes a challenge from the server and returns the response
+	// to send back. Once done is true, the response, if not nil, is the
+	// last one sent and the exchange is complete when the server accepts it.
+	Next(challenge []byte) (response []byte, done bool, err error)
+}
+
+// WithSASL returns a connection option that authenticates every connection
+// with the given SASL client. The state goes to StateHasSession once the
+// exchange succeeded. If it fails, e.g. because the server rejected the
+// credentials, the state goes to StateAuthFailed and the client stops
+// reconnecting, as if closed: requests, and ConnectContext, fail with
+// ErrAuthFailed.
+func WithSASL(client SASLClient) connOption {
+	return func(c *Conn) {
+		c.saslClient = client
+	}
+}
+
+// digestMD5URI is the digest-uri ZooKeeper servers expect: the "zookeeper"
+// protocol on the "zk-sasl-md5" server.
+const digestMD5URI = "zookeeper/zk-sasl-md5"
+
+// errDigestMD5 is returned when the server's DIGEST-MD5 messages are invalid.
+var errDigestMD5 = errors.New("zk: invalid DIGEST-MD5 challenge")
+
+// DigestMD5Client is a SASLClient for the DIGEST-MD5 mechanism, which
+// ZooKeeper servers support with users configured in their JAAS Server
+// section.
+type DigestMD5Client struct {
+	username string
+	password string
+
+	step    int
+	rspauth string // expected response auth of the server
+}
+
+// NewDigestMD5Client creates a DIGEST-MD5 client that authenticates as the
+// given user.
+func NewDigestMD5Client(username, password string) *DigestMD5Client {
+	return &DigestMD5Client{
+		username: username,
+		password: password,
+	}
+}
+
+// Start implements SASLClient. DIGEST-MD5 has no initial response.
+func (d *DigestMD5Client) Start() ([]byte, error) {
+	d.step = 0
+	d.rspauth = ""
+	return []byte{}, nil
+}
+
+// Next implements SASLClient.
+func (d *DigestMD5Client) Next(challenge []byte) ([]byte, bool, error) {
+	d.step++
+	switch d.step {
+	case 1:
+		return d.respond(challenge)
+	case 2:
+		// The server proves it knows the password too.
+		fields := parseDigestChallenge(string(challenge))
+		if fields["rspauth"] == "" || fields["rspauth"] != d.rspauth {
+			return nil, false, errDigestMD5
+		}
+		return nil, true, nil
+	}
+	return nil, false, errDigestMD5
+}
+
+// respond computes the digest-response to the digest-challenge, as described
+// in RFC 2831.
+func (d *DigestMD5Client) respond(challenge []byte) ([]byte, bool, error) {
+	fields := parseDigestChallenge(string(challenge))
+	nonce := fields["nonce"]
+	if nonce == "" {
+		return nil, false, errDigestMD5
+	}
+	if qop, ok := fields["qop"]; ok && !containsToken(qop, "auth") {
+		return nil, false, fmt.Errorf("zk: unsupported DIGEST-MD5 qop %q", qop)
+	}
+	realm := fields["realm"]
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, false, err
+	}
+	cnonce := hex.EncodeToString(b)
+	const nc = "00000001"
+
+	userHash := md5.Sum([]byte(d.username + ":" + realm + ":" + d.password))
+	a1 := string(userHash[:]) + ":" + nonce + ":" + cnonce
+	kd := func(a2 string) string {
+		return md5Hex(md5Hex(a1) + ":" + nonce + ":" + nc + ":" + cnonce + ":auth:" + md5Hex(a2))
+	}
+	d.rspauth = kd(":" + digestMD5URI)
+
+	response := fmt.Sprintf(`charset=utf-8,username="%s",realm="%s",nonce="%s",nc=%s,cnonce="%s",digest-uri="%s",maxbuf=65536,response=%s,qop=auth`,
+		d.username, realm, nonce, nc, cnonce, digestMD5URI, kd("AUTHENTICATE:"+digestMD5URI))
+	return []byte(response), false, nil
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseDigestChallenge parses the comma separated key=value pairs of a
+// DIGEST-MD5 challenge. Values may be quoted.
+func parseDigestChallenge(challenge string) map[string]string {
+	fields := make(map[string]string)
+	for len(challenge) > 0 {
+		key, rest, ok := cut(challenge, "=")
+		if !ok {
+			break
+		}
+		key = strings.TrimSpace(key)
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				break
+			}
+			value, rest = rest[1:end+1], rest[end+2:]
+			_, rest, _ = cut(rest, ",")
+		} else {
+			value, rest, _ = cut(rest, ",")
+		}
+		fields[key] = value
+		challenge = rest
+	}
+	return fields
+}
+
+// containsToken reports whether the comma separated list contains token.
+func containsToken(list, token string) bool {
+	for _, t := range strings.Split(list, ",") {
+		if strings.TrimSpace(t) == token {
+			return true
+		}
+	}
+	return false
+}
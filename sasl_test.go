@@ -0,0 +1,174 @@
+package zk
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// digestMD5Server is the server side of a DIGEST-MD5 exchange, as done by a
+// ZooKeeper server with a single configured user.
+type digestMD5Server struct {
+	username, password string
+
+	mu            sync.Mutex
+	exchanges     int
+	authenticated bool
+}
+
+func (s *digestMD5Server) handle(t *testing.T, opcode int32, body []byte) (interface{}, ErrCode) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if opcode != opSasl {
+		if !s.authenticated {
+			t.Errorf("request %s sent before SASL authentication completed", opNames[opcode])
+		}
+		return &createResponse{Path: "/created"}, 0
+	}
+
+	req := &saslRequest{}
+	if _, err := decodePacket(body, req); err != nil {
+		t.Errorf("failed to decode SASL request: %v", err)
+		return nil, errMarshallingError
+	}
+	if len(req.Token) == 0 {
+		s.exchanges++
+		s.authenticated = false
+		return &saslResponse{Token: []byte(`realm="zk-sasl-md5",nonce="srvnonce",charset=utf-8,algorithm=md5-sess`)}, 0
+	}
+
+	fields := parseDigestChallenge(string(req.Token))
+	if fields["username"] != s.username || fields["digest-uri"] != "zookeeper/zk-sasl-md5" || fields["nonce"] != "srvnonce" {
+		t.Errorf("unexpected digest-response %q", req.Token)
+		return nil, errAuthFailed
+	}
+	h := func(s string) string {
+		sum := md5.Sum([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	userHash := md5.Sum([]byte(s.username + ":" + fields["realm"] + ":" + s.password))
+	ha1 := h(string(userHash[:]) + ":" + fields["nonce"] + ":" + fields["cnonce"])
+	kd := func(a2 string) string {
+		return h(fmt.Sprintf("%s:%s:%s:%s:%s:%s", ha1, fields["nonce"], fields["nc"], fields["cnonce"], fields["qop"], h(a2)))
+	}
+	if fields["response"] != kd("AUTHENTICATE:"+fields["digest-uri"]) {
+		return nil, errAuthFailed
+	}
+	s.authenticated = true
+	return &saslResponse{Token: []byte("rspauth=" + kd(":"+fields["digest-uri"]))}, 0
+}
+
+func TestSASLDigestMD5(t *testing.T) {
+	srv := &digestMD5Server{username: "super", password: "secret"}
+	fs := newFakeServer(t, func(opcode int32, body []byte) (interface{}, ErrCode) {
+		return srv.handle(t, opcode, body)
+	})
+	defer fs.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn := connectFake(t, fs, WithSASL(NewDigestMD5Client("super", "secret")))
+	srv.mu.Lock()
+	authenticated := srv.authenticated
+	srv.mu.Unlock()
+	if !authenticated {
+		t.Fatal("client has a session before SASL authentication completed")
+	}
+
+	if _, err := conn.Create("/foo", nil, 0, WorldACL(PermAll)); err != nil {
+		t.Fatalf("Create returned error: %v", err)
+	}
+
+	// The exchange is replayed on reconnect, before any other request.
+	fs.DropConns()
+	for fs.Connects() < 2 {
+		if ctx.Err() != nil {
+			t.Fatal("client did not reconnect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := conn.Create("/foo", nil, 0, WorldACL(PermAll)); err != nil {
+		t.Fatalf("Create returned error: %v", err)
+	}
+	srv.mu.Lock()
+	exchanges := srv.exchanges
+	srv.mu.Unlock()
+	if exchanges != 2 {
+		t.Fatalf("server saw %d SASL exchanges; want 2", exchanges)
+	}
+}
+
+func TestSASLDigestMD5WrongPassword(t *testing.T) {
+	srv := &digestMD5Server{username: "super", password: "secret"}
+	fs := newFakeServer(t, func(opcode int32, body []byte) (interface{}, ErrCode) {
+		return srv.handle(t, opcode, body)
+	})
+	defer fs.Close()
+
+	conn, events, err := Connect([]string{fs.Addr()}, 15*time.Second, WithLogInfo(false), WithLogger(&testLogger{}),
+		WithSASL(NewDigestMD5Client("super", "wrong")), WithReconnectBackoff(time.Millisecond, time.Millisecond, 1))
+	if err != nil {
+		t.Fatalf("Connect returned error: %v", err)
+	}
+	defer conn.Close()
+
+	// The client gives up after the credentials were rejected, without
+	// ever reporting a session.
+	var states []State
+	timeout := time.After(5 * time.Second)
+	for closed := false; !closed; {
+		select {
+		case ev, ok := <-events:
+			if ev.Type == EventSession {
+				states = append(states, ev.State)
+			}
+			closed = !ok
+		case <-timeout:
+			t.Fatalf("event channel not closed after the authentication failed, got states %v", states)
+		}
+	}
+	if want := []State{StateConnecting, StateConnected, StateAuthFailed}; !reflect.DeepEqual(states, want) {
+		t.Fatalf("got states %v; want %v", states, want)
+	}
+	if n := fs.Connects(); n != 1 {
+		t.Fatalf("client connected %d times; want 1", n)
+	}
+	if s := conn.State(); s != StateAuthFailed {
+		t.Fatalf("state is %v; want %v", s, StateAuthFailed)
+	}
+	if _, _, err := conn.Get("/foo"); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("Get returned %v; want %v", err, ErrAuthFailed)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, _, err := ConnectContext(ctx, []string{fs.Addr()}, 15*time.Second, WithLogInfo(false), WithLogger(&testLogger{}),
+		WithSASL(NewDigestMD5Client("super", "wrong"))); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("ConnectContext returned %v; want %v", err, ErrAuthFailed)
+	}
+}
+
+func TestDigestMD5ClientRejectsServer(t *testing.T) {
+	d := NewDigestMD5Client("super", "secret")
+	if _, err := d.Start(); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+	if _, _, err := d.Next([]byte(`realm="zk-sasl-md5",nonce="n"`)); err != nil {
+		t.Fatalf("Next returned error: %v", err)
+	}
+	if _, _, err := d.Next([]byte("rspauth=0123")); err != errDigestMD5 {
+		t.Fatalf("Next returned %v for a bad rspauth; want %v", err, errDigestMD5)
+	}
+
+	d.Start()
+	if _, _, err := d.Next([]byte(`realm="zk-sasl-md5",qop="auth-conf",nonce="n"`)); err == nil {
+		t.Fatal("Next accepted an unsupported qop")
+	}
+}
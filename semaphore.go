@@ -0,0 +1,99 @@
+package zk
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrLeaseReleased is returned by Release when the lease was already released.
+var ErrLeaseReleased = errors.New("zk: lease already released")
+
+// Semaphore is a counting semaphore that hands out up to maxLeases leases at
+// a time. It mirrors Curator's InterProcessSemaphoreV2: each lease is an
+// ephemeral node under path/leases, and a lock at path/locks makes counting
+// the leases atomic. Leases of a session are released when it expires.
+type Semaphore struct {
+	c         *Conn
+	path      string
+	maxLeases int
+	acl       []ACL
+}
+
+// Lease is a lease acquired from a Semaphore.
+type Lease struct {
+	c    *Conn
+	path string
+}
+
+// NewSemaphore creates a new semaphore instance using the provided connection
+// and path. The path must be a node that is only used by this semaphore, and
+// all instances must use the same maxLeases.
+func NewSemaphore(c *Conn, path string, maxLeases int) *Semaphore {
+	return &Semaphore{
+		c:         c,
+		path:      path,
+		maxLeases: maxLeases,
+		acl:       WorldACL(PermAll),
+	}
+}
+
+// Acquire acquires a lease, waiting until fewer than maxLeases leases are held.
+// If ctx is done first, ctx.Err() is returned.
+func (s *Semaphore) Acquire(ctx context.Context) (*Lease, error) {
+	// Acquirers queue on the lock, which also makes them acquire leases in
+	// the order they asked for them.
+	lock := NewLock(s.c, s.path+"/locks", s.acl)
+	if err := lock.lock(ctx, []byte{}); err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	leasesPath := s.path + "/leases"
+	path, err := createLockNode(s.c, leasesPath, "lease-", []byte{}, s.acl)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		children, _, ch, err := s.c.ChildrenW(leasesPath)
+		if err != nil {
+			s.c.Delete(path, -1)
+			return nil, err
+		}
+		found := false
+		for _, child := range children {
+			if leasesPath+"/"+child == path {
+				found = true
+			}
+		}
+		if !found {
+			// Our node is gone, e.g. because the session expired.
+			return nil, ErrSessionExpired
+		}
+		if len(children) <= s.maxLeases {
+			return &Lease{c: s.c, path: path}, nil
+		}
+
+		select {
+		case ev := <-ch:
+			if ev.Err != nil {
+				return nil, ev.Err
+			}
+		case <-ctx.Done():
+			s.c.Delete(path, -1)
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Release releases the lease.
+func (l *Lease) Release() error {
+	if l.path == "" {
+		return ErrLeaseReleased
+	}
+	if err := l.c.Delete(l.path, -1); err != nil && !errors.Is(err, ErrNoNode) {
+		return err
+	}
+	l.path = ""
+	return nil
+}
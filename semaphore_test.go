@@ -0,0 +1,104 @@
+package zk
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSemaphore(t *testing.T) {
+	fs := newFakeTreeServer(t)
+	defer fs.Close()
+
+	const (
+		maxLeases = 2
+		workers   = 5
+	)
+	conns := make([]*Conn, workers)
+	for i := range conns {
+		conns[i] = connectFake(t, fs)
+	}
+
+	var held, maxHeld int32
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s := NewSemaphore(conns[i], "/test-semaphore", maxLeases)
+			for j := 0; j < 3; j++ {
+				lease, err := s.Acquire(context.Background())
+				if err != nil {
+					t.Errorf("Acquire returned error: %v", err)
+					return
+				}
+				n := atomic.AddInt32(&held, 1)
+				for {
+					m := atomic.LoadInt32(&maxHeld)
+					if n <= m || atomic.CompareAndSwapInt32(&maxHeld, m, n) {
+						break
+					}
+				}
+				time.Sleep(20 * time.Millisecond)
+				atomic.AddInt32(&held, -1)
+				if err := lease.Release(); err != nil {
+					t.Errorf("Release returned error: %v", err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if maxHeld > maxLeases {
+		t.Fatalf("%d leases held at the same time; want at most %d", maxHeld, maxLeases)
+	}
+
+	// Acquire gives up when its context is done.
+	s := NewSemaphore(conns[0], "/test-semaphore", maxLeases)
+	for i := 0; i < maxLeases; i++ {
+		if _, err := NewSemaphore(conns[1], "/test-semaphore", maxLeases).Acquire(context.Background()); err != nil {
+			t.Fatalf("Acquire returned error: %v", err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := s.Acquire(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Acquire returned %v; want %v", err, context.DeadlineExceeded)
+	}
+	if children, _, err := conns[0].Children("/test-semaphore/leases"); err != nil || len(children) != maxLeases {
+		t.Fatalf("Children returned %q, %v; want %d leases", children, err, maxLeases)
+	}
+
+	// Leases are released when the session holding them expires.
+	acquired := make(chan *Lease, 1)
+	go func() {
+		lease, err := s.Acquire(context.Background())
+		if err != nil {
+			t.Errorf("Acquire returned error: %v", err)
+		}
+		acquired <- lease
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("Acquire returned while all leases are held")
+	case <-time.After(100 * time.Millisecond):
+	}
+	fs.ExpireSession(conns[1].SessionID())
+	select {
+	case lease := <-acquired:
+		if lease == nil {
+			t.FailNow()
+		}
+		if err := lease.Release(); err != nil {
+			t.Fatalf("Release returned error: %v", err)
+		}
+		if err := lease.Release(); !errors.Is(err, ErrLeaseReleased) {
+			t.Fatalf("Release twice returned %v; want %v", err, ErrLeaseReleased)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Acquire did not return after the session holding the leases expired")
+	}
+}
@@ -0,0 +1,119 @@
+package zk
+
+import (
+	"errors"
+	"sort"
+)
+
+// TreeSnapshot is a copy of the znodes of a subtree, as made by ExportSubtree.
+// It can be serialized, e.g. with encoding/json, to back up or migrate the
+// subtree, and restored by ImportSubtree.
+type TreeSnapshot struct {
+	Path  string         `json:"path"`  // the root of the exported subtree
+	Nodes []SnapshotNode `json:"nodes"` // parents come before their children
+}
+
+// SnapshotNode is a znode of a TreeSnapshot.
+type SnapshotNode struct {
+	Path string `json:"path"` // relative to the root, e.g. "/a/b"; empty for the root
+	Data []byte `json:"data,omitempty"`
+	ACL  []ACL  `json:"acl"`
+}
+
+// ExportSubtree reads the data and ACLs of the znode at path and all its
+// descendants into a TreeSnapshot. Ephemeral nodes are skipped, as they
+// belong to a session, and so is /zookeeper, which the server keeps itself.
+// Nodes deleted while exporting are skipped as well; the snapshot is not
+// consistent if the subtree is modified meanwhile.
+//
+// The whole snapshot is held in memory, so it is meant for subtrees that fit
+// into it, like configuration, not for millions of znodes.
+func (c *Conn) ExportSubtree(path string) (*TreeSnapshot, error) {
+	if err := validatePath(path, false); err != nil {
+		return nil, err
+	}
+	snap := &TreeSnapshot{Path: path}
+	if err := c.exportNode(snap, path, ""); err != nil {
+		return nil, err
+	}
+	if len(snap.Nodes) == 0 {
+		return nil, ErrNoNode
+	}
+	return snap, nil
+}
+
+// exportNode adds the znode at path, with the path rel in the snapshot, and
+// its descendants to snap.
+func (c *Conn) exportNode(snap *TreeSnapshot, path, rel string) error {
+	if path == "/zookeeper" {
+		return nil
+	}
+	data, stat, err := c.Get(path)
+	if errors.Is(err, ErrNoNode) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if stat.IsEphemeral() {
+		return nil
+	}
+	acl, _, err := c.GetACL(path)
+	if errors.Is(err, ErrNoNode) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	snap.Nodes = append(snap.Nodes, SnapshotNode{Path: rel, Data: data, ACL: acl})
+
+	if stat.NumChildren == 0 {
+		return nil
+	}
+	children, _, err := c.Children(path)
+	if errors.Is(err, ErrNoNode) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	sort.Strings(children)
+	for _, child := range children {
+		if err := c.exportNode(snap, joinPath(path, child), rel+"/"+child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportSubtree creates the znodes of snap under path, which takes the place
+// of the root of the exported subtree, along with any missing parents of
+// path. Existing znodes are left as they are, unless overwrite is set, in
+// which case their data and ACLs are replaced by the ones of the snapshot.
+// Znodes that are not in the snapshot are never deleted.
+func (c *Conn) ImportSubtree(path string, snap *TreeSnapshot, overwrite bool) error {
+	if err := validatePath(path, false); err != nil {
+		return err
+	}
+	for _, node := range snap.Nodes {
+		target := path + node.Path
+		if path == "/" && node.Path != "" {
+			target = node.Path
+		}
+		err := ErrNodeExists // the root always exists
+		if target != "/" {
+			_, err = c.CreateRecursive(target, node.Data, 0, node.ACL)
+		}
+		if errors.Is(err, ErrNodeExists) {
+			if !overwrite {
+				continue
+			}
+			if _, err := c.Set(target, node.Data, -1); err != nil {
+				return err
+			}
+			if _, err := c.SetACL(target, node.ACL, -1); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package zk
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestExportImportSubtree(t *testing.T) {
+	fs := newFakeTreeServer(t)
+	defer fs.Close()
+
+	conn := connectFake(t, fs)
+
+	readOnly := []ACL{{Perms: PermRead, Scheme: "world", ID: "anyone"}}
+	for _, n := range []struct {
+		path  string
+		data  string
+		flags int32
+		acl   []ACL
+	}{
+		{"/src", "root", 0, WorldACL(PermAll)},
+		{"/src/a", "a", 0, readOnly},
+		{"/src/a/b", "", 0, WorldACL(PermAll)},
+		{"/src/c", "c", 0, WorldACL(PermAll)},
+		{"/src/session", "e", FlagEphemeral, WorldACL(PermAll)},
+	} {
+		if _, err := conn.Create(n.path, []byte(n.data), n.flags, n.acl); err != nil {
+			t.Fatalf("Create(%s) returned error: %v", n.path, err)
+		}
+	}
+
+	if _, err := conn.ExportSubtree("/missing"); !errors.Is(err, ErrNoNode) {
+		t.Fatalf("ExportSubtree of a missing node returned %v; want %v", err, ErrNoNode)
+	}
+	snap, err := conn.ExportSubtree("/src")
+	if err != nil {
+		t.Fatalf("ExportSubtree returned error: %v", err)
+	}
+	want := &TreeSnapshot{Path: "/src", Nodes: []SnapshotNode{
+		{Path: "", Data: []byte("root"), ACL: WorldACL(PermAll)},
+		{Path: "/a", Data: []byte("a"), ACL: readOnly},
+		{Path: "/a/b", Data: []byte{}, ACL: WorldACL(PermAll)},
+		{Path: "/c", Data: []byte("c"), ACL: WorldACL(PermAll)},
+	}}
+	if !reflect.DeepEqual(snap, want) {
+		t.Fatalf("ExportSubtree returned %+v; want %+v", snap, want)
+	}
+
+	b, err := json.Marshal(snap)
+	if err != nil {
+		t.Fatalf("Marshal returned error: %v", err)
+	}
+	var decoded TreeSnapshot
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatalf("Unmarshal returned error: %v", err)
+	}
+
+	if err := conn.ImportSubtree("/backup/dst", &decoded, false); err != nil {
+		t.Fatalf("ImportSubtree returned error: %v", err)
+	}
+	imported, err := conn.ExportSubtree("/backup/dst")
+	if err != nil {
+		t.Fatalf("ExportSubtree returned error: %v", err)
+	}
+	imported.Path = snap.Path
+	// Compared as JSON, which doesn't tell empty data from none.
+	if got, _ := json.Marshal(imported); string(got) != string(b) {
+		t.Fatalf("imported subtree is %s; want %s", got, b)
+	}
+
+	// Existing nodes are only replaced when overwriting.
+	if _, err := conn.Set("/backup/dst/c", []byte("changed"), -1); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if err := conn.ImportSubtree("/backup/dst", snap, false); err != nil {
+		t.Fatalf("ImportSubtree returned error: %v", err)
+	}
+	if data, _, err := conn.Get("/backup/dst/c"); err != nil || string(data) != "changed" {
+		t.Fatalf("Get returned %q, %v after importing without overwrite; want %q", data, err, "changed")
+	}
+	if err := conn.ImportSubtree("/backup/dst", snap, true); err != nil {
+		t.Fatalf("ImportSubtree returned error: %v", err)
+	}
+	if data, _, err := conn.Get("/backup/dst/c"); err != nil || string(data) != "c" {
+		t.Fatalf("Get returned %q, %v after importing with overwrite; want %q", data, err, "c")
+	}
+}
@@ -3,6 +3,7 @@ package zk
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"log"
 	"reflect"
 	"runtime"
@@ -22,6 +23,42 @@ func (defaultLogger) Printf(format string, a ...interface{}) {
 	log.Printf(format, a...)
 }
 
+// printfLogger adapts a Logger to a StructuredLogger, printing the keys and
+// values after the message.
+type printfLogger struct {
+	Logger
+}
+
+func (l printfLogger) Debug(msg string, keysAndValues ...interface{}) {
+	l.print(msg, keysAndValues)
+}
+
+func (l printfLogger) Info(msg string, keysAndValues ...interface{}) {
+	l.print(msg, keysAndValues)
+}
+
+func (l printfLogger) Warn(msg string, keysAndValues ...interface{}) {
+	l.print(msg, keysAndValues)
+}
+
+func (l printfLogger) Error(msg string, keysAndValues ...interface{}) {
+	l.print(msg, keysAndValues)
+}
+
+func (l printfLogger) print(msg string, keysAndValues []interface{}) {
+	var b strings.Builder
+	b.WriteString(msg)
+	for i := 0; i < len(keysAndValues); i += 2 {
+		b.WriteByte(' ')
+		if i+1 < len(keysAndValues) {
+			fmt.Fprintf(&b, "%v=%v", keysAndValues[i], keysAndValues[i+1])
+		} else {
+			fmt.Fprintf(&b, "%v", keysAndValues[i])
+		}
+	}
+	l.Printf("%s", b.String())
+}
+
 type ACL struct {
 	Perms  int32
 	Scheme string
@@ -42,6 +79,45 @@ type Stat struct {
 	Pzxid          int64 // last modified children
 }
 
+// ephemeralOwner values of container and TTL nodes, which aren't owned by a
+// session.
+const (
+	containerEphemeralOwner = -1 << 63
+	extendedEphemeralMask   = -1 << 56
+)
+
+// IsEphemeral reports whether the znode is an ephemeral node, i.e. owned by
+// the session EphemeralOwner. Container and TTL nodes, which the server
+// marks with special EphemeralOwner values, aren't ephemeral.
+func (s *Stat) IsEphemeral() bool {
+	return s.EphemeralOwner != 0 && s.EphemeralOwner != containerEphemeralOwner &&
+		s.EphemeralOwner&extendedEphemeralMask != extendedEphemeralMask
+}
+
+// Created returns the time the znode was created, or the zero time if Ctime
+// is not set.
+func (s *Stat) Created() time.Time {
+	return msToTime(s.Ctime)
+}
+
+// Modified returns the time the znode was last modified, or the zero time if
+// Mtime is not set.
+func (s *Stat) Modified() time.Time {
+	return msToTime(s.Mtime)
+}
+
+// HasChildren reports whether the znode has children.
+func (s *Stat) HasChildren() bool {
+	return s.NumChildren > 0
+}
+
+func msToTime(ms int64) time.Time {
+	if ms == 0 {
+		return time.Time{}
+	}
+	return time.Unix(ms/1000, ms%1000*int64(time.Millisecond))
+}
+
 // ServerClient is the information for a single Zookeeper client and its session.
 // This is used to parse/extract the output fo the `cons` command.
 type ServerClient struct {
@@ -91,6 +167,70 @@ type ServerStats struct {
 	Error       error
 }
 
+// MntrStats is the information pulled from the Zookeeper `mntr` command.
+// Fields that the server does not report are left zero; Followers,
+// SyncedFollowers and PendingSyncs are only reported by the leader.
+type MntrStats struct {
+	Server                  string
+	Version                 string
+	ServerState             Mode
+	AvgLatency              float64
+	MinLatency              int64
+	MaxLatency              int64
+	PacketsReceived         int64
+	PacketsSent             int64
+	NumAliveConnections     int64
+	OutstandingRequests     int64
+	ZnodeCount              int64
+	WatchCount              int64
+	EphemeralsCount         int64
+	ApproximateDataSize     int64
+	OpenFileDescriptorCount int64
+	MaxFileDescriptorCount  int64
+	Followers               int64
+	SyncedFollowers         int64
+	PendingSyncs            int64
+	// Raw holds every key and value reported by the server, including the
+	// ones parsed into the fields above.
+	Raw   map[string]string
+	Error error
+}
+
+// ServerWatches is the information pulled from the Zookeeper `wchs`, `wchc`
+// and `wchp` commands.
+type ServerWatches struct {
+	Server      string
+	Connections int64 // number of connections with watches, from wchs
+	Paths       int64 // number of watched paths, from wchs
+	Total       int64 // total number of watches, from wchs
+	// BySession maps session IDs to the paths they watch, from wchc.
+	BySession map[int64][]string
+	// ByPath maps paths to the sessions watching them, from wchp.
+	ByPath map[string][]int64
+	// Disabled lists the commands that are not allowed by the server's
+	// 4lw.commands.whitelist. Their fields are left empty.
+	Disabled []string
+	Error    error
+}
+
+// DumpInfo is the information pulled from the Zookeeper `dump` command.
+type DumpInfo struct {
+	Server string
+	// Leader reports whether Server is the leader. Only the leader tracks
+	// all the sessions of the ensemble; the other servers list the ones
+	// connected to them.
+	Leader bool
+	// Sessions maps session IDs to their timeouts. The leader doesn't report
+	// timeouts, so its sessions map to 0; see Expires instead.
+	Sessions map[int64]time.Duration
+	// Expires maps session IDs to when they expire unless they hear from
+	// their client, as reported by the leader.
+	Expires map[int64]time.Time
+	// Ephemerals maps session IDs to the paths of their ephemeral nodes.
+	Ephemerals map[int64][]string
+	Error      error
+}
+
 type requestHeader struct {
 	Xid    int32
 	Opcode int32
@@ -140,6 +280,13 @@ type statResponse struct {
 
 //
 
+type addWatchRequest struct {
+	Path string
+	Mode AddWatchMode
+}
+
+type addWatchResponse struct{}
+
 type CheckVersionRequest PathVersionRequest
 type closeRequest struct{}
 type closeResponse struct{}
@@ -193,7 +340,7 @@ type getAclResponse struct {
 	Stat Stat
 }
 
-type getChildrenRequest pathRequest
+type getChildrenRequest pathWatchRequest
 
 type getChildrenResponse struct {
 	Children []string
@@ -262,14 +409,66 @@ type setWatchesRequest struct {
 	ChildWatches []string
 }
 
+// setWatches2Request is setWatchesRequest with the persistent watches, for
+// ZooKeeper 3.6+.
+type setWatches2Request struct {
+	RelativeZxid               int64
+	DataWatches                []string
+	ExistWatches               []string
+	ChildWatches               []string
+	PersistentWatches          []string
+	PersistentRecursiveWatches []string
+}
+
 type setWatchesResponse struct{}
 
+type removeWatchesRequest struct {
+	Path string
+	Type WatcherType
+}
+
+type removeWatchesResponse struct{}
+
+// AuthInfo is an auth identity of a session, as returned by WhoAmI.
+type AuthInfo struct {
+	Scheme string
+	ID     string
+}
+
+type whoAmIRequest struct{}
+
+type whoAmIResponse struct {
+	ClientInfo []AuthInfo
+}
+
+type getEphemeralsRequest struct {
+	PrefixPath string
+}
+
+type getEphemeralsResponse struct {
+	Ephemerals []string
+}
+
+type getAllChildrenNumberRequest pathRequest
+
+type getAllChildrenNumberResponse struct {
+	TotalNumber int32
+}
+
 type syncRequest pathRequest
 type syncResponse pathResponse
 
 type setAuthRequest auth
 type setAuthResponse struct{}
 
+type saslRequest struct {
+	Token []byte
+}
+
+type saslResponse struct {
+	Token []byte
+}
+
 type multiRequestOp struct {
 	Header multiHeader
 	Op     interface{}
@@ -289,6 +488,18 @@ type multiResponse struct {
 	DoneHeader multiHeader
 }
 
+type multiReadResponseOp struct {
+	Header   multiHeader
+	Data     []byte
+	Children []string
+	Stat     *Stat
+	Err      ErrCode
+}
+type multiReadResponse struct {
+	Ops        []multiReadResponseOp
+	DoneHeader multiHeader
+}
+
 // zk version 3.5 reconfig API
 type reconfigRequest struct {
 	JoiningServers []byte
@@ -405,6 +616,54 @@ type watcherEvent struct {
 	Path  string
 }
 
+// Decode decodes the results of a multiRead. Unlike Multi, per-operation
+// errors are not returned as the error of the whole response.
+func (r *multiReadResponse) Decode(buf []byte) (int, error) {
+	r.Ops = make([]multiReadResponseOp, 0)
+	r.DoneHeader = multiHeader{-1, true, -1}
+	total := 0
+	for {
+		header := &multiHeader{}
+		n, err := decodePacketValue(buf[total:], reflect.ValueOf(header))
+		if err != nil {
+			return total, err
+		}
+		total += n
+		if header.Done {
+			r.DoneHeader = *header
+			break
+		}
+
+		res := multiReadResponseOp{Header: *header}
+		var w reflect.Value
+		switch header.Type {
+		default:
+			return total, ErrAPIError
+		case opError:
+			w = reflect.ValueOf(&res.Err)
+		case opGetData:
+			dataRes := &getDataResponse{}
+			n, err := decodePacketValue(buf[total:], reflect.ValueOf(dataRes))
+			if err != nil {
+				return total, err
+			}
+			total += n
+			res.Data, res.Stat = dataRes.Data, &dataRes.Stat
+		case opGetChildren:
+			w = reflect.ValueOf(&res.Children)
+		}
+		if w.IsValid() {
+			n, err := decodePacketValue(buf[total:], w)
+			if err != nil {
+				return total, err
+			}
+			total += n
+		}
+		r.Ops = append(r.Ops, res)
+	}
+	return total, nil
+}
+
 type decoder interface {
 	Decode(buf []byte) (int, error)
 }
@@ -596,6 +855,8 @@ func encodePacketValue(buf []byte, v reflect.Value) (int, error) {
 
 func requestStructForOp(op int32) interface{} {
 	switch op {
+	case opAddWatch:
+		return &addWatchRequest{}
 	case opClose:
 		return &closeRequest{}
 	case opCreate:
@@ -624,16 +885,28 @@ func requestStructForOp(op int32) interface{} {
 		return &SetDataRequest{}
 	case opSetWatches:
 		return &setWatchesRequest{}
+	case opSetWatches2:
+		return &setWatches2Request{}
 	case opSync:
 		return &syncRequest{}
 	case opSetAuth:
 		return &setAuthRequest{}
+	case opSasl:
+		return &saslRequest{}
+	case opGetEphemerals:
+		return &getEphemeralsRequest{}
+	case opWhoAmI:
+		return &whoAmIRequest{}
+	case opGetAllChildrenNumber:
+		return &getAllChildrenNumberRequest{}
 	case opCheck:
 		return &CheckVersionRequest{}
-	case opMulti:
+	case opMulti, opMultiRead:
 		return &multiRequest{}
 	case opReconfig:
 		return &reconfigRequest{}
+	case opRemoveWatches:
+		return &removeWatchesRequest{}
 	}
 	return nil
 }
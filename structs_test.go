@@ -3,6 +3,7 @@ package zk
 import (
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestEncodeDecodePacket(t *testing.T) {
@@ -53,6 +54,58 @@ func encodeDecodeTest(t *testing.T, r interface{}) {
 	}
 }
 
+func TestEncodeCreateTTLRequest(t *testing.T) {
+	t.Parallel()
+	buf := make([]byte, 1024)
+	n, err := encodePacket(buf, &CreateTTLRequest{"/a", []byte{9}, []ACL{{PermRead, "world", "anyone"}}, FlagTTL | FlagSequence, 0x0102030405})
+	if err != nil {
+		t.Fatalf("encodePacket returned error: %v", err)
+	}
+	want := []byte{
+		0, 0, 0, 2, '/', 'a', // path
+		0, 0, 0, 1, 9, // data
+		0, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0, 5, 'w', 'o', 'r', 'l', 'd', 0, 0, 0, 6, 'a', 'n', 'y', 'o', 'n', 'e', // acl
+		0, 0, 0, 6, // flags
+		0, 0, 0, 1, 2, 3, 4, 5, // ttl in ms
+	}
+	if !reflect.DeepEqual(buf[:n], want) {
+		t.Fatalf("encodePacket returned %v; want %v", buf[:n], want)
+	}
+}
+
+func TestStatHelpers(t *testing.T) {
+	var zero Stat
+	if zero.IsEphemeral() || zero.HasChildren() || !zero.Created().IsZero() || !zero.Modified().IsZero() {
+		t.Fatalf("zero Stat is ephemeral %v, has children %v, created %v, modified %v; want false, false and zero times",
+			zero.IsEphemeral(), zero.HasChildren(), zero.Created(), zero.Modified())
+	}
+
+	for _, tc := range []struct {
+		owner int64
+		want  bool
+	}{
+		{0x1000000000000001, true},
+		{-0x7e00000000000000, true}, // session of a server with id > 127
+		{containerEphemeralOwner, false},
+		{extendedEphemeralMask | 60000, false}, // TTL node
+	} {
+		if got := (&Stat{EphemeralOwner: tc.owner}).IsEphemeral(); got != tc.want {
+			t.Errorf("IsEphemeral with owner %#x returned %v; want %v", uint64(tc.owner), got, tc.want)
+		}
+	}
+
+	s := &Stat{Ctime: 1500000000123, Mtime: 1600000000456, NumChildren: 2}
+	if want := time.Date(2017, 7, 14, 2, 40, 0, 123e6, time.UTC); !s.Created().Equal(want) {
+		t.Errorf("Created returned %v; want %v", s.Created(), want)
+	}
+	if want := time.Date(2020, 9, 13, 12, 26, 40, 456e6, time.UTC); !s.Modified().Equal(want) {
+		t.Errorf("Modified returned %v; want %v", s.Modified(), want)
+	}
+	if !s.HasChildren() {
+		t.Error("HasChildren returned false for a znode with children")
+	}
+}
+
 func TestEncodeShortBuffer(t *testing.T) {
 	t.Parallel()
 	_, err := encodePacket([]byte{}, &requestHeader{1, 2})
@@ -0,0 +1,27 @@
+package zk
+
+import "context"
+
+// Tracer is called before every request with the context of the request, the
+// name of the operation, e.g. "getData", and the path of the znode, if the
+// operation has one. It returns the context to send the request with, and a
+// function that is called with the error of the request once it completed,
+// failed or was canceled. This allows wrapping every request in a span of a
+// tracing library. Requests without a context use context.Background().
+type Tracer func(ctx context.Context, op, path string) (context.Context, func(error))
+
+// WithTracer returns a connection option that calls tracer for every request.
+func WithTracer(tracer Tracer) connOption {
+	return func(c *Conn) {
+		c.tracer = tracer
+	}
+}
+
+// trace starts tracing a request, if a tracer is set. The returned function
+// is nil otherwise.
+func (c *Conn) trace(ctx context.Context, opcode int32, req interface{}) (context.Context, func(error)) {
+	if c.tracer == nil {
+		return ctx, nil
+	}
+	return c.tracer(ctx, opNames[opcode], requestPath(req))
+}
@@ -0,0 +1,94 @@
+package zk
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+type tracerKey struct{}
+
+// testSpan is a span started by the tracer of TestTracer.
+type testSpan struct {
+	op, path string
+	ended    bool
+	err      error
+}
+
+func TestTracer(t *testing.T) {
+	fs := newFakeTreeServer(t)
+	defer fs.Close()
+
+	var (
+		mu    sync.Mutex
+		spans []*testSpan
+	)
+	tracer := func(ctx context.Context, op, path string) (context.Context, func(error)) {
+		span := &testSpan{op: op, path: path}
+		mu.Lock()
+		spans = append(spans, span)
+		mu.Unlock()
+		return context.WithValue(ctx, tracerKey{}, span), func(err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if span.ended {
+				t.Errorf("span %s %s ended twice", op, path)
+			}
+			span.ended, span.err = true, err
+		}
+	}
+	// reset returns the spans started so far and forgets them.
+	reset := func() []*testSpan {
+		mu.Lock()
+		defer mu.Unlock()
+		s := spans
+		spans = nil
+		return s
+	}
+	expect := func(got []*testSpan, want ...testSpan) {
+		t.Helper()
+		if len(got) != len(want) {
+			t.Fatalf("got %d spans; want %d", len(got), len(want))
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for i, s := range got {
+			w := want[i]
+			if s.op != w.op || s.path != w.path || !s.ended || !errors.Is(s.err, w.err) || (s.err == nil) != (w.err == nil) {
+				t.Fatalf("span %d is %+v; want %+v", i, *s, w)
+			}
+		}
+	}
+
+	zk := connectFake(t, fs, WithTracer(tracer))
+	reset()
+
+	if _, err := zk.Create("/a", nil, 0, WorldACL(PermAll)); err != nil {
+		t.Fatalf("Create returned error: %v", err)
+	}
+	zk.Get("/missing")
+	<-zk.SetAsync("/a", []byte("a"), -1)
+	expect(reset(),
+		testSpan{op: "create", path: "/a"},
+		testSpan{op: "getData", path: "/missing", err: ErrNoNode},
+		testSpan{op: "setData", path: "/a"},
+	)
+
+	canceled, cancelNow := context.WithCancel(context.Background())
+	cancelNow()
+	if _, _, err := zk.GetCtx(canceled, "/a"); err != context.Canceled {
+		t.Fatalf("GetCtx returned %v; want %v", err, context.Canceled)
+	}
+	expect(reset(), testSpan{op: "getData", path: "/a", err: context.Canceled})
+
+	zk.Close()
+	zk.Get("/a")
+	var spansAfterClose []*testSpan
+	for _, s := range reset() {
+		if s.op == "getData" {
+			spansAfterClose = append(spansAfterClose, s)
+		}
+	}
+	expect(spansAfterClose, testSpan{op: "getData", path: "/a", err: ErrConnectionClosed})
+}
@@ -0,0 +1,47 @@
+package zk
+
+// Transaction builds a list of operations that are executed atomically by
+// Commit: either all of them succeed, or none of them is applied. It is not
+// safe for concurrent use.
+type Transaction struct {
+	c   *Conn
+	ops []interface{}
+}
+
+// Transaction starts a new transaction on the connection.
+func (c *Conn) Transaction() *Transaction {
+	return &Transaction{c: c}
+}
+
+// Create adds an operation that creates a znode, like Create.
+func (t *Transaction) Create(path string, data []byte, flags int32, acl []ACL) *Transaction {
+	t.ops = append(t.ops, &CreateRequest{Path: path, Data: data, Acl: acl, Flags: flags})
+	return t
+}
+
+// SetData adds an operation that sets the data of a znode, like Set.
+func (t *Transaction) SetData(path string, data []byte, version int32) *Transaction {
+	t.ops = append(t.ops, &SetDataRequest{Path: path, Data: data, Version: version})
+	return t
+}
+
+// Delete adds an operation that deletes a znode, like Delete.
+func (t *Transaction) Delete(path string, version int32) *Transaction {
+	t.ops = append(t.ops, &DeleteRequest{Path: path, Version: version})
+	return t
+}
+
+// Check adds an operation that fails the transaction unless the znode exists
+// and has the given version. A version of -1 only checks that it exists.
+func (t *Transaction) Check(path string, version int32) *Transaction {
+	t.ops = append(t.ops, &CheckVersionRequest{Path: path, Version: version})
+	return t
+}
+
+// Commit executes the operations with Multi. The responses are in the order
+// the operations were added. If the transaction failed, the returned error is
+// the error of the first operation that failed, and the Error of its
+// response is set too.
+func (t *Transaction) Commit() ([]MultiResponse, error) {
+	return t.c.Multi(t.ops...)
+}
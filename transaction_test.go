@@ -0,0 +1,67 @@
+package zk
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestTransaction(t *testing.T) {
+	fs := newFakeTreeServer(t)
+	defer fs.Close()
+
+	zk := connectFake(t, fs)
+
+	acl := WorldACL(PermAll)
+	for _, path := range []string{"/a", "/b"} {
+		if _, err := zk.Create(path, nil, 0, acl); err != nil {
+			t.Fatalf("Create returned error: %v", err)
+		}
+	}
+
+	res, err := zk.Transaction().
+		Create("/c", []byte("c"), 0, acl).
+		SetData("/a", []byte("a"), 0).
+		Check("/a", 1).
+		Delete("/b", 0).
+		Commit()
+	if err != nil {
+		t.Fatalf("Commit returned error: %v", err)
+	}
+	if len(res) != 4 {
+		t.Fatalf("Commit returned %d responses; want 4", len(res))
+	}
+	for i, r := range res {
+		if r.Error != nil {
+			t.Fatalf("response %d has error %v", i, r.Error)
+		}
+	}
+	if res[0].String != "/c" {
+		t.Fatalf("create response has path %q; want /c", res[0].String)
+	}
+	if res[1].Stat == nil || res[1].Stat.Version != 1 {
+		t.Fatalf("set response has stat %+v; want version 1", res[1].Stat)
+	}
+	if ok, _, err := zk.Exists("/b"); err != nil || ok {
+		t.Fatalf("Exists returned %v, %v for a znode deleted by the transaction", ok, err)
+	}
+
+	// Delete /c only if /a is still at version 0: the whole transaction is
+	// rolled back.
+	res, err = zk.Transaction().
+		SetData("/c", []byte("changed"), -1).
+		Check("/a", 0).
+		Delete("/c", -1).
+		Commit()
+	if !errors.Is(err, ErrBadVersion) {
+		t.Fatalf("Commit returned %v; want %v", err, ErrBadVersion)
+	}
+	if len(res) != 3 {
+		t.Fatalf("Commit returned %d responses; want 3", len(res))
+	}
+	if res[0].Error != nil || !errors.Is(res[1].Error, ErrBadVersion) || res[2].Error == nil {
+		t.Fatalf("Commit returned errors %v, %v, %v; want nil, %v and an error", res[0].Error, res[1].Error, res[2].Error, ErrBadVersion)
+	}
+	if data, _, err := zk.Get("/c"); err != nil || string(data) != "c" {
+		t.Fatalf("Get returned %q, %v after a failed transaction; want %q", data, err, "c")
+	}
+}
@@ -0,0 +1,442 @@
+package zk
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TreeEventType is the type of a TreeEvent.
+type TreeEventType int32
+
+const (
+	// NodeAdded means a node was added to the cache.
+	NodeAdded TreeEventType = 1
+	// NodeUpdated means the data of a cached node changed.
+	NodeUpdated TreeEventType = 2
+	// NodeRemoved means a node was removed from the cache.
+	NodeRemoved TreeEventType = 3
+)
+
+var treeEventNames = map[TreeEventType]string{
+	NodeAdded:   "NodeAdded",
+	NodeUpdated: "NodeUpdated",
+	NodeRemoved: "NodeRemoved",
+}
+
+func (t TreeEventType) String() string {
+	if name := treeEventNames[t]; name != "" {
+		return name
+	}
+	return "Unknown"
+}
+
+// TreeEvent is a change of the nodes cached by a TreeCache. For NodeRemoved,
+// the data is the last one cached.
+type TreeEvent struct {
+	Type TreeEventType
+	Path string
+	Data []byte
+	Stat *Stat
+}
+
+type treeCacheNode struct {
+	data     []byte
+	stat     *Stat
+	children map[string]bool
+}
+
+// TreeCache keeps a local copy of a node and all its descendants, updated
+// through watches. It mirrors Curator's TreeCache. It uses a single
+// persistent recursive watch with ZooKeeper 3.6 or later, and a data and
+// child watch on every node with older servers. The node doesn't need to
+// exist. The whole tree is read again after reconnecting, so changes made
+// while disconnected are not missed.
+type TreeCache struct {
+	c      *Conn
+	path   string
+	events chan TreeEvent
+
+	mu   sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+
+	valueMu sync.Mutex
+	nodes   map[string]*treeCacheNode // by path
+
+	// Only used by the cache goroutine, or after it is done.
+	fired        chan Event
+	recursive    <-chan Event // the persistent recursive watch, if set
+	legacy       bool         // the server doesn't support persistent watches
+	dataWatched  map[string]bool
+	childWatched map[string]bool
+}
+
+// NewTreeCache creates a new cache of the node at path and its descendants,
+// using the provided connection.
+func NewTreeCache(c *Conn, path string) *TreeCache {
+	return &TreeCache{
+		c:      c,
+		path:   path,
+		events: make(chan TreeEvent, 64),
+		nodes:  make(map[string]*treeCacheNode),
+	}
+}
+
+// Start starts loading the tree in the background, and keeps the cache
+// updated until Stop is called. A NodeAdded event is sent for every node
+// already there, parents first.
+func (tc *TreeCache) Start() error {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	if tc.done != nil {
+		return ErrCacheStarted
+	}
+	if err := validatePath(tc.path, false); err != nil {
+		return err
+	}
+	tc.stop = make(chan struct{})
+	tc.done = make(chan struct{})
+	go tc.run(tc.stop, tc.done)
+	return nil
+}
+
+// Stop stops updating the cache. Start can be called again afterwards.
+func (tc *TreeCache) Stop() {
+	tc.mu.Lock()
+	stop, done := tc.stop, tc.done
+	tc.stop, tc.done = nil, nil
+	tc.mu.Unlock()
+
+	if done == nil {
+		return
+	}
+	close(stop)
+	<-done
+	if tc.recursive != nil {
+		// The channel must be read until it is closed.
+		go func(ch <-chan Event) {
+			for range ch {
+			}
+		}(tc.recursive)
+		tc.c.RemoveWatches(tc.path, WatcherTypePersistentRecursive)
+		tc.recursive = nil
+	}
+}
+
+// Events returns the channel the changes of the cache are sent on. It must
+// be received from, or the cache stops being updated.
+func (tc *TreeCache) Events() <-chan TreeEvent {
+	return tc.events
+}
+
+// Get returns the cached data and stat of the node at path, and whether it is
+// in the cache.
+func (tc *TreeCache) Get(path string) ([]byte, *Stat, bool) {
+	tc.valueMu.Lock()
+	defer tc.valueMu.Unlock()
+
+	node := tc.nodes[path]
+	if node == nil {
+		return nil, nil, false
+	}
+	return node.data, node.stat, true
+}
+
+// Children returns the names of the cached children of the node at path,
+// sorted, and whether the node is in the cache.
+func (tc *TreeCache) Children(path string) ([]string, bool) {
+	tc.valueMu.Lock()
+	defer tc.valueMu.Unlock()
+
+	node := tc.nodes[path]
+	if node == nil {
+		return nil, false
+	}
+	children := make([]string, 0, len(node.children))
+	for child := range node.children {
+		children = append(children, child)
+	}
+	sort.Strings(children)
+	return children, true
+}
+
+func (tc *TreeCache) run(stop, done chan struct{}) {
+	defer close(done)
+
+	tc.fired = make(chan Event)
+	tc.dataWatched = make(map[string]bool)
+	tc.childWatched = make(map[string]bool)
+	resync := true
+	var connected <-chan struct{}
+	for {
+		if resync {
+			connected = tc.c.nextConnect()
+			err := tc.resync(stop)
+			if err == errCacheStopped || errors.Is(err, ErrClosing) {
+				return
+			} else if err != nil {
+				select {
+				case <-stop:
+					return
+				case <-tc.c.shouldQuit:
+					return
+				case <-time.After(100 * time.Millisecond):
+				}
+				continue
+			}
+			resync = false
+		}
+
+		var ev Event
+		select {
+		case ev = <-tc.fired:
+		case <-connected:
+			resync = true
+			continue
+		case <-stop:
+			return
+		}
+		if errors.Is(ev.Err, ErrClosing) {
+			return
+		}
+		if tc.recursive != nil && ev.Type == EventNotWatching {
+			// The session expired; the watch must be set again.
+			tc.recursive = nil
+			resync = true
+			continue
+		}
+		switch ev.Type {
+		case EventNodeChildrenChanged:
+			delete(tc.childWatched, ev.Path)
+		case EventNodeCreated, EventNodeDataChanged:
+			delete(tc.dataWatched, ev.Path)
+		default:
+			delete(tc.childWatched, ev.Path)
+			delete(tc.dataWatched, ev.Path)
+		}
+		if err := tc.sync(ev.Path, false, stop); err == errCacheStopped || errors.Is(err, ErrClosing) {
+			return
+		} else if err != nil {
+			resync = true
+		}
+	}
+}
+
+// resync sets the persistent recursive watch if needed and reads the whole
+// tree again.
+func (tc *TreeCache) resync(stop chan struct{}) error {
+	if tc.recursive == nil && !tc.legacy {
+		ch, err := tc.c.AddWatch(tc.path, AddWatchModePersistentRecursive)
+		if errors.Is(err, ErrUnimplemented) {
+			tc.legacy = true
+		} else if err != nil {
+			return err
+		} else {
+			tc.recursive = ch
+			go func() {
+				for ev := range ch {
+					select {
+					case tc.fired <- ev:
+					case <-stop:
+						// Drained by Stop.
+						return
+					}
+				}
+			}()
+		}
+	}
+	return tc.sync(tc.path, true, stop)
+}
+
+// sync reads the node at path again, and the nodes below it that are not in
+// the cache yet, or all of them if full is true. Nodes that are gone are
+// removed from the cache with their descendants.
+func (tc *TreeCache) sync(path string, full bool, stop chan struct{}) error {
+	if path != tc.path && !strings.HasPrefix(path, strings.TrimSuffix(tc.path, "/")+"/") {
+		return nil
+	}
+	if path != tc.path {
+		tc.valueMu.Lock()
+		parent := tc.nodes[parentPath(path)]
+		tc.valueMu.Unlock()
+		if parent == nil {
+			// The parent is new too; it is read with its children.
+			return tc.sync(parentPath(path), false, stop)
+		}
+	}
+
+	data, stat, err := tc.getData(path, stop)
+	if errors.Is(err, ErrNoNode) {
+		return tc.remove(path, stop)
+	} else if err != nil {
+		return err
+	}
+	children, err := tc.getChildren(path, stop)
+	if errors.Is(err, ErrNoNode) {
+		return tc.remove(path, stop)
+	} else if err != nil {
+		return err
+	}
+
+	names := make(map[string]bool, len(children))
+	for _, child := range children {
+		names[child] = true
+	}
+	tc.valueMu.Lock()
+	node := tc.nodes[path]
+	typ := NodeUpdated
+	if node == nil {
+		node = &treeCacheNode{}
+		tc.nodes[path] = node
+		if parent := tc.nodes[parentPath(path)]; parent != nil && path != tc.path {
+			parent.children[nodeName(path)] = true
+		}
+		typ = NodeAdded
+	} else if node.stat.Mzxid == stat.Mzxid && bytes.Equal(node.data, data) {
+		// Only the children changed.
+		typ = 0
+	}
+	node.data, node.stat = data, stat
+	var removed []string
+	for child := range node.children {
+		if !names[child] {
+			removed = append(removed, child)
+		}
+	}
+	node.children = names
+	tc.valueMu.Unlock()
+
+	if typ != 0 {
+		if err := tc.emit(typ, path, data, stat, stop); err != nil {
+			return err
+		}
+	}
+	sort.Strings(removed)
+	for _, child := range removed {
+		if err := tc.remove(joinPath(path, child), stop); err != nil {
+			return err
+		}
+	}
+	for _, child := range children {
+		childPath := joinPath(path, child)
+		tc.valueMu.Lock()
+		cached := tc.nodes[childPath] != nil
+		tc.valueMu.Unlock()
+		if full || !cached {
+			if err := tc.sync(childPath, full, stop); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// getData reads the data of the node, watching it with a data watch if that
+// is how the tree is watched and it isn't watched yet.
+func (tc *TreeCache) getData(path string, stop chan struct{}) ([]byte, *Stat, error) {
+	if !tc.legacy || tc.dataWatched[path] {
+		return tc.c.Get(path)
+	}
+	for {
+		data, stat, ch, err := tc.c.GetW(path)
+		if err == nil {
+			tc.dataWatched[path] = true
+			tc.forward(ch, stop)
+			return data, stat, nil
+		} else if !errors.Is(err, ErrNoNode) || path != tc.path {
+			// Missing descendants are noticed by the child watch of their
+			// parent.
+			return nil, nil, err
+		}
+
+		exists, _, ch, err := tc.c.ExistsW(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !exists {
+			tc.dataWatched[path] = true
+			tc.forward(ch, stop)
+			return nil, nil, ErrNoNode
+		}
+		// The node was created in the meantime.
+	}
+}
+
+// getChildren reads the children of the node, watching them with a child
+// watch if that is how the tree is watched and they aren't watched yet.
+func (tc *TreeCache) getChildren(path string, stop chan struct{}) ([]string, error) {
+	if !tc.legacy || tc.childWatched[path] {
+		children, _, err := tc.c.Children(path)
+		return children, err
+	}
+	children, _, ch, err := tc.c.ChildrenW(path)
+	if err != nil {
+		return nil, err
+	}
+	tc.childWatched[path] = true
+	tc.forward(ch, stop)
+	return children, nil
+}
+
+// remove removes the node at path and its descendants from the cache,
+// descendants first.
+func (tc *TreeCache) remove(path string, stop chan struct{}) error {
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	tc.valueMu.Lock()
+	var paths []string
+	for p := range tc.nodes {
+		if p == path || strings.HasPrefix(p, prefix) {
+			paths = append(paths, p)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(paths)))
+	removed := make([]*treeCacheNode, len(paths))
+	for i, p := range paths {
+		removed[i] = tc.nodes[p]
+		delete(tc.nodes, p)
+	}
+	if parent := tc.nodes[parentPath(path)]; parent != nil && path != tc.path {
+		delete(parent.children, nodeName(path))
+	}
+	tc.valueMu.Unlock()
+
+	for i, p := range paths {
+		if err := tc.emit(NodeRemoved, p, removed[i].data, removed[i].stat, stop); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nodeName returns the last element of path.
+func nodeName(path string) string {
+	return path[strings.LastIndexByte(path, '/')+1:]
+}
+
+// forward sends the event of the watch to the cache goroutine.
+func (tc *TreeCache) forward(ch <-chan Event, stop chan struct{}) {
+	go func() {
+		select {
+		case ev := <-ch:
+			select {
+			case tc.fired <- ev:
+			case <-stop:
+			}
+		case <-stop:
+		}
+	}()
+}
+
+func (tc *TreeCache) emit(typ TreeEventType, path string, data []byte, stat *Stat, stop chan struct{}) error {
+	select {
+	case tc.events <- TreeEvent{Type: typ, Path: path, Data: data, Stat: stat}:
+		return nil
+	case <-stop:
+		return errCacheStopped
+	}
+}
@@ -0,0 +1,108 @@
+package zk
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTreeCache(t *testing.T) {
+	testTreeCache(t, false)
+}
+
+func TestTreeCacheLegacy(t *testing.T) {
+	testTreeCache(t, true)
+}
+
+func testTreeCache(t *testing.T, legacy bool) {
+	fs := newFakeTreeServer(t)
+	fs.tree.noAddWatch = legacy
+	defer fs.Close()
+
+	zk := connectFake(t, fs)
+
+	acl := WorldACL(PermAll)
+	if _, err := zk.CreateRecursive("/tree/a", []byte("a"), 0, acl); err != nil {
+		t.Fatalf("CreateRecursive returned error: %v", err)
+	}
+
+	tc := NewTreeCache(zk, "/tree")
+	if err := tc.Start(); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+	defer tc.Stop()
+
+	expect := func(typ TreeEventType, path, data string) {
+		t.Helper()
+		select {
+		case ev := <-tc.Events():
+			if ev.Type != typ || ev.Path != path || string(ev.Data) != data {
+				t.Fatalf("got event %s %s %q; want %s %s %q", ev.Type, ev.Path, ev.Data, typ, path, data)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no event; want %s %s %q", typ, path, data)
+		}
+	}
+
+	expect(NodeAdded, "/tree", "")
+	expect(NodeAdded, "/tree/a", "a")
+
+	if _, err := zk.CreateRecursive("/tree/b/c/d", []byte("d"), 0, acl); err != nil {
+		t.Fatalf("CreateRecursive returned error: %v", err)
+	}
+	expect(NodeAdded, "/tree/b", "")
+	expect(NodeAdded, "/tree/b/c", "")
+	expect(NodeAdded, "/tree/b/c/d", "d")
+	if _, err := zk.Set("/tree/b/c", []byte("c"), -1); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	expect(NodeUpdated, "/tree/b/c", "c")
+	if data, stat, ok := tc.Get("/tree/b/c"); !ok || string(data) != "c" || stat.NumChildren != 1 {
+		t.Fatalf("Get returned %q, %+v, %v", data, stat, ok)
+	}
+	if children, ok := tc.Children("/tree"); !ok || len(children) != 2 || children[0] != "a" || children[1] != "b" {
+		t.Fatalf("Children returned %q, %v; want [a b]", children, ok)
+	}
+	if err := zk.DeleteRecursive("/tree/b", -1); err != nil {
+		t.Fatalf("DeleteRecursive returned error: %v", err)
+	}
+	expect(NodeRemoved, "/tree/b/c/d", "d")
+	expect(NodeRemoved, "/tree/b/c", "c")
+	expect(NodeRemoved, "/tree/b", "")
+	if _, _, ok := tc.Get("/tree/b/c"); ok {
+		t.Fatal("Get found a removed node")
+	}
+
+	// Changes whose notifications are lost are read after reconnecting.
+	fs.mu.Lock()
+	fs.zxid++
+	fs.tree.delete(fs.zxid, "/tree/a", -1)
+	fs.tree.create(0, fs.zxid, "/tree/e", []byte("e"), WorldACL(PermAll), 0)
+	fs.mu.Unlock()
+	fs.DropConns()
+	expect(NodeRemoved, "/tree/a", "a")
+	expect(NodeAdded, "/tree/e", "e")
+
+	fs.mu.Lock()
+	watches := len(fs.tree.recursiveWatches["/tree"])
+	fs.mu.Unlock()
+	if legacy && watches != 0 || !legacy && watches != 1 {
+		t.Fatalf("%d persistent recursive watches set on the tree", watches)
+	}
+
+	// Deleting the node removes it from the cache; it is added back once
+	// created again.
+	if err := zk.DeleteRecursive("/tree", -1); err != nil {
+		t.Fatalf("DeleteRecursive returned error: %v", err)
+	}
+	expect(NodeRemoved, "/tree/e", "e")
+	expect(NodeRemoved, "/tree", "")
+	if _, err := zk.Create("/tree", []byte("again"), 0, acl); err != nil {
+		t.Fatalf("Create returned error: %v", err)
+	}
+	expect(NodeAdded, "/tree", "again")
+	select {
+	case ev := <-tc.Events():
+		t.Fatalf("got unexpected event %s %s", ev.Type, ev.Path)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -5,8 +5,10 @@ import (
 	"encoding/base64"
 	"fmt"
 	"math/rand"
+	"net"
 	"strconv"
 	"strings"
+	"time"
 	"unicode/utf8"
 )
 
@@ -34,6 +36,109 @@ func DigestACL(perms int32, user, password string) []ACL {
 	return []ACL{{perms, "digest", fmt.Sprintf("%s:%s", user, digest)}}
 }
 
+// X509ACL produces an ACL list containing a single ACL which uses the
+// provided permissions, with the scheme "x509", and the subject
+// distinguished name of a TLS client certificate as ID, e.g.
+// "CN=client,OU=ops,O=example".
+func X509ACL(perms int32, subjectDN string) []ACL {
+	return []ACL{{perms, "x509", subjectDN}}
+}
+
+// IPACL produces an ACL list containing a single ACL which uses the
+// provided permissions, with the scheme "ip", and an IP address or a CIDR
+// block like "10.0.0.0/8" as ID. It returns an error if cidr is neither.
+func IPACL(perms int32, cidr string) ([]ACL, error) {
+	if strings.Contains(cidr, "/") {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return nil, fmt.Errorf("zk: invalid ip ACL %q: %v", cidr, err)
+		}
+	} else if net.ParseIP(cidr) == nil {
+		return nil, fmt.Errorf("zk: invalid ip ACL %q: not an IP address", cidr)
+	}
+	return []ACL{{perms, "ip", cidr}}, nil
+}
+
+// CheckPermission reports whether a client with the identities auths, as
+// returned by WhoAmI, is granted perm by the ACL list acls, as returned by
+// GetACL. If perm combines several Perm constants, all of them must be
+// granted. It evaluates the ACLs like the server does: an empty list or a
+// "super" identity grants everything, "world:anyone" grants to everybody,
+// and other entries grant to matching identities of the same scheme. An
+// "auth" entry, as made by AuthACL, matches any authenticated identity; the
+// server replaces it by the identities of the client when the ACL is set.
+//
+// A "digest" identity matches with its user name alone, as returned by
+// WhoAmI, as "user:password", as passed to AddAuth, or as "user:digest", as
+// stored in the ACL. An "ip" identity matches an address or CIDR block.
+func CheckPermission(acls []ACL, auths []AuthInfo, perm int32) bool {
+	if len(acls) == 0 {
+		return true
+	}
+	for _, auth := range auths {
+		if auth.Scheme == "super" {
+			return true
+		}
+	}
+	for bit := int32(1); bit <= perm; bit <<= 1 {
+		if perm&bit != 0 && !checkPermission(acls, auths, bit) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkPermission reports whether an entry of acls grants the single
+// permission perm to one of auths.
+func checkPermission(acls []ACL, auths []AuthInfo, perm int32) bool {
+	for _, acl := range acls {
+		if acl.Perms&perm == 0 {
+			continue
+		}
+		if acl.Scheme == "world" && acl.ID == "anyone" {
+			return true
+		}
+		for _, auth := range auths {
+			if aclMatches(acl, auth) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// aclMatches reports whether the ACL grants its permissions to auth.
+func aclMatches(acl ACL, auth AuthInfo) bool {
+	if acl.Scheme == "auth" {
+		return auth.Scheme != "ip" && auth.Scheme != "world"
+	}
+	if acl.Scheme != auth.Scheme {
+		return false
+	}
+	switch acl.Scheme {
+	case "digest":
+		if auth.ID == acl.ID {
+			return true
+		}
+		user, _, _ := cut(acl.ID, ":")
+		authUser, password, ok := cut(auth.ID, ":")
+		if !ok {
+			return authUser == user
+		}
+		return DigestACL(0, authUser, password)[0].ID == acl.ID
+	case "ip":
+		ip := net.ParseIP(auth.ID)
+		if ip == nil {
+			return false
+		}
+		if !strings.Contains(acl.ID, "/") {
+			return ip.Equal(net.ParseIP(acl.ID))
+		}
+		_, ipNet, err := net.ParseCIDR(acl.ID)
+		return err == nil && ipNet.Contains(ip)
+	}
+	return auth.ID == acl.ID
+}
+
 // FormatServers takes a slice of addresses, and makes sure they are in a format
 // that resembles <addr>:<port>. If the server has no port provided, the
 // DefaultPort constant is added to the end.
@@ -57,6 +162,25 @@ func stringShuffle(s []string) {
 	}
 }
 
+// jitter returns d scaled by a random factor in [1+lo, 1+hi).
+func jitter(d time.Duration, lo, hi float64) time.Duration {
+	if lo == hi {
+		return d
+	}
+	return time.Duration(float64(d) * (1 + lo + rand.Float64()*(hi-lo)))
+}
+
+// ValidatePath checks that path is a valid znode path, following the rules of
+// the ZooKeeper server, and returns ErrInvalidPath if it is not. A path is
+// absolute, has no empty, "." or ".." segments, no trailing slash, and no
+// null or other control characters. All operations check their paths like
+// this before sending the request, except that the path given to create a
+// sequential node may end with a slash, as the server appends the sequence
+// number to it.
+func ValidatePath(path string) error {
+	return validatePath(path, false)
+}
+
 // validatePath will make sure a path is valid before sending the request
 func validatePath(path string, isSequential bool) error {
 	if path == "" {
@@ -109,8 +233,11 @@ func validatePath(path string, isSequential bool) error {
 			}
 		case r >= '\u0000' && r <= '\u001f',
 			r >= '\u007f' && r <= '\u009f',
-			r >= '\uf000' && r <= '\uf8ff',
-			r >= '\ufff0' && r < '\uffff':
+			r >= '\ue000' && r <= '\uf8ff',
+			r >= '\ufff0' && r <= '\uffff':
+			// Surrogates, which the server rejects as well, never
+			// decode from UTF-8; invalid UTF-8 decodes to U+FFFD and is
+			// rejected too.
 			return ErrInvalidPath
 		}
 		w = width
@@ -1,6 +1,9 @@
 package zk
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 func TestFormatServers(t *testing.T) {
 	t.Parallel()
@@ -13,6 +16,87 @@ func TestFormatServers(t *testing.T) {
 	}
 }
 
+func TestIPACL(t *testing.T) {
+	for _, cidr := range []string{"10.0.0.1", "10.0.0.0/8", "::1", "fe80::/10"} {
+		acl, err := IPACL(PermRead, cidr)
+		if err != nil {
+			t.Errorf("IPACL(%q) returned error: %v", cidr, err)
+			continue
+		}
+		if want := []ACL{{PermRead, "ip", cidr}}; len(acl) != 1 || acl[0] != want[0] {
+			t.Errorf("IPACL(%q) returned %v; want %v", cidr, acl, want)
+		}
+	}
+	for _, cidr := range []string{"", "10.0.0", "10.0.0.0/33", "10.0.0.0/", "host.example.com"} {
+		if _, err := IPACL(PermRead, cidr); err == nil {
+			t.Errorf("IPACL(%q) returned no error", cidr)
+		}
+	}
+}
+
+func TestCheckPermission(t *testing.T) {
+	digest := DigestACL(PermRead|PermWrite, "user", "secret")
+	ips := []ACL{{PermRead, "ip", "10.0.0.0/8"}, {PermWrite, "ip", "192.168.0.1"}}
+	tests := []struct {
+		name  string
+		acls  []ACL
+		auths []AuthInfo
+		perm  int32
+		want  bool
+	}{
+		{"empty ACL", nil, nil, PermAdmin, true},
+		{"world", WorldACL(PermRead), nil, PermRead, true},
+		{"world missing bit", WorldACL(PermRead), nil, PermWrite, false},
+		{"world other ID", []ACL{{PermAll, "world", "nobody"}}, nil, PermRead, false},
+		{"super", digest, []AuthInfo{{"super", ""}}, PermAdmin, true},
+		{"auth", AuthACL(PermCreate), []AuthInfo{{"digest", "user"}}, PermCreate, true},
+		{"auth without identity", AuthACL(PermCreate), nil, PermCreate, false},
+		{"auth with ip only", AuthACL(PermCreate), []AuthInfo{{"ip", "10.0.0.1"}}, PermCreate, false},
+		{"digest user name", digest, []AuthInfo{{"digest", "user"}}, PermRead, true},
+		{"digest password", digest, []AuthInfo{{"digest", "user:secret"}}, PermWrite, true},
+		{"digest stored ID", digest, []AuthInfo{{"digest", digest[0].ID}}, PermRead, true},
+		{"digest wrong password", digest, []AuthInfo{{"digest", "user:wrong"}}, PermRead, false},
+		{"digest other user", digest, []AuthInfo{{"digest", "other"}}, PermRead, false},
+		{"digest missing bit", digest, []AuthInfo{{"digest", "user"}}, PermDelete, false},
+		{"digest combined bits", digest, []AuthInfo{{"digest", "user"}}, PermRead | PermWrite, true},
+		{"ip in block", ips, []AuthInfo{{"ip", "10.1.2.3"}}, PermRead, true},
+		{"ip outside block", ips, []AuthInfo{{"ip", "11.1.2.3"}}, PermRead, false},
+		{"ip address", ips, []AuthInfo{{"ip", "192.168.0.1"}}, PermWrite, true},
+		{"ip bits from two entries", ips, []AuthInfo{{"ip", "10.0.0.1"}, {"ip", "192.168.0.1"}}, PermRead | PermWrite, true},
+		{"ip other bit", ips, []AuthInfo{{"ip", "10.1.2.3"}}, PermWrite, false},
+		{"x509", X509ACL(PermAll, "CN=client"), []AuthInfo{{"x509", "CN=client"}}, PermDelete, true},
+		{"x509 other subject", X509ACL(PermAll, "CN=client"), []AuthInfo{{"x509", "CN=other"}}, PermDelete, false},
+		{"scheme mismatch", X509ACL(PermAll, "CN=client"), []AuthInfo{{"sasl", "CN=client"}}, PermRead, false},
+	}
+	for _, tt := range tests {
+		if got := CheckPermission(tt.acls, tt.auths, tt.perm); got != tt.want {
+			t.Errorf("%s: CheckPermission(%v, %v, %d) = %v; want %v", tt.name, tt.acls, tt.auths, tt.perm, got, tt.want)
+		}
+	}
+}
+
+func TestJitter(t *testing.T) {
+	if d := jitter(time.Second, 0, 0); d != time.Second {
+		t.Fatalf("jitter without a range returned %v", d)
+	}
+	min, max := time.Second, time.Duration(0)
+	for i := 0; i < 1000; i++ {
+		d := jitter(time.Second, -0.2, 0.2)
+		if d < 800*time.Millisecond || d >= 1200*time.Millisecond {
+			t.Fatalf("jitter returned %v; want within 20%% of 1s", d)
+		}
+		if d < min {
+			min = d
+		}
+		if d > max {
+			max = d
+		}
+	}
+	if min > 900*time.Millisecond || max < 1100*time.Millisecond {
+		t.Fatalf("jitter returned values in [%v, %v]; want them spread over [800ms, 1.2s)", min, max)
+	}
+}
+
 func TestValidatePath(t *testing.T) {
 	tt := []struct {
 		path  string
@@ -39,9 +123,17 @@ func TestValidatePath(t *testing.T) {
 		{"/test\u007e", false, true}, // last valid ascii
 		{"/test\u007f", false, false},
 		{"/test\u009f", false, false},
+		{"/test\ud7ff", false, true},
+		{"/test\ue000", false, false},
 		{"/test\uf8ff", false, false},
+		{"/test\uf900", false, true},
 		{"/test\uffef", false, true},
 		{"/test\ufff0", false, false},
+		{"/test\uffff", false, false},
+		{"/test\xff", false, false}, // invalid UTF-8
+		{"/single/.period", false, true},
+		{"/triple/.../period", false, true},
+		{"/sequential/./", true, false},
 	}
 
 	for _, tc := range tt {
@@ -49,5 +141,13 @@ func TestValidatePath(t *testing.T) {
 		if (err != nil) == tc.valid {
 			t.Errorf("failed to validate path %q", tc.path)
 		}
+		if err != nil && err != ErrInvalidPath {
+			t.Errorf("validatePath(%q) returned %v; want %v", tc.path, err, ErrInvalidPath)
+		}
+		if !tc.seq {
+			if err := ValidatePath(tc.path); (err != nil) == tc.valid {
+				t.Errorf("ValidatePath(%q) returned %v", tc.path, err)
+			}
+		}
 	}
 }
@@ -0,0 +1,184 @@
+package zk
+
+import (
+	"bytes"
+	"errors"
+	"time"
+)
+
+// WatchHandle is a watch set by GetWithWatch, ExistsWithWatch or
+// ChildrenWithWatch. Unlike the channels returned by GetW and friends, it can
+// be canceled, so code that stops waiting for the watch doesn't leave it set
+// on the server.
+type WatchHandle struct {
+	// C receives the event of the watch. It is closed once the watch fired
+	// or was canceled.
+	C <-chan Event
+
+	c       *Conn
+	path    string
+	watcher WatcherType
+}
+
+// Cancel removes the watch and closes C without sending an event. The watch
+// is removed from the server too, unless another watch of the client on the
+// same znode relies on it. Removing it from the server requires ZooKeeper
+// 3.5 or later; with older servers, the error of the request is returned,
+// but the watch is removed from the client all the same. Canceling a watch
+// that already fired or was canceled does nothing.
+func (h *WatchHandle) Cancel() error {
+	c := h.c
+	found, shared := false, false
+	c.watchersLock.Lock()
+	for _, t := range watchTypesFor(h.watcher) {
+		wpt := watchPathType{h.path, t}
+		watchers := c.watchers[wpt]
+		for i, ch := range watchers {
+			if ch == h.C {
+				close(ch)
+				watchers = append(watchers[:i:i], watchers[i+1:]...)
+				found = true
+				break
+			}
+		}
+		if len(watchers) == 0 {
+			delete(c.watchers, wpt)
+		} else {
+			c.watchers[wpt] = watchers
+			shared = true
+		}
+	}
+	c.watchersLock.Unlock()
+	if !found || shared {
+		return nil
+	}
+
+	// A watch set on the same znode at the same time may be removed from
+	// the server as well, as it doesn't tell watches of a client apart.
+	_, err := c.request(opRemoveWatches, &removeWatchesRequest{Path: h.path, Type: h.watcher}, &removeWatchesResponse{}, nil)
+	if errors.Is(err, ErrNoWatcher) {
+		// The watch fired in the meantime.
+		return nil
+	}
+	return err
+}
+
+// GetWithWatch is like GetW, but returns a WatchHandle that can cancel the
+// watch.
+func (c *Conn) GetWithWatch(path string) ([]byte, *Stat, *WatchHandle, error) {
+	data, stat, ch, err := c.GetW(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return data, stat, &WatchHandle{C: ch, c: c, path: path, watcher: WatcherTypeData}, nil
+}
+
+// ExistsWithWatch is like ExistsW, but returns a WatchHandle that can cancel
+// the watch.
+func (c *Conn) ExistsWithWatch(path string) (bool, *Stat, *WatchHandle, error) {
+	exists, stat, ch, err := c.ExistsW(path)
+	if err != nil {
+		return false, nil, nil, err
+	}
+	return exists, stat, &WatchHandle{C: ch, c: c, path: path, watcher: WatcherTypeData}, nil
+}
+
+// ChildrenWithWatch is like ChildrenW, but returns a WatchHandle that can
+// cancel the watch.
+func (c *Conn) ChildrenWithWatch(path string) ([]string, *Stat, *WatchHandle, error) {
+	children, stat, ch, err := c.ChildrenW(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return children, stat, &WatchHandle{C: ch, c: c, path: path, watcher: WatcherTypeChildren}, nil
+}
+
+// DebouncedWatch returns a channel that receives the data of the znode at
+// path: its current data first, then its data after each change, once it
+// stayed unchanged for quiet. A burst of changes is thus delivered as a
+// single value, the latest one, e.g. to reload a configuration once rather
+// than for every write of it. A missing or deleted znode is delivered as nil,
+// and a value equal to the last one delivered is not sent again. The watch is
+// set again after it fired, and after the session expired; the channel is
+// closed once the connection is closed.
+func (c *Conn) DebouncedWatch(path string, quiet time.Duration) <-chan []byte {
+	out := make(chan []byte)
+	go c.debounceWatch(path, quiet, out)
+	return out
+}
+
+func (c *Conn) debounceWatch(path string, quiet time.Duration, out chan<- []byte) {
+	defer close(out)
+
+	var (
+		ch      <-chan Event     // the watch, nil until it is set again
+		retry   <-chan time.Time // set while reading the znode failed
+		settled <-chan time.Time // fires once the znode stayed unchanged for quiet
+		send    chan<- []byte    // out while latest is to be delivered
+
+		latest, delivered []byte
+		loaded, sent      bool
+	)
+	for {
+		if ch == nil && retry == nil {
+			data, stat, w, err := c.getDataW(path)
+			if errors.Is(err, ErrClosing) {
+				return
+			} else if err != nil {
+				retry = time.After(100 * time.Millisecond)
+			} else {
+				if stat != nil && data == nil {
+					data = []byte{}
+				}
+				ch, latest = w, data
+				if loaded {
+					settled, send = time.After(quiet), nil
+				} else {
+					// The current data is delivered right away.
+					loaded, send = true, out
+				}
+			}
+		}
+
+		select {
+		case ev := <-ch:
+			if errors.Is(ev.Err, ErrClosing) {
+				return
+			}
+			ch = nil
+		case <-retry:
+			retry = nil
+		case <-settled:
+			settled = nil
+			if !sent || (latest == nil) != (delivered == nil) || !bytes.Equal(latest, delivered) {
+				send = out
+			}
+		case send <- latest:
+			send, delivered, sent = nil, latest, true
+		case <-c.shouldQuit:
+			return
+		}
+	}
+}
+
+// getDataW reads the znode at path and watches it, or watches for it to be
+// created if it doesn't exist. The stat is nil if the znode doesn't exist.
+func (c *Conn) getDataW(path string) ([]byte, *Stat, <-chan Event, error) {
+	for {
+		data, stat, ch, err := c.GetW(path)
+		if err == nil {
+			return data, stat, ch, nil
+		} else if !errors.Is(err, ErrNoNode) {
+			return nil, nil, nil, err
+		}
+
+		exists, _, ch, err := c.ExistsW(path)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if !exists {
+			return nil, nil, ch, nil
+		}
+		// The znode was created in the meantime.
+	}
+}
@@ -0,0 +1,265 @@
+package zk
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWatchHandle(t *testing.T) {
+	fs := newFakeTreeServer(t)
+	defer fs.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn := connectFake(t, fs)
+
+	if _, err := conn.Create("/a", []byte("a"), 0, WorldACL(PermAll)); err != nil {
+		t.Fatalf("Create returned error: %v", err)
+	}
+	serverWatches := func() int {
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+		return len(fs.tree.dataWatches["/a"]) + len(fs.tree.existWatches["/a"]) + len(fs.tree.childWatches["/a"])
+	}
+
+	_, _, h, err := conn.GetWithWatch("/a")
+	if err != nil {
+		t.Fatalf("GetWithWatch returned error: %v", err)
+	}
+	if n := serverWatches(); n != 1 {
+		t.Fatalf("server has %d watches on /a; want 1", n)
+	}
+	if err := h.Cancel(); err != nil {
+		t.Fatalf("Cancel returned error: %v", err)
+	}
+	if ev, ok := <-h.C; ok {
+		t.Fatalf("channel of a canceled watch received %+v; want it closed", ev)
+	}
+	if n := serverWatches(); n != 0 {
+		t.Fatalf("server has %d watches on /a after Cancel; want 0", n)
+	}
+	if err := h.Cancel(); err != nil {
+		t.Fatalf("second Cancel returned error: %v", err)
+	}
+
+	// A watch shared by other watchers of the znode stays on the server.
+	_, _, h1, err := conn.ExistsWithWatch("/a")
+	if err != nil {
+		t.Fatalf("ExistsWithWatch returned error: %v", err)
+	}
+	_, _, h2, err := conn.GetWithWatch("/a")
+	if err != nil {
+		t.Fatalf("GetWithWatch returned error: %v", err)
+	}
+	_, _, h3, err := conn.ChildrenWithWatch("/a")
+	if err != nil {
+		t.Fatalf("ChildrenWithWatch returned error: %v", err)
+	}
+	if err := h1.Cancel(); err != nil {
+		t.Fatalf("Cancel returned error: %v", err)
+	}
+	if err := h3.Cancel(); err != nil {
+		t.Fatalf("Cancel returned error: %v", err)
+	}
+	if n := serverWatches(); n != 1 {
+		t.Fatalf("server has %d watches on /a; want the data watch still set", n)
+	}
+	if _, err := conn.Set("/a", []byte("b"), -1); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	select {
+	case ev := <-h2.C:
+		if ev.Type != EventNodeDataChanged {
+			t.Fatalf("watch received %+v; want %v", ev, EventNodeDataChanged)
+		}
+	case <-ctx.Done():
+		t.Fatal("watch did not fire")
+	}
+	if err := h2.Cancel(); err != nil {
+		t.Fatalf("Cancel of a fired watch returned error: %v", err)
+	}
+}
+
+func TestCoalescedWatches(t *testing.T) {
+	var (
+		fs      *fakeServer
+		mu      sync.Mutex
+		watches int
+		fire    bool // fire the watch before answering the next unwatched read
+	)
+	fs = newFakeServer(t, func(opcode int32, body []byte) (interface{}, ErrCode) {
+		if opcode != opGetData {
+			return nil, errUnimplemented
+		}
+		req := &getDataRequest{}
+		if _, err := decodePacket(body, req); err != nil {
+			return nil, errMarshallingError
+		}
+		mu.Lock()
+		if req.Watch {
+			watches++
+		} else if fire {
+			fire = false
+			mu.Unlock()
+			fs.SendEvent(watcherEvent{Type: EventNodeDataChanged, State: StateConnected, Path: "/a"})
+			mu.Lock()
+		}
+		mu.Unlock()
+		return &getDataResponse{Data: []byte("a")}, 0
+	})
+	defer fs.Close()
+
+	serverWatches := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		n := watches
+		watches = 0
+		return n
+	}
+	getW := func(conn *Conn, n int) []<-chan Event {
+		var chans []<-chan Event
+		for i := 0; i < n; i++ {
+			_, _, ch, err := conn.GetW("/a")
+			if err != nil {
+				t.Fatalf("GetW returned error: %v", err)
+			}
+			chans = append(chans, ch)
+		}
+		return chans
+	}
+	expectEvent := func(chans []<-chan Event) {
+		for i, ch := range chans {
+			select {
+			case ev := <-ch:
+				if ev.Type != EventNodeDataChanged {
+					t.Fatalf("watch %d received %+v; want %v", i, ev, EventNodeDataChanged)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("watch %d did not fire", i)
+			}
+		}
+	}
+
+	conn := connectFake(t, fs)
+	getW(conn, 3)
+	conn.Close()
+	if n := serverWatches(); n != 3 {
+		t.Fatalf("server got %d watches without coalescing; want 3", n)
+	}
+
+	conn = connectFake(t, fs, WithCoalescedWatches())
+	chans := getW(conn, 3)
+	if n := serverWatches(); n != 1 {
+		t.Fatalf("server got %d watches; want 1", n)
+	}
+	fs.SendEvent(watcherEvent{Type: EventNodeDataChanged, State: StateConnected, Path: "/a"})
+	expectEvent(chans)
+
+	// If the shared watch fires before the server answers, the watch is set
+	// again.
+	first := getW(conn, 1)
+	mu.Lock()
+	fire = true
+	mu.Unlock()
+	second := getW(conn, 1)
+	expectEvent(first)
+	if n := serverWatches(); n != 2 {
+		t.Fatalf("server got %d watches; want the watch to be set again", n)
+	}
+	fs.SendEvent(watcherEvent{Type: EventNodeDataChanged, State: StateConnected, Path: "/a"})
+	expectEvent(second)
+}
+
+func TestDebouncedWatch(t *testing.T) {
+	fs := newFakeTreeServer(t)
+	defer fs.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn := connectFake(t, fs, WithReconnectBackoff(time.Millisecond, time.Millisecond, 1))
+	if _, err := conn.Create("/config", []byte("v0"), 0, WorldACL(PermAll)); err != nil {
+		t.Fatalf("Create returned error: %v", err)
+	}
+
+	const quiet = 100 * time.Millisecond
+	values := conn.DebouncedWatch("/config", quiet)
+	receive := func(want string) {
+		t.Helper()
+		select {
+		case data := <-values:
+			if string(data) != want {
+				t.Fatalf("got %q; want %q", data, want)
+			}
+		case <-ctx.Done():
+			t.Fatalf("no value received; want %q", want)
+		}
+	}
+	noValue := func() {
+		t.Helper()
+		select {
+		case data := <-values:
+			t.Fatalf("got unexpected value %q", data)
+		case <-time.After(3 * quiet):
+		}
+	}
+
+	// The current value is delivered right away.
+	receive("v0")
+
+	// A burst of changes is delivered once, with the last value.
+	for _, v := range []string{"v1", "v2", "v3", "v4"} {
+		if _, err := conn.Set("/config", []byte(v), -1); err != nil {
+			t.Fatalf("Set returned error: %v", err)
+		}
+		time.Sleep(quiet / 10)
+	}
+	receive("v4")
+	noValue()
+
+	// Setting the same value again is not delivered.
+	if _, err := conn.Set("/config", []byte("v4"), -1); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	noValue()
+
+	// The watch is restored after reconnecting.
+	fs.DropConns()
+	for fs.Connects() < 2 {
+		if ctx.Err() != nil {
+			t.Fatal("client did not reconnect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := conn.waitForState(ctx, func(s State) bool { return s == StateHasSession }); err != nil {
+		t.Fatalf("waiting to reconnect: %v", err)
+	}
+	if _, err := conn.Set("/config", []byte("v5"), -1); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	receive("v5")
+
+	// A deleted znode is delivered as nil.
+	if err := conn.Delete("/config", -1); err != nil {
+		t.Fatalf("Delete returned error: %v", err)
+	}
+	select {
+	case data := <-values:
+		if data != nil {
+			t.Fatalf("got %q for a deleted znode; want nil", data)
+		}
+	case <-ctx.Done():
+		t.Fatal("no value received for a deleted znode")
+	}
+
+	conn.Close()
+	select {
+	case _, ok := <-values:
+		if ok {
+			t.Fatal("got a value after closing the connection")
+		}
+	case <-ctx.Done():
+		t.Fatal("channel not closed after closing the connection")
+	}
+}
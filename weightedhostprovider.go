@@ -0,0 +1,121 @@
+package zk
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+// WeightedHostProvider is a HostProvider that prefers servers with a higher
+// weight, for example to keep clients in the local datacenter unless all
+// local servers are unreachable. The servers are not looked up in DNS; they
+// are handed to the Dialer as given in the connection string.
+//
+// Each pass over the servers tries every server once, in a random order in
+// which a server with weight w is w times as likely to come first as a
+// server with weight 1. Servers with weight 0 are only tried after all
+// others. A new pass starts after Connected is called.
+type WeightedHostProvider struct {
+	mu      sync.Mutex // Protects everything.
+	weights map[string]int
+	servers []string
+	pass    []string // order of the current pass
+	pos     int      // index of the next server in pass
+	tried   int      // servers returned by Next since Init or Connected
+}
+
+// NewWeightedHostProvider creates a WeightedHostProvider. weights maps
+// servers, in the same form as in the connection string, to their weight.
+// Servers that are not in weights have weight 1.
+func NewWeightedHostProvider(weights map[string]int) *WeightedHostProvider {
+	hp := &WeightedHostProvider{weights: make(map[string]int, len(weights))}
+	for server, weight := range weights {
+		hp.weights[FormatServers([]string{server})[0]] = weight
+	}
+	return hp
+}
+
+// Init is called first, with the servers specified in the connection string.
+func (hp *WeightedHostProvider) Init(servers []string) error {
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+
+	if len(servers) == 0 {
+		return fmt.Errorf("No hosts found for addresses %q", servers)
+	}
+	for _, server := range servers {
+		if hp.weight(server) < 0 {
+			return fmt.Errorf("zk: negative weight %d for server %q", hp.weight(server), server)
+		}
+	}
+
+	hp.servers = append([]string(nil), servers...)
+	hp.pass = nil
+	hp.pos = 0
+	hp.tried = 0
+	return nil
+}
+
+// ordersServers tells the Conn not to shuffle the servers given to Init, as
+// each pass is in an order drawn by the weights.
+func (hp *WeightedHostProvider) ordersServers() {}
+
+func (hp *WeightedHostProvider) weight(server string) int {
+	if weight, ok := hp.weights[server]; ok {
+		return weight
+	}
+	return 1
+}
+
+// Len returns the number of servers available
+func (hp *WeightedHostProvider) Len() int {
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+	return len(hp.servers)
+}
+
+// Next returns the next server to connect to. retryStart will be true
+// if we've looped through all known servers without Connected() being
+// called.
+func (hp *WeightedHostProvider) Next() (server string, retryStart bool) {
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+
+	if hp.pass == nil || hp.pos == len(hp.pass) {
+		hp.newPass()
+	}
+	retryStart = hp.tried > 0 && hp.tried%len(hp.servers) == 0
+	server = hp.pass[hp.pos]
+	hp.pos++
+	hp.tried++
+	return server, retryStart
+}
+
+// newPass orders the servers for the next pass by weighted random sampling
+// without replacement: each server gets the key u^(1/w) for a uniformly
+// random u, and the servers are tried in order of decreasing key.
+func (hp *WeightedHostProvider) newPass() {
+	keys := make(map[string]float64, len(hp.servers))
+	for _, server := range hp.servers {
+		if w := hp.weight(server); w > 0 {
+			keys[server] = math.Pow(rand.Float64(), 1/float64(w))
+		} else {
+			keys[server] = -rand.Float64() - 1
+		}
+	}
+	hp.pass = append(hp.pass[:0], hp.servers...)
+	sort.Slice(hp.pass, func(i, j int) bool { return keys[hp.pass[i]] > keys[hp.pass[j]] })
+	hp.pos = 0
+}
+
+// Connected notifies the HostProvider of a successful connection.
+// The next call to Next starts a new pass, so a reconnect prefers the
+// servers with the highest weight again.
+func (hp *WeightedHostProvider) Connected() {
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+	hp.pass = nil
+	hp.tried = 0
+}
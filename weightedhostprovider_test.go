@@ -0,0 +1,112 @@
+package zk
+
+import (
+	"testing"
+)
+
+func TestWeightedHostProviderDistribution(t *testing.T) {
+	t.Parallel()
+
+	hp := NewWeightedHostProvider(map[string]int{
+		"local1:2181": 10,
+		"local2":      10,
+		"remote:2181": 0,
+	})
+	if err := hp.Init([]string{"local1:2181", "local2:2181", "remote:2181", "other:2181"}); err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 10000
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		server, retryStart := hp.Next()
+		if retryStart {
+			t.Fatalf("%d: Next returned retryStart=true right after Connected", i)
+		}
+		counts[server]++
+		hp.Connected()
+	}
+
+	// local1 and local2 each come first with probability 10/21, other with 1/21.
+	for _, server := range []string{"local1:2181", "local2:2181"} {
+		if c := counts[server]; c < n*40/100 || c > n*55/100 {
+			t.Errorf("%s picked first %d times out of %d; want about %d", server, c, n, n*10/21)
+		}
+	}
+	if c := counts["other:2181"]; c == 0 || c > n*10/100 {
+		t.Errorf("other:2181 picked first %d times out of %d; want about %d", c, n, n/21)
+	}
+	if c := counts["remote:2181"]; c != 0 {
+		t.Errorf("remote:2181 with weight 0 picked first %d times", c)
+	}
+}
+
+func TestWeightedHostProviderRetryStart(t *testing.T) {
+	t.Parallel()
+
+	servers := []string{"a:2181", "b:2181", "c:2181"}
+	hp := NewWeightedHostProvider(map[string]int{"a:2181": 100})
+	if err := hp.Init(servers); err != nil {
+		t.Fatal(err)
+	}
+
+	testdata := []struct {
+		retryStartWant bool
+		callConnected  bool
+	}{
+		// Repeated failures.
+		{false, false},
+		{false, false},
+		{false, false},
+		{true, false},
+		{false, false},
+		{false, false},
+		{true, true},
+
+		// A success starts a new pass.
+		{false, false},
+		{false, false},
+		{false, false},
+		{true, true},
+
+		// Repeated successes.
+		{false, true},
+		{false, true},
+		{false, true},
+	}
+
+	var pass []string
+	for i, td := range testdata {
+		server, retryStartGot := hp.Next()
+		if retryStartGot != td.retryStartWant {
+			t.Errorf("%d: retryStart=%v; want %v", i, retryStartGot, td.retryStartWant)
+		}
+		if retryStartGot {
+			pass = nil
+		}
+		pass = append(pass, server)
+		if td.callConnected {
+			hp.Connected()
+			pass = nil
+		}
+		if len(pass) == len(servers) {
+			// Every server is tried once per pass.
+			seen := make(map[string]bool)
+			for _, s := range pass {
+				seen[s] = true
+			}
+			if len(seen) != len(servers) {
+				t.Errorf("%d: pass %q does not contain every server", i, pass)
+			}
+		}
+	}
+}
+
+func TestWeightedHostProviderNegativeWeight(t *testing.T) {
+	t.Parallel()
+
+	hp := NewWeightedHostProvider(map[string]int{"a:2181": -1})
+	if err := hp.Init([]string{"a:2181"}); err == nil {
+		t.Fatal("Init succeeded with a negative weight")
+	}
+}
@@ -3,9 +3,11 @@ package zk
 import (
 	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"math/rand"
 	"net"
 	"os"
@@ -80,7 +82,7 @@ func TestIntegration_Create(t *testing.T) {
 
 	path := "/gozk-test"
 
-	if err := zk.Delete(path, -1); err != nil && err != ErrNoNode {
+	if err := zk.Delete(path, -1); err != nil && !errors.Is(err, ErrNoNode) {
 		t.Fatalf("Delete returned error: %+v", err)
 	}
 	if p, err := zk.Create(path, []byte{1, 2, 3, 4}, 0, WorldACL(PermAll)); err != nil {
@@ -97,6 +99,26 @@ func TestIntegration_Create(t *testing.T) {
 	}
 }
 
+func TestIntegration_ConnectContext(t *testing.T) {
+	ts, err := StartTestCluster(t, 1, nil, logWriter{t: t, p: "[ZKERR] "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	zk, _, err := ConnectContext(ctx, []string{fmt.Sprintf("127.0.0.1:%d", ts.Servers[0].Port)}, time.Second*15)
+	if err != nil {
+		t.Fatalf("ConnectContext returned error: %+v", err)
+	}
+	defer zk.Close()
+
+	if s := zk.State(); s != StateHasSession {
+		t.Fatalf("State()=%v after ConnectContext; want %v", s, StateHasSession)
+	}
+}
+
 func TestIntegration_CreateTTL(t *testing.T) {
 	ts, err := StartTestCluster(t, 1, nil, logWriter{t: t, p: "[ZKERR] "})
 	if err != nil {
@@ -111,13 +133,13 @@ func TestIntegration_CreateTTL(t *testing.T) {
 
 	path := "/gozk-test"
 
-	if err := zk.Delete(path, -1); err != nil && err != ErrNoNode {
+	if err := zk.Delete(path, -1); err != nil && !errors.Is(err, ErrNoNode) {
 		t.Fatalf("Delete returned error: %+v", err)
 	}
-	if _, err := zk.CreateTTL("", []byte{1, 2, 3, 4}, FlagTTL|FlagEphemeral, WorldACL(PermAll), 60*time.Second); err != ErrInvalidPath {
+	if _, err := zk.CreateTTL("", []byte{1, 2, 3, 4}, FlagTTL|FlagEphemeral, WorldACL(PermAll), 60*time.Second); !errors.Is(err, ErrInvalidPath) {
 		t.Fatalf("Create path check failed")
 	}
-	if _, err := zk.CreateTTL(path, []byte{1, 2, 3, 4}, 0, WorldACL(PermAll), 60*time.Second); err != ErrInvalidFlags {
+	if _, err := zk.CreateTTL(path, []byte{1, 2, 3, 4}, 0, WorldACL(PermAll), 60*time.Second); !errors.Is(err, ErrInvalidFlags) {
 		t.Fatalf("Create flags check failed")
 	}
 	if p, err := zk.CreateTTL(path, []byte{1, 2, 3, 4}, FlagTTL|FlagEphemeral, WorldACL(PermAll), 60*time.Second); err != nil {
@@ -133,7 +155,7 @@ func TestIntegration_CreateTTL(t *testing.T) {
 		t.Fatal("Get returned wrong size data")
 	}
 
-	if err := zk.Delete(path, -1); err != nil && err != ErrNoNode {
+	if err := zk.Delete(path, -1); err != nil && !errors.Is(err, ErrNoNode) {
 		t.Fatalf("Delete returned error: %+v", err)
 	}
 	if p, err := zk.CreateTTL(path, []byte{1, 2, 3, 4}, FlagTTL|FlagSequence, WorldACL(PermAll), 60*time.Second); err != nil {
@@ -163,16 +185,19 @@ func TestIntegration_CreateContainer(t *testing.T) {
 
 	path := "/gozk-test"
 
-	if err := zk.Delete(path, -1); err != nil && err != ErrNoNode {
+	if err := zk.Delete(path, -1); err != nil && !errors.Is(err, ErrNoNode) {
 		t.Fatalf("Delete returned error: %+v", err)
 	}
-	if _, err := zk.CreateContainer("", []byte{1, 2, 3, 4}, FlagTTL, WorldACL(PermAll)); err != ErrInvalidPath {
+	if _, err := zk.CreateContainer("", []byte{1, 2, 3, 4}, FlagTTL, WorldACL(PermAll)); !errors.Is(err, ErrInvalidPath) {
 		t.Fatalf("Create path check failed")
 	}
-	if _, err := zk.CreateContainer(path, []byte{1, 2, 3, 4}, 0, WorldACL(PermAll)); err != ErrInvalidFlags {
+	if _, err := zk.CreateContainer(path, []byte{1, 2, 3, 4}, 0, WorldACL(PermAll)); !errors.Is(err, ErrInvalidFlags) {
+		t.Fatalf("Create flags check failed")
+	}
+	if _, err := zk.CreateContainer(path, []byte{1, 2, 3, 4}, FlagContainer|FlagEphemeral, WorldACL(PermAll)); !errors.Is(err, ErrInvalidFlags) {
 		t.Fatalf("Create flags check failed")
 	}
-	if p, err := zk.CreateContainer(path, []byte{1, 2, 3, 4}, FlagTTL, WorldACL(PermAll)); err != nil {
+	if p, err := zk.CreateContainer(path, []byte{1, 2, 3, 4}, FlagContainer, WorldACL(PermAll)); err != nil {
 		t.Fatalf("Create returned error: %+v", err)
 	} else if p != path {
 		t.Fatalf("Create returned different path '%s' != '%s'", p, path)
@@ -183,6 +208,9 @@ func TestIntegration_CreateContainer(t *testing.T) {
 		t.Fatal("Get returned nil stat")
 	} else if len(data) < 4 {
 		t.Fatal("Get returned wrong size data")
+	} else if stat.EphemeralOwner != math.MinInt64 {
+		// The server marks containers with this ephemeral owner.
+		t.Fatalf("Get returned ephemeral owner %x for a container", stat.EphemeralOwner)
 	}
 }
 
@@ -254,14 +282,21 @@ func TestIntegration_IncrementalReconfig(t *testing.T) {
 	err = waitForSession(waitCtx, events)
 	requireNoError(t, err, "failed to wail for session")
 
-	_, _, err = zk.Get("/zookeeper/config")
+	data, _, err := zk.GetConfig()
 	if err != nil {
 		t.Fatalf("get config returned error: %+v", err)
 	}
+	clusterCfg, err := ParseConfig(data)
+	requireNoError(t, err, "failed to parse config")
+	if len(clusterCfg.Servers) != 3 {
+		t.Fatalf("expected 3 servers in config, got %+v", clusterCfg.Servers)
+	}
 
 	// initially should be 1<<32, which is 0x100000000. This is the zxid
 	// of the first NEWLEADER message, used as the inital version
-	// reflect.DeepEqual(bytes.Split(data, []byte("\n")), []byte("version=100000000"))
+	if clusterCfg.Version != 1<<32 {
+		t.Fatalf("expected config version %x, got %x", 1<<32, clusterCfg.Version)
+	}
 
 	// remove node 3.
 	_, err = zk.IncrementalReconfig(nil, []string{"3"}, -1)
@@ -308,7 +343,7 @@ func TestIntegration_Reconfig(t *testing.T) {
 	err = waitForSession(waitCtx, events)
 	requireNoError(t, err, "failed to wail for session")
 
-	_, _, err = zk.Get("/zookeeper/config")
+	_, _, err = zk.GetConfig()
 	if err != nil {
 		t.Fatalf("get config returned error: %+v", err)
 	}
@@ -377,7 +412,7 @@ func TestIntegration_Multi(t *testing.T) {
 
 	path := "/gozk-test"
 
-	if err := zk.Delete(path, -1); err != nil && err != ErrNoNode {
+	if err := zk.Delete(path, -1); err != nil && !errors.Is(err, ErrNoNode) {
 		t.Fatalf("Delete returned error: %+v", err)
 	}
 	ops := []interface{}{
@@ -420,12 +455,12 @@ func TestIntegration_IfAuthdataSurvivesReconnect(t *testing.T) {
 	acl := DigestACL(PermAll, "userfoo", "passbar")
 
 	_, err = zk.Create(testNode, []byte("Some very secret content"), 0, acl)
-	if err != nil && err != ErrNodeExists {
+	if err != nil && !errors.Is(err, ErrNodeExists) {
 		t.Fatalf("Failed to create test node : %+v", err)
 	}
 
 	_, _, err = zk.Get(testNode)
-	if err == nil || err != ErrNoAuth {
+	if err == nil || !errors.Is(err, ErrNoAuth) {
 		var msg string
 
 		if err == nil {
@@ -471,7 +506,7 @@ func TestIntegration_MultiFailures(t *testing.T) {
 
 	// Ensure firstPath doesn't exist and secondPath does. This will cause the
 	// 2nd operation in the Multi() to fail.
-	if err := zk.Delete(firstPath, -1); err != nil && err != ErrNoNode {
+	if err := zk.Delete(firstPath, -1); err != nil && !errors.Is(err, ErrNoNode) {
 		t.Fatalf("Delete returned error: %+v", err)
 	}
 	if _, err := zk.Create(secondPath, nil /* data */, 0, WorldACL(PermAll)); err != nil {
@@ -483,7 +518,7 @@ func TestIntegration_MultiFailures(t *testing.T) {
 		&CreateRequest{Path: secondPath, Data: []byte{3, 4}, Acl: WorldACL(PermAll)},
 	}
 	res, err := zk.Multi(ops...)
-	if err != ErrNodeExists {
+	if !errors.Is(err, ErrNodeExists) {
 		t.Fatalf("Multi() didn't return correct error: %+v", err)
 	}
 	if len(res) != 2 {
@@ -492,10 +527,10 @@ func TestIntegration_MultiFailures(t *testing.T) {
 	if res[0].Error != nil {
 		t.Fatalf("First operation returned an unexpected error %+v", res[0].Error)
 	}
-	if res[1].Error != ErrNodeExists {
+	if !errors.Is(res[1].Error, ErrNodeExists) {
 		t.Fatalf("Second operation returned incorrect error %+v", res[1].Error)
 	}
-	if _, _, err := zk.Get(firstPath); err != ErrNoNode {
+	if _, _, err := zk.Get(firstPath); !errors.Is(err, ErrNoNode) {
 		t.Fatalf("Node %s was incorrectly created: %+v", firstPath, err)
 	}
 }
@@ -518,7 +553,7 @@ func TestIntegration_GetSetACL(t *testing.T) {
 
 	path := "/gozk-test"
 
-	if err := zk.Delete(path, -1); err != nil && err != ErrNoNode {
+	if err := zk.Delete(path, -1); err != nil && !errors.Is(err, ErrNoNode) {
 		t.Fatalf("Delete returned error: %+v", err)
 	}
 	if path, err := zk.Create(path, []byte{1, 2, 3, 4}, 0, WorldACL(PermAll)); err != nil {
@@ -567,7 +602,7 @@ func TestIntegration_Auth(t *testing.T) {
 	defer zk.Close()
 
 	path := "/gozk-digest-test"
-	if err := zk.Delete(path, -1); err != nil && err != ErrNoNode {
+	if err := zk.Delete(path, -1); err != nil && !errors.Is(err, ErrNoNode) {
 		t.Fatalf("Delete returned error: %+v", err)
 	}
 
@@ -579,7 +614,7 @@ func TestIntegration_Auth(t *testing.T) {
 		t.Fatalf("Create returned different path '%s' != '%s'", p, path)
 	}
 
-	if _, _, err := zk.Get(path); err != ErrNoAuth {
+	if _, _, err := zk.Get(path); !errors.Is(err, ErrNoAuth) {
 		t.Fatalf("Get returned error %+v instead of ErrNoAuth", err)
 	}
 
@@ -617,7 +652,7 @@ func TestIntegration_Children(t *testing.T) {
 	defer zk.Close()
 
 	deleteNode := func(node string) {
-		if err := zk.Delete(node, -1); err != nil && err != ErrNoNode {
+		if err := zk.Delete(node, -1); err != nil && !errors.Is(err, ErrNoNode) {
 			t.Fatalf("Delete returned error: %+v", err)
 		}
 	}
@@ -669,7 +704,7 @@ func TestIntegration_ChildWatch(t *testing.T) {
 	}
 	defer zk.Close()
 
-	if err := zk.Delete("/gozk-test", -1); err != nil && err != ErrNoNode {
+	if err := zk.Delete("/gozk-test", -1); err != nil && !errors.Is(err, ErrNoNode) {
 		t.Fatalf("Delete returned error: %+v", err)
 	}
 
@@ -711,7 +746,7 @@ func TestIntegration_ChildWatch(t *testing.T) {
 		t.Fatal("Children should return 0 children")
 	}
 
-	if err := zk.Delete("/gozk-test", -1); err != nil && err != ErrNoNode {
+	if err := zk.Delete("/gozk-test", -1); err != nil && !errors.Is(err, ErrNoNode) {
 		t.Fatalf("Delete returned error: %+v", err)
 	}
 
@@ -753,7 +788,7 @@ func TestIntegration_SetWatchers(t *testing.T) {
 	}
 	defer zk2.Close()
 
-	if err := zk.Delete("/gozk-test", -1); err != nil && err != ErrNoNode {
+	if err := zk.Delete("/gozk-test", -1); err != nil && !errors.Is(err, ErrNoNode) {
 		t.Fatalf("Delete returned error: %+v", err)
 	}
 
@@ -792,7 +827,7 @@ func TestIntegration_SetWatchers(t *testing.T) {
 	// Simulate network error by brutally closing the network connection.
 	zk.conn.Close()
 	for p := range testPaths {
-		if err := zk2.Delete(p, -1); err != nil && err != ErrNoNode {
+		if err := zk2.Delete(p, -1); err != nil && !errors.Is(err, ErrNoNode) {
 			t.Fatalf("Delete returned error: %+v", err)
 		}
 	}
@@ -883,7 +918,7 @@ func TestIntegration_ExpiringWatch(t *testing.T) {
 	}
 	defer zk.Close()
 
-	if err := zk.Delete("/gozk-test", -1); err != nil && err != ErrNoNode {
+	if err := zk.Delete("/gozk-test", -1); err != nil && !errors.Is(err, ErrNoNode) {
 		t.Fatalf("Delete returned error: %+v", err)
 	}
 
@@ -901,7 +936,7 @@ func TestIntegration_ExpiringWatch(t *testing.T) {
 
 	select {
 	case ev := <-childCh:
-		if ev.Err != ErrSessionExpired {
+		if !errors.Is(ev.Err, ErrSessionExpired) {
 			t.Fatalf("Child watcher error %+v instead of expected ErrSessionExpired", ev.Err)
 		}
 		if ev.Path != "/" {
@@ -912,6 +947,261 @@ func TestIntegration_ExpiringWatch(t *testing.T) {
 	}
 }
 
+func TestIntegration_AddWatchPersistent(t *testing.T) {
+	requireZK36(t)
+	ts, err := StartTestCluster(t, 1, nil, logWriter{t: t, p: "[ZKERR] "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Stop()
+	zk, _, err := ts.ConnectAll()
+	if err != nil {
+		t.Fatalf("Connect returned error: %+v", err)
+	}
+	defer zk.Close()
+
+	path := "/gozk-test-persistent"
+	if err := zk.Delete(path, -1); err != nil && !errors.Is(err, ErrNoNode) {
+		t.Fatalf("Delete returned error: %+v", err)
+	}
+
+	ech, err := zk.AddWatch(path, AddWatchModePersistent)
+	if err != nil {
+		t.Fatalf("AddWatch returned error: %+v", err)
+	}
+
+	expectEvent := func(typ EventType) {
+		t.Helper()
+		select {
+		case ev := <-ech:
+			if ev.Type != typ || ev.Path != path {
+				t.Fatalf("got event %+v; want %s for %s", ev, typ, path)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %s event for %s", typ, path)
+		}
+	}
+
+	if _, err := zk.Create(path, []byte{1}, 0, WorldACL(PermAll)); err != nil {
+		t.Fatalf("Create returned error: %+v", err)
+	}
+	expectEvent(EventNodeCreated)
+	for i := 0; i < 3; i++ {
+		if _, err := zk.Set(path, []byte{byte(i)}, -1); err != nil {
+			t.Fatalf("Set returned error: %+v", err)
+		}
+		expectEvent(EventNodeDataChanged)
+	}
+	if err := zk.Delete(path, -1); err != nil {
+		t.Fatalf("Delete returned error: %+v", err)
+	}
+	expectEvent(EventNodeDeleted)
+}
+
+func TestIntegration_AddWatchPersistentRecursive(t *testing.T) {
+	requireZK36(t)
+	ts, err := StartTestCluster(t, 1, nil, logWriter{t: t, p: "[ZKERR] "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Stop()
+	zk, _, err := ts.ConnectAll()
+	if err != nil {
+		t.Fatalf("Connect returned error: %+v", err)
+	}
+	defer zk.Close()
+
+	if _, err := zk.Create("/a", nil, 0, WorldACL(PermAll)); err != nil {
+		t.Fatalf("Create returned error: %+v", err)
+	}
+	ech, err := zk.AddWatch("/a", AddWatchModePersistentRecursive)
+	if err != nil {
+		t.Fatalf("AddWatch returned error: %+v", err)
+	}
+
+	for _, path := range []string{"/a/b", "/a/b/c"} {
+		if _, err := zk.Create(path, nil, 0, WorldACL(PermAll)); err != nil {
+			t.Fatalf("Create returned error: %+v", err)
+		}
+		select {
+		case ev := <-ech:
+			if ev.Type != EventNodeCreated || ev.Path != path {
+				t.Fatalf("got event %+v; want %s for %s", ev, EventNodeCreated, path)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no event for %s", path)
+		}
+	}
+}
+
+func TestIntegration_RemoveWatches(t *testing.T) {
+	ts, err := StartTestCluster(t, 1, nil, logWriter{t: t, p: "[ZKERR] "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Stop()
+	zk, _, err := ts.ConnectAll()
+	if err != nil {
+		t.Fatalf("Connect returned error: %+v", err)
+	}
+	defer zk.Close()
+
+	path := "/gozk-test-remove-watches"
+	_, _, ech, err := zk.ExistsW(path)
+	if err != nil {
+		t.Fatalf("ExistsW returned error: %+v", err)
+	}
+	if err := zk.RemoveWatches(path, WatcherTypeData); err != nil {
+		t.Fatalf("RemoveWatches returned error: %+v", err)
+	}
+	select {
+	case ev := <-ech:
+		if ev.Type != EventNotWatching {
+			t.Fatalf("got event %+v; want %s", ev, EventNotWatching)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch channel not notified")
+	}
+	if err := zk.RemoveWatches(path, WatcherTypeData); !errors.Is(err, ErrNoWatcher) {
+		t.Fatalf("RemoveWatches returned %v; want %v", err, ErrNoWatcher)
+	}
+}
+
+func TestIntegration_AllChildrenNumber(t *testing.T) {
+	requireZK36(t)
+	ts, err := StartTestCluster(t, 1, nil, logWriter{t: t, p: "[ZKERR] "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Stop()
+	zk, _, err := ts.ConnectAll()
+	if err != nil {
+		t.Fatalf("Connect returned error: %+v", err)
+	}
+	defer zk.Close()
+
+	path := "/gozk-test-all-children-number"
+	for _, p := range []string{path, path + "/a", path + "/a/b", path + "/c"} {
+		if _, err := zk.Create(p, nil, 0, WorldACL(PermAll)); err != nil {
+			t.Fatalf("Create returned error: %+v", err)
+		}
+	}
+	if n, err := zk.AllChildrenNumber(path); err != nil || n != 3 {
+		t.Fatalf("AllChildrenNumber returned %d, %v; want 3", n, err)
+	}
+	if _, err := zk.AllChildrenNumber(path + "/missing"); !errors.Is(err, ErrNoNode) {
+		t.Fatalf("AllChildrenNumber returned %v; want %v", err, ErrNoNode)
+	}
+}
+
+func TestIntegration_WhoAmI(t *testing.T) {
+	requireZK37(t)
+	ts, err := StartTestCluster(t, 1, nil, logWriter{t: t, p: "[ZKERR] "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Stop()
+	zk, _, err := ts.ConnectAll()
+	if err != nil {
+		t.Fatalf("Connect returned error: %+v", err)
+	}
+	defer zk.Close()
+
+	if err := zk.AddAuth("digest", []byte("user:password")); err != nil {
+		t.Fatalf("AddAuth returned error: %+v", err)
+	}
+	infos, err := zk.WhoAmI()
+	if err != nil {
+		t.Fatalf("WhoAmI returned error: %+v", err)
+	}
+	found := false
+	for _, info := range infos {
+		if info.Scheme == "digest" && strings.HasPrefix(info.ID, "user:") {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("WhoAmI returned %+v; want a digest identity for user", infos)
+	}
+}
+
+func TestIntegration_GetEphemerals(t *testing.T) {
+	requireZK36(t)
+	ts, err := StartTestCluster(t, 1, nil, logWriter{t: t, p: "[ZKERR] "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Stop()
+	zk, _, err := ts.ConnectAll()
+	if err != nil {
+		t.Fatalf("Connect returned error: %+v", err)
+	}
+	defer zk.Close()
+
+	if ephemerals, err := zk.GetEphemerals("/"); err != nil || len(ephemerals) != 0 {
+		t.Fatalf("GetEphemerals returned %q, %v; want none", ephemerals, err)
+	}
+
+	path := "/gozk-test-ephemerals"
+	if _, err := zk.Create(path, nil, 0, WorldACL(PermAll)); err != nil {
+		t.Fatalf("Create returned error: %+v", err)
+	}
+	for _, p := range []string{path + "/a", path + "/b"} {
+		if _, err := zk.Create(p, nil, FlagEphemeral, WorldACL(PermAll)); err != nil {
+			t.Fatalf("Create returned error: %+v", err)
+		}
+	}
+	ephemerals, err := zk.GetEphemerals(path)
+	if err != nil {
+		t.Fatalf("GetEphemerals returned error: %+v", err)
+	}
+	sort.Strings(ephemerals)
+	if want := []string{path + "/a", path + "/b"}; !reflect.DeepEqual(ephemerals, want) {
+		t.Fatalf("GetEphemerals returned %q; want %q", ephemerals, want)
+	}
+}
+
+func TestIntegration_MultiRead(t *testing.T) {
+	requireZK36(t)
+	ts, err := StartTestCluster(t, 1, nil, logWriter{t: t, p: "[ZKERR] "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Stop()
+	zk, _, err := ts.ConnectAll()
+	if err != nil {
+		t.Fatalf("Connect returned error: %+v", err)
+	}
+	defer zk.Close()
+
+	path := "/gozk-test-multiread"
+	if _, err := zk.Create(path, []byte("parent"), 0, WorldACL(PermAll)); err != nil {
+		t.Fatalf("Create returned error: %+v", err)
+	}
+	if _, err := zk.Create(path+"/child", nil, 0, WorldACL(PermAll)); err != nil {
+		t.Fatalf("Create returned error: %+v", err)
+	}
+	res, err := zk.MultiRead(GetDataOp(path), GetChildrenOp(path), ExistsOp(path+"/missing"), GetDataOp(path+"/missing"))
+	if err != nil {
+		t.Fatalf("MultiRead returned error: %+v", err)
+	}
+	if len(res) != 4 {
+		t.Fatalf("MultiRead returned %d responses; want 4", len(res))
+	}
+	if string(res[0].Data) != "parent" || res[0].Error != nil {
+		t.Fatalf("getData response is %+v", res[0])
+	}
+	if !reflect.DeepEqual(res[1].Children, []string{"child"}) || res[1].Error != nil {
+		t.Fatalf("getChildren response is %+v", res[1])
+	}
+	if res[2].Stat != nil || res[2].Error != nil {
+		t.Fatalf("exists response is %+v", res[2])
+	}
+	if !errors.Is(res[3].Error, ErrNoNode) {
+		t.Fatalf("getData response for a missing znode is %+v", res[3])
+	}
+}
+
 func TestRequestFail(t *testing.T) {
 	// If connecting fails to all servers in the list then pending requests
 	// should be errored out so they don't hang forever.
@@ -1170,6 +1460,31 @@ func startSlowProxy(t *testing.T, up, down Rate, upstream string, adj func(ln *L
 	return ln.Addr().String(), stopCh, nil
 }
 
+// requireZK36 skips the test unless it runs against ZooKeeper 3.6 or later.
+func requireZK36(t *testing.T) {
+	t.Helper()
+	requireZKMinor(t, 6)
+}
+
+func requireZK37(t *testing.T) {
+	t.Helper()
+	requireZKMinor(t, 7)
+}
+
+// requireZKMinor skips the test unless zk_version is at least 3.<minor>.
+func requireZKMinor(t *testing.T, minor int) {
+	t.Helper()
+	val, ok := os.LookupEnv("zk_version")
+	if !ok {
+		t.Skipf("did not detect zk_version from env. skipping 3.%d+ test", minor)
+	}
+	for m := 4; m < minor; m++ {
+		if strings.HasPrefix(val, fmt.Sprintf("3.%d", m)) {
+			t.Skip("running with zookeeper that does not support this api")
+		}
+	}
+}
+
 func expectErr(t *testing.T, err error, expected error) {
 	if err == nil {
 		t.Fatalf("Get for node that is too large should have returned error!")